@@ -1,21 +1,39 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
-	"strconv"
+	"strings"
+
+	"metrics-service/internal/config"
 )
 
-var (
-	serverHost     string
-	reportInterval int
-	pollInterval   int
+// agentConfig - конфигурация агента. Интервалы задаются в секундах.
+type agentConfig struct {
+	Address        string `json:"address" yaml:"address" env:"ADDRESS"`
+	ReportInterval int    `json:"report_interval" yaml:"report_interval" env:"REPORT_INTERVAL"`
+	PollInterval   int    `json:"poll_interval" yaml:"poll_interval" env:"POLL_INTERVAL"`
+
+	HashKey string `json:"key" yaml:"key" env:"KEY" secret:"true"`
+	KeyID   string `json:"key_id" yaml:"key_id" env:"KEY_ID"`
+	APIKey  string `json:"api_key" yaml:"api_key" env:"API_KEY" secret:"true"`
+
+	RateLimit   int  `json:"rate_limit" yaml:"rate_limit" env:"RATE_LIMIT"`
+	ReportBatch bool `json:"report_batch" yaml:"report_batch" env:"REPORT_BATCH"`
 
-	flagHashKey string
+	TLSCA   string `json:"tls_ca" yaml:"tls_ca" env:"TLS_CA"`
+	TLSCert string `json:"tls_cert" yaml:"tls_cert" env:"TLS_CERT"`
+	TLSKey  string `json:"tls_key" yaml:"tls_key" env:"TLS_KEY"`
+
+	CryptoKey string `json:"crypto_key" yaml:"crypto_key" env:"CRYPTO_KEY"`
+}
+
+var (
+	cfg agentConfig
 
-	flagRateLimit   int
-	flagReportBatch bool
+	flagPrintConfig bool
 
 	// Флаги линковщика
 	buildVersion string
@@ -23,51 +41,59 @@ var (
 	buildCommit  string
 )
 
-func parseFlags() {
-	flag.StringVar(&serverHost, "a", "localhost:8080", "endpoint address")
-	flag.IntVar(&reportInterval, "r", 10, "report interval")
-	flag.IntVar(&pollInterval, "p", 2, "poll interval")
-	flag.StringVar(&flagHashKey, "k", "", "hash key")
-	flag.IntVar(&flagRateLimit, "l", 0, "http requests rate limit")
-	flag.BoolVar(&flagReportBatch, "b", true, "determinate batch reporting")
-	flag.Parse()
-
-	if envServerHost := os.Getenv("ADDRESS"); envServerHost != "" {
-		serverHost = envServerHost
-	}
-
-	if envReportInterval := os.Getenv("REPORT_INTERVAL"); envReportInterval != "" {
-		val, err := strconv.Atoi(envReportInterval)
-		if err == nil {
-			reportInterval = val
-		}
-	}
-
-	if envPollInterval := os.Getenv("POLL_INTERVAL"); envPollInterval != "" {
-		val, err := strconv.Atoi(envPollInterval)
-		if err == nil {
-			pollInterval = val
-		}
+// parseFlags собирает конфигурацию агента: значения по умолчанию < файл -c/CONFIG < переменные окружения < флаги.
+func parseFlags() error {
+	flag.StringVar(&cfg.Address, "a", "localhost:8080", "endpoint address")
+	flag.IntVar(&cfg.ReportInterval, "r", 10, "report interval")
+	flag.IntVar(&cfg.PollInterval, "p", 2, "poll interval")
+	flag.StringVar(&cfg.HashKey, "k", "", "HMAC key for signing requests")
+	flag.StringVar(&cfg.KeyID, "key-id", "", "id of the HMAC key on the server, empty for the default key")
+	flag.StringVar(&cfg.APIKey, "api-key", "", "API key presented to the server")
+	flag.IntVar(&cfg.RateLimit, "l", 0, "http requests rate limit")
+	flag.BoolVar(&cfg.ReportBatch, "b", true, "determinate batch reporting")
+	flag.StringVar(&cfg.TLSCA, "tls-ca", "", "server CA file, enables HTTPS with the CA pinned")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "client certificate file for mutual TLS")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "", "client private key file for mutual TLS")
+	flag.StringVar(&cfg.CryptoKey, "crypto-key", "", "server RSA public key file, enables payload encryption")
+	flag.BoolVar(&flagPrintConfig, "print-config", false, "print effective configuration and exit")
+
+	if err := config.Parse(flag.CommandLine, os.Args[1:], &cfg); err != nil {
+		return err
 	}
+	return cfg.validate()
+}
 
-	if envHashKey := os.Getenv("KEY"); envHashKey != "" {
-		flagHashKey = envHashKey
+// validate проверяет значения конфигурации.
+func (c *agentConfig) validate() error {
+	switch {
+	case c.Address == "":
+		return errors.New("address must not be empty")
+	case c.ReportInterval < 1:
+		return fmt.Errorf("report_interval must be positive, got %d", c.ReportInterval)
+	case c.PollInterval < 1:
+		return fmt.Errorf("poll_interval must be positive, got %d", c.PollInterval)
+	case c.RateLimit < 0:
+		return fmt.Errorf("rate_limit must not be negative, got %d", c.RateLimit)
+	case (c.TLSCert == "") != (c.TLSKey == ""):
+		return errors.New("tls_cert and tls_key must be set together")
+	case c.TLSCert != "" && c.TLSCA == "":
+		return errors.New("tls_cert requires tls_ca")
+	case c.KeyID != "" && c.HashKey == "":
+		return errors.New("key_id requires key")
 	}
+	return nil
+}
 
-	if envRateLimit := os.Getenv("RATE_LIMIT"); envRateLimit != "" {
-		val, err := strconv.Atoi(envRateLimit)
-		if err == nil {
-			flagRateLimit = val
-		}
+// baseURL возвращает адрес сервера со схемой: https при заданном CA сервера, иначе http.
+// Адрес, уже содержащий схему, используется как есть.
+func (c *agentConfig) baseURL() string {
+	if strings.HasPrefix(c.Address, "http://") || strings.HasPrefix(c.Address, "https://") {
+		return c.Address
 	}
-
-	if envReportBatch := os.Getenv("REPORT_BATCH"); envReportBatch != "" {
-		val, err := strconv.ParseBool(envReportBatch)
-		if err == nil {
-			flagReportBatch = val
-		}
+	if c.TLSCA != "" {
+		return "https://" + c.Address
 	}
-
+	return "http://" + c.Address
 }
 
 func printBuildInfo() {
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"crypto/rsa"
+	"crypto/tls"
 	"fmt"
+	"log"
 	"os"
 	"os/signal"
 	"syscall"
@@ -9,23 +12,49 @@ import (
 	"metrics-service/internal/agent"
 	"metrics-service/internal/agent/collector"
 	"metrics-service/internal/agent/sender"
+	"metrics-service/internal/config"
+	"metrics-service/internal/encryption"
+	"metrics-service/internal/tlsutil"
 )
 
 func main() {
 
-	printBuildInfo()
+	// Получаем config (файл, env или flags)
+	if err := parseFlags(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if flagPrintConfig {
+		if err := config.Print(os.Stdout, &cfg); err != nil {
+			log.Fatalf("Failed to print configuration: %v", err)
+		}
+		return
+	}
 
-	// Получаем config (flags или env)
-	parseFlags()
+	printBuildInfo()
 
 	// Создаем интерфейсы
 	metricsCollector := collector.NewMetricsCollector()
 
-	baseURL := "http://" + serverHost
-	metricsSender := sender.NewSender(baseURL, []byte(flagHashKey))
+	var tlsConfig *tls.Config
+	if cfg.TLSCA != "" {
+		var err error
+		tlsConfig, err = tlsutil.ClientConfig(cfg.TLSCA, cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			log.Fatalf("Failed to configure TLS: %v", err)
+		}
+	}
+	var publicKey *rsa.PublicKey
+	if cfg.CryptoKey != "" {
+		var err error
+		publicKey, err = encryption.LoadPublicKey(cfg.CryptoKey)
+		if err != nil {
+			log.Fatalf("Failed to load crypto key: %v", err)
+		}
+	}
+	metricsSender := sender.NewSender(cfg.baseURL(), []byte(cfg.HashKey), cfg.KeyID, cfg.APIKey, tlsConfig, publicKey)
 
 	// Создаем агент
-	a := agent.NewAgent(pollInterval, reportInterval, flagRateLimit, metricsCollector, metricsSender)
+	a := agent.NewAgent(cfg.PollInterval, cfg.ReportInterval, cfg.RateLimit, metricsCollector, metricsSender)
 
 	doneCh := make(chan struct{})
 	// Перехватываем сигнал Ctrl+C
@@ -34,7 +63,7 @@ func main() {
 
 	// Запускаем агент
 	a.Collect(doneCh)
-	if flagReportBatch {
+	if cfg.ReportBatch {
 		a.ReportBatch(doneCh)
 	} else {
 		a.Report(doneCh)
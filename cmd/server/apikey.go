@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"metrics-service/internal/auth"
+)
+
+// runAPIKey выпускает новый API-ключ с именем и правами из args и печатает ключ и его описание для api_keys.
+// Аргумент tenant=<имя> ограничивает ключ метриками арендатора.
+func runAPIKey(args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: server [flags] apikey name write|read|admin... [tenant=name]")
+	}
+	token, err := auth.GenerateToken()
+	if err != nil {
+		return err
+	}
+	key := auth.Key{Name: args[0], Hash: auth.Hash(token)}
+	for _, arg := range args[1:] {
+		if name, ok := strings.CutPrefix(arg, "tenant="); ok {
+			key.Tenant = name
+			continue
+		}
+		key.Scopes = append(key.Scopes, arg)
+	}
+	// Проверяем имя и права так же, как при загрузке ключей сервером
+	if _, err = auth.NewKeyring([]auth.Key{key}); err != nil {
+		return err
+	}
+
+	entry, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("API key (shown once, pass it to the agent): %s\n", token)
+	fmt.Printf("Add to api_keys: %s\n", entry)
+	return nil
+}
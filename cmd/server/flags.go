@@ -1,23 +1,84 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
-	"strconv"
+	"strings"
+
+	"metrics-service/internal/auth"
+	"metrics-service/internal/config"
+	"metrics-service/internal/server/graphite"
+	"metrics-service/internal/server/handler"
+	"metrics-service/internal/server/middleware"
+	"metrics-service/internal/server/storage"
+	"metrics-service/internal/signature"
+	"metrics-service/internal/tenant"
 )
 
-var (
-	flagRunAddr  string
-	flagLogLevel string
+// serverConfig - конфигурация сервера. Длительности задаются в секундах.
+type serverConfig struct {
+	Address  string `json:"address" yaml:"address" env:"ADDRESS"`
+	LogLevel string `json:"log_level" yaml:"log_level" env:"LOG_LEVEL"`
+
+	StoreInterval   int    `json:"store_interval" yaml:"store_interval" env:"STORE_INTERVAL"`
+	FileStoragePath string `json:"file_storage_path" yaml:"file_storage_path" env:"FILE_STORAGE_PATH"`
+	Restore         bool   `json:"restore" yaml:"restore" env:"RESTORE"`
+	SnapshotKeep    int    `json:"snapshot_keep" yaml:"snapshot_keep" env:"SNAPSHOT_KEEP"`
+	WALSync         string `json:"wal_sync" yaml:"wal_sync" env:"WAL_SYNC"`
+
+	HistoryRetention int `json:"history_retention" yaml:"history_retention" env:"HISTORY_RETENTION"`
+	IdempotencyTTL   int `json:"idempotency_ttl" yaml:"idempotency_ttl" env:"IDEMPOTENCY_TTL"`
+
+	// TenantLimits задаются только в файле конфигурации и заменяют TenantMaxSeries для отдельных арендаторов.
+	TenantMaxSeries int            `json:"tenant_max_series" yaml:"tenant_max_series" env:"TENANT_MAX_SERIES"`
+	TenantLimits    map[string]int `json:"tenant_limits" yaml:"tenant_limits"`
+	MaxTenants      int            `json:"max_tenants" yaml:"max_tenants" env:"MAX_TENANTS"`
+
+	DatabaseDSN     string `json:"database_dsn" yaml:"database_dsn" env:"DATABASE_DSN" secret:"true"`
+	DatabaseTimeout int    `json:"database_timeout" yaml:"database_timeout" env:"DATABASE_TIMEOUT"`
+
+	HashKey  string `json:"key" yaml:"key" env:"KEY" secret:"true"`
+	HashKeys string `json:"hmac_keys" yaml:"hmac_keys" env:"HMAC_KEYS" secret:"true"`
+	HashSkew int    `json:"hmac_skew" yaml:"hmac_skew" env:"HMAC_SKEW"`
+
+	// APIKeys задаются только в файле конфигурации, ключи из APIKeysFile добавляются к ним.
+	APIKeys     []auth.Key `json:"api_keys" yaml:"api_keys"`
+	APIKeysFile string     `json:"api_keys_file" yaml:"api_keys_file" env:"API_KEYS_FILE"`
+
+	TrustedSubnet  string `json:"trusted_subnet" yaml:"trusted_subnet" env:"TRUSTED_SUBNET"`
+	TrustedProxies string `json:"trusted_proxies" yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+
+	StatsDAddress       string `json:"statsd_address" yaml:"statsd_address" env:"STATSD_ADDRESS"`
+	StatsDTCPAddress    string `json:"statsd_tcp_address" yaml:"statsd_tcp_address" env:"STATSD_TCP_ADDRESS"`
+	StatsDFlushInterval int    `json:"statsd_flush_interval" yaml:"statsd_flush_interval" env:"STATSD_FLUSH_INTERVAL"`
+	StatsDTenant        string `json:"statsd_tenant" yaml:"statsd_tenant" env:"STATSD_TENANT"`
+
+	InfluxNameTemplate string `json:"influx_name_template" yaml:"influx_name_template" env:"INFLUX_NAME_TEMPLATE"`
+
+	GraphiteAddress  string `json:"graphite_address" yaml:"graphite_address" env:"GRAPHITE_ADDRESS"`
+	GraphiteTenant   string `json:"graphite_tenant" yaml:"graphite_tenant" env:"GRAPHITE_TENANT"`
+	GraphiteMaxLines int    `json:"graphite_max_lines" yaml:"graphite_max_lines" env:"GRAPHITE_MAX_LINES"`
+	// GraphiteRules задаются только в файле конфигурации.
+	GraphiteRules []graphite.Rule `json:"graphite_rules" yaml:"graphite_rules"`
 
-	flagStoreInterval   int
-	flagFileStoragePath string
-	flagRestore         bool
+	OTLPResourceLabels string `json:"otlp_resource_labels" yaml:"otlp_resource_labels" env:"OTLP_RESOURCE_LABELS"`
+	OTLPNameAttribute  string `json:"otlp_name_attribute" yaml:"otlp_name_attribute" env:"OTLP_NAME_ATTRIBUTE"`
 
-	flagDatabaseDSN string
+	ShutdownTimeout int `json:"shutdown_timeout" yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
 
-	flagHashKey string
+	TLSCert     string `json:"tls_cert" yaml:"tls_cert" env:"TLS_CERT"`
+	TLSKey      string `json:"tls_key" yaml:"tls_key" env:"TLS_KEY"`
+	TLSClientCA string `json:"tls_client_ca" yaml:"tls_client_ca" env:"TLS_CLIENT_CA"`
+
+	CryptoKey string `json:"crypto_key" yaml:"crypto_key" env:"CRYPTO_KEY"`
+}
+
+var (
+	cfg serverConfig
+
+	flagPrintConfig bool
 
 	// Флаги линковщика
 	buildVersion string
@@ -25,47 +86,189 @@ var (
 	buildCommit  string
 )
 
-func parseFlags() {
-	flag.StringVar(&flagRunAddr, "a", "localhost:8080", "endpoint address")
-	flag.StringVar(&flagLogLevel, "l", "info", "log level")
+// parseFlags собирает конфигурацию сервера: значения по умолчанию < файл -c/CONFIG < переменные окружения < флаги.
+func parseFlags() error {
+	registerFlags(flag.CommandLine, &cfg)
+	flag.BoolVar(&flagPrintConfig, "print-config", false, "print effective configuration and exit")
+
+	if err := config.Parse(flag.CommandLine, os.Args[1:], &cfg); err != nil {
+		return err
+	}
+	return cfg.validate()
+}
+
+// loadConfig заново собирает конфигурацию сервера из тех же аргументов, файла и переменных окружения, что и parseFlags.
+func loadConfig() (serverConfig, error) {
+	var c serverConfig
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	registerFlags(fs, &c)
+	fs.Bool("print-config", false, "print effective configuration and exit")
+
+	if err := config.Parse(fs, os.Args[1:], &c); err != nil {
+		return serverConfig{}, err
+	}
+	return c, c.validate()
+}
+
+// registerFlags связывает флаги сервера с полями c.
+func registerFlags(fs *flag.FlagSet, c *serverConfig) {
+	fs.StringVar(&c.Address, "a", "localhost:8080", "endpoint address")
+	fs.StringVar(&c.LogLevel, "l", "info", "log level")
+
+	fs.IntVar(&c.StoreInterval, "i", 300, "metrics store interval")
+	fs.StringVar(&c.FileStoragePath, "f", "metrics.json", "metrics store path")
+	fs.BoolVar(&c.Restore, "r", true, "load metrics bool")
+	fs.IntVar(&c.SnapshotKeep, "snapshot-keep", 3, "number of metrics snapshots to keep")
+	fs.StringVar(&c.WALSync, "wal-sync", storage.WALSyncOff, "WAL sync mode: off, none, interval, always")
+
+	fs.IntVar(&c.HistoryRetention, "hr", 3600, "metrics history retention in seconds, 0 disables history")
+	fs.IntVar(&c.IdempotencyTTL, "idempotency-ttl", 3600, "batch idempotency keys retention in seconds")
+	fs.IntVar(&c.TenantMaxSeries, "tenant-max-series", 0, "max metric series per tenant, 0 is unlimited")
+	fs.IntVar(&c.MaxTenants, "max-tenants", 100, "max tenants of the memory storage besides tenant_limits, 0 is unlimited")
+
+	fs.StringVar(&c.DatabaseDSN, "d", "", "database DSN")
+	fs.IntVar(&c.DatabaseTimeout, "db-timeout", 1, "database query timeout in seconds")
+
+	fs.StringVar(&c.HashKey, "k", "", "default HMAC key for requests without key id")
+	fs.StringVar(&c.HashKeys, "hmac-keys", "", "additional HMAC keys as id:key,id:key for key rotation")
+	fs.IntVar(&c.HashSkew, "hmac-skew", 300, "allowed signature timestamp skew in seconds")
+	fs.StringVar(&c.APIKeysFile, "api-keys-file", "", "JSON or YAML file with hashed API keys, enables authentication")
+
+	fs.StringVar(&c.TrustedSubnet, "t", "", "comma-separated CIDRs allowed to write metrics")
+	fs.StringVar(&c.TrustedProxies, "trusted-proxies", "", "comma-separated CIDRs of proxies allowed to set X-Real-IP")
 
-	flag.IntVar(&flagStoreInterval, "i", 300, "metrics store interval")
-	flag.StringVar(&flagFileStoragePath, "f", "metrics.json", "metrics store path")
-	flag.BoolVar(&flagRestore, "r", true, "load metrics bool")
+	fs.StringVar(&c.StatsDAddress, "statsd-address", "", "UDP address of the StatsD listener, e.g. :8125")
+	fs.StringVar(&c.StatsDTCPAddress, "statsd-tcp-address", "", "TCP address of the StatsD listener")
+	fs.IntVar(&c.StatsDFlushInterval, "statsd-flush-interval", 1, "StatsD aggregation window in seconds")
+	fs.StringVar(&c.StatsDTenant, "statsd-tenant", "", "tenant of metrics received over StatsD")
 
-	flag.StringVar(&flagDatabaseDSN, "d", "", "database DSN")
+	fs.StringVar(&c.InfluxNameTemplate, "influx-name-template", handler.DefaultInfluxNameTemplate,
+		"metric name template for InfluxDB line protocol fields with {measurement} and {field}")
 
-	flag.StringVar(&flagHashKey, "k", "", "hash key")
+	fs.StringVar(&c.GraphiteAddress, "graphite-address", "", "TCP address of the Graphite plaintext listener, e.g. :2003")
+	fs.StringVar(&c.GraphiteTenant, "graphite-tenant", "", "tenant of metrics received over Graphite")
+	fs.IntVar(&c.GraphiteMaxLines, "graphite-max-lines", 100000, "maximum lines per Graphite connection, 0 - unlimited")
 
-	flag.Parse()
+	fs.StringVar(&c.OTLPResourceLabels, "otlp-resource-labels", "service.name,service.namespace,service.instance.id,host.name",
+		"comma-separated OTLP resource attributes copied to labels, * - all")
+	fs.StringVar(&c.OTLPNameAttribute, "otlp-name-attribute", "", "OTLP resource attribute prefixing metric names, e.g. service.name")
 
-	if envRunAddr := os.Getenv("ADDRESS"); envRunAddr != "" {
-		flagRunAddr = envRunAddr
+	fs.IntVar(&c.ShutdownTimeout, "shutdown-timeout", 10, "in-flight requests drain deadline on shutdown in seconds")
+
+	fs.StringVar(&c.TLSCert, "tls-cert", "", "TLS certificate file, enables HTTPS")
+	fs.StringVar(&c.TLSKey, "tls-key", "", "TLS private key file")
+	fs.StringVar(&c.TLSClientCA, "tls-client-ca", "", "CA file for client certificates, enables mutual TLS")
+
+	fs.StringVar(&c.CryptoKey, "crypto-key", "", "RSA private key file for decrypting agent payloads")
+}
+
+// validate проверяет значения конфигурации.
+func (c *serverConfig) validate() error {
+	switch {
+	case c.Address == "":
+		return errors.New("address must not be empty")
+	case c.StoreInterval < 0:
+		return fmt.Errorf("store_interval must not be negative, got %d", c.StoreInterval)
+	case c.SnapshotKeep < 1:
+		return fmt.Errorf("snapshot_keep must be at least 1, got %d", c.SnapshotKeep)
+	case c.HistoryRetention < 0:
+		return fmt.Errorf("history_retention must not be negative, got %d", c.HistoryRetention)
+	case c.IdempotencyTTL < 1:
+		return fmt.Errorf("idempotency_ttl must be positive, got %d", c.IdempotencyTTL)
+	case c.TenantMaxSeries < 0:
+		return fmt.Errorf("tenant_max_series must not be negative, got %d", c.TenantMaxSeries)
+	case c.MaxTenants < 0:
+		return fmt.Errorf("max_tenants must not be negative, got %d", c.MaxTenants)
+	case c.DatabaseTimeout < 1:
+		return fmt.Errorf("database_timeout must be positive, got %d", c.DatabaseTimeout)
+	case c.HashSkew < 1:
+		return fmt.Errorf("hmac_skew must be positive, got %d", c.HashSkew)
+	case c.StatsDFlushInterval < 1:
+		return fmt.Errorf("statsd_flush_interval must be positive, got %d", c.StatsDFlushInterval)
+	case c.StatsDTenant != "" && !tenant.Valid(c.StatsDTenant):
+		return fmt.Errorf("invalid statsd_tenant %q", c.StatsDTenant)
+	case !strings.Contains(c.InfluxNameTemplate, "{field}"):
+		return fmt.Errorf("influx_name_template must contain {field}, got %q", c.InfluxNameTemplate)
+	case c.GraphiteTenant != "" && !tenant.Valid(c.GraphiteTenant):
+		return fmt.Errorf("invalid graphite_tenant %q", c.GraphiteTenant)
+	case c.GraphiteMaxLines < 0:
+		return fmt.Errorf("graphite_max_lines must not be negative, got %d", c.GraphiteMaxLines)
+	case c.ShutdownTimeout < 0:
+		return fmt.Errorf("shutdown_timeout must not be negative, got %d", c.ShutdownTimeout)
+	case (c.TLSCert == "") != (c.TLSKey == ""):
+		return errors.New("tls_cert and tls_key must be set together")
+	case c.TLSClientCA != "" && c.TLSCert == "":
+		return errors.New("tls_client_ca requires tls_cert and tls_key")
 	}
-	if envLogLevel := os.Getenv("LOG_LEVEL"); envLogLevel != "" {
-		flagLogLevel = envLogLevel
+	if _, err := c.hashKeys(); err != nil {
+		return err
 	}
-	if envStoreInterval := os.Getenv("STORE_INTERVAL"); envStoreInterval != "" {
-		interval, err := strconv.Atoi(envStoreInterval)
-		if err == nil {
-			flagStoreInterval = interval
+	for name, limit := range c.TenantLimits {
+		if !tenant.Valid(name) {
+			return fmt.Errorf("tenant_limits: invalid tenant name %q", name)
+		}
+		if limit < 0 {
+			return fmt.Errorf("tenant_limits: limit of tenant %q must not be negative, got %d", name, limit)
 		}
 	}
-	if envFileStoragePath := os.Getenv("LOG_LEVEL"); envFileStoragePath != "" {
-		flagLogLevel = envFileStoragePath
+	if _, err := graphite.NewMapper(c.GraphiteRules); err != nil {
+		return fmt.Errorf("invalid graphite_rules: %w", err)
+	}
+	if _, err := middleware.ParseSubnets(c.TrustedSubnet); err != nil {
+		return fmt.Errorf("invalid trusted_subnet: %w", err)
 	}
-	if envRestore := os.Getenv("RESTORE"); envRestore != "" {
-		restore, err := strconv.ParseBool(envRestore)
-		if err == nil {
-			flagRestore = restore
+	if _, err := middleware.ParseSubnets(c.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid trusted_proxies: %w", err)
+	}
+	if c.TrustedProxies != "" && c.TrustedSubnet == "" {
+		return errors.New("trusted_proxies requires trusted_subnet")
+	}
+	switch c.WALSync {
+	case storage.WALSyncOff, storage.WALSyncNone, storage.WALSyncInterval, storage.WALSyncAlways:
+	default:
+		return fmt.Errorf("unknown wal_sync mode %q, expected off, none, interval or always", c.WALSync)
+	}
+	return nil
+}
+
+// otlpConfig возвращает параметры преобразования ресурсов OTLP.
+func (c *serverConfig) otlpConfig() handler.OTLPConfig {
+	cfg := handler.OTLPConfig{NameAttribute: c.OTLPNameAttribute}
+	for _, key := range strings.Split(c.OTLPResourceLabels, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			cfg.ResourceLabels = append(cfg.ResourceLabels, key)
 		}
 	}
-	if envDatabaseDSN := os.Getenv("DATABASE_DSN"); envDatabaseDSN != "" {
-		flagDatabaseDSN = envDatabaseDSN
+	return cfg
+}
+
+// hashKeys возвращает действующие ключи HMAC: ключ key с идентификатором по умолчанию и ключи hmac_keys.
+func (c *serverConfig) hashKeys() (map[string][]byte, error) {
+	keys, err := signature.ParseKeys(c.HashKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hmac_keys: %w", err)
+	}
+	if c.HashKey != "" {
+		keys[""] = []byte(c.HashKey)
+	}
+	return keys, nil
+}
+
+// apiKeyring собирает API-ключи из конфигурации и файла api_keys_file. Файл читается при каждом вызове.
+// Без ключей и файла возвращает nil: проверка ключей отключена. Пустой файл оставляет проверку включенной.
+func (c *serverConfig) apiKeyring() (*auth.Keyring, error) {
+	if len(c.APIKeys) == 0 && c.APIKeysFile == "" {
+		return nil, nil
 	}
-	if envHashKey := os.Getenv("KEY"); envHashKey != "" {
-		flagHashKey = envHashKey
+	keys := append([]auth.Key(nil), c.APIKeys...)
+	if c.APIKeysFile != "" {
+		fileKeys, err := auth.LoadFile(c.APIKeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load api keys: %w", err)
+		}
+		keys = append(keys, fileKeys...)
 	}
+	return auth.NewKeyring(keys)
 }
 
 func printBuildInfo() {
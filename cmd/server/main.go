@@ -2,8 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/rsa"
+	"crypto/tls"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -12,30 +20,133 @@ import (
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
 
+	"metrics-service/internal/auth"
+	"metrics-service/internal/config"
+	"metrics-service/internal/encryption"
 	apperrors "metrics-service/internal/server/errors"
+	"metrics-service/internal/server/graphite"
 	"metrics-service/internal/server/handler"
 	"metrics-service/internal/server/middleware"
+	"metrics-service/internal/server/statsd"
 	"metrics-service/internal/server/storage"
+	"metrics-service/internal/tlsutil"
+)
+
+const (
+	// walCheckpointInterval - период снапшота в секундах, если включен журнал и задано синхронное сохранение.
+	walCheckpointInterval = 300
+	// historyPruneInterval - период удаления истории, вышедшей за окно хранения.
+	historyPruneInterval = time.Minute
 )
 
 func main() {
 
+	// Обрабатываем файл конфигурации, переменные окружения и аргументы командной строки
+	if err := parseFlags(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if flagPrintConfig {
+		if err := config.Print(os.Stdout, &cfg); err != nil {
+			log.Fatalf("Failed to print configuration: %v", err)
+		}
+		return
+	}
+
 	printBuildInfo()
 
-	// Обрабатываем аргументы командной строки
-	parseFlags()
+	// Выпуск API-ключа: server [flags] apikey name scope...
+	if flag.Arg(0) == "apikey" {
+		if err := runAPIKey(flag.Args()[1:]); err != nil {
+			log.Fatalf("Failed to generate api key: %v", err)
+		}
+		return
+	}
+
+	// Режим миграций схемы бд: server [flags] migrate up|down|status
+	if flag.Arg(0) == "migrate" {
+		err := runMigrate(flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("Failed to migrate: %v", err)
+		}
+		return
+	}
+
+	// Код возврата: 0 - штатная остановка по сигналу, 1 - ошибка запуска или остановки
+	if err := run(); err != nil {
+		log.Fatalf("Server stopped with error: %v", err)
+	}
+	log.Println("Server stopped")
+}
+
+// run запускает сервер и блокируется до SIGINT/SIGTERM или ошибки сервера.
+//
+// При остановке сервер перестает принимать соединения и дожидается текущих запросов не дольше cfg.ShutdownTimeout,
+// затем останавливает периодическое сохранение, сохраняет метрики на диск последний раз и закрывает хранилище.
+func run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Создаем middleware (логгер, gzip)
-	mid := middleware.NewMiddleware([]byte(flagHashKey))
-	err := mid.InitializeZap(flagLogLevel)
+	hashKeys, err := cfg.hashKeys()
+	if err != nil {
+		return err
+	}
+	mid := middleware.NewMiddleware(hashKeys)
+	err = mid.InitializeZap(cfg.LogLevel)
+	if err != nil {
+		return fmt.Errorf("failed to initialize middleware: %w", err)
+	}
+	keyring, err := cfg.apiKeyring()
 	if err != nil {
-		log.Fatalf("Failed to initialize middleware: %v", err)
+		return err
+	}
+	mid.SetAPIKeys(keyring)
+
+	// TLS: сертификат перечитывается при изменении файлов, CA клиентов включает mTLS
+	var tlsConfig *tls.Config
+	if cfg.TLSCert != "" {
+		tlsConfig, err = tlsutil.ServerConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA)
+		if err != nil {
+			return fmt.Errorf("failed to configure TLS: %w", err)
+		}
+	}
+
+	// Закрытый ключ для расшифровки тел запросов агентов
+	var privateKey *rsa.PrivateKey
+	if cfg.CryptoKey != "" {
+		privateKey, err = encryption.LoadPrivateKey(cfg.CryptoKey)
+		if err != nil {
+			return fmt.Errorf("failed to load crypto key: %w", err)
+		}
+	}
+
+	// Доверенные подсети для записи по HTTP, StatsD и Graphite
+	trustedSubnet, err := middleware.ParseSubnets(cfg.TrustedSubnet)
+	if err != nil {
+		return fmt.Errorf("invalid trusted subnet: %w", err)
+	}
+	trustedProxies, err := middleware.ParseSubnets(cfg.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid trusted proxies: %w", err)
 	}
 
 	// Создаем storage
-	storage, err := storage.NewStorage(flagDatabaseDSN, flagFileStoragePath, flagRestore, flagStoreInterval)
+	storage, err := storage.NewStorage(storage.Config{
+		DatabaseDSN:      cfg.DatabaseDSN,
+		DatabaseTimeout:  cfg.DatabaseTimeout,
+		FileStoragePath:  cfg.FileStoragePath,
+		Restore:          cfg.Restore,
+		StoreInterval:    cfg.StoreInterval,
+		SnapshotKeep:     cfg.SnapshotKeep,
+		HistoryRetention: cfg.HistoryRetention,
+		IdempotencyTTL:   cfg.IdempotencyTTL,
+		WALSync:          cfg.WALSync,
+		MaxSeries:        cfg.TenantMaxSeries,
+		TenantMaxSeries:  cfg.TenantLimits,
+		MaxTenants:       cfg.MaxTenants,
+	})
 	if err != nil {
-		log.Fatalf("Failed to initialize storage: %v", err)
+		return fmt.Errorf("failed to initialize storage: %w", err)
 	}
 
 	storageRetryer := retryables.NewRetryer(nil)
@@ -50,20 +161,91 @@ func main() {
 	if err != nil {
 		log.Printf("Failed to bootstrap storage: %v", err)
 	}
-	defer storage.Close()
 
-	isSync := flagStoreInterval <= 0
+	isSync, storeInterval := saveMode(cfg)
+
+	// Прием метрик StatsD. Как и запись по HTTP, ограничен доверенными подсетями
+	var statsdListener *statsd.Listener
+	if cfg.StatsDAddress != "" || cfg.StatsDTCPAddress != "" {
+		statsdListener = statsd.NewListener(statsd.Config{
+			UDPAddress:     cfg.StatsDAddress,
+			TCPAddress:     cfg.StatsDTCPAddress,
+			FlushInterval:  time.Duration(cfg.StatsDFlushInterval) * time.Second,
+			Tenant:         cfg.StatsDTenant,
+			TrustedSubnets: trustedSubnet,
+			SaveOnFlush:    isSync,
+		}, storage, storageRetryer)
+		if err = statsdListener.Start(); err != nil {
+			storage.Close()
+			return fmt.Errorf("failed to start StatsD listener: %w", err)
+		}
+	}
+	// Прием метрик Graphite, также ограничен доверенными подсетями
+	var graphiteListener *graphite.Listener
+	if cfg.GraphiteAddress != "" {
+		graphiteListener, err = graphite.NewListener(graphite.Config{
+			Address:         cfg.GraphiteAddress,
+			Tenant:          cfg.GraphiteTenant,
+			TrustedSubnets:  trustedSubnet,
+			Rules:           cfg.GraphiteRules,
+			MaxLinesPerConn: cfg.GraphiteMaxLines,
+			SaveOnWrite:     isSync,
+		}, storage, storageRetryer)
+		if err == nil {
+			err = graphiteListener.Start()
+		}
+		if err != nil {
+			if statsdListener != nil {
+				statsdListener.Shutdown(context.Background())
+			}
+			storage.Close()
+			return fmt.Errorf("failed to start Graphite listener: %w", err)
+		}
+	}
 	// Сохранение данных на диск
-	if flagDatabaseDSN == "" && !isSync {
-		ticker := time.NewTicker(time.Duration(flagStoreInterval) * time.Second)
+	saveDoneCh := make(chan struct{})
+	var saveIntervalCh chan time.Duration
+	var saveWg sync.WaitGroup
+	if cfg.DatabaseDSN == "" && !isSync {
+		saveIntervalCh = make(chan time.Duration)
+		ticker := time.NewTicker(time.Duration(storeInterval) * time.Second)
 		defer ticker.Stop()
+		saveWg.Add(1)
 		go func() {
-			for range ticker.C {
-				err = storageRetryer.Retry(func() error {
-					return storage.Save()
-				})
-				if err != nil {
-					log.Printf("Failed to save metrics on disk: %v\n", err)
+			defer saveWg.Done()
+			for {
+				select {
+				case <-ticker.C:
+					saveErr := storageRetryer.Retry(func() error {
+						return storage.Save()
+					})
+					if saveErr != nil {
+						log.Printf("Failed to save metrics on disk: %v\n", saveErr)
+					}
+				case interval := <-saveIntervalCh:
+					ticker.Reset(interval)
+				case <-saveDoneCh:
+					return
+				}
+			}
+		}()
+	}
+
+	// Удаление устаревшей истории. Оно не зависит от сохранения на диск и нужно также для Postgres
+	if cfg.HistoryRetention > 0 {
+		saveWg.Add(1)
+		go func() {
+			defer saveWg.Done()
+			ticker := time.NewTicker(historyPruneInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if pruneErr := storage.PruneHistory(context.Background()); pruneErr != nil {
+						log.Printf("Failed to prune metrics history: %v\n", pruneErr)
+					}
+				case <-saveDoneCh:
+					return
 				}
 			}
 		}()
@@ -72,30 +254,130 @@ func main() {
 	// Создаем handler's
 	metricsHandler := handler.NewMetricsHandler(storage, storageRetryer, isSync)
 	htmlHandler := handler.NewHTMLHandler(storage, storageRetryer)
+	prometheusHandler := handler.NewPrometheusHandler(storage, storageRetryer)
+	influxHandler := handler.NewInfluxHandler(storage, storageRetryer, isSync, cfg.InfluxNameTemplate)
+	remoteWriteHandler := handler.NewRemoteWriteHandler(storage, storageRetryer, isSync)
+	otlpHandler := handler.NewOTLPHandler(storage, storageRetryer, isSync, cfg.otlpConfig())
 
-	server := gin.Default()
+	router := gin.Default()
+	// Хранилище получает gin.Context, арендатор запроса передается ему через контекст запроса
+	router.ContextWithFallback = true
 	// Роутинг
 	// Для всех эндпоинтов используем логирование
-	server.Use(mid.WithLogging())
+	router.Use(mid.WithLogging())
+	// Идентификатор агента из клиентского сертификата для логов и авторизации
+	router.Use(mid.WithClientCert())
+
+	// Запись принимается только из доверенных подсетей
+	trusted := mid.WithTrustedSubnet(trustedSubnet, trustedProxies)
+	// Права API-ключей: запись, чтение и служебные эндпоинты. /ping доступен без ключа для проверок доступности
+	write := mid.WithAuth(auth.ScopeWrite)
+	read := mid.WithAuth(auth.ScopeRead)
+	// Расшифровка тел агента после проверок подсети и ключа, раньше gzip и HMAC: агент шифрует сжатое и подписанное тело
+	decrypted := mid.WithDecryption(privateKey)
+	// Сжатие gzip. На маршрутах записи стоит после расшифровки, поэтому подключается к каждому маршруту
+	gzipped := mid.WithGzip()
+	// Подпись проверяется на запросах записи. Один обработчик на все маршруты, чтобы nonce не повторялись между ними
+	signed := mid.WithHMAC(time.Duration(cfg.HashSkew) * time.Second)
+	// Арендатор определяется по проверенному API-ключу или заголовку
+	scoped := mid.WithTenant()
+
+	router.POST("/update/:metricType/:metricName/:metricVal", trusted, write, decrypted, signed, scoped, metricsHandler.Update)
+	router.GET("/value/:metricType/:metricName", read, scoped, metricsHandler.Get)
+	router.GET("/history/:metricType/:metricName", read, scoped, metricsHandler.History)
+	router.GET("/ping", metricsHandler.Ping)
+	// Prometheus remote write сжимает тело snappy и не подписывает запросы HMAC,
+	// поэтому маршрут защищен только доверенными подсетями и API-ключом (authorization в remote_write)
+	router.POST("/api/v1/write", trusted, write, scoped, remoteWriteHandler.Write)
+
+	// Группа для чтения с gzip
+	gzipGroup := router.Group("")
+	gzipGroup.Use(gzipped)
 
-	server.POST("/update/:metricType/:metricName/:metricVal", metricsHandler.Update)
-	server.GET("/value/:metricType/:metricName", metricsHandler.Get)
-	server.GET("/ping", metricsHandler.Ping)
+	gzipGroup.GET("/", read, scoped, htmlHandler.Get)
+	gzipGroup.GET("/metrics", read, scoped, prometheusHandler.Get)
+	gzipGroup.POST("/value/", read, scoped, metricsHandler.GetJSON)
+	gzipGroup.POST("/values/", read, scoped, metricsHandler.GetByLabels)
 
-	// Группа для методов с gzip
-	gzipGroup := server.Group("")
-	gzipGroup.Use(mid.WithGzip())
+	// Запись с gzip. HMAC стоит после gzip: агент подписывает несжатое тело
+	router.POST("/update/", trusted, write, decrypted, gzipped, signed, scoped, metricsHandler.UpdateJSON)
+	router.POST("/updates/", trusted, write, decrypted, gzipped, signed, scoped, metricsHandler.UpdateBatch)
+	// Запись в формате InfluxDB line protocol для Telegraf и шлюзов. Они не подписывают запросы HMAC,
+	// поэтому маршрут, как и remote write, защищен доверенными подсетями и API-ключом
+	router.POST("/write", trusted, write, gzipped, scoped, influxHandler.Write)
+	// OTLP/HTTP, как и remote write, без подписи HMAC: SDK OpenTelemetry передают API-ключ в заголовках
+	router.POST("/v1/metrics", trusted, write, gzipped, scoped, otlpHandler.Write)
 
-	gzipGroup.GET("/", htmlHandler.Get)
+	pprof.Register(router.Group("", mid.WithAuth(auth.ScopeAdmin)), "dev/pprof")
 
-	gzipGroup.POST("/update/", metricsHandler.UpdateJSON)
-	gzipGroup.POST("/value/", metricsHandler.GetJSON)
-	gzipGroup.POST("/updates/", metricsHandler.UpdateBatch)
+	server := &http.Server{Addr: cfg.Address, Handler: router, TLSConfig: tlsConfig}
+	serveErrCh := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			// Сертификат отдает TLSConfig.GetCertificate, поэтому пути к файлам не передаются
+			serveErrCh <- server.ListenAndServeTLS("", "")
+			return
+		}
+		serveErrCh <- server.ListenAndServe()
+	}()
 
-	pprof.Register(server, "dev/pprof")
+	// SIGHUP перечитывает конфигурацию и применяет настройки, изменяемые без перезапуска
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+	r := &reloader{mid: mid, storage: storage, saveIntervalCh: saveIntervalCh}
 
-	err = server.Run(flagRunAddr)
+	var errs []error
+	for running := true; running; {
+		select {
+		case <-ctx.Done():
+			log.Println("Shutting down server")
+			running = false
+		case err = <-serveErrCh:
+			errs = append(errs, fmt.Errorf("failed to start server: %w", err))
+			running = false
+		case <-hupCh:
+			next, loadErr := loadConfig()
+			if loadErr != nil {
+				log.Printf("Failed to reload configuration, keeping current: %v", loadErr)
+				continue
+			}
+			cfg = r.reload(cfg, next)
+		}
+	}
+	// Повторный сигнал во время остановки завершает процесс сразу
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout)*time.Second)
+	defer cancel()
+	if err = server.Shutdown(shutdownCtx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to drain requests: %w", err))
+	}
+
+	// Последнее окно StatsD записывается до последнего сохранения на диск
+	if statsdListener != nil {
+		if err = statsdListener.Shutdown(shutdownCtx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to flush StatsD metrics: %w", err))
+		}
+	}
+	if graphiteListener != nil {
+		if err = graphiteListener.Shutdown(shutdownCtx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to stop Graphite listener: %w", err))
+		}
+	}
+
+	close(saveDoneCh)
+	saveWg.Wait()
+
+	// Последнее сохранение: метрики, полученные после последнего тика, иначе теряются
+	err = storageRetryer.Retry(func() error {
+		return storage.Save()
+	})
 	if err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+		errs = append(errs, fmt.Errorf("failed to save metrics on disk: %w", err))
+	}
+	if err = storage.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close storage: %w", err))
 	}
+	return errors.Join(errs...)
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+
+	"metrics-service/internal/server/storage/migrations"
+)
+
+// migrateTimeout - время на выполнение команды migrate, включая ожидание lock других реплик.
+const migrateTimeout = 5 * time.Minute
+
+// runMigrate выполняет команду миграций схемы бд: up, down или status.
+func runMigrate(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: server [flags] migrate up|down|status")
+	}
+	if cfg.DatabaseDSN == "" {
+		return errors.New("database DSN is not set")
+	}
+
+	db, err := sql.Open("pgx", cfg.DatabaseDSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := migrations.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applied %d migrations\n", applied)
+	case "down":
+		version, err := migrator.Down(ctx)
+		if err != nil {
+			return err
+		}
+		if version == 0 {
+			fmt.Println("No migrations to revert")
+			return nil
+		}
+		fmt.Printf("Reverted migration %04d\n", version)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", args[0])
+	}
+	return nil
+}
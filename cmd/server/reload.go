@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"metrics-service/internal/config"
+	"metrics-service/internal/server/middleware"
+	"metrics-service/internal/server/storage"
+)
+
+// reloader применяет конфигурацию, перечитанную по SIGHUP, к работающему серверу.
+//
+// Без перезапуска меняются уровень логирования, ключи HMAC, API-ключи, период сохранения снапшотов, время на остановку
+// и лимиты серий и арендаторов. Адрес, хранилище и остальные его параметры заданы при запуске, их изменения отклоняются.
+type reloader struct {
+	mid     middleware.IMiddleware
+	storage storage.Storage
+	// saveIntervalCh передает новый период в цикл сохранения, nil - цикл не запущен.
+	saveIntervalCh chan<- time.Duration
+}
+
+// reload применяет изменения next относительно current и возвращает действующую конфигурацию.
+// Отклоненные изменения записываются в лог с причиной, для них остаются прежние значения.
+func (r *reloader) reload(current, next serverConfig) serverConfig {
+	// Файл API-ключей перечитывается при каждом SIGHUP: ключи добавляют и отзывают, не меняя путь к файлу
+	apiKeysErr := r.reloadAPIKeys(next)
+
+	changed, err := config.Changed(&current, &next)
+	if err != nil {
+		log.Printf("Failed to compare configurations: %v", err)
+		return current
+	}
+	if len(changed) == 0 {
+		log.Println("Configuration reloaded, nothing changed")
+		return current
+	}
+
+	applied := current
+	var appliedKeys []string
+	for _, key := range changed {
+		switch key {
+		case "log_level":
+			if err = r.mid.SetLogLevel(next.LogLevel); err != nil {
+				log.Printf("Refused to reload log_level: %v", err)
+				continue
+			}
+			applied.LogLevel = next.LogLevel
+		case "key", "hmac_keys":
+			// Конфигурация уже проверена, ключи разбираются без ошибок
+			hashKeys, _ := next.hashKeys()
+			r.mid.SetHashKeys(hashKeys)
+			applied.HashKey, applied.HashKeys = next.HashKey, next.HashKeys
+		case "api_keys", "api_keys_file":
+			if apiKeysErr != nil {
+				log.Printf("Refused to reload %s: %v", key, apiKeysErr)
+				continue
+			}
+			applied.APIKeys, applied.APIKeysFile = next.APIKeys, next.APIKeysFile
+		case "store_interval":
+			if err = r.setStoreInterval(current, next.StoreInterval); err != nil {
+				log.Printf("Refused to reload store_interval: %v", err)
+				continue
+			}
+			applied.StoreInterval = next.StoreInterval
+		case "shutdown_timeout":
+			applied.ShutdownTimeout = next.ShutdownTimeout
+		case "tenant_max_series", "tenant_limits", "max_tenants":
+			// Лимиты проверены вместе с остальной конфигурацией и применяются вместе
+			r.storage.SetSeriesLimits(next.TenantMaxSeries, next.TenantLimits, next.MaxTenants)
+			applied.TenantMaxSeries, applied.TenantLimits, applied.MaxTenants = next.TenantMaxSeries, next.TenantLimits, next.MaxTenants
+		default:
+			log.Printf("Refused to reload %s: the setting cannot be changed without restart", key)
+			continue
+		}
+		appliedKeys = append(appliedKeys, key)
+	}
+
+	if len(appliedKeys) > 0 {
+		log.Printf("Configuration reloaded, applied: %s", strings.Join(appliedKeys, ", "))
+	}
+	return applied
+}
+
+// reloadAPIKeys заменяет API-ключи ключами конфигурации next. При ошибке остаются прежние ключи.
+func (r *reloader) reloadAPIKeys(next serverConfig) error {
+	keyring, err := next.apiKeyring()
+	if err != nil {
+		log.Printf("Failed to reload API keys, keeping current: %v", err)
+		return err
+	}
+	r.mid.SetAPIKeys(keyring)
+	if keyring != nil {
+		log.Printf("API keys reloaded: %d keys", keyring.Len())
+	}
+	return nil
+}
+
+// setStoreInterval меняет период цикла сохранения. Переход между синхронным и периодическим сохранением
+// требует перезапуска: режим задан обработчикам при запуске.
+func (r *reloader) setStoreInterval(current serverConfig, storeInterval int) error {
+	next := current
+	next.StoreInterval = storeInterval
+
+	currentSync, _ := saveMode(current)
+	nextSync, interval := saveMode(next)
+	if currentSync != nextSync {
+		return errors.New("switching between synchronous and periodic saving requires restart")
+	}
+	if r.saveIntervalCh != nil {
+		r.saveIntervalCh <- time.Duration(interval) * time.Second
+	}
+	return nil
+}
+
+// saveMode возвращает режим сохранения снапшотов: синхронный после каждого обновления
+// или периодический с интервалом в секундах.
+func saveMode(c serverConfig) (isSync bool, interval int) {
+	if c.StoreInterval > 0 {
+		return false, c.StoreInterval
+	}
+	// С журналом каждое обновление уже сохраняется на диск, поэтому снапшот пишется периодически
+	if walEnabled(c) {
+		return false, walCheckpointInterval
+	}
+	return true, 0
+}
+
+// walEnabled сообщает, ведет ли in-memory хранилище журнал упреждающей записи.
+func walEnabled(c serverConfig) bool {
+	return c.DatabaseDSN == "" && c.FileStoragePath != "" && c.WALSync != storage.WALSyncOff
+}
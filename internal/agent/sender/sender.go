@@ -5,18 +5,25 @@ package sender
 import (
 	"bytes"
 	"compress/gzip"
-	"crypto/hmac"
-	"crypto/sha256"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-resty/resty/v2"
 
+	"metrics-service/internal/encryption"
 	"metrics-service/internal/server/models"
+	"metrics-service/internal/signature"
 )
 
 // ISender представляет интерфейс для отправки метрик на сервер.
@@ -27,16 +34,50 @@ type ISender interface {
 	SendBatch(metricsMap map[string]interface{}) error
 }
 
+// idempotencyKeyHeader - заголовок с ключом идемпотентности пакета метрик.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// realIPHeader - заголовок с адресом агента для проверки доверенной подсети на сервере.
+const realIPHeader = "X-Real-IP"
+
 // sender реализует интерфейс Sender.
 type sender struct {
 	client  *resty.Client
 	baseURL string
 	hashKey []byte
+	// keyID - идентификатор ключа hashKey на сервере, "" - ключ по умолчанию.
+	keyID string
+	// apiKey - API-ключ агента, передается в заголовке "Authorization: Bearer", "" - без ключа.
+	apiKey string
+	// tlsConfig - TLS-конфигурация для HTTPS, nil для HTTP.
+	tlsConfig *tls.Config
+	// publicKey - открытый ключ сервера для шифрования тел запросов, nil - без шифрования.
+	publicKey *rsa.PublicKey
+	// realIP - адрес интерфейса, через который агент обращается к серверу, "" - не определен.
+	realIP string
+
+	// agentID и seq образуют ключ идемпотентности пакета: сервер не применяет повторно пакет,
+	// ответ на который потерялся и который resty отправил еще раз.
+	agentID string
+	seq     atomic.Uint64
 }
 
-// NewSender создает новый экземпляр sender с заданным базовым URL и ключом для хеширования.
-func NewSender(baseURL string, hashKey []byte) ISender {
+// NewSender создает новый экземпляр sender с заданным базовым URL и ключом для подписи запросов.
+// keyID - идентификатор ключа на сервере, "" - ключ сервера по умолчанию. apiKey - API-ключ агента, "" - без ключа.
+// tlsConfig задает доверенный CA и клиентский сертификат для HTTPS, nil - без собственной TLS-конфигурации.
+// publicKey - открытый ключ сервера для шифрования тел запросов, nil - тела не шифруются.
+func NewSender(baseURL string, hashKey []byte, keyID, apiKey string, tlsConfig *tls.Config, publicKey *rsa.PublicKey) ISender {
 	client := resty.New()
+	if tlsConfig != nil {
+		client.SetTLSClientConfig(tlsConfig)
+	}
+	if apiKey != "" {
+		client.SetAuthToken(apiKey)
+	}
+	realIP := outboundIP(baseURL)
+	if realIP != "" {
+		client.SetHeader(realIPHeader, realIP)
+	}
 	// Настройка retry
 	client.SetRetryCount(3)
 	client.SetRetryAfter(func(client *resty.Client, response *resty.Response) (time.Duration, error) {
@@ -58,7 +99,76 @@ func NewSender(baseURL string, hashKey []byte) ISender {
 		}
 		return false
 	}) // retry только в случае, если сервер недоступен (maintenance или перегрузка) или внут. ошибка
-	return &sender{client, baseURL, hashKey}
+	s := &sender{
+		client:    client,
+		baseURL:   baseURL,
+		hashKey:   hashKey,
+		keyID:     keyID,
+		apiKey:    apiKey,
+		tlsConfig: tlsConfig,
+		publicKey: publicKey,
+		realIP:    realIP,
+		agentID:   newAgentID(),
+	}
+	client.OnBeforeRequest(s.signRequest)
+	return s
+}
+
+// newAgentID возвращает случайный идентификатор экземпляра агента.
+func newAgentID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		// Без случайного идентификатора ключи разных агентов могут совпасть, берем время запуска
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+// newClient создает клиент для одиночных запросов с TLS-конфигурацией, API-ключом, адресом агента и подписью sender.
+func (s *sender) newClient() *resty.Client {
+	client := resty.New()
+	if s.tlsConfig != nil {
+		client.SetTLSClientConfig(s.tlsConfig)
+	}
+	if s.apiKey != "" {
+		client.SetAuthToken(s.apiKey)
+	}
+	if s.realIP != "" {
+		client.SetHeader(realIPHeader, s.realIP)
+	}
+	client.OnBeforeRequest(s.signRequest)
+	return client
+}
+
+// outboundIP возвращает адрес локального интерфейса, через который идут соединения к серверу baseURL.
+// UDP-сокет только выбирает маршрут, пакеты не отправляются. При ошибке возвращается пустая строка.
+func outboundIP(baseURL string) string {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Hostname() == "" {
+		return ""
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return ""
+	}
+	return addr.IP.String()
+}
+
+// nextIdempotencyKey возвращает ключ идемпотентности для очередного пакета.
+func (s *sender) nextIdempotencyKey() string {
+	return s.agentID + "-" + strconv.FormatUint(s.seq.Add(1), 10)
 }
 
 // Send отправляет метрики на сервер. Каждая метрика может быть типа "counter" или "gauge".
@@ -86,7 +196,7 @@ func (s *sender) Send(metricsMap map[string]interface{}) error {
 
 		url := s.baseURL + "/update/" + metricType + "/" + metricName + "/" + metricValStr
 
-		client := resty.New()
+		client := s.newClient()
 		client.SetHeader("Content-type", "text/plain")
 
 		resp, err := client.R().Post(url)
@@ -133,16 +243,6 @@ func (s *sender) SendJSON(metricName string, metricValI interface{}) error {
 		return fmt.Errorf("failed to marshal JSON: %v", err)
 	}
 
-	// Хеш в заголовке
-	var hash string
-	if len(s.hashKey) > 0 {
-		hash, err = s.generateHash(jsonData)
-		if err != nil {
-			return fmt.Errorf("failed to generate hash: %w", err)
-		}
-		s.client.SetHeader("HashSHA256", hash)
-	}
-
 	// Сжатие данных в gzip
 	var buf bytes.Buffer
 	gzipWriter := gzip.NewWriter(&buf)
@@ -154,19 +254,23 @@ func (s *sender) SendJSON(metricName string, metricValI interface{}) error {
 		return fmt.Errorf("failed to close gzip writer: %v", err)
 	}
 
-	url := s.baseURL + "/update"
+	url := s.baseURL + "/update/"
 
-	client := resty.New()
+	client := s.newClient()
 	client.SetHeader("Content-type", "application/json")
 	client.SetHeader("Content-Encoding", "gzip")
 
-	resp, err := client.R().SetBody(buf.Bytes()).Post(url)
+	req := client.R().SetContext(withSignedBody(jsonData))
+	if err = s.setBody(req, buf.Bytes()); err != nil {
+		return err
+	}
+	resp, err := req.Post(url)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %v", err)
 	}
 
 	if resp.StatusCode() != 200 {
-		return fmt.Errorf("request %v failed: %v", url, err)
+		return fmt.Errorf("request %v failed with status %d: %s", url, resp.StatusCode(), resp.String())
 	}
 
 	fmt.Println("Metric send to server")
@@ -208,16 +312,6 @@ func (s *sender) SendBatch(metricsMap map[string]interface{}) error {
 		return fmt.Errorf("failed to marshal JSON: %w", err)
 	}
 
-	// Хеш в заголовке
-	var hash string
-	if len(s.hashKey) > 0 {
-		hash, err = s.generateHash(jsonData)
-		if err != nil {
-			return fmt.Errorf("failed to generate hash: %w", err)
-		}
-		s.client.SetHeader("HashSHA256", hash)
-	}
-
 	// Сжатие данных в gzip
 	var buf bytes.Buffer
 	gzipWriter := gzip.NewWriter(&buf)
@@ -229,27 +323,76 @@ func (s *sender) SendBatch(metricsMap map[string]interface{}) error {
 		return fmt.Errorf("failed to close gzip writer: %w", err)
 	}
 
-	url := s.baseURL + "/updates"
+	url := s.baseURL + "/updates/"
 
 	s.client.SetHeader("Content-type", "application/json")
 	s.client.SetHeader("Content-Encoding", "gzip")
 
-	resp, err := s.client.R().SetBody(buf.Bytes()).Post(url)
+	// Ключ задается на запрос, поэтому повторы resty отправляют пакет с тем же ключом
+	req := s.client.R().
+		SetContext(withSignedBody(jsonData)).
+		SetHeader(idempotencyKeyHeader, s.nextIdempotencyKey())
+	if err = s.setBody(req, buf.Bytes()); err != nil {
+		return err
+	}
+	resp, err := req.Post(url)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %w", err)
 	}
 
 	if resp.StatusCode() != 200 {
-		return fmt.Errorf("request %v failed: %w", url, err)
+		return fmt.Errorf("request %v failed with status %d: %s", url, resp.StatusCode(), resp.String())
+	}
+	return nil
+}
+
+// setBody задает тело запроса. При заданном открытом ключе сервера тело шифруется,
+// а запрос помечается заголовком encryption.Header.
+func (s *sender) setBody(req *resty.Request, body []byte) error {
+	if s.publicKey == nil {
+		req.SetBody(body)
+		return nil
+	}
+	encrypted, err := encryption.Encrypt(s.publicKey, body)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt payload: %w", err)
 	}
+	req.SetHeader(encryption.Header, encryption.Algorithm).SetBody(encrypted)
 	return nil
 }
 
-func (s *sender) generateHash(src []byte) (string, error) {
-	h := hmac.New(sha256.New, s.hashKey)
-	_, err := h.Write(src)
+// signedBodyKey - ключ контекста запроса с телом, которое подписывается перед каждой попыткой.
+type signedBodyKey struct{}
+
+// withSignedBody возвращает контекст запроса с несжатым телом body для подписи.
+func withSignedBody(body []byte) context.Context {
+	return context.WithValue(context.Background(), signedBodyKey{}, body)
+}
+
+// signRequest подписывает запрос перед каждой попыткой. Повтор получает новые время и nonce,
+// иначе сервер отклонил бы его как повторно отправленный.
+func (s *sender) signRequest(_ *resty.Client, req *resty.Request) error {
+	if len(s.hashKey) == 0 {
+		return nil
+	}
+	body, _ := req.Context().Value(signedBodyKey{}).([]byte)
+	// Сервер сверяет подпись с URI из строки запроса, которую HTTP-клиент формирует так же
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return fmt.Errorf("failed to parse request url: %w", err)
+	}
+	requestURI := u.RequestURI()
+	nonce, err := signature.NewNonce()
 	if err != nil {
-		return "", err
+		return fmt.Errorf("failed to generate nonce: %w", err)
 	}
-	return hex.EncodeToString(h.Sum(nil)), nil
+	timestamp := signature.Timestamp(time.Now())
+
+	req.SetHeader(signature.TimestampHeader, timestamp)
+	req.SetHeader(signature.NonceHeader, nonce)
+	req.SetHeader(signature.HashHeader, signature.Sign(s.hashKey, req.Method, requestURI, timestamp, nonce, body))
+	if s.keyID != "" {
+		req.SetHeader(signature.KeyIDHeader, s.keyID)
+	}
+	return nil
 }
@@ -1,15 +1,26 @@
 package sender
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-service/internal/encryption"
+	"metrics-service/internal/signature"
 )
 
 func TestSender_Send(t *testing.T) {
@@ -69,9 +80,7 @@ func TestSender_Send(t *testing.T) {
 			defer server.Close()
 
 			s := &sender{
-				nil,
-				server.URL,
-				nil,
+				baseURL: server.URL,
 			}
 
 			s.Send(test.metricsMap)
@@ -80,8 +89,138 @@ func TestSender_Send(t *testing.T) {
 
 }
 
+func TestSender_SendBatchIdempotencyKey(t *testing.T) {
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(idempotencyKeyHeader))
+		// Первая попытка первого пакета теряет ответ
+		if len(keys) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	s := NewSender(server.URL, nil, "", "", nil, nil)
+	metrics := map[string]interface{}{"PollCount": int64(1)}
+
+	assert.NoError(t, s.SendBatch(metrics))
+	assert.NoError(t, s.SendBatch(metrics))
+
+	if assert.Len(t, keys, 3) {
+		assert.NotEmpty(t, keys[0])
+		assert.Equal(t, keys[0], keys[1], "retry must reuse the idempotency key")
+		assert.NotEqual(t, keys[1], keys[2], "next batch must get a new idempotency key")
+	}
+}
+
+func TestSender_SendBatchAPIKey(t *testing.T) {
+	var auth []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		// Агент сообщает адрес интерфейса, через который обращается к серверу
+		assert.Equal(t, "127.0.0.1", r.Header.Get(realIPHeader))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	metrics := map[string]interface{}{"PollCount": int64(1)}
+	assert.NoError(t, NewSender(server.URL, nil, "", "agent-token", nil, nil).SendBatch(metrics))
+	assert.NoError(t, NewSender(server.URL, nil, "", "", nil, nil).SendBatch(metrics))
+	assert.Equal(t, []string{"Bearer agent-token", ""}, auth)
+}
+
+func TestSender_SendBatchSigned(t *testing.T) {
+	key := []byte("secret-key")
+	var nonces []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(gz)
+
+		nonce := r.Header.Get(signature.NonceHeader)
+		nonces = append(nonces, nonce)
+		assert.Equal(t, "k2", r.Header.Get(signature.KeyIDHeader))
+		assert.Equal(t, "/updates/", r.RequestURI)
+		assert.True(t, signature.Verify(key, r.Header.Get(signature.HashHeader), r.Method, r.RequestURI,
+			r.Header.Get(signature.TimestampHeader), nonce, body))
+		// Первая попытка получает ошибку сервера
+		if len(nonces) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	metrics := map[string]interface{}{"PollCount": int64(1)}
+	assert.NoError(t, NewSender(server.URL, key, "k2", "", nil, nil).SendBatch(metrics))
+	if assert.Len(t, nonces, 2) {
+		assert.NotEqual(t, nonces[0], nonces[1], "retry must be signed with a new nonce")
+	}
+
+	// Без ключа запросы не подписываются
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get(signature.HashHeader))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	assert.NoError(t, NewSender(server.URL, nil, "", "", nil, nil).SendBatch(metrics))
+}
+
+func TestSender_SendBatchEncrypted(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		plaintext, err := encryption.Decrypt(key, data)
+		if r.Header.Get(encryption.Header) != encryption.Algorithm || err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"` + err.Error() + `"}`))
+			return
+		}
+		// Внутри конверта - сжатое тело
+		gz, err := gzip.NewReader(bytes.NewReader(plaintext))
+		require.NoError(t, err)
+		raw, _ := io.ReadAll(gz)
+		body = string(raw)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	metrics := map[string]interface{}{"PollCount": int64(1)}
+	assert.NoError(t, NewSender(server.URL, nil, "", "", nil, &key.PublicKey).SendBatch(metrics))
+	assert.Contains(t, body, `"id":"PollCount"`)
+
+	// Ошибка несовпадения ключа доходит до агента
+	err = NewSender(server.URL, nil, "", "", nil, &otherKey.PublicKey).SendBatch(metrics)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "does not match")
+	}
+}
+
 func generateTestHash(src []byte, key []byte) string {
 	h := hmac.New(sha256.New, key)
 	h.Write(src)
 	return hex.EncodeToString(h.Sum(nil))
 }
+
+func TestSender_SendBatchTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	metrics := map[string]interface{}{"PollCount": int64(1)}
+	assert.NoError(t, NewSender(server.URL, nil, "", "", &tls.Config{RootCAs: pool}, nil).SendBatch(metrics))
+	// Без доверенного CA сертификат сервера не принимается, повторы не помогают
+	assert.Error(t, NewSender(server.URL, nil, "", "", &tls.Config{RootCAs: x509.NewCertPool()}, nil).SendBatch(metrics))
+}
@@ -0,0 +1,155 @@
+// Package auth проверяет API-ключи клиентов сервера и их права.
+//
+// Сервер хранит не сами ключи, а их хэши SHA-256 в виде "sha256:<hex>". Ключи генерируются случайно
+// (см. GenerateToken), поэтому медленная функция хэширования паролей не нужна. Хэш ключа можно получить
+// командой server apikey или вручную: printf %s "$KEY" | sha256sum.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"metrics-service/internal/config"
+	"metrics-service/internal/tenant"
+)
+
+// Права API-ключей.
+const (
+	// ScopeWrite разрешает запись метрик.
+	ScopeWrite = "write"
+	// ScopeRead разрешает чтение метрик.
+	ScopeRead = "read"
+	// ScopeAdmin разрешает служебные эндпоинты (pprof).
+	ScopeAdmin = "admin"
+)
+
+const hashPrefix = "sha256:"
+
+// Key - описание API-ключа.
+type Key struct {
+	// Name - имя ключа для логов, например имя агента.
+	Name string `json:"name" yaml:"name"`
+	// Hash - хэш ключа в виде "sha256:<hex>".
+	Hash string `json:"hash" yaml:"hash"`
+	// Scopes - права ключа.
+	Scopes []string `json:"scopes" yaml:"scopes"`
+	// Tenant - арендатор, к метрикам которого ограничен доступ ключа. Пустое значение - любой арендатор.
+	Tenant string `json:"tenant,omitempty" yaml:"tenant,omitempty"`
+}
+
+// HasScope сообщает, есть ли у ключа право scope.
+func (k Key) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Hash возвращает хэш ключа token для хранения в конфигурации.
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hashPrefix + hex.EncodeToString(sum[:])
+}
+
+// GenerateToken возвращает новый случайный API-ключ.
+func GenerateToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// Keyring - набор действующих API-ключей.
+type Keyring struct {
+	keys map[[sha256.Size]byte]Key
+}
+
+// NewKeyring проверяет описания ключей и возвращает набор для проверки запросов.
+func NewKeyring(keys []Key) (*Keyring, error) {
+	r := &Keyring{keys: make(map[[sha256.Size]byte]Key, len(keys))}
+	names := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if key.Name == "" {
+			return nil, errors.New("api key name must not be empty")
+		}
+		if _, ok := names[key.Name]; ok {
+			return nil, fmt.Errorf("duplicate api key name %q", key.Name)
+		}
+		names[key.Name] = struct{}{}
+
+		digest, err := parseHash(key.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("api key %q: %w", key.Name, err)
+		}
+		if _, ok := r.keys[digest]; ok {
+			return nil, fmt.Errorf("api key %q: the same key is already configured", key.Name)
+		}
+
+		if len(key.Scopes) == 0 {
+			return nil, fmt.Errorf("api key %q has no scopes", key.Name)
+		}
+		for _, scope := range key.Scopes {
+			switch scope {
+			case ScopeWrite, ScopeRead, ScopeAdmin:
+			default:
+				return nil, fmt.Errorf("api key %q: unknown scope %q, expected write, read or admin", key.Name, scope)
+			}
+		}
+		if key.Tenant != "" && !tenant.Valid(key.Tenant) {
+			return nil, fmt.Errorf("api key %q: invalid tenant name %q", key.Name, key.Tenant)
+		}
+		r.keys[digest] = key
+	}
+	return r, nil
+}
+
+// Len возвращает количество ключей.
+func (r *Keyring) Len() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.keys)
+}
+
+// Authenticate возвращает описание ключа token. Ключ ищется по хэшу, поэтому время поиска
+// не зависит от совпадения token с хранимыми ключами.
+func (r *Keyring) Authenticate(token string) (Key, bool) {
+	if r == nil || token == "" {
+		return Key{}, false
+	}
+	key, ok := r.keys[sha256.Sum256([]byte(token))]
+	return key, ok
+}
+
+// LoadFile читает описания ключей из файла JSON или YAML вида
+// {"keys": [{"name": ..., "hash": ..., "scopes": [...], "tenant": ...}]}.
+func LoadFile(path string) ([]Key, error) {
+	var file struct {
+		Keys []Key `json:"keys" yaml:"keys"`
+	}
+	if err := config.LoadFile(path, &file); err != nil {
+		return nil, err
+	}
+	return file.Keys, nil
+}
+
+func parseHash(hash string) ([sha256.Size]byte, error) {
+	var digest [sha256.Size]byte
+	hexDigest, ok := strings.CutPrefix(hash, hashPrefix)
+	if !ok {
+		return digest, errors.New(`hash must start with "sha256:"`)
+	}
+	decoded, err := hex.DecodeString(hexDigest)
+	if err != nil || len(decoded) != sha256.Size {
+		return digest, errors.New("hash must contain 64 hex characters")
+	}
+	copy(digest[:], decoded)
+	return digest, nil
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyring(t *testing.T) {
+	token, err := GenerateToken()
+	require.NoError(t, err)
+	keyring, err := NewKeyring([]Key{
+		{Name: "agent-1", Hash: Hash(token), Scopes: []string{ScopeWrite}},
+		{Name: "grafana", Hash: Hash("read-token"), Scopes: []string{ScopeRead, ScopeAdmin}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, keyring.Len())
+
+	key, ok := keyring.Authenticate(token)
+	require.True(t, ok)
+	assert.Equal(t, "agent-1", key.Name)
+	assert.True(t, key.HasScope(ScopeWrite))
+	assert.False(t, key.HasScope(ScopeRead))
+
+	_, ok = keyring.Authenticate("unknown-token")
+	assert.False(t, ok)
+	_, ok = keyring.Authenticate("")
+	assert.False(t, ok)
+
+	var empty *Keyring
+	assert.Equal(t, 0, empty.Len())
+	_, ok = empty.Authenticate(token)
+	assert.False(t, ok)
+}
+
+func TestNewKeyring_Invalid(t *testing.T) {
+	valid := Key{Name: "agent", Hash: Hash("token"), Scopes: []string{ScopeWrite}}
+	testTable := []struct {
+		name string
+		keys []Key
+	}{
+		{"Empty name", []Key{{Hash: Hash("token"), Scopes: []string{ScopeWrite}}}},
+		{"Duplicate name", []Key{valid, {Name: "agent", Hash: Hash("other"), Scopes: []string{ScopeRead}}}},
+		{"Duplicate key", []Key{valid, {Name: "other", Hash: Hash("token"), Scopes: []string{ScopeRead}}}},
+		{"Plain key instead of hash", []Key{{Name: "agent", Hash: "token", Scopes: []string{ScopeWrite}}}},
+		{"Short hash", []Key{{Name: "agent", Hash: "sha256:abcd", Scopes: []string{ScopeWrite}}}},
+		{"No scopes", []Key{{Name: "agent", Hash: Hash("token")}}},
+		{"Unknown scope", []Key{{Name: "agent", Hash: Hash("token"), Scopes: []string{"delete"}}}},
+		{"Invalid tenant", []Key{{Name: "agent", Hash: Hash("token"), Scopes: []string{ScopeWrite}, Tenant: "../team"}}},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewKeyring(test.keys)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	data := "keys:\n  - name: agent-1\n    hash: " + Hash("token") + "\n    scopes: [write]\n"
+	require.NoError(t, os.WriteFile(path, []byte(data), 0600))
+
+	keys, err := LoadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, []Key{{Name: "agent-1", Hash: Hash("token"), Scopes: []string{ScopeWrite}}}, keys)
+
+	require.NoError(t, os.WriteFile(path, []byte("keys:\n  - name: agent-1\n    token: secret\n"), 0600))
+	_, err = LoadFile(path)
+	assert.Error(t, err)
+}
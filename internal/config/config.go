@@ -0,0 +1,218 @@
+// Package config загружает конфигурацию сервера и агента.
+//
+// Конфигурация - структура, поля которой связаны с флагами командной строки. Значения берутся
+// из источников по возрастанию приоритета: значения флагов по умолчанию, файл конфигурации (JSON или YAML),
+// переменные окружения, явно заданные флаги. Путь к файлу задается флагом -c или переменной окружения CONFIG.
+//
+// Поля структуры размечаются тегами:
+//   - json и yaml - ключ в файле конфигурации;
+//   - env - переменная окружения;
+//   - secret:"true" - значение скрывается при выводе конфигурации.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigEnv - переменная окружения с путем к файлу конфигурации.
+const ConfigEnv = "CONFIG"
+
+// secretMask заменяет непустые секретные значения при выводе конфигурации.
+const secretMask = "******"
+
+// Parse разбирает флаги args в fs и собирает конфигурацию cfg с приоритетом:
+// значения по умолчанию < файл конфигурации < переменные окружения < явно заданные флаги.
+//
+// cfg - указатель на структуру, поля которой связаны с флагами fs. Флаг -c регистрируется в fs.
+func Parse(fs *flag.FlagSet, args []string, cfg any) error {
+	fs.String("c", "", "config file path (JSON or YAML), env "+ConfigEnv)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// Флаги записали значения в cfg, поэтому запоминаем явно заданные и возвращаем значения по умолчанию
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if setErr := f.Value.Set(f.DefValue); setErr != nil && err == nil {
+			err = fmt.Errorf("failed to reset flag -%s: %w", f.Name, setErr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	path, ok := explicit["c"]
+	if !ok {
+		path = os.Getenv(ConfigEnv)
+	}
+	if path != "" {
+		if err = LoadFile(path, cfg); err != nil {
+			return err
+		}
+	}
+
+	if err = ApplyEnv(cfg); err != nil {
+		return err
+	}
+
+	for name, value := range explicit {
+		if err = fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for flag -%s: %w", value, name, err)
+		}
+	}
+	return nil
+}
+
+// LoadFile читает файл конфигурации в cfg. Формат определяется по расширению: .json, .yaml или .yml.
+// Ключи, отсутствующие в файле, не меняют cfg. Неизвестные ключи считаются ошибкой.
+func LoadFile(path string, cfg any) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(file)
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(cfg)
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(file)
+		decoder.KnownFields(true)
+		err = decoder.Decode(cfg)
+	default:
+		return fmt.Errorf("unsupported config file format %q, expected .json, .yaml or .yml", path)
+	}
+	// Пустой файл не меняет конфигурацию
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %v: %w", path, err)
+	}
+	return nil
+}
+
+// ApplyEnv записывает в поля cfg значения заданных переменных окружения из тегов env.
+func ApplyEnv(cfg any) error {
+	v, err := structValue(cfg)
+	if err != nil {
+		return err
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		raw, ok := os.LookupEnv(name)
+		if !ok || raw == "" {
+			continue
+		}
+		if err = setValue(v.Field(i), raw); err != nil {
+			return fmt.Errorf("invalid value %q for env %s: %w", raw, name, err)
+		}
+	}
+	return nil
+}
+
+// Print выводит конфигурацию cfg в формате JSON, который можно использовать как файл конфигурации.
+// Значения полей с тегом secret:"true" скрываются.
+func Print(w io.Writer, cfg any) error {
+	v, err := structValue(cfg)
+	if err != nil {
+		return err
+	}
+
+	masked := reflect.New(v.Type()).Elem()
+	masked.Set(v)
+	for i := 0; i < masked.NumField(); i++ {
+		field := masked.Field(i)
+		if masked.Type().Field(i).Tag.Get("secret") == "true" && field.Kind() == reflect.String && field.String() != "" {
+			field.SetString(secretMask)
+		}
+	}
+
+	data, err := json.MarshalIndent(masked.Interface(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// Changed возвращает ключи файла конфигурации (теги json) полей, значения которых в prev и next различаются.
+// prev и next - указатели на структуры одного типа.
+func Changed(prev, next any) ([]string, error) {
+	prevValue, err := structValue(prev)
+	if err != nil {
+		return nil, err
+	}
+	nextValue, err := structValue(next)
+	if err != nil {
+		return nil, err
+	}
+	if prevValue.Type() != nextValue.Type() {
+		return nil, fmt.Errorf("config types differ: %T and %T", prev, next)
+	}
+
+	var changed []string
+	t := prevValue.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if reflect.DeepEqual(prevValue.Field(i).Interface(), nextValue.Field(i).Interface()) {
+			continue
+		}
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		changed = append(changed, name)
+	}
+	return changed, nil
+}
+
+func structValue(cfg any) (reflect.Value, error) {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("config must be a pointer to struct, got %T", cfg)
+	}
+	return v.Elem(), nil
+}
+
+// setValue разбирает raw в соответствии с типом поля.
+func setValue(field reflect.Value, raw string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		val, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return errors.New("expected integer")
+		}
+		field.SetInt(val)
+	case reflect.Bool:
+		val, err := strconv.ParseBool(raw)
+		if err != nil {
+			return errors.New("expected boolean")
+		}
+		field.SetBool(val)
+	default:
+		return fmt.Errorf("unsupported field type %v", field.Type())
+	}
+	return nil
+}
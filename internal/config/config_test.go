@@ -0,0 +1,148 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testConfig struct {
+	Address  string `json:"address" yaml:"address" env:"TEST_ADDRESS"`
+	Interval int    `json:"interval" yaml:"interval" env:"TEST_INTERVAL"`
+	Restore  bool   `json:"restore" yaml:"restore" env:"TEST_RESTORE"`
+	Key      string `json:"key" yaml:"key" env:"TEST_KEY" secret:"true"`
+}
+
+func newFlagSet(cfg *testConfig) *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&cfg.Address, "a", "localhost:8080", "")
+	fs.IntVar(&cfg.Interval, "i", 300, "")
+	fs.BoolVar(&cfg.Restore, "r", true, "")
+	fs.StringVar(&cfg.Key, "k", "", "")
+	return fs
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0666))
+	return path
+}
+
+func TestParse(t *testing.T) {
+	jsonPath := writeFile(t, "config.json", `{"address": "file:1", "interval": 10, "restore": false}`)
+	yamlPath := writeFile(t, "config.yaml", "address: file:1\ninterval: 10\n")
+
+	testTable := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		want    testConfig
+		wantErr string
+	}{
+		{name: "Defaults", want: testConfig{Address: "localhost:8080", Interval: 300, Restore: true}},
+		{name: "File JSON", args: []string{"-c", jsonPath}, want: testConfig{Address: "file:1", Interval: 10}},
+		{name: "File YAML from env", env: map[string]string{ConfigEnv: yamlPath}, want: testConfig{Address: "file:1", Interval: 10, Restore: true}},
+		{
+			name: "Env overrides file",
+			args: []string{"-c", jsonPath},
+			env:  map[string]string{"TEST_INTERVAL": "20", "TEST_RESTORE": "true"},
+			want: testConfig{Address: "file:1", Interval: 20, Restore: true},
+		},
+		{
+			name: "Flags override env and file",
+			args: []string{"-c", jsonPath, "-i", "30", "-a", "flag:1"},
+			env:  map[string]string{"TEST_INTERVAL": "20"},
+			want: testConfig{Address: "flag:1", Interval: 30},
+		},
+		{name: "Flag equal to default overrides file", args: []string{"-c", jsonPath, "-i", "300"}, want: testConfig{Address: "file:1", Interval: 300}},
+		{name: "Invalid env", env: map[string]string{"TEST_INTERVAL": "ten"}, wantErr: `invalid value "ten" for env TEST_INTERVAL`},
+		{name: "Invalid flag", args: []string{"-i", "ten"}, wantErr: `invalid value "ten" for flag -i`},
+		{name: "Missing file", args: []string{"-c", "missing.json"}, wantErr: "failed to open config file"},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			var cfg testConfig
+			err := Parse(newFlagSet(&cfg), test.args, &cfg)
+			if test.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, cfg)
+		})
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	testTable := []struct {
+		name    string
+		file    string
+		content string
+		wantErr bool
+	}{
+		{"Unknown JSON key", "config.json", `{"adress": "a"}`, true},
+		{"Unknown YAML key", "config.yml", "adress: a\n", true},
+		{"Wrong type", "config.json", `{"interval": "ten"}`, true},
+		{"Unsupported format", "config.toml", `address = "a"`, true},
+		{"Empty YAML", "config.yaml", "", false},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig{Interval: 5}
+			err := LoadFile(writeFile(t, test.file, test.content), &cfg)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, 5, cfg.Interval)
+		})
+	}
+}
+
+func TestPrint(t *testing.T) {
+	cfg := testConfig{Address: "localhost:8080", Interval: 10, Key: "secret"}
+
+	var buf bytes.Buffer
+	require.NoError(t, Print(&buf, &cfg))
+	assert.NotContains(t, buf.String(), "secret")
+	assert.Contains(t, buf.String(), `"key": "******"`)
+	assert.Equal(t, "secret", cfg.Key)
+
+	// Вывод можно использовать как файл конфигурации
+	var loaded testConfig
+	require.NoError(t, LoadFile(writeFile(t, "config.json", buf.String()), &loaded))
+	assert.Equal(t, "localhost:8080", loaded.Address)
+	assert.Equal(t, 10, loaded.Interval)
+}
+
+func TestChanged(t *testing.T) {
+	prev := testConfig{Address: "localhost:8080", Interval: 10, Key: "a"}
+	next := prev
+	next.Interval = 20
+	next.Key = "b"
+
+	changed, err := Changed(&prev, &next)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"interval", "key"}, changed)
+
+	changed, err = Changed(&prev, &prev)
+	require.NoError(t, err)
+	assert.Empty(t, changed)
+
+	_, err = Changed(&prev, &struct{}{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,185 @@
+// Package encryption шифрует тела запросов агента открытым ключом RSA сервера.
+//
+// Используется гибридная схема: тело шифруется AES-256-GCM случайным ключом, ключ шифруется RSA-OAEP (SHA-256).
+// Формат конверта:
+//
+//	версия (1 байт) | длина зашифрованного ключа (2 байта, big endian) | зашифрованный ключ | nonce | шифротекст
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Header - заголовок запроса с алгоритмом шифрования тела.
+const Header = "Content-Encryption"
+
+// Algorithm - значение заголовка Header для гибридной схемы.
+const Algorithm = "rsa-oaep-aes256-gcm"
+
+const (
+	version    = 1
+	aesKeySize = 32
+)
+
+// label связывает зашифрованный ключ с назначением, чтобы шифротекст нельзя было использовать в другом протоколе.
+var label = []byte("metrics-service payload")
+
+var (
+	// ErrKeyMismatch - тело зашифровано открытым ключом, не соответствующим закрытому ключу сервера.
+	ErrKeyMismatch = errors.New("payload is encrypted with a public key that does not match the server private key")
+	// ErrMalformed - конверт поврежден или имеет неизвестный формат.
+	ErrMalformed = errors.New("malformed encrypted payload")
+)
+
+// Encrypt шифрует plaintext открытым ключом publicKey.
+func Encrypt(publicKey *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+	key := make([]byte, aesKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key, label)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt payload key: %w", err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, 3+len(encryptedKey)+len(nonce)+len(plaintext)+gcm.Overhead())
+	out = append(out, version)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(encryptedKey)))
+	out = append(out, encryptedKey...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plaintext, nil), nil
+}
+
+// Decrypt расшифровывает конверт data закрытым ключом privateKey.
+func Decrypt(privateKey *rsa.PrivateKey, data []byte) ([]byte, error) {
+	if len(data) < 3 || data[0] != version {
+		return nil, ErrMalformed
+	}
+	keyLen := int(binary.BigEndian.Uint16(data[1:3]))
+	data = data[3:]
+	if len(data) < keyLen {
+		return nil, ErrMalformed
+	}
+	// Длина зашифрованного ключа равна размеру модуля RSA, другая длина - признак чужого ключа
+	if keyLen != privateKey.Size() {
+		return nil, ErrKeyMismatch
+	}
+
+	key, err := rsa.DecryptOAEP(sha256.New(), nil, privateKey, data[:keyLen], label)
+	if err != nil {
+		return nil, ErrKeyMismatch
+	}
+	data = data[keyLen:]
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrMalformed
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	return plaintext, nil
+}
+
+// LoadPublicKey читает открытый ключ RSA из PEM-файла: PKIX, PKCS #1 или сертификат.
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key any
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("unsupported public key PEM block %q in %v", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key %v: %w", path, err)
+	}
+
+	publicKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key %v is not an RSA key", path)
+	}
+	return publicKey, nil
+}
+
+// LoadPrivateKey читает закрытый ключ RSA из PEM-файла: PKCS #1 или PKCS #8.
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported private key PEM block %q in %v", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %v: %w", path, err)
+	}
+
+	privateKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key %v is not an RSA key", path)
+	}
+	return privateKey, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %v", path)
+	}
+	return block, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
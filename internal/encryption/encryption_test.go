@@ -0,0 +1,99 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func generateKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return key
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := generateKey(t)
+	plaintext := []byte(`[{"id":"PollCount","type":"counter","delta":1}]`)
+
+	data, err := Encrypt(&key.PublicKey, plaintext)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "PollCount")
+
+	got, err := Decrypt(key, data)
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, got)
+
+	// Чужой ключ того же размера
+	_, err = Decrypt(generateKey(t), data)
+	assert.ErrorIs(t, err, ErrKeyMismatch)
+
+	// Ключ другого размера
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	_, err = Decrypt(small, data)
+	assert.ErrorIs(t, err, ErrKeyMismatch)
+
+	// Поврежденный шифротекст
+	broken := append([]byte(nil), data...)
+	broken[len(broken)-1] ^= 0xff
+	_, err = Decrypt(key, broken)
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	for _, data := range [][]byte{nil, {2, 1, 0}, data[:10]} {
+		_, err = Decrypt(key, data)
+		assert.ErrorIs(t, err, ErrMalformed)
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir := t.TempDir()
+	key := generateKey(t)
+	write := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+		return path
+	}
+
+	pkix, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	for _, path := range []string{
+		write("pkix.pem", "PUBLIC KEY", pkix),
+		write("pkcs1.pem", "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&key.PublicKey)),
+	} {
+		publicKey, err := LoadPublicKey(path)
+		require.NoError(t, err, path)
+		assert.True(t, key.PublicKey.Equal(publicKey), path)
+	}
+
+	for _, path := range []string{
+		write("pkcs1.key", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)),
+		write("pkcs8.key", "PRIVATE KEY", pkcs8),
+	} {
+		privateKey, err := LoadPrivateKey(path)
+		require.NoError(t, err, path)
+		assert.True(t, key.Equal(privateKey), path)
+	}
+
+	// Закрытый ключ вместо открытого и наоборот
+	_, err = LoadPublicKey(filepath.Join(dir, "pkcs8.key"))
+	assert.Error(t, err)
+	_, err = LoadPrivateKey(filepath.Join(dir, "pkix.pem"))
+	assert.Error(t, err)
+
+	_, err = LoadPublicKey(filepath.Join(dir, "missing.pem"))
+	assert.Error(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "empty.pem"), []byte("not a key"), 0600))
+	_, err = LoadPrivateKey(filepath.Join(dir, "empty.pem"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,100 @@
+// Package conns отслеживает TCP-соединения приемников метрик (StatsD, Graphite): ограничивает их количество,
+// проверяет доверенные подсети отправителей и закрывает простаивающие соединения.
+package conns
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// DefaultIdleTimeout - время, после которого соединение без данных закрывается, если не задано другое.
+const DefaultIdleTimeout = 5 * time.Minute
+
+// Tracker хранит открытые соединения приемника, чтобы закрыть их при остановке.
+//
+// Количество соединений ограничено, а простаивающие соединения закрываются, поэтому отправители,
+// открывшие соединения и переставшие писать, не занимают все места.
+type Tracker struct {
+	max         int
+	idleTimeout time.Duration
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// NewTracker создает Tracker не более чем на max соединений. Соединение без данных дольше idleTimeout
+// закрывается, при idleTimeout <= 0 используется DefaultIdleTimeout.
+func NewTracker(max int, idleTimeout time.Duration) *Tracker {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+	return &Tracker{max: max, idleTimeout: idleTimeout, conns: make(map[net.Conn]struct{})}
+}
+
+// Add запоминает соединение. Возвращает false, если соединений слишком много.
+func (t *Tracker) Add(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.conns) >= t.max {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	return true
+}
+
+// Remove забывает и закрывает соединение.
+func (t *Tracker) Remove(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+	conn.Close()
+}
+
+// CloseAll закрывает все соединения, обработчики соединений получают ошибку чтения и вызывают Remove.
+func (t *Tracker) CloseAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for conn := range t.conns {
+		conn.Close()
+	}
+}
+
+// Reader возвращает поток чтения соединения, продлевающий срок чтения перед каждым чтением.
+// Если данных нет дольше времени простоя, чтение завершается ошибкой os.ErrDeadlineExceeded.
+func (t *Tracker) Reader(conn net.Conn) io.Reader {
+	return &idleReader{conn: conn, timeout: t.idleTimeout}
+}
+
+// Trusted проверяет, что адрес отправителя входит в одну из подсетей subnets. Пустой список допускает любые адреса.
+func Trusted(addr net.Addr, subnets []netip.Prefix) bool {
+	if len(subnets) == 0 {
+		return true
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := addrPort.Addr().Unmap()
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// idleReader читает соединение со сроком чтения timeout от начала каждого чтения.
+type idleReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+		return 0, err
+	}
+	return r.conn.Read(p)
+}
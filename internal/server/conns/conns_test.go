@@ -0,0 +1,67 @@
+package conns
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracker(t *testing.T) {
+	tracker := NewTracker(1, time.Minute)
+	server, client := net.Pipe()
+	defer client.Close()
+	other, otherClient := net.Pipe()
+	defer other.Close()
+	defer otherClient.Close()
+
+	assert.True(t, tracker.Add(server))
+	assert.False(t, tracker.Add(other), "limit of connections")
+
+	// Закрытое соединение освобождает место
+	tracker.Remove(server)
+	assert.True(t, tracker.Add(other))
+	tracker.CloseAll()
+	_, err := other.Write([]byte("x"))
+	assert.Error(t, err)
+}
+
+func TestTrackerIdleTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	tracker := NewTracker(1, 50*time.Millisecond)
+	scanner := bufio.NewScanner(tracker.Reader(conn))
+
+	// Срок продлевается при каждом чтении, поэтому соединение с данными не закрывается
+	for i := 0; i < 3; i++ {
+		_, err = client.Write([]byte("line\n"))
+		require.NoError(t, err)
+		require.True(t, scanner.Scan())
+		time.Sleep(30 * time.Millisecond)
+	}
+
+	assert.False(t, scanner.Scan())
+	assert.ErrorIs(t, scanner.Err(), os.ErrDeadlineExceeded)
+}
+
+func TestTrusted(t *testing.T) {
+	subnets := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	assert.True(t, Trusted(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}, subnets))
+	assert.True(t, Trusted(&net.UDPAddr{IP: net.ParseIP("::ffff:10.1.2.3"), Port: 1}, subnets))
+	assert.False(t, Trusted(&net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1}, subnets))
+	assert.True(t, Trusted(&net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1}, nil))
+}
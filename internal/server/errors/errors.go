@@ -12,4 +12,20 @@ var (
 	ErrPingMemory        = errors.New("trying to ping memory storage")
 	ErrHashHeaderMissing = errors.New("HashSHA256 header is missing")
 	ErrHashHeaderInvalid = errors.New("invalid hash")
+	ErrHashKeyUnknown    = errors.New("unknown signing key id")
+	ErrHashTimestamp     = errors.New("signature timestamp is missing or outside the allowed window")
+	ErrHashNonceInvalid  = errors.New("signature nonce is missing or too long")
+	ErrHashReplay        = errors.New("request with this signature nonce was already received")
+	ErrUnauthorized      = errors.New("missing or invalid api key")
+	ErrForbidden         = errors.New("api key has no required scope")
+	ErrUntrustedSubnet   = errors.New("client address is not in a trusted subnet")
+	ErrInvalidTimeRange  = errors.New("invalid time range")
+	ErrInvalidHistogram  = errors.New("invalid histogram")
+	ErrHistogramBuckets  = errors.New("histogram buckets conflict with declared buckets")
+	ErrSnapshotCorrupted = errors.New("snapshot is corrupted")
+	ErrDuplicateBatch    = errors.New("batch with this idempotency key is already applied")
+	ErrSeriesLimit       = errors.New("tenant series limit exceeded")
+	ErrTenantInvalid     = errors.New("invalid tenant name")
+	ErrTenantLimit       = errors.New("tenant limit exceeded")
+	ErrTenantForbidden   = errors.New("api key is bound to another tenant")
 )
@@ -0,0 +1,286 @@
+// Package graphite принимает метрики в текстовом протоколе Graphite (plaintext) по TCP и записывает их в хранилище.
+//
+// Каждая строка вида path.to.metric value [timestamp] записывается как gauge. Путь преобразуется в имя и метки
+// метрики правилами Rule, путь без совпавшего правила становится именем метрики.
+package graphite
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/llaxzi/retryables/v2"
+
+	"metrics-service/internal/server/conns"
+	"metrics-service/internal/server/models"
+	"metrics-service/internal/server/storage"
+	"metrics-service/internal/tenant"
+)
+
+const (
+	// maxLineSize - максимальная длина строки.
+	maxLineSize = 64 * 1024
+	// maxConns - максимальное количество одновременных соединений.
+	maxConns = 1024
+	// maxLoggedLine - длина строки с ошибкой разбора в логе.
+	maxLoggedLine = 256
+	// statsInterval - период записи счетчиков приемника в хранилище.
+	statsInterval = 10 * time.Second
+)
+
+// Config содержит параметры приемника Graphite.
+type Config struct {
+	// Address - адрес TCP.
+	Address string
+	// Tenant - арендатор, в пространство которого записываются метрики, пустой - tenant.Default.
+	Tenant string
+	// TrustedSubnets - подсети, из которых принимаются соединения, пустой список - любые адреса.
+	TrustedSubnets []netip.Prefix
+	// Rules - правила преобразования путей в имена и метки метрик.
+	Rules []Rule
+	// IdleTimeout - время без данных, после которого соединение закрывается, 0 - conns.DefaultIdleTimeout.
+	IdleTimeout time.Duration
+	// MaxLinesPerConn - максимальное количество строк в одном соединении, после него соединение закрывается.
+	// 0 - без ограничения.
+	MaxLinesPerConn int
+	// SaveOnWrite - сохранять хранилище после каждой записи (синхронный режим сохранения сервера).
+	SaveOnWrite bool
+}
+
+// Stats - счетчики приемника с момента запуска. Счетчики ошибок периодически записываются в хранилище
+// как метрики counter graphite_parse_errors, graphite_dropped и graphite_write_errors.
+type Stats struct {
+	Lines       uint64 // записанные строки
+	ParseErrors uint64 // строки с ошибкой разбора
+	Dropped     uint64 // отклоненные соединения: из недоверенных подсетей, сверх лимита соединений или строк
+	WriteErrors uint64 // строки, не записанные в хранилище
+}
+
+// Listener - приемник метрик Graphite.
+type Listener struct {
+	cfg     Config
+	mapper  *Mapper
+	storage storage.Storage
+	retryer *retryables.Retryer
+
+	lines, parseErrors, dropped, writeErrors atomic.Uint64
+	// reported - значения счетчиков, уже записанные в хранилище как метрики приемника.
+	reported Stats
+
+	ln    net.Listener
+	conns *conns.Tracker
+	wg    sync.WaitGroup // горутины приема
+
+	statsWg sync.WaitGroup // горутина записи счетчиков
+	done    chan struct{}
+}
+
+// NewListener создает приемник Graphite, записывающий метрики в storage. Возвращает ошибку для некорректных правил.
+func NewListener(cfg Config, storage storage.Storage, retryer *retryables.Retryer) (*Listener, error) {
+	mapper, err := NewMapper(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Tenant == "" {
+		cfg.Tenant = tenant.Default
+	}
+	return &Listener{
+		cfg:     cfg,
+		mapper:  mapper,
+		storage: storage,
+		retryer: retryer,
+		conns:   conns.NewTracker(maxConns, cfg.IdleTimeout),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Start открывает сокет и запускает прием соединений и периодическую запись счетчиков приемника.
+func (l *Listener) Start() error {
+	ln, err := net.Listen("tcp", l.cfg.Address)
+	if err != nil {
+		return err
+	}
+	l.ln = ln
+
+	l.wg.Add(1)
+	go l.serve()
+	l.statsWg.Add(1)
+	go l.statsLoop()
+	log.Printf("Graphite listening on tcp %v", l.ln.Addr())
+	return nil
+}
+
+// Shutdown закрывает сокет и соединения, дожидается записи принятых строк и записывает счетчики приемника последний раз.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.ln.Close()
+	l.conns.CloseAll()
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	close(l.done)
+	l.statsWg.Wait()
+	return l.reportStats(ctx)
+}
+
+// Stats возвращает счетчики приемника.
+func (l *Listener) Stats() Stats {
+	return Stats{
+		Lines:       l.lines.Load(),
+		ParseErrors: l.parseErrors.Load(),
+		Dropped:     l.dropped.Load(),
+		WriteErrors: l.writeErrors.Load(),
+	}
+}
+
+// internal
+
+func (l *Listener) serve() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Graphite accept failed: %v", err)
+			}
+			return
+		}
+		if !conns.Trusted(conn.RemoteAddr(), l.cfg.TrustedSubnets) || !l.conns.Add(conn) {
+			l.dropped.Add(1)
+			conn.Close()
+			continue
+		}
+		l.wg.Add(1)
+		go l.serveConn(conn)
+	}
+}
+
+// serveConn читает строки из соединения до его закрытия или лимита строк.
+func (l *Listener) serveConn(conn net.Conn) {
+	defer l.wg.Done()
+	defer l.conns.Remove(conn)
+
+	ctx := tenant.WithContext(context.Background(), l.cfg.Tenant)
+	scanner := bufio.NewScanner(l.conns.Reader(conn))
+	scanner.Buffer(make([]byte, 4096), maxLineSize)
+	count := 0
+	for scanner.Scan() {
+		raw := strings.TrimSpace(scanner.Text())
+		if raw == "" {
+			continue
+		}
+		count++
+		if l.cfg.MaxLinesPerConn > 0 && count > l.cfg.MaxLinesPerConn {
+			l.dropped.Add(1)
+			log.Printf("Graphite connection %v exceeded %d lines, closing", conn.RemoteAddr(), l.cfg.MaxLinesPerConn)
+			return
+		}
+		l.handleLine(ctx, conn.RemoteAddr(), raw)
+	}
+	err := scanner.Err()
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		log.Printf("Graphite connection %v is idle, closing", conn.RemoteAddr())
+	case err != nil && !errors.Is(err, net.ErrClosed):
+		log.Printf("Graphite connection %v failed: %v", conn.RemoteAddr(), err)
+	}
+}
+
+func (l *Listener) statsLoop() {
+	defer l.statsWg.Done()
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			if err := l.reportStats(context.Background()); err != nil {
+				log.Printf("Graphite stats write failed: %v", err)
+			}
+		}
+	}
+}
+
+// reportStats записывает приращения счетчиков ошибок приемника с прошлой записи в хранилище как метрики counter
+// graphite_parse_errors, graphite_dropped и graphite_write_errors.
+func (l *Listener) reportStats(ctx context.Context) error {
+	stats := l.Stats()
+	var metrics []models.Metrics
+	for _, counter := range []struct {
+		name          string
+		value, former uint64
+	}{
+		{"graphite_parse_errors", stats.ParseErrors, l.reported.ParseErrors},
+		{"graphite_dropped", stats.Dropped, l.reported.Dropped},
+		{"graphite_write_errors", stats.WriteErrors, l.reported.WriteErrors},
+	} {
+		if counter.value == counter.former {
+			continue
+		}
+		delta := int64(counter.value - counter.former)
+		metrics = append(metrics, models.Metrics{ID: counter.name, MType: "counter", Delta: &delta})
+	}
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	ctx = tenant.WithContext(ctx, l.cfg.Tenant)
+	err := l.retryer.Retry(func() error {
+		return l.storage.UpdateBatch(ctx, metrics)
+	})
+	if err != nil {
+		return err
+	}
+	// Счетчики считаются записанными только после успешной записи, иначе их приращения войдут в следующую
+	l.reported = stats
+	if l.cfg.SaveOnWrite {
+		return l.storage.Save()
+	}
+	return nil
+}
+
+// handleLine разбирает строку и записывает ее в хранилище как gauge.
+func (l *Listener) handleLine(ctx context.Context, addr net.Addr, raw string) {
+	parsed, err := parseLine(raw)
+	if err != nil {
+		l.parseErrors.Add(1)
+		if len(raw) > maxLoggedLine {
+			raw = raw[:maxLoggedLine] + "..."
+		}
+		log.Printf("Graphite malformed line from %v: %q: %v", addr, raw, err)
+		return
+	}
+
+	name, labels := l.mapper.Map(parsed.path)
+	value := parsed.value
+	metrics := []models.Metrics{{ID: name, MType: "gauge", Value: &value, Labels: labels}}
+	err = l.retryer.Retry(func() error {
+		return l.storage.UpdateBatch(ctx, metrics)
+	})
+	if err == nil && l.cfg.SaveOnWrite {
+		err = l.storage.Save()
+	}
+	if err != nil {
+		l.writeErrors.Add(1)
+		log.Printf("Graphite write of %q failed: %v", name, err)
+		return
+	}
+	l.lines.Add(1)
+}
@@ -0,0 +1,178 @@
+package graphite
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/llaxzi/retryables/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-service/internal/server/storage"
+	"metrics-service/internal/tenant"
+)
+
+func newTestListener(t *testing.T, cfg Config) (*Listener, storage.Storage) {
+	st, err := storage.NewStorage(storage.Config{})
+	require.NoError(t, err)
+	retryer := retryables.NewRetryer(nil)
+	retryer.SetCount(1)
+	if cfg.Address == "" {
+		cfg.Address = "127.0.0.1:0"
+	}
+	l, err := NewListener(cfg, st, retryer)
+	require.NoError(t, err)
+	return l, st
+}
+
+// send отправляет строки в одном соединении и дожидается его закрытия сервером или таймаута.
+func send(t *testing.T, l *Listener, data string) {
+	conn, err := net.Dial("tcp", l.ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	conn.Read(make([]byte, 1))
+}
+
+func TestParseLine(t *testing.T) {
+	testTable := []struct {
+		name    string
+		line    string
+		want    line
+		wantErr bool
+	}{
+		{name: "With timestamp", line: "servers.web1.cpu 12.5 1700000000", want: line{path: "servers.web1.cpu", value: 12.5}},
+		{name: "Without timestamp", line: "load  -1", want: line{path: "load", value: -1}},
+		{name: "Missing value", line: "load", wantErr: true},
+		{name: "Extra field", line: "load 1 2 3", wantErr: true},
+		{name: "Invalid value", line: "load abc 1700000000", wantErr: true},
+		{name: "NaN", line: "load NaN", wantErr: true},
+		{name: "Invalid timestamp", line: "load 1 now", wantErr: true},
+		{name: "Empty path component", line: "servers..cpu 1", wantErr: true},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseLine(test.line)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestMapper(t *testing.T) {
+	m, err := NewMapper([]Rule{
+		{Match: "servers.*.cpu.*", Name: "cpu_$2", Labels: map[string]string{"host": "$1"}},
+		{Match: "app.web-?.requests", Name: "requests", Labels: map[string]string{"instance": "$1", "app": "web"}},
+	})
+	require.NoError(t, err)
+
+	name, labels := m.Map("servers.web1.cpu.idle")
+	assert.Equal(t, "cpu_idle", name)
+	assert.Equal(t, map[string]string{"host": "web1"}, labels)
+
+	name, labels = m.Map("app.web-1.requests")
+	assert.Equal(t, "requests", name)
+	assert.Equal(t, map[string]string{"instance": "web-1", "app": "web"}, labels)
+
+	// Путь без совпавшего правила остается именем метрики
+	name, labels = m.Map("servers.web1.cpu")
+	assert.Equal(t, "servers.web1.cpu", name)
+	assert.Nil(t, labels)
+
+	for _, rule := range []Rule{
+		{Match: "", Name: "x"},
+		{Match: "a.*", Name: ""},
+		{Match: "a..b", Name: "x"},
+		{Match: "a.[", Name: "x"},
+		{Match: "a.*", Name: "x_$2"},
+		{Match: "a.b", Name: "x", Labels: map[string]string{"host": "$1"}},
+		{Match: "a.*", Name: "x", Labels: map[string]string{"": "$1"}},
+	} {
+		_, err = NewMapper([]Rule{rule})
+		assert.Error(t, err, "rule %+v", rule)
+	}
+}
+
+func TestListener(t *testing.T) {
+	l, st := newTestListener(t, Config{
+		Tenant: "cron",
+		Rules:  []Rule{{Match: "servers.*.cpu", Name: "cpu", Labels: map[string]string{"host": "$1"}}},
+	})
+	require.NoError(t, l.Start())
+
+	send(t, l, "servers.web1.cpu 12.5 1700000000\r\nbackup.duration 30 1700000000\nbroken line here now\n\n")
+	require.NoError(t, l.Shutdown(context.Background()))
+
+	ctx := tenant.WithContext(context.Background(), "cron")
+	value, err := st.Get(ctx, "gauge", "backup.duration")
+	require.NoError(t, err)
+	assert.Equal(t, "30", value)
+	metrics, err := st.GetByLabels(ctx, "gauge", "cpu", map[string]string{"host": "web1"})
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, 12.5, *metrics[0].Value)
+
+	stats := l.Stats()
+	assert.Equal(t, uint64(2), stats.Lines)
+	assert.Equal(t, uint64(1), stats.ParseErrors)
+	// Счетчики ошибок записываются в хранилище как метрики приемника
+	value, err = st.Get(ctx, "counter", "graphite_parse_errors")
+	require.NoError(t, err)
+	assert.Equal(t, "1", value)
+}
+
+func TestListener_MaxLinesPerConn(t *testing.T) {
+	l, st := newTestListener(t, Config{MaxLinesPerConn: 2})
+	require.NoError(t, l.Start())
+	defer l.Shutdown(context.Background())
+
+	send(t, l, "a 1\nb 2\nc 3\n")
+	require.Eventually(t, func() bool { return l.Stats().Dropped == 1 }, time.Second, 10*time.Millisecond)
+
+	_, err := st.Get(context.Background(), "gauge", "b")
+	assert.NoError(t, err)
+	_, err = st.Get(context.Background(), "gauge", "c")
+	assert.Error(t, err)
+}
+
+func TestListener_TrustedSubnets(t *testing.T) {
+	l, st := newTestListener(t, Config{TrustedSubnets: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}})
+	require.NoError(t, l.Start())
+	defer l.Shutdown(context.Background())
+
+	// Соединение закрывается сервером сразу, запись может завершиться ошибкой
+	conn, err := net.Dial("tcp", l.ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("a 1\n"))
+
+	require.Eventually(t, func() bool { return l.Stats().Dropped == 1 }, time.Second, 10*time.Millisecond)
+	_, err = st.Get(context.Background(), "gauge", "a")
+	assert.Error(t, err)
+}
+
+func TestListener_IdleTimeout(t *testing.T) {
+	l, _ := newTestListener(t, Config{IdleTimeout: 50 * time.Millisecond})
+	require.NoError(t, l.Start())
+	defer l.Shutdown(context.Background())
+
+	// Соединение без данных закрывается сервером
+	conn, err := net.Dial("tcp", l.ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
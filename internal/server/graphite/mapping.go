@@ -0,0 +1,146 @@
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Rule - правило преобразования пути Graphite в имя и метки метрики.
+//
+// Match - шаблон пути из компонентов через точку. Компонент шаблона сравнивается с компонентом пути
+// по правилам path.Match (*, ?, [...]), количество компонентов должно совпадать.
+// В Name и значениях Labels подстановка $n заменяется n-м компонентом пути, совпавшим с компонентом
+// шаблона, содержащим подстановочные символы.
+//
+//	match: servers.*.cpu.*
+//	name: cpu_$2
+//	labels: {host: $1}
+type Rule struct {
+	Match  string            `json:"match" yaml:"match"`
+	Name   string            `json:"name" yaml:"name"`
+	Labels map[string]string `json:"labels" yaml:"labels"`
+}
+
+// captureRe - подстановка компонента пути в имени и метках.
+var captureRe = regexp.MustCompile(`\$(\d+)`)
+
+// Mapper преобразует пути Graphite в имена и метки метрик по первому совпавшему правилу.
+// Путь, не совпавший ни с одним правилом, становится именем метрики без меток.
+type Mapper struct {
+	rules []compiledRule
+}
+
+// compiledRule - проверенное правило: компоненты шаблона и признак подстановочного компонента.
+type compiledRule struct {
+	Rule
+	parts    []string
+	wildcard []bool
+}
+
+// NewMapper проверяет правила и создает Mapper.
+func NewMapper(rules []Rule) (*Mapper, error) {
+	m := &Mapper{rules: make([]compiledRule, 0, len(rules))}
+	for i, rule := range rules {
+		compiled, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d (%q): %w", i+1, rule.Match, err)
+		}
+		m.rules = append(m.rules, compiled)
+	}
+	return m, nil
+}
+
+// Map возвращает имя и метки метрики для пути.
+func (m *Mapper) Map(metricPath string) (string, map[string]string) {
+	parts := strings.Split(metricPath, ".")
+	for _, rule := range m.rules {
+		captures, ok := rule.match(parts)
+		if !ok {
+			continue
+		}
+		var labels map[string]string
+		if len(rule.Labels) > 0 {
+			labels = make(map[string]string, len(rule.Labels))
+			for key, value := range rule.Labels {
+				labels[key] = expand(value, captures)
+			}
+		}
+		return expand(rule.Name, captures), labels
+	}
+	return metricPath, nil
+}
+
+func compileRule(rule Rule) (compiledRule, error) {
+	if rule.Match == "" {
+		return compiledRule{}, errors.New("empty match")
+	}
+	if rule.Name == "" {
+		return compiledRule{}, errors.New("empty name")
+	}
+
+	c := compiledRule{Rule: rule, parts: strings.Split(rule.Match, ".")}
+	captures := 0
+	for _, part := range c.parts {
+		if part == "" {
+			return compiledRule{}, errors.New("empty path component")
+		}
+		if _, err := path.Match(part, ""); err != nil {
+			return compiledRule{}, fmt.Errorf("invalid pattern %q: %w", part, err)
+		}
+		wildcard := strings.ContainsAny(part, "*?[")
+		if wildcard {
+			captures++
+		}
+		c.wildcard = append(c.wildcard, wildcard)
+	}
+
+	templates := []string{rule.Name}
+	for key, value := range rule.Labels {
+		if key == "" {
+			return compiledRule{}, errors.New("empty label name")
+		}
+		templates = append(templates, value)
+	}
+	for _, template := range templates {
+		for _, match := range captureRe.FindAllStringSubmatch(template, -1) {
+			n, _ := strconv.Atoi(match[1])
+			if n < 1 || n > captures {
+				return compiledRule{}, fmt.Errorf("%s refers to a missing wildcard, match has %d", match[0], captures)
+			}
+		}
+	}
+	return c, nil
+}
+
+// match сравнивает компоненты пути с шаблоном и возвращает компоненты, совпавшие с подстановочными.
+func (r *compiledRule) match(parts []string) ([]string, bool) {
+	if len(parts) != len(r.parts) {
+		return nil, false
+	}
+	var captures []string
+	for i, pattern := range r.parts {
+		if !r.wildcard[i] {
+			if pattern != parts[i] {
+				return nil, false
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, parts[i]); !ok {
+			return nil, false
+		}
+		captures = append(captures, parts[i])
+	}
+	return captures, true
+}
+
+// expand заменяет подстановки $n компонентами пути. Номера проверены при создании правила.
+func expand(template string, captures []string) string {
+	return captureRe.ReplaceAllStringFunc(template, func(s string) string {
+		n, _ := strconv.Atoi(s[1:])
+		return captures[n-1]
+	})
+}
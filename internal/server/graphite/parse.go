@@ -0,0 +1,45 @@
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// line - разобранная строка Graphite вида path value [timestamp].
+type line struct {
+	path  string
+	value float64
+}
+
+// parseLine разбирает строку Graphite. Время точки проверяется, но не сохраняется:
+// хранилище записывает значения со временем приема.
+func parseLine(s string) (line, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 || len(fields) > 3 {
+		return line{}, errors.New("expected \"path value [timestamp]\"")
+	}
+
+	l := line{path: fields[0]}
+	for _, part := range strings.Split(l.path, ".") {
+		if part == "" {
+			return line{}, fmt.Errorf("invalid metric path %q", l.path)
+		}
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return line{}, fmt.Errorf("invalid value %q", fields[1])
+	}
+	l.value = value
+
+	// -1 означает время приема
+	if len(fields) == 3 {
+		if _, err = strconv.ParseFloat(fields[2], 64); err != nil {
+			return line{}, fmt.Errorf("invalid timestamp %q", fields[2])
+		}
+	}
+	return l, nil
+}
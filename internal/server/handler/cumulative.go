@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/llaxzi/retryables/v2"
+
+	apperrors "metrics-service/internal/server/errors"
+	"metrics-service/internal/server/models"
+	"metrics-service/internal/server/storage"
+)
+
+// maxCumulativeStreams - максимальное количество запомненных рядов с накопленными значениями.
+// При переполнении состояние сбрасывается, и следующие значения рядов становятся новой точкой отсчета.
+const maxCumulativeStreams = 100000
+
+// cumulativeState хранит последние накопленные значения рядов, которые источник передает нарастающим итогом
+// (counter Prometheus, cumulative sum и histogram OTLP), чтобы записывать в хранилище приращения.
+type cumulativeState struct {
+	mu      sync.Mutex
+	streams map[string]cumulativeStream
+}
+
+// cumulativeStream - последнее накопленное значение ряда.
+type cumulativeStream struct {
+	// start - время начала накопления, смена которого означает сброс ряда. 0 - неизвестно.
+	start uint64
+	// value - значение counter.
+	value float64
+	// counts и sum - значения бакетов и сумма histogram.
+	counts []uint64
+	sum    float64
+}
+
+func newCumulativeState() *cumulativeState {
+	return &cumulativeState{streams: make(map[string]cumulativeStream)}
+}
+
+// batch начинает изменение состояния для одного запроса.
+func (s *cumulativeState) batch() *cumulativeBatch {
+	return &cumulativeBatch{state: s, pending: make(map[string]cumulativeStream)}
+}
+
+// cumulativeBatch - изменения состояния рядов одного запроса. Они применяются только после записи
+// в хранилище, чтобы повтор запроса после ошибки записи не потерял приращения. Хранилище не применяет
+// пакет с ошибкой частично, поэтому повтор не учтет приращения дважды.
+type cumulativeBatch struct {
+	state   *cumulativeState
+	pending map[string]cumulativeStream
+}
+
+// get возвращает значение ряда с учетом изменений запроса.
+func (b *cumulativeBatch) get(key string) (cumulativeStream, bool) {
+	if stream, ok := b.pending[key]; ok {
+		return stream, true
+	}
+	b.state.mu.Lock()
+	defer b.state.mu.Unlock()
+	stream, ok := b.state.streams[key]
+	return stream, ok
+}
+
+// set запоминает значение ряда в изменениях запроса.
+func (b *cumulativeBatch) set(key string, stream cumulativeStream) {
+	b.pending[key] = stream
+}
+
+// commit применяет изменения запроса к состоянию.
+func (b *cumulativeBatch) commit() {
+	b.state.mu.Lock()
+	defer b.state.mu.Unlock()
+	for key, stream := range b.pending {
+		if _, ok := b.state.streams[key]; !ok && len(b.state.streams) >= maxCumulativeStreams {
+			b.state.streams = make(map[string]cumulativeStream)
+		}
+		b.state.streams[key] = stream
+	}
+}
+
+// seriesExists проверяет, что ряд уже есть в хранилище.
+func seriesExists(ctx context.Context, st storage.Storage, retryer *retryables.Retryer, metric models.Metrics) (bool, error) {
+	err := retryer.Retry(func() error {
+		return st.GetJSON(ctx, &metric)
+	})
+	if errors.Is(err, apperrors.ErrMetricNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// counterDelta возвращает целое приращение counter между накопленными значениями prev и value.
+// Уменьшение значения считается сбросом счетчика.
+func counterDelta(prev, value float64) int64 {
+	if value < prev {
+		prev = 0
+	}
+	return int64(math.Floor(value)) - int64(math.Floor(prev))
+}
+
+// streamKey возвращает ключ ряда по арендатору, типу, имени и меткам, не зависящий от порядка меток.
+func streamKey(tenantName, metricType, name string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(tenantName)
+	b.WriteByte(0)
+	b.WriteString(metricType)
+	b.WriteByte(0)
+	b.WriteString(name)
+	for _, key := range keys {
+		b.WriteByte(0)
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(labels[key])
+	}
+	return b.String()
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -17,9 +18,15 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/proto"
 
+	apperrors "metrics-service/internal/server/errors"
 	"metrics-service/internal/server/mocks"
 	"metrics-service/internal/server/models"
+	"metrics-service/internal/server/remotewrite"
 	"metrics-service/internal/server/storage"
 )
 
@@ -57,7 +64,7 @@ func TestMetricsHandler_Update(t *testing.T) {
 
 		router := gin.Default()
 
-		memoryStorage, _ := storage.NewStorage("", "", false, 300)
+		memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300})
 		retryer := retryables.NewRetryer(nil)
 		retryer.SetCount(1)
 
@@ -108,7 +115,7 @@ func TestMetricsHandler_Get(t *testing.T) {
 
 			w := httptest.NewRecorder()
 
-			memoryStorage, _ := storage.NewStorage("", "", false, 300)
+			memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300})
 			retryer := retryables.NewRetryer(nil)
 			retryer.SetCount(1)
 			test.storageSet(memoryStorage)
@@ -168,7 +175,7 @@ func TestHtmlHandler_Get(t *testing.T) {
 	for _, test := range testTable {
 		t.Run(test.name, func(t *testing.T) {
 
-			memoryStorage, _ := storage.NewStorage("", "", false, 300)
+			memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300})
 			retryer := retryables.NewRetryer(nil)
 			retryer.SetCount(1)
 			test.storageSet(memoryStorage)
@@ -254,7 +261,7 @@ func TestMetricsHandler_UpdateJSON(t *testing.T) {
 			w := httptest.NewRecorder()
 			router := gin.Default()
 
-			memoryStorage, _ := storage.NewStorage("", "", false, 300)
+			memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300})
 			retryer := retryables.NewRetryer(nil)
 			retryer.SetCount(1)
 
@@ -305,7 +312,7 @@ func TestMetricsHandler_GetJSON(t *testing.T) {
 
 	for _, test := range testTable {
 		t.Run(test.name, func(t *testing.T) {
-			memoryStorage, _ := storage.NewStorage("", "", false, 300)
+			memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300})
 			retryer := retryables.NewRetryer(nil)
 			retryer.SetCount(1)
 			test.setup(memoryStorage)
@@ -406,7 +413,7 @@ func TestMetricsHandler_UpdateBatch(t *testing.T) {
 
 			w := httptest.NewRecorder()
 
-			memoryStorage, _ := storage.NewStorage("", "", false, 300)
+			memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300})
 			retryer := retryables.NewRetryer(nil)
 			retryer.SetCount(1)
 
@@ -421,6 +428,674 @@ func TestMetricsHandler_UpdateBatch(t *testing.T) {
 	}
 }
 
+func TestMetricsHandler_UpdateBatchIdempotency(t *testing.T) {
+	memoryStorage, err := storage.NewStorage(storage.Config{StoreInterval: 300})
+	require.NoError(t, err)
+	retryer := retryables.NewRetryer(nil)
+	retryer.SetCount(1)
+
+	metricsH := NewMetricsHandler(memoryStorage, retryer, false)
+	router := gin.Default()
+	router.POST("/updates", metricsH.UpdateBatch)
+
+	send := func(key string) *httptest.ResponseRecorder {
+		body, err := json.Marshal([]models.Metrics{{ID: "PollCount", MType: "counter", Delta: int64Ptr(5)}})
+		require.NoError(t, err)
+		request, err := http.NewRequest(http.MethodPost, "/updates", bytes.NewReader(body))
+		require.NoError(t, err)
+		request.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			request.Header.Set(IdempotencyKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, request)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, send("agent-1").Code)
+	// Повтор с тем же ключом подтверждается, но не применяется
+	w := send("agent-1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "already applied")
+	assert.Equal(t, http.StatusOK, send("agent-2").Code)
+	// Пакеты без ключа применяются всегда
+	assert.Equal(t, http.StatusOK, send("").Code)
+
+	value, err := memoryStorage.Get(context.Background(), "counter", "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, "15", value)
+
+	tooLong := make([]byte, storage.MaxIdempotencyKeyLen+1)
+	for i := range tooLong {
+		tooLong[i] = 'k'
+	}
+	assert.Equal(t, http.StatusBadRequest, send(string(tooLong)).Code)
+}
+
+func TestPrometheusHandler_Get(t *testing.T) {
+	testTable := []struct {
+		name       string
+		want       string
+		storageSet func(s storage.Storage)
+	}{
+		{"Empty storage", "", func(s storage.Storage) {}},
+		{"Gauge and counter", "# TYPE Alloc gauge\nAlloc 12.5\n# TYPE PollCount counter\nPollCount 7\n", func(s storage.Storage) {
+			s.Update(context.Background(), "gauge", "Alloc", "12.5")
+			s.Update(context.Background(), "counter", "PollCount", "7")
+		}},
+		{"Name sanitization", "# TYPE _1cpu_usage_total gauge\n_1cpu_usage_total 0.5\n", func(s storage.Storage) {
+			s.Update(context.Background(), "gauge", "1cpu.usage-total", "0.5")
+		}},
+		{"Labels", "# TYPE CPUutilization gauge\nCPUutilization{core=\"1\",host=\"web\\\"1\"} 12\nCPUutilization{core=\"2\",host=\"web\\\"1\"} 3.5\n", func(s storage.Storage) {
+			s.UpdateBatch(context.Background(), []models.Metrics{
+				{ID: "CPUutilization", MType: "gauge", Value: float64Ptr(3.5), Labels: map[string]string{"host": `web"1`, "core": "2"}},
+				{ID: "CPUutilization", MType: "gauge", Value: float64Ptr(12), Labels: map[string]string{"host": `web"1`, "core": "1"}},
+			})
+		}},
+		{"Histogram", "# TYPE latency histogram\nlatency_bucket{path=\"/\",le=\"0.1\"} 1\nlatency_bucket{path=\"/\",le=\"0.5\"} 3\nlatency_bucket{path=\"/\",le=\"+Inf\"} 4\nlatency_sum{path=\"/\"} 2.35\nlatency_count{path=\"/\"} 4\n", func(s storage.Storage) {
+			s.UpdateBatch(context.Background(), []models.Metrics{
+				{ID: "latency", MType: "histogram", Labels: map[string]string{"path": "/"}, Histogram: &models.Histogram{Bounds: []float64{0.1, 0.5}}, Observations: []float64{0.05, 0.2, 0.3, 1.8}},
+			})
+		}},
+		{"Type conflict", "# TYPE someMetric counter\nsomeMetric 5\n", func(s storage.Storage) {
+			s.Update(context.Background(), "counter", "someMetric", "5")
+			s.Update(context.Background(), "gauge", "someMetric", "5.2")
+		}},
+		{"Duplicate series after sanitization", "# TYPE a_b gauge\na_b 1\n", func(s storage.Storage) {
+			s.Update(context.Background(), "gauge", "a.b", "1")
+			s.Update(context.Background(), "gauge", "a_b", "2")
+		}},
+		{"Duplicate label names", "# TYPE up gauge\nup{service_name=\"b\"} 1\n", func(s storage.Storage) {
+			s.UpdateBatch(context.Background(), []models.Metrics{
+				{ID: "up", MType: "gauge", Value: float64Ptr(1), Labels: map[string]string{"service_name": "b"}},
+				{ID: "up", MType: "gauge", Value: float64Ptr(2), Labels: map[string]string{"service.name": "a", "service_name": "a"}},
+			})
+		}},
+		{"Histogram le label", "", func(s storage.Storage) {
+			s.UpdateBatch(context.Background(), []models.Metrics{
+				{ID: "latency", MType: "histogram", Labels: map[string]string{"le": "x"}, Histogram: &models.Histogram{Bounds: []float64{1}}, Observations: []float64{0.5}},
+			})
+		}},
+		{"Histogram sample names", "# TYPE latency histogram\nlatency_bucket{le=\"1\"} 1\nlatency_bucket{le=\"+Inf\"} 1\nlatency_sum 0.5\nlatency_count 1\n", func(s storage.Storage) {
+			s.UpdateBatch(context.Background(), []models.Metrics{
+				{ID: "latency", MType: "histogram", Histogram: &models.Histogram{Bounds: []float64{1}}, Observations: []float64{0.5}},
+				{ID: "latency_sum", MType: "gauge", Value: float64Ptr(3)},
+				{ID: "latency.count", MType: "counter", Delta: int64Ptr(1)},
+			})
+		}},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+
+			memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300})
+			retryer := retryables.NewRetryer(nil)
+			retryer.SetCount(1)
+			test.storageSet(memoryStorage)
+
+			prometheusH := NewPrometheusHandler(memoryStorage, retryer)
+
+			router := gin.Default()
+			router.GET("/metrics", prometheusH.Get)
+
+			w := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			router.ServeHTTP(w, request)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+			assert.Equal(t, test.want, w.Body.String())
+		})
+	}
+}
+
+func TestInfluxHandler_Write(t *testing.T) {
+	testTable := []struct {
+		name     string
+		target   string
+		body     string
+		template string
+		want     int
+		wantBody string
+		check    func(t *testing.T, s storage.Storage)
+	}{
+		{name: "OK", target: "/write", body: "cpu,host=a usage=0.5,count=3i,state=\"up\",ok=t\n\n# comment\nmem free=10u\n", want: http.StatusNoContent,
+			check: func(t *testing.T, s storage.Storage) {
+				usage := models.Metrics{ID: "cpu_usage", MType: "gauge", Labels: map[string]string{"host": "a"}}
+				require.NoError(t, s.GetJSON(context.Background(), &usage))
+				assert.Equal(t, 0.5, *usage.Value)
+				count := models.Metrics{ID: "cpu_count", MType: "counter", Labels: map[string]string{"host": "a"}}
+				require.NoError(t, s.GetJSON(context.Background(), &count))
+				assert.Equal(t, int64(3), *count.Delta)
+				free := models.Metrics{ID: "mem_free", MType: "gauge"}
+				require.NoError(t, s.GetJSON(context.Background(), &free))
+				assert.Equal(t, float64(10), *free.Value)
+				state := models.Metrics{ID: "cpu_state", MType: "gauge", Labels: map[string]string{"host": "a"}}
+				assert.ErrorIs(t, s.GetJSON(context.Background(), &state), apperrors.ErrMetricNotExist)
+			}},
+		{name: "Running totals", target: "/write", body: "net bytes=100i\nnet bytes=150i\nnet bytes=20i\n", want: http.StatusNoContent,
+			check: func(t *testing.T, s storage.Storage) {
+				// Приращения нарастающего итога, уменьшение - сброс
+				bytesRecv := models.Metrics{ID: "net_bytes", MType: "counter"}
+				require.NoError(t, s.GetJSON(context.Background(), &bytesRecv))
+				assert.Equal(t, int64(170), *bytesRecv.Delta)
+
+				// Ряд, существующий в хранилище, но новый для обработчика, начинается с первого значения
+				restarted := NewInfluxHandler(s, retryables.NewRetryer(nil), false, DefaultInfluxNameTemplate)
+				router := gin.New()
+				router.POST("/write", restarted.Write)
+				for _, body := range []string{"net bytes=30i", "net bytes=45i"} {
+					w := httptest.NewRecorder()
+					router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/write", bytes.NewBufferString(body)))
+					require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+				}
+				require.NoError(t, s.GetJSON(context.Background(), &bytesRecv))
+				assert.Equal(t, int64(185), *bytesRecv.Delta)
+			}},
+		{name: "Name template", target: "/write", template: "influx.{measurement}.{field}", body: "cpu usage=1", want: http.StatusNoContent,
+			check: func(t *testing.T, s storage.Storage) {
+				usage := models.Metrics{ID: "influx.cpu.usage", MType: "gauge"}
+				assert.NoError(t, s.GetJSON(context.Background(), &usage))
+			}},
+		{name: "Partial write", target: "/write", body: "cpu usage=1\ncpu usage=oops\ncpu\n", want: http.StatusBadRequest,
+			wantBody: `{"error":"partial write: 2 of 3 lines rejected","lines":[{"line":2,"error":"field \"usage\": invalid float \"oops\""},{"line":3,"error":"missing fields"}]}`,
+			check: func(t *testing.T, s storage.Storage) {
+				usage := models.Metrics{ID: "cpu_usage", MType: "gauge"}
+				assert.NoError(t, s.GetJSON(context.Background(), &usage))
+			}},
+		{name: "Precision", target: "/write?precision=s", body: "cpu usage=1 1700000000", want: http.StatusNoContent},
+		{name: "Invalid precision", target: "/write?precision=h", body: "cpu usage=1", want: http.StatusBadRequest},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+
+			memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300})
+			retryer := retryables.NewRetryer(nil)
+			retryer.SetCount(1)
+
+			template := test.template
+			if template == "" {
+				template = DefaultInfluxNameTemplate
+			}
+			influxH := NewInfluxHandler(memoryStorage, retryer, false, template)
+
+			router := gin.Default()
+			router.POST("/write", influxH.Write)
+
+			w := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodPost, test.target, bytes.NewBufferString(test.body))
+			router.ServeHTTP(w, request)
+
+			assert.Equal(t, test.want, w.Code)
+			if test.wantBody != "" {
+				assert.JSONEq(t, test.wantBody, w.Body.String())
+			}
+			if test.check != nil {
+				test.check(t, memoryStorage)
+			}
+		})
+	}
+}
+
+func TestRemoteWriteHandler_Write(t *testing.T) {
+	series := func(name string, labels map[string]string, values ...float64) remotewrite.TimeSeries {
+		ts := remotewrite.TimeSeries{Labels: []remotewrite.Label{{Name: remotewrite.NameLabel, Value: name}}}
+		for key, value := range labels {
+			ts.Labels = append(ts.Labels, remotewrite.Label{Name: key, Value: value})
+		}
+		for i, value := range values {
+			ts.Samples = append(ts.Samples, remotewrite.Sample{Value: value, Timestamp: int64(i) * 15000})
+		}
+		return ts
+	}
+
+	memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300})
+	retryer := retryables.NewRetryer(nil)
+	retryer.SetCount(1)
+	remoteWriteH := NewRemoteWriteHandler(memoryStorage, retryer, false)
+
+	router := gin.Default()
+	router.POST("/api/v1/write", remoteWriteH.Write)
+
+	write := func(body []byte, contentType string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(body))
+		request.Header.Set("Content-Encoding", "snappy")
+		request.Header.Set("Content-Type", contentType)
+		router.ServeHTTP(w, request)
+		return w
+	}
+	ctx := context.Background()
+
+	// Тип из метаданных, по суффиксу _total и gauge по умолчанию. Устаревшие значения (NaN) пропускаются
+	w := write(remotewrite.Encode(&remotewrite.WriteRequest{
+		Series: []remotewrite.TimeSeries{
+			series("http_requests_total", map[string]string{"code": "200"}, 10, 12),
+			series("process_cpu_seconds", nil, 1.5, 2.7),
+			series("temperature", nil, 20, 21.5, math.NaN()),
+		},
+		Metadata: []remotewrite.Metadata{{Type: remotewrite.TypeCounter, Family: "process_cpu_seconds"}},
+	}), "application/x-protobuf")
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	requests := models.Metrics{ID: "http_requests_total", MType: "counter", Labels: map[string]string{"code": "200"}}
+	require.NoError(t, memoryStorage.GetJSON(ctx, &requests))
+	assert.Equal(t, int64(12), *requests.Delta)
+	value, err := memoryStorage.Get(ctx, "counter", "process_cpu_seconds")
+	require.NoError(t, err)
+	assert.Equal(t, "2", value)
+	value, err = memoryStorage.Get(ctx, "gauge", "temperature")
+	require.NoError(t, err)
+	assert.Equal(t, "21.5", value)
+
+	// Накопленные значения counter записываются приращениями, уменьшение - сброс счетчика
+	w = write(remotewrite.Encode(&remotewrite.WriteRequest{
+		Series: []remotewrite.TimeSeries{series("http_requests_total", map[string]string{"code": "200"}, 15, 3)},
+	}), "application/x-protobuf")
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	require.NoError(t, memoryStorage.GetJSON(ctx, &requests))
+	assert.Equal(t, int64(18), *requests.Delta)
+
+	// Ряд, существующий в хранилище, но новый для обработчика, не учитывается повторно
+	restarted := NewRemoteWriteHandler(memoryStorage, retryer, false)
+	router.POST("/restarted", restarted.Write)
+	rw := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/restarted", bytes.NewReader(remotewrite.Encode(&remotewrite.WriteRequest{
+		Series: []remotewrite.TimeSeries{series("http_requests_total", map[string]string{"code": "200"}, 3, 5)},
+	})))
+	router.ServeHTTP(rw, request)
+	require.Equal(t, http.StatusNoContent, rw.Code, rw.Body.String())
+	require.NoError(t, memoryStorage.GetJSON(ctx, &requests))
+	assert.Equal(t, int64(20), *requests.Delta)
+
+	// Пакет сверх лимита рядов не применяется, повтор без новых рядов учитывает приращение один раз
+	limited, _ := storage.NewStorage(storage.Config{StoreInterval: 300, MaxSeries: 2})
+	limitedH := NewRemoteWriteHandler(limited, retryer, false)
+	router.POST("/limited", limitedH.Write)
+	writeLimited := func(series ...remotewrite.TimeSeries) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/limited", bytes.NewReader(remotewrite.Encode(&remotewrite.WriteRequest{Series: series}))))
+		return w.Code
+	}
+	jobs := series("jobs_total", nil, 10)
+	require.Equal(t, http.StatusNoContent, writeLimited(jobs))
+	jobs = series("jobs_total", nil, 15)
+	require.Equal(t, http.StatusBadRequest, writeLimited(jobs, series("a", nil, 1), series("b", nil, 1)))
+	require.Equal(t, http.StatusNoContent, writeLimited(jobs))
+	value, err = limited.Get(ctx, "counter", "jobs_total")
+	require.NoError(t, err)
+	assert.Equal(t, "15", value)
+
+	testTable := []struct {
+		name        string
+		body        []byte
+		contentType string
+		want        int
+	}{
+		{name: "Not snappy", body: []byte("plain"), contentType: "application/x-protobuf", want: http.StatusBadRequest},
+		{name: "Series without name", body: remotewrite.Encode(&remotewrite.WriteRequest{
+			Series: []remotewrite.TimeSeries{{Labels: []remotewrite.Label{{Name: "job", Value: "node"}}, Samples: []remotewrite.Sample{{Value: 1}}}},
+		}), contentType: "application/x-protobuf", want: http.StatusBadRequest},
+		{name: "Remote write 2.0", body: remotewrite.Encode(&remotewrite.WriteRequest{}),
+			contentType: "application/x-protobuf;proto=io.prometheus.write.v2.Request", want: http.StatusUnsupportedMediaType},
+		{name: "JSON", body: []byte("{}"), contentType: "application/json", want: http.StatusUnsupportedMediaType},
+	}
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, write(test.body, test.contentType).Code)
+		})
+	}
+}
+
+func TestOTLPHandler_Write(t *testing.T) {
+	attrs := func(kv ...string) []*commonpb.KeyValue {
+		var attributes []*commonpb.KeyValue
+		for i := 0; i < len(kv); i += 2 {
+			attributes = append(attributes, &commonpb.KeyValue{Key: kv[i], Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: kv[i+1]}}})
+		}
+		return attributes
+	}
+	cumulative := metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+	request := func(requests float64, start uint64, active int64, counts []uint64, sum float64) []byte {
+		data := &metricspb.MetricsData{ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: &resourcepb.Resource{Attributes: attrs("service.name", "checkout", "host.name", "a", "telemetry.sdk.language", "go")},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: []*metricspb.Metric{
+				{Name: "queue.size", Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: []*metricspb.NumberDataPoint{
+					{Attributes: attrs("queue", "q1"), Value: &metricspb.NumberDataPoint_AsInt{AsInt: 5}},
+				}}}},
+				{Name: "http.requests", Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{IsMonotonic: true, AggregationTemporality: cumulative, DataPoints: []*metricspb.NumberDataPoint{
+					{StartTimeUnixNano: start, Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: requests}},
+				}}}},
+				{Name: "active", Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA, DataPoints: []*metricspb.NumberDataPoint{
+					{Value: &metricspb.NumberDataPoint_AsInt{AsInt: active}},
+				}}}},
+				{Name: "latency", Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{AggregationTemporality: cumulative, DataPoints: []*metricspb.HistogramDataPoint{
+					{StartTimeUnixNano: start, ExplicitBounds: []float64{0.1, 1}, BucketCounts: counts, Sum: &sum},
+				}}}},
+				{Name: "rpc", Data: &metricspb.Metric_Summary{Summary: &metricspb.Summary{DataPoints: []*metricspb.SummaryDataPoint{{}}}}},
+			}}},
+		}}}
+		body, err := proto.Marshal(data)
+		require.NoError(t, err)
+		return body
+	}
+
+	memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300})
+	retryer := retryables.NewRetryer(nil)
+	retryer.SetCount(1)
+	otlpH := NewOTLPHandler(memoryStorage, retryer, false, OTLPConfig{ResourceLabels: []string{"service.name", "host.name"}})
+	prefixedH := NewOTLPHandler(memoryStorage, retryer, false, OTLPConfig{NameAttribute: "service.name"})
+
+	router := gin.Default()
+	router.POST("/v1/metrics", otlpH.Write)
+	router.POST("/prefixed/v1/metrics", prefixedH.Write)
+	send := func(target, contentType string, body []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		router.ServeHTTP(w, req)
+		return w
+	}
+	ctx := context.Background()
+	resource := map[string]string{"service.name": "checkout", "host.name": "a"}
+	get := func(metricType, name string, labels map[string]string) models.Metrics {
+		metric := models.Metrics{ID: name, MType: metricType, Labels: labels}
+		require.NoError(t, memoryStorage.GetJSON(ctx, &metric))
+		return metric
+	}
+
+	w := send("/v1/metrics", "application/x-protobuf", request(10.7, 1, 3, []uint64{1, 2, 0}, 1.5))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NotEmpty(t, w.Body.Bytes(), "partial success for summary")
+	assert.Equal(t, 5.0, *get("gauge", "queue.size", map[string]string{"service.name": "checkout", "host.name": "a", "queue": "q1"}).Value)
+	assert.Equal(t, int64(10), *get("counter", "http.requests", resource).Delta)
+	assert.Equal(t, 3.0, *get("gauge", "active", resource).Value)
+	assert.Equal(t, []int64{1, 2, 0}, get("histogram", "latency", resource).Histogram.Counts)
+
+	// Накопленные значения записываются приращениями, приращения немонотонной Sum складываются с gauge
+	w = send("/v1/metrics", "application/x-protobuf", request(15.2, 1, -1, []uint64{2, 3, 1}, 3))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, int64(15), *get("counter", "http.requests", resource).Delta)
+	assert.Equal(t, 2.0, *get("gauge", "active", resource).Value)
+	latency := get("histogram", "latency", resource).Histogram
+	assert.Equal(t, []int64{2, 3, 1}, latency.Counts)
+	assert.Equal(t, 3.0, latency.Sum)
+
+	// Новое время начала - сброс ряда
+	w = send("/v1/metrics", "application/x-protobuf", request(4, 2, 0, []uint64{1, 0, 0}, 0.05))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, int64(19), *get("counter", "http.requests", resource).Delta)
+	assert.Equal(t, []int64{3, 3, 1}, get("histogram", "latency", resource).Histogram.Counts)
+
+	// JSON, префикс имени из атрибута ресурса и partial success
+	w = send("/prefixed/v1/metrics", "application/json", []byte(`{"resourceMetrics":[{"resource":{"attributes":[
+		{"key":"service.name","value":{"stringValue":"billing"}}]},"scopeMetrics":[{"metrics":[
+		{"name":"jobs","sum":{"aggregationTemporality":1,"isMonotonic":true,"dataPoints":[{"asDouble":2.5},{"asDouble":2.5}]}},
+		{"name":"size","exponentialHistogram":{"aggregationTemporality":1,"dataPoints":[{}]}}]}]}]}`))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"partialSuccess":{"rejectedDataPoints":"1","errorMessage":"metric billing.size: exponential histogram is not supported"}}`, w.Body.String())
+	assert.Equal(t, int64(5), *get("counter", "billing.jobs", nil).Delta)
+
+	// Точка histogram с бесконечной суммой отклоняется
+	w = send("/prefixed/v1/metrics", "application/json", []byte(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[
+		{"name":"size","histogram":{"aggregationTemporality":1,"dataPoints":[{"explicitBounds":[1],"bucketCounts":["1","0"],"sum":"Infinity"}]}}]}]}]}`))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"partialSuccess":{"rejectedDataPoints":"1","errorMessage":"metric size: histogram sum must be finite"}}`, w.Body.String())
+
+	// Пакет сверх лимита рядов не применяется, повтор без новых рядов учитывает приращение один раз
+	limited, _ := storage.NewStorage(storage.Config{StoreInterval: 300, MaxSeries: 2})
+	router.POST("/limited/v1/metrics", NewOTLPHandler(limited, retryer, false, OTLPConfig{}).Write)
+	jobs := func(value string, gauges ...string) []byte {
+		metrics := `{"name":"jobs","sum":{"aggregationTemporality":2,"isMonotonic":true,"dataPoints":[{"startTimeUnixNano":"1","asDouble":` + value + `}]}}`
+		for _, name := range gauges {
+			metrics += `,{"name":"` + name + `","gauge":{"dataPoints":[{"asDouble":1}]}}`
+		}
+		return []byte(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[` + metrics + `]}]}]}`)
+	}
+	require.Equal(t, http.StatusOK, send("/limited/v1/metrics", "application/json", jobs("10")).Code)
+	require.Equal(t, http.StatusBadRequest, send("/limited/v1/metrics", "application/json", jobs("15", "a", "b")).Code)
+	require.Equal(t, http.StatusOK, send("/limited/v1/metrics", "application/json", jobs("15")).Code)
+	value, err := limited.Get(ctx, "counter", "jobs")
+	require.NoError(t, err)
+	assert.Equal(t, "15", value)
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, send("/v1/metrics", "text/plain", []byte("x")).Code)
+	w = send("/v1/metrics", "application/json", []byte("{"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":3`)
+	assert.Equal(t, http.StatusBadRequest, send("/v1/metrics", "application/x-protobuf", []byte{0xff}).Code)
+}
+
+func TestMetricsHandler_History(t *testing.T) {
+	type want struct {
+		statusCode int
+		samples    []models.Sample
+	}
+	testTable := []struct {
+		name       string
+		request    string
+		want       want
+		storageSet func(s storage.Storage)
+	}{
+		{"OK counter", "/history/counter/someMetric", want{http.StatusOK, []models.Sample{{Delta: int64Ptr(5)}, {Delta: int64Ptr(8)}}}, func(s storage.Storage) {
+			s.Update(context.Background(), "counter", "someMetric", "5")
+			s.Update(context.Background(), "counter", "someMetric", "3")
+		}},
+		{"OK gauge", "/history/gauge/someMetric", want{http.StatusOK, []models.Sample{{Value: float64Ptr(5.2)}, {Value: float64Ptr(1.5)}}}, func(s storage.Storage) {
+			s.Update(context.Background(), "gauge", "someMetric", "5.2")
+			s.UpdateBatch(context.Background(), []models.Metrics{{ID: "someMetric", MType: "gauge", Value: float64Ptr(1.5)}})
+		}},
+		{"Empty range", "/history/gauge/someMetric?from=0&to=1", want{http.StatusOK, []models.Sample{}}, func(s storage.Storage) {
+			s.Update(context.Background(), "gauge", "someMetric", "5.2")
+		}},
+		{"Not found metric", "/history/gauge/someMetric", want{http.StatusNotFound, nil}, func(s storage.Storage) {}},
+		{"Invalid metric type", "/history/unknown/someMetric", want{http.StatusBadRequest, nil}, func(s storage.Storage) {}},
+		{"Invalid from", "/history/gauge/someMetric?from=yesterday", want{http.StatusBadRequest, nil}, func(s storage.Storage) {}},
+		{"Invalid range", "/history/gauge/someMetric?from=2025-01-02T00:00:00Z&to=2025-01-01T00:00:00Z", want{http.StatusBadRequest, nil}, func(s storage.Storage) {}},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+
+			memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300, HistoryRetention: 3600})
+			retryer := retryables.NewRetryer(nil)
+			retryer.SetCount(1)
+			test.storageSet(memoryStorage)
+
+			metricsH := NewMetricsHandler(memoryStorage, retryer, false)
+
+			router := gin.Default()
+			router.GET("/history/:metricType/:metricName", metricsH.History)
+
+			w := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, test.request, nil)
+			router.ServeHTTP(w, request)
+
+			assert.Equal(t, test.want.statusCode, w.Code)
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var samples []models.Sample
+			err := json.NewDecoder(w.Body).Decode(&samples)
+			require.NoError(t, err)
+			require.Len(t, samples, len(test.want.samples))
+			for i, sample := range samples {
+				assert.False(t, sample.Timestamp.IsZero())
+				assert.Equal(t, test.want.samples[i].Delta, sample.Delta)
+				assert.Equal(t, test.want.samples[i].Value, sample.Value)
+			}
+		})
+	}
+}
+
+func TestMetricsHandler_Labels(t *testing.T) {
+	memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300, HistoryRetention: 3600})
+	retryer := retryables.NewRetryer(nil)
+	retryer.SetCount(1)
+
+	metricsH := NewMetricsHandler(memoryStorage, retryer, false)
+
+	router := gin.Default()
+	router.POST("/updates", metricsH.UpdateBatch)
+	router.POST("/value", metricsH.GetJSON)
+	router.POST("/values", metricsH.GetByLabels)
+	router.GET("/history/:metricType/:metricName", metricsH.History)
+
+	serve := func(method, url string, body interface{}) *httptest.ResponseRecorder {
+		var reader *bytes.Reader
+		if body != nil {
+			jsonData, err := json.Marshal(body)
+			require.NoError(t, err)
+			reader = bytes.NewReader(jsonData)
+		} else {
+			reader = bytes.NewReader(nil)
+		}
+		request := httptest.NewRequest(method, url, reader)
+		request.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, request)
+		return w
+	}
+
+	// Серии с одним именем и разными метками хранятся независимо
+	w := serve(http.MethodPost, "/updates", []models.Metrics{
+		{ID: "CPUutilization", MType: "gauge", Value: float64Ptr(10), Labels: map[string]string{"host": "a", "core": "1"}},
+		{ID: "CPUutilization", MType: "gauge", Value: float64Ptr(20), Labels: map[string]string{"host": "a", "core": "2"}},
+		{ID: "CPUutilization", MType: "gauge", Value: float64Ptr(30), Labels: map[string]string{"host": "b", "core": "1"}},
+		{ID: "CPUutilization", MType: "gauge", Value: float64Ptr(40)},
+		{ID: "Requests", MType: "counter", Delta: int64Ptr(1), Labels: map[string]string{"host": "a"}},
+		{ID: "Requests", MType: "counter", Delta: int64Ptr(2), Labels: map[string]string{"host": "a"}},
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	t.Run("Exact series", func(t *testing.T) {
+		w := serve(http.MethodPost, "/value", models.Metrics{ID: "CPUutilization", MType: "gauge", Labels: map[string]string{"core": "2", "host": "a"}})
+		require.Equal(t, http.StatusOK, w.Code)
+		var response models.Metrics
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Equal(t, float64Ptr(20), response.Value)
+
+		w = serve(http.MethodPost, "/value", models.Metrics{ID: "CPUutilization", MType: "gauge"})
+		require.Equal(t, http.StatusOK, w.Code)
+		var unlabeled models.Metrics
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&unlabeled))
+		assert.Equal(t, float64Ptr(40), unlabeled.Value)
+
+		w = serve(http.MethodPost, "/value", models.Metrics{ID: "Requests", MType: "counter", Labels: map[string]string{"host": "a"}})
+		require.Equal(t, http.StatusOK, w.Code)
+		var counter models.Metrics
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&counter))
+		assert.Equal(t, int64Ptr(3), counter.Delta)
+
+		w = serve(http.MethodPost, "/value", models.Metrics{ID: "CPUutilization", MType: "gauge", Labels: map[string]string{"host": "c"}})
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Match by labels", func(t *testing.T) {
+		w := serve(http.MethodPost, "/values", models.Metrics{ID: "CPUutilization", MType: "gauge", Labels: map[string]string{"host": "a"}})
+		require.Equal(t, http.StatusOK, w.Code)
+		var response []models.Metrics
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.ElementsMatch(t, []models.Metrics{
+			{ID: "CPUutilization", MType: "gauge", Value: float64Ptr(10), Labels: map[string]string{"host": "a", "core": "1"}},
+			{ID: "CPUutilization", MType: "gauge", Value: float64Ptr(20), Labels: map[string]string{"host": "a", "core": "2"}},
+		}, response)
+
+		w = serve(http.MethodPost, "/values", models.Metrics{MType: "counter", Labels: map[string]string{"host": "a"}})
+		require.Equal(t, http.StatusOK, w.Code)
+		var counters []models.Metrics
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&counters))
+		assert.Equal(t, []models.Metrics{{ID: "Requests", MType: "counter", Delta: int64Ptr(3), Labels: map[string]string{"host": "a"}}}, counters)
+
+		w = serve(http.MethodPost, "/values", models.Metrics{MType: "unknown"})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("History by labels", func(t *testing.T) {
+		w := serve(http.MethodGet, "/history/counter/Requests?label=host=a", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		var samples []models.Sample
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&samples))
+		require.Len(t, samples, 2)
+		assert.Equal(t, int64Ptr(3), samples[1].Delta)
+
+		w = serve(http.MethodGet, "/history/counter/Requests", nil)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		w = serve(http.MethodGet, "/history/counter/Requests?label=host", nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Invalid labels", func(t *testing.T) {
+		w := serve(http.MethodPost, "/updates", []models.Metrics{{ID: "Alloc", MType: "gauge", Value: float64Ptr(1), Labels: map[string]string{"": "a"}}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestMetricsHandler_Histogram(t *testing.T) {
+	memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300})
+	retryer := retryables.NewRetryer(nil)
+	retryer.SetCount(1)
+
+	metricsH := NewMetricsHandler(memoryStorage, retryer, false)
+
+	router := gin.Default()
+	router.POST("/update", metricsH.UpdateJSON)
+	router.POST("/update/:metricType/:metricName/:metricVal", metricsH.Update)
+	router.POST("/updates", metricsH.UpdateBatch)
+	router.POST("/value", metricsH.GetJSON)
+	router.GET("/value/:metricType/:metricName", metricsH.Get)
+
+	serve := func(method, url string, body interface{}) *httptest.ResponseRecorder {
+		jsonData, err := json.Marshal(body)
+		require.NoError(t, err)
+		request := httptest.NewRequest(method, url, bytes.NewReader(jsonData))
+		request.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, request)
+		return w
+	}
+
+	testTable := []struct {
+		name       string
+		method     string
+		url        string
+		body       interface{}
+		wantStatus int
+	}{
+		{"Observations without buckets", http.MethodPost, "/update", models.Metrics{ID: "latency", MType: "histogram", Observations: []float64{0.2}}, http.StatusBadRequest},
+		{"Empty histogram", http.MethodPost, "/update", models.Metrics{ID: "latency", MType: "histogram"}, http.StatusBadRequest},
+		{"Unsorted buckets", http.MethodPost, "/update", models.Metrics{ID: "latency", MType: "histogram", Histogram: &models.Histogram{Bounds: []float64{1, 0.5}}}, http.StatusBadRequest},
+		{"Declare and observe", http.MethodPost, "/update", models.Metrics{ID: "latency", MType: "histogram", Histogram: &models.Histogram{Bounds: []float64{0.1, 0.5, 1}}, Observations: []float64{0.0625, 0.25}}, http.StatusOK},
+		{"Observe declared", http.MethodPost, "/update", models.Metrics{ID: "latency", MType: "histogram", Observations: []float64{0.75, 3}}, http.StatusOK},
+		{"Observe via URL", http.MethodPost, "/update/histogram/latency/0.5", nil, http.StatusOK},
+		{"Pre-bucketed counts", http.MethodPost, "/updates", []models.Metrics{{ID: "latency", MType: "histogram", Histogram: &models.Histogram{Counts: []int64{1, 0, 0, 1}, Sum: 10}}}, http.StatusOK},
+		{"Wrong counts length", http.MethodPost, "/updates", []models.Metrics{{ID: "latency", MType: "histogram", Histogram: &models.Histogram{Counts: []int64{1, 1}}}}, http.StatusBadRequest},
+		{"Conflicting buckets", http.MethodPost, "/update", models.Metrics{ID: "latency", MType: "histogram", Histogram: &models.Histogram{Bounds: []float64{0.1, 1}}, Observations: []float64{0.2}}, http.StatusBadRequest},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			w := serve(test.method, test.url, test.body)
+			assert.Equal(t, test.wantStatus, w.Code, w.Body.String())
+		})
+	}
+
+	t.Run("Read back", func(t *testing.T) {
+		w := serve(http.MethodPost, "/value", models.Metrics{ID: "latency", MType: "histogram"})
+		require.Equal(t, http.StatusOK, w.Code)
+		var response models.Metrics
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Equal(t, &models.Histogram{Bounds: []float64{0.1, 0.5, 1}, Counts: []int64{2, 2, 1, 2}, Sum: 14.5625, Count: 7}, response.Histogram)
+
+		w = serve(http.MethodGet, "/value/histogram/latency", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "count=7 sum=14.5625 buckets=[0.1:2 0.5:2 1:1 +Inf:2]", w.Body.String())
+	})
+}
+
 func int64Ptr(i int64) *int64 {
 	return &i
 }
@@ -435,7 +1110,7 @@ func ExampleMetricsHandler_Update() {
 
 	// Настраиваем тестовое окружение
 	r := gin.Default()
-	memoryStorage, _ := storage.NewStorage("", "", false, 300)
+	memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300})
 	retryer := retryables.NewRetryer(nil)
 	retryer.SetCount(1)
 	h := NewMetricsHandler(memoryStorage, retryer, false)
@@ -456,7 +1131,7 @@ func ExampleMetricsHandler_Get() {
 
 	// Настраиваем тестовое окружение
 	r := gin.Default()
-	memoryStorage, _ := storage.NewStorage("", "", false, 300)
+	memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300})
 	retryer := retryables.NewRetryer(nil)
 	retryer.SetCount(1)
 	h := NewMetricsHandler(memoryStorage, retryer, false)
@@ -477,7 +1152,7 @@ func ExampleMetricsHandler_UpdateJSON() {
 
 	// Настраиваем тестовое окружение
 	r := gin.Default()
-	memoryStorage, _ := storage.NewStorage("", "", false, 300)
+	memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300})
 	retryer := retryables.NewRetryer(nil)
 	retryer.SetCount(1)
 	h := NewMetricsHandler(memoryStorage, retryer, false)
@@ -503,7 +1178,7 @@ func ExampleMetricsHandler_GetJSON() {
 
 	// Настраиваем тестовое окружение
 	r := gin.Default()
-	memoryStorage, _ := storage.NewStorage("", "", false, 300)
+	memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300})
 	retryer := retryables.NewRetryer(nil)
 	retryer.SetCount(1)
 	h := NewMetricsHandler(memoryStorage, retryer, false)
@@ -530,7 +1205,7 @@ func ExampleMetricsHandler_Ping() {
 	// Настраиваем тестовое окружение
 	r := gin.Default()
 	// Будем пинговать memoryStorage - получим 500
-	memoryStorage, _ := storage.NewStorage("", "", false, 300)
+	memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300})
 	retryer := retryables.NewRetryer(nil)
 	retryer.SetCount(1)
 	h := NewMetricsHandler(memoryStorage, retryer, false)
@@ -550,7 +1225,7 @@ func ExampleMetricsHandler_UpdateBatch() {
 
 	// Настраиваем тестовое окружение
 	r := gin.Default()
-	memoryStorage, _ := storage.NewStorage("", "", false, 300)
+	memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300})
 	retryer := retryables.NewRetryer(nil)
 	retryer.SetCount(1)
 	h := NewMetricsHandler(memoryStorage, retryer, false)
@@ -579,7 +1254,7 @@ func ExampleHTMLHandler_Get() {
 
 	// Настраиваем тестовое окружение
 	r := gin.Default()
-	memoryStorage, _ := storage.NewStorage("", "", false, 300)
+	memoryStorage, _ := storage.NewStorage(storage.Config{StoreInterval: 300})
 	retryer := retryables.NewRetryer(nil)
 	retryer.SetCount(1)
 	h := NewHTMLHandler(memoryStorage, retryer)
@@ -8,6 +8,7 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"metrics-service/internal/server/storage"
+	"metrics-service/internal/tenant"
 )
 
 // IHTMLHandler определяет интерфейс для обработки HTTP-запросов, связанных с HTML отдачей метрик.
@@ -26,7 +27,7 @@ type HTMLHandler struct {
 	retryer *retryables.Retryer
 }
 
-// Get возвращает все метрики в HTML формате.
+// Get возвращает все метрики арендатора запроса в HTML формате.
 func (h *HTMLHandler) Get(ctx *gin.Context) {
 	var metrics [][]string
 	err := h.retryer.Retry(func() error {
@@ -35,8 +36,11 @@ func (h *HTMLHandler) Get(ctx *gin.Context) {
 		return err
 	})
 
-	// Формируем HTML
+	// Формируем HTML. Имя арендатора состоит из безопасных символов (см. tenant.Valid)
 	metricsHTML := "<h1>Metrics List</h1><div>"
+	if name := tenant.FromContext(ctx); name != tenant.Default {
+		metricsHTML = "<h1>Metrics List: " + name + "</h1><div>"
+	}
 	if len(metrics) == 0 {
 		metricsHTML += "<p>No metrics available</p>"
 	} else {
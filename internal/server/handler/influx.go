@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/llaxzi/retryables/v2"
+
+	"github.com/gin-gonic/gin"
+
+	"metrics-service/internal/server/influx"
+	"metrics-service/internal/server/models"
+	"metrics-service/internal/server/storage"
+	"metrics-service/internal/tenant"
+)
+
+const (
+	// DefaultInfluxNameTemplate - шаблон имени метрики по умолчанию для полей line protocol.
+	DefaultInfluxNameTemplate = "{measurement}_{field}"
+	// maxInfluxLineLen - максимальная длина строки line protocol.
+	maxInfluxLineLen = 1 << 20
+	// maxInfluxLineErrors - максимальное количество ошибок строк в ответе, остальные только подсчитываются.
+	maxInfluxLineErrors = 100
+)
+
+// IInfluxHandler определяет интерфейс для приема метрик в формате InfluxDB line protocol.
+type IInfluxHandler interface {
+	Write(ctx *gin.Context)
+}
+
+// NewInfluxHandler создает новый экземпляр IInfluxHandler. nameTemplate - шаблон имени метрики
+// с подстановками {measurement} и {field}.
+func NewInfluxHandler(storage storage.Storage, retryer *retryables.Retryer, isSync bool, nameTemplate string) IInfluxHandler {
+	return &InfluxHandler{
+		storage:      storage,
+		retryer:      retryer,
+		isSync:       isSync,
+		nameTemplate: nameTemplate,
+		counters:     newCumulativeState(),
+	}
+}
+
+// InfluxHandler реализует интерфейс IInfluxHandler.
+type InfluxHandler struct {
+	storage      storage.Storage
+	retryer      *retryables.Retryer
+	isSync       bool
+	nameTemplate string
+	// counters - последние значения целых полей.
+	counters *cumulativeState
+}
+
+// influxLineError - ошибка разбора строки line protocol, номер строки начинается с 1.
+type influxLineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// Write принимает метрики в формате InfluxDB line protocol.
+//
+// Каждое числовое поле становится отдельной метрикой с именем по шаблону, теги - метками серии.
+// Целые поля с суффиксом i записываются как counter, числа с плавающей точкой и беззнаковые (суффикс u) - как gauge.
+// Telegraf передает целые поля нарастающим итогом, поэтому counter увеличивается на разницу с прошлым значением
+// поля, уменьшение значения считается сбросом. Первое значение нового ряда записывается целиком, а ряд, уже
+// существующий в хранилище, но новый для обработчика (после перезапуска), начинается с него без записи.
+// Строковые и логические поля пропускаются. Время точки проверяется с учетом query-параметра precision,
+// но значения сохраняются со временем приема.
+//
+// Корректные строки записываются одним пакетом, даже если часть строк отклонена. Если все строки приняты,
+// возвращается 204 (No Content), иначе 400 (Bad Request) со списком ошибок по номерам строк.
+func (h *InfluxHandler) Write(ctx *gin.Context) {
+	precision, err := influx.ParsePrecision(ctx.Query("precision"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var metrics []models.Metrics
+	var lineErrors []influxLineError
+	total, rejected := 0, 0
+	name := tenant.FromContext(ctx)
+	counters := h.counters.batch()
+
+	scanner := bufio.NewScanner(ctx.Request.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxInfluxLineLen)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		total++
+		point, err := influx.ParseLine(line, precision)
+		if err != nil {
+			rejected++
+			if len(lineErrors) < maxInfluxLineErrors {
+				lineErrors = append(lineErrors, influxLineError{Line: n, Error: err.Error()})
+			}
+			continue
+		}
+		pointMetrics, err := h.pointMetrics(ctx, name, point, counters)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		metrics = append(metrics, pointMetrics...)
+	}
+	if err = scanner.Err(); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("failed to read body: %v", err)})
+		return
+	}
+
+	if len(metrics) > 0 {
+		err = h.retryer.Retry(func() error {
+			return h.storage.UpdateBatch(ctx, metrics)
+		})
+		if err != nil {
+			ctx.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+	}
+	// Значения запоминаются и без записи: первое значение ряда из хранилища - точка отсчета
+	counters.commit()
+
+	// Сохраняем на диск при синхронном режиме
+	if len(metrics) > 0 && h.isSync {
+		err = h.storage.Save()
+		if err != nil {
+			ctx.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	if rejected > 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("partial write: %d of %d lines rejected", rejected, total),
+			"lines": lineErrors,
+		})
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// pointMetrics преобразует числовые поля точки в метрики. Новые значения целых полей запоминаются в counters.
+func (h *InfluxHandler) pointMetrics(ctx *gin.Context, name string, point influx.Point, counters *cumulativeBatch) ([]models.Metrics, error) {
+	metrics := make([]models.Metrics, 0, len(point.Fields))
+	for _, field := range point.Fields {
+		m := models.Metrics{ID: influxMetricName(h.nameTemplate, point.Measurement, field.Key), Labels: point.Tags}
+		switch field.Type {
+		case influx.FieldInteger:
+			key := streamKey(name, "counter", m.ID, m.Labels)
+			value := float64(field.Int)
+			stream, seen := counters.get(key)
+			counters.set(key, cumulativeStream{value: value})
+			if !seen {
+				exists, err := seriesExists(ctx, h.storage, h.retryer, models.Metrics{ID: m.ID, MType: "counter", Labels: m.Labels})
+				if err != nil {
+					return nil, err
+				}
+				if exists {
+					continue
+				}
+			}
+			delta := counterDelta(stream.value, value)
+			m.MType, m.Delta = "counter", &delta
+		case influx.FieldFloat, influx.FieldUnsigned:
+			value := field.Float
+			m.MType, m.Value = "gauge", &value
+		default:
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+// influxMetricName возвращает имя метрики по шаблону с подстановками {measurement} и {field}.
+func influxMetricName(template, measurement, field string) string {
+	return strings.NewReplacer("{measurement}", measurement, "{field}", field).Replace(template)
+}
@@ -2,12 +2,17 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/llaxzi/retryables/v2"
 
 	"github.com/gin-gonic/gin"
 
+	apperrors "metrics-service/internal/server/errors"
 	"metrics-service/internal/server/models"
 	"metrics-service/internal/server/storage"
 )
@@ -20,8 +25,13 @@ type IMetricsHandler interface {
 	GetJSON(ctx *gin.Context)
 	Ping(ctx *gin.Context)
 	UpdateBatch(ctx *gin.Context)
+	History(ctx *gin.Context)
+	GetByLabels(ctx *gin.Context)
 }
 
+// IdempotencyKeyHeader - заголовок с ключом идемпотентности пакета метрик.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
 // NewMetricsHandler создает новый экземпляр IMetricsHandler
 //
 // Storage - хранилище метрик.
@@ -110,22 +120,28 @@ func (h *MetricsHandler) UpdateJSON(ctx *gin.Context) {
 		return
 	}
 
-	if requestData.MType != "counter" && requestData.MType != "gauge" {
+	if !validMetricType(requestData.MType) {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid metric type"})
 		return
 	}
 
-	if requestData.MType == "counter" && requestData.Delta == nil || requestData.MType == "gauge" && requestData.Value == nil {
+	if requestData.MType == "counter" && requestData.Delta == nil || requestData.MType == "gauge" && requestData.Value == nil ||
+		requestData.MType == "histogram" && requestData.Histogram == nil && len(requestData.Observations) == 0 {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON"})
 		return
 	}
 
+	if !validLabels(requestData.Labels) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid labels"})
+		return
+	}
+
 	err = h.retryer.Retry(func() error {
 		return h.storage.UpdateJSON(ctx, &requestData)
 	})
 
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		ctx.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -157,7 +173,7 @@ func (h *MetricsHandler) GetJSON(ctx *gin.Context) {
 		return
 	}
 
-	if requestData.MType != "counter" && requestData.MType != "gauge" {
+	if !validMetricType(requestData.MType) {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid metric type"})
 		return
 	}
@@ -204,14 +220,32 @@ func (h *MetricsHandler) UpdateBatch(ctx *gin.Context) {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid metric in array"})
 			return
 		}
+		if !validLabels(m.Labels) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid labels in array"})
+			return
+		}
 		metrics = append(metrics, m)
 	}
 
+	// Повтор пакета с тем же ключом идемпотентности подтверждается без повторного применения
+	key := ctx.GetHeader(IdempotencyKeyHeader)
+	if len(key) > storage.MaxIdempotencyKeyLen {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "idempotency key is too long"})
+		return
+	}
+
 	err := h.retryer.Retry(func() error {
-		return h.storage.UpdateBatch(ctx, metrics)
+		if key == "" {
+			return h.storage.UpdateBatch(ctx, metrics)
+		}
+		return h.storage.UpdateBatchOnce(ctx, key, metrics)
 	})
+	if errors.Is(err, apperrors.ErrDuplicateBatch) {
+		ctx.JSON(http.StatusOK, gin.H{"message": "already applied"})
+		return
+	}
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		ctx.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -225,3 +259,150 @@ func (h *MetricsHandler) UpdateBatch(ctx *gin.Context) {
 
 	ctx.JSON(http.StatusOK, gin.H{"message": "updated successfully"})
 }
+
+// History возвращает историю значений метрики за интервал времени.
+//
+// Границы интервала передаются в query-параметрах from и to в формате RFC3339 или unix-времени в секундах.
+// По умолчанию from - начало хранимой истории, to - текущий момент.
+// Метки серии передаются повторяющимся query-параметром label в виде key=value.
+func (h *MetricsHandler) History(ctx *gin.Context) {
+
+	metricType := ctx.Param("metricType")
+	metricName := ctx.Param("metricName")
+
+	labels, err := parseLabelParams(ctx.QueryArray("label"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	from, err := parseTimeParam(ctx.Query("from"), time.Time{})
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid from: " + err.Error()})
+		return
+	}
+	to, err := parseTimeParam(ctx.Query("to"), time.Now())
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid to: " + err.Error()})
+		return
+	}
+	if to.Before(from) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": apperrors.ErrInvalidTimeRange.Error()})
+		return
+	}
+
+	var samples []models.Sample
+	err = h.retryer.Retry(func() error {
+		var err error
+		samples, err = h.storage.GetHistory(ctx, metricType, metricName, labels, from, to)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, apperrors.ErrInvalidMetricType):
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, apperrors.ErrMetricNotExist):
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		default:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	ctx.JSON(http.StatusOK, samples)
+}
+
+// parseTimeParam разбирает время в формате RFC3339 или unix-времени в секундах.
+// Для пустой строки возвращается def.
+func parseTimeParam(param string, def time.Time) (time.Time, error) {
+	if param == "" {
+		return def, nil
+	}
+	if sec, err := strconv.ParseInt(param, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, param)
+}
+
+// GetByLabels возвращает все серии метрик, метки которых содержат переданные в запросе.
+//
+// Тело запроса - models.Metrics, где type обязателен, id - необязателен, labels - метки для сопоставления.
+func (h *MetricsHandler) GetByLabels(ctx *gin.Context) {
+
+	contentType := ctx.GetHeader("Content-type")
+	if contentType != "application/json" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid content type"})
+		return
+	}
+
+	var requestData models.Metrics
+	dec := json.NewDecoder(ctx.Request.Body)
+	err := dec.Decode(&requestData)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON"})
+		return
+	}
+
+	if !validMetricType(requestData.MType) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid metric type"})
+		return
+	}
+
+	var metrics []models.Metrics
+	err = h.retryer.Retry(func() error {
+		var err error
+		metrics, err = h.storage.GetByLabels(ctx, requestData.MType, requestData.ID, requestData.Labels)
+		return err
+	})
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, metrics)
+}
+
+// validMetricType проверяет, что тип метрики поддерживается сервером.
+func validMetricType(metricType string) bool {
+	return metricType == "counter" || metricType == "gauge" || metricType == "histogram"
+}
+
+// updateErrorStatus возвращает HTTP-статус для ошибки обновления метрик:
+// ошибки в описании histogram и превышение лимита серий арендатора - ошибки клиента, превышение количества
+// арендаторов - 403 (Forbidden), остальные - ошибки сервера.
+func updateErrorStatus(err error) int {
+	if errors.Is(err, apperrors.ErrTenantLimit) {
+		return http.StatusForbidden
+	}
+	if errors.Is(err, apperrors.ErrInvalidHistogram) || errors.Is(err, apperrors.ErrHistogramBuckets) ||
+		errors.Is(err, apperrors.ErrSeriesLimit) || errors.Is(err, apperrors.ErrTenantInvalid) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// validLabels проверяет, что у всех меток непустые имена.
+func validLabels(labels map[string]string) bool {
+	for key := range labels {
+		if key == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// parseLabelParams разбирает метки из query-параметров вида key=value.
+func parseLabelParams(params []string) (map[string]string, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(params))
+	for _, param := range params {
+		key, value, found := strings.Cut(param, "=")
+		if !found || key == "" {
+			return nil, errors.New("invalid label: " + param)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
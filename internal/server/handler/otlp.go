@@ -0,0 +1,530 @@
+package handler
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/llaxzi/retryables/v2"
+
+	"github.com/gin-gonic/gin"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	"metrics-service/internal/server/models"
+	"metrics-service/internal/server/storage"
+	"metrics-service/internal/tenant"
+)
+
+const (
+	// maxOTLPBody - максимальный размер тела запроса OTLP после распаковки gzip.
+	maxOTLPBody = 16 << 20
+
+	otlpProtobuf = "application/x-protobuf"
+	otlpJSON     = "application/json"
+
+	// Коды google.rpc.Status в ответах с ошибкой.
+	rpcInvalidArgument  = 3
+	rpcPermissionDenied = 7
+	rpcInternal         = 13
+	rpcUnavailable      = 14
+)
+
+// OTLPConfig задает преобразование атрибутов ресурса OTLP в имена и метки метрик.
+type OTLPConfig struct {
+	// ResourceLabels - атрибуты ресурса, которые становятся метками точек, "*" - все атрибуты.
+	// Атрибуты точки имеют приоритет над атрибутами ресурса.
+	ResourceLabels []string
+	// NameAttribute - атрибут ресурса, значение которого добавляется к имени метрики префиксом через точку,
+	// например service.name. Пустой - имена метрик не меняются.
+	NameAttribute string
+}
+
+// IOTLPHandler определяет интерфейс для приема метрик OTLP/HTTP.
+type IOTLPHandler interface {
+	Write(ctx *gin.Context)
+}
+
+// NewOTLPHandler создает новый экземпляр IOTLPHandler
+func NewOTLPHandler(storage storage.Storage, retryer *retryables.Retryer, isSync bool, cfg OTLPConfig) IOTLPHandler {
+	allResource := false
+	resourceLabels := make(map[string]bool, len(cfg.ResourceLabels))
+	for _, key := range cfg.ResourceLabels {
+		if key == "*" {
+			allResource = true
+		}
+		resourceLabels[key] = true
+	}
+	return &OTLPHandler{
+		storage:        storage,
+		retryer:        retryer,
+		isSync:         isSync,
+		nameAttribute:  cfg.NameAttribute,
+		allResource:    allResource,
+		resourceLabels: resourceLabels,
+		streams:        newCumulativeState(),
+	}
+}
+
+// OTLPHandler реализует интерфейс IOTLPHandler.
+//
+// Монотонные Sum записываются как counter, Gauge и немонотонные Sum - как gauge, Histogram с явными границами
+// бакетов - как histogram. Хранилище складывает приращения counter и histogram, поэтому накопленные (cumulative)
+// значения преобразуются в приращения по последнему значению каждого ряда, как в RemoteWriteHandler.
+// Смена времени начала ряда или уменьшение значения считается сбросом.
+type OTLPHandler struct {
+	storage        storage.Storage
+	retryer        *retryables.Retryer
+	isSync         bool
+	nameAttribute  string
+	allResource    bool
+	resourceLabels map[string]bool
+	streams        *cumulativeState
+}
+
+// otlpBatch - метрики одного запроса и отклоненные точки.
+type otlpBatch struct {
+	h       *OTLPHandler
+	ctx     *gin.Context
+	tenant  string
+	streams *cumulativeBatch
+	// gauges - значения gauge, записанные в этом запросе, для применения приращений немонотонных Sum.
+	gauges   map[string]float64
+	metrics  []models.Metrics
+	rejected int64
+	// reason - причина первого отказа, передается клиенту в partial success.
+	reason string
+}
+
+// Write принимает метрики OTLP/HTTP в кодировке protobuf или JSON.
+//
+// Точки неподдерживаемых типов (ExponentialHistogram, Summary) и некорректные точки отклоняются, остальные
+// записываются одним пакетом, а количество отклоненных точек возвращается в partial success с кодом 200 (OK).
+// Коды ответа соответствуют спецификации OTLP/HTTP: 400 (Bad Request) для запросов, которые нельзя повторять,
+// 503 (Service Unavailable) при ошибке хранилища - клиент повторит запрос.
+func (h *OTLPHandler) Write(ctx *gin.Context) {
+	mediaType, _, err := mime.ParseMediaType(ctx.GetHeader("Content-Type"))
+	if err != nil || (mediaType != otlpProtobuf && mediaType != otlpJSON) {
+		ctx.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "unsupported content type, expected application/x-protobuf or application/json"})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(ctx.Request.Body, maxOTLPBody+1))
+	if err != nil {
+		otlpStatus(ctx, mediaType, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(body) > maxOTLPBody {
+		otlpStatus(ctx, mediaType, http.StatusRequestEntityTooLarge, "request body is too large")
+		return
+	}
+
+	// MetricsData совпадает с ExportMetricsServiceRequest в protobuf и JSON
+	data := &metricspb.MetricsData{}
+	if mediaType == otlpJSON {
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(body, data)
+	} else {
+		err = proto.Unmarshal(body, data)
+	}
+	if err != nil {
+		otlpStatus(ctx, mediaType, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	b := &otlpBatch{h: h, ctx: ctx, tenant: tenant.FromContext(ctx), streams: h.streams.batch(), gauges: make(map[string]float64)}
+	for _, rm := range data.GetResourceMetrics() {
+		prefix, resource := h.resource(rm.GetResource())
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				if err = b.add(m, prefix, resource); err != nil {
+					otlpStatus(ctx, mediaType, http.StatusServiceUnavailable, err.Error())
+					return
+				}
+			}
+		}
+	}
+
+	if len(b.metrics) > 0 {
+		err = h.retryer.Retry(func() error {
+			return h.storage.UpdateBatch(ctx, b.metrics)
+		})
+		if err != nil {
+			status := updateErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				status = http.StatusServiceUnavailable
+			}
+			otlpStatus(ctx, mediaType, status, err.Error())
+			return
+		}
+		b.streams.commit()
+
+		// Сохраняем на диск при синхронном режиме. Метрики уже записаны, поэтому ошибка не должна вызывать повтор
+		if h.isSync {
+			err = h.storage.Save()
+			if err != nil {
+				otlpStatus(ctx, mediaType, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+	}
+
+	otlpResponse(ctx, mediaType, b.rejected, b.reason)
+}
+
+// resource возвращает префикс имени и метки из атрибутов ресурса.
+func (h *OTLPHandler) resource(resource *resourcepb.Resource) (string, map[string]string) {
+	var prefix string
+	labels := make(map[string]string)
+	for _, attr := range resource.GetAttributes() {
+		value := attributeValue(attr.GetValue())
+		if h.nameAttribute != "" && attr.GetKey() == h.nameAttribute {
+			prefix = value
+			continue
+		}
+		if attr.GetKey() != "" && (h.allResource || h.resourceLabels[attr.GetKey()]) {
+			labels[attr.GetKey()] = value
+		}
+	}
+	return prefix, labels
+}
+
+// add преобразует точки метрики в метрики хранилища.
+func (b *otlpBatch) add(m *metricspb.Metric, prefix string, resource map[string]string) error {
+	name := m.GetName()
+	if name == "" {
+		b.reject(dataPoints(m), "metric without name")
+		return nil
+	}
+	if prefix != "" {
+		name = prefix + "." + name
+	}
+
+	switch data := m.GetData().(type) {
+	case *metricspb.Metric_Gauge:
+		for _, dp := range data.Gauge.GetDataPoints() {
+			if value, ok := numberValue(dp); ok {
+				b.gauge(name, labelsOf(resource, dp.GetAttributes()), value)
+			}
+		}
+	case *metricspb.Metric_Sum:
+		points := data.Sum.GetDataPoints()
+		temporality := data.Sum.GetAggregationTemporality()
+		if temporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_UNSPECIFIED {
+			b.reject(len(points), fmt.Sprintf("metric %s: unspecified aggregation temporality", name))
+			return nil
+		}
+		cumulative := temporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+		for _, dp := range points {
+			value, ok := numberValue(dp)
+			if !ok {
+				continue
+			}
+			labels := labelsOf(resource, dp.GetAttributes())
+			var err error
+			switch {
+			case data.Sum.GetIsMonotonic():
+				err = b.counter(name, labels, dp.GetStartTimeUnixNano(), value, cumulative)
+			case cumulative:
+				b.gauge(name, labels, value)
+			default:
+				err = b.gaugeDelta(name, labels, value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case *metricspb.Metric_Histogram:
+		points := data.Histogram.GetDataPoints()
+		temporality := data.Histogram.GetAggregationTemporality()
+		if temporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_UNSPECIFIED {
+			b.reject(len(points), fmt.Sprintf("metric %s: unspecified aggregation temporality", name))
+			return nil
+		}
+		cumulative := temporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+		for _, dp := range points {
+			if noRecordedValue(dp.GetFlags()) {
+				continue
+			}
+			if err := b.histogram(name, labelsOf(resource, dp.GetAttributes()), dp, cumulative); err != nil {
+				return err
+			}
+		}
+	case *metricspb.Metric_ExponentialHistogram:
+		b.reject(len(data.ExponentialHistogram.GetDataPoints()), fmt.Sprintf("metric %s: exponential histogram is not supported", name))
+	case *metricspb.Metric_Summary:
+		b.reject(len(data.Summary.GetDataPoints()), fmt.Sprintf("metric %s: summary is not supported", name))
+	}
+	return nil
+}
+
+// dataPoints возвращает количество точек метрики.
+func dataPoints(m *metricspb.Metric) int {
+	switch data := m.GetData().(type) {
+	case *metricspb.Metric_Gauge:
+		return len(data.Gauge.GetDataPoints())
+	case *metricspb.Metric_Sum:
+		return len(data.Sum.GetDataPoints())
+	case *metricspb.Metric_Histogram:
+		return len(data.Histogram.GetDataPoints())
+	case *metricspb.Metric_ExponentialHistogram:
+		return len(data.ExponentialHistogram.GetDataPoints())
+	case *metricspb.Metric_Summary:
+		return len(data.Summary.GetDataPoints())
+	}
+	return 0
+}
+
+// reject учитывает отклоненные точки.
+func (b *otlpBatch) reject(points int, reason string) {
+	if points == 0 {
+		return
+	}
+	b.rejected += int64(points)
+	if b.reason == "" {
+		b.reason = reason
+	}
+}
+
+func (b *otlpBatch) gauge(name string, labels map[string]string, value float64) {
+	b.gauges[streamKey(b.tenant, "gauge", name, labels)] = value
+	b.metrics = append(b.metrics, models.Metrics{ID: name, MType: "gauge", Value: &value, Labels: labels})
+}
+
+// gaugeDelta добавляет приращение немонотонной Sum к текущему значению gauge.
+func (b *otlpBatch) gaugeDelta(name string, labels map[string]string, delta float64) error {
+	key := streamKey(b.tenant, "gauge", name, labels)
+	current, ok := b.gauges[key]
+	if !ok {
+		metric := models.Metrics{ID: name, MType: "gauge", Labels: labels}
+		exists, err := seriesExists(b.ctx, b.h.storage, b.h.retryer, metric)
+		if err != nil {
+			return err
+		}
+		if exists {
+			err = b.h.retryer.Retry(func() error {
+				return b.h.storage.GetJSON(b.ctx, &metric)
+			})
+			if err != nil {
+				return err
+			}
+			current = *metric.Value
+		}
+	}
+	b.gauge(name, labels, current+delta)
+	return nil
+}
+
+// counter добавляет приращение монотонной Sum. Приращения delta-рядов тоже накапливаются в состоянии,
+// чтобы дробные части не терялись при округлении до целого counter.
+func (b *otlpBatch) counter(name string, labels map[string]string, start uint64, value float64, cumulative bool) error {
+	key := streamKey(b.tenant, "counter", name, labels)
+	stream, seen := b.streams.get(key)
+	if !cumulative {
+		next := stream.value + value
+		b.appendCounter(name, labels, counterDelta(stream.value, next))
+		b.streams.set(key, cumulativeStream{value: next})
+		return nil
+	}
+
+	if !seen {
+		// Ряд, уже существующий в хранилище, начинается с первого значения, без его записи
+		exists, err := seriesExists(b.ctx, b.h.storage, b.h.retryer, models.Metrics{ID: name, MType: "counter", Labels: labels})
+		if err != nil {
+			return err
+		}
+		if exists {
+			b.streams.set(key, cumulativeStream{start: start, value: value})
+			return nil
+		}
+	} else if stream.start != start {
+		stream.value = 0
+	}
+	b.appendCounter(name, labels, counterDelta(stream.value, value))
+	b.streams.set(key, cumulativeStream{start: start, value: value})
+	return nil
+}
+
+func (b *otlpBatch) appendCounter(name string, labels map[string]string, delta int64) {
+	b.metrics = append(b.metrics, models.Metrics{ID: name, MType: "counter", Delta: &delta, Labels: labels})
+}
+
+// histogram добавляет приращение бакетов histogram.
+func (b *otlpBatch) histogram(name string, labels map[string]string, dp *metricspb.HistogramDataPoint, cumulative bool) error {
+	bounds, counts := dp.GetExplicitBounds(), dp.GetBucketCounts()
+	if len(bounds) == 0 || len(counts) != len(bounds)+1 || !increasing(bounds) {
+		b.reject(1, fmt.Sprintf("metric %s: histogram needs increasing explicit bounds and a count for each bucket", name))
+		return nil
+	}
+	if math.IsNaN(dp.GetSum()) || math.IsInf(dp.GetSum(), 0) {
+		b.reject(1, fmt.Sprintf("metric %s: histogram sum must be finite", name))
+		return nil
+	}
+
+	prevCounts, prevSum := make([]uint64, len(counts)), 0.0
+	if cumulative {
+		key := streamKey(b.tenant, "histogram", name, labels)
+		stream, seen := b.streams.get(key)
+		next := cumulativeStream{start: dp.GetStartTimeUnixNano(), counts: counts, sum: dp.GetSum()}
+		if !seen {
+			exists, err := seriesExists(b.ctx, b.h.storage, b.h.retryer, models.Metrics{ID: name, MType: "histogram", Labels: labels})
+			if err != nil {
+				return err
+			}
+			if exists {
+				b.streams.set(key, next)
+				return nil
+			}
+		} else if stream.start == next.start && !histogramReset(stream.counts, counts) {
+			prevCounts, prevSum = stream.counts, stream.sum
+		}
+		b.streams.set(key, next)
+	}
+
+	histogram := &models.Histogram{Bounds: bounds, Counts: make([]int64, len(counts)), Sum: dp.GetSum() - prevSum}
+	for i, count := range counts {
+		histogram.Counts[i] = int64(count - prevCounts[i])
+	}
+	b.metrics = append(b.metrics, models.Metrics{ID: name, MType: "histogram", Histogram: histogram, Labels: labels})
+	return nil
+}
+
+// histogramReset проверяет, что накопленные бакеты histogram сброшены: их число изменилось или значение уменьшилось.
+func histogramReset(prev, counts []uint64) bool {
+	if len(prev) != len(counts) {
+		return true
+	}
+	for i := range counts {
+		if counts[i] < prev[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// increasing проверяет, что границы бакетов конечны и строго возрастают.
+func increasing(bounds []float64) bool {
+	for i, bound := range bounds {
+		if math.IsNaN(bound) || math.IsInf(bound, 0) || (i > 0 && bound <= bounds[i-1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// numberValue возвращает значение точки. false - точка без значения.
+func numberValue(dp *metricspb.NumberDataPoint) (float64, bool) {
+	if noRecordedValue(dp.GetFlags()) {
+		return 0, false
+	}
+	var value float64
+	switch v := dp.GetValue().(type) {
+	case *metricspb.NumberDataPoint_AsDouble:
+		value = v.AsDouble
+	case *metricspb.NumberDataPoint_AsInt:
+		value = float64(v.AsInt)
+	default:
+		return 0, false
+	}
+	return value, !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+func noRecordedValue(flags uint32) bool {
+	return flags&uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK) != 0
+}
+
+// labelsOf объединяет метки ресурса и атрибуты точки.
+func labelsOf(resource map[string]string, attributes []*commonpb.KeyValue) map[string]string {
+	if len(resource) == 0 && len(attributes) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(resource)+len(attributes))
+	for key, value := range resource {
+		labels[key] = value
+	}
+	for _, attr := range attributes {
+		if attr.GetKey() != "" {
+			labels[attr.GetKey()] = attributeValue(attr.GetValue())
+		}
+	}
+	return labels
+}
+
+// attributeValue возвращает значение атрибута строкой. Массивы и вложенные атрибуты записываются в JSON.
+func attributeValue(value *commonpb.AnyValue) string {
+	switch v := value.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(v.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(v.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(v.DoubleValue, 'f', -1, 64)
+	case *commonpb.AnyValue_BytesValue:
+		return hex.EncodeToString(v.BytesValue)
+	case nil:
+		return ""
+	default:
+		data, _ := protojson.Marshal(value)
+		return string(data)
+	}
+}
+
+// otlpResponse отвечает ExportMetricsServiceResponse, с partial success, если часть точек отклонена.
+func otlpResponse(ctx *gin.Context, mediaType string, rejected int64, reason string) {
+	if mediaType == otlpJSON {
+		if rejected == 0 {
+			ctx.JSON(http.StatusOK, gin.H{})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"partialSuccess": gin.H{
+			"rejectedDataPoints": strconv.FormatInt(rejected, 10),
+			"errorMessage":       reason,
+		}})
+		return
+	}
+
+	var body []byte
+	if rejected > 0 {
+		var partial []byte
+		partial = protowire.AppendTag(partial, 1, protowire.VarintType)
+		partial = protowire.AppendVarint(partial, uint64(rejected))
+		partial = protowire.AppendTag(partial, 2, protowire.BytesType)
+		partial = protowire.AppendString(partial, reason)
+		body = protowire.AppendTag(body, 1, protowire.BytesType)
+		body = protowire.AppendBytes(body, partial)
+	}
+	ctx.Data(http.StatusOK, otlpProtobuf, body)
+}
+
+// otlpStatus отвечает ошибкой с телом google.rpc.Status.
+func otlpStatus(ctx *gin.Context, mediaType string, status int, message string) {
+	code := rpcInvalidArgument
+	switch status {
+	case http.StatusForbidden:
+		code = rpcPermissionDenied
+	case http.StatusServiceUnavailable:
+		code = rpcUnavailable
+	case http.StatusInternalServerError:
+		code = rpcInternal
+	}
+
+	if mediaType == otlpJSON {
+		ctx.JSON(status, gin.H{"code": code, "message": message})
+		return
+	}
+	var body []byte
+	body = protowire.AppendTag(body, 1, protowire.VarintType)
+	body = protowire.AppendVarint(body, uint64(code))
+	body = protowire.AppendTag(body, 2, protowire.BytesType)
+	body = protowire.AppendString(body, message)
+	ctx.Data(status, otlpProtobuf, body)
+}
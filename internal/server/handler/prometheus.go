@@ -0,0 +1,269 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/llaxzi/retryables/v2"
+
+	"github.com/gin-gonic/gin"
+
+	"metrics-service/internal/server/models"
+	"metrics-service/internal/server/storage"
+)
+
+// prometheusContentType - content type текстового формата экспозиции Prometheus.
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// IPrometheusHandler определяет интерфейс для отдачи метрик в формате Prometheus.
+type IPrometheusHandler interface {
+	Get(ctx *gin.Context)
+}
+
+// NewPrometheusHandler создает новый экземпляр IPrometheusHandler
+func NewPrometheusHandler(storage storage.Storage, retryer *retryables.Retryer) IPrometheusHandler {
+	return &PrometheusHandler{storage, retryer}
+}
+
+// PrometheusHandler реализует интерфейс IPrometheusHandler и отдает все метрики хранилища
+// в текстовом формате экспозиции Prometheus.
+type PrometheusHandler struct {
+	storage storage.Storage
+	retryer *retryables.Retryer
+}
+
+// Get возвращает все метрики в текстовом формате экспозиции Prometheus.
+func (h *PrometheusHandler) Get(ctx *gin.Context) {
+	var metrics []models.Metrics
+	err := h.retryer.Retry(func() error {
+		var err error
+		metrics, err = h.storage.GetMetricsJSON(ctx)
+		return err
+	})
+	if err != nil {
+		ctx.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx.Data(http.StatusOK, prometheusContentType, []byte(renderPrometheus(metrics)))
+}
+
+// promFamily - семейство метрик Prometheus: одно имя, один тип, набор строк с сэмплами.
+// Для histogram одна "строка" содержит все сэмплы серии: бакеты, _sum и _count.
+type promFamily struct {
+	name  string
+	mType string
+	lines []string
+}
+
+// renderPrometheus формирует текстовое представление метрик в формате экспозиции Prometheus.
+//
+// Имена метрик и меток приводятся к допустимому виду. Prometheus отклоняет экспозицию целиком, если в ней
+// повторяются серии или имена меток, поэтому после приведения пропускаются: метрики, имя которых совпадает
+// с семейством другого типа или с сэмплами histogram (name_bucket, name_sum, name_count); повторные серии
+// с тем же именем и метками; серии с совпадающими именами меток и histogram с собственной меткой le.
+func renderPrometheus(metrics []models.Metrics) string {
+	// Порядок метрик из хранилища не определен, сортируем, чтобы разрешение конфликтов было стабильным
+	sort.SliceStable(metrics, func(i, j int) bool {
+		if metrics[i].ID != metrics[j].ID {
+			return metrics[i].ID < metrics[j].ID
+		}
+		return metrics[i].MType < metrics[j].MType
+	})
+
+	families := make(map[string]*promFamily)
+	// owners - семейство, которому принадлежит имя сэмплов, seen - уже выведенные серии
+	owners := make(map[string]string)
+	seen := make(map[string]bool)
+
+	for _, metric := range metrics {
+		var line string
+		name := sanitizePromName(metric.ID)
+		var reserved []string
+		if metric.MType == "histogram" {
+			reserved = []string{"le"}
+		}
+		pairs, err := promLabelPairs(metric.Labels, reserved...)
+		if err != nil {
+			log.Printf("prometheus: skip %s %q: %v", metric.MType, metric.ID, err)
+			continue
+		}
+		series := name + formatPromLabels(pairs)
+
+		switch metric.MType {
+		case "gauge":
+			if metric.Value == nil {
+				continue
+			}
+			line = series + " " + formatPromFloat(*metric.Value)
+		case "counter":
+			if metric.Delta == nil {
+				continue
+			}
+			line = series + " " + strconv.FormatInt(*metric.Delta, 10)
+		case "histogram":
+			if metric.Histogram == nil {
+				continue
+			}
+			line = formatPromHistogram(name, pairs, metric.Histogram)
+		default:
+			continue
+		}
+
+		family, exists := families[name]
+		if !exists {
+			if owner := promNameOwner(owners, name, metric.MType); owner != "" {
+				log.Printf("prometheus: skip %s %q, name %q conflicts with %s %q", metric.MType, metric.ID, name, families[owner].mType, owner)
+				continue
+			}
+			family = &promFamily{name: name, mType: metric.MType}
+			families[name] = family
+			for _, sample := range promSampleNames(name, metric.MType) {
+				owners[sample] = name
+			}
+		}
+		if family.mType != metric.MType {
+			log.Printf("prometheus: skip %s %q, name conflicts with %s %q", metric.MType, metric.ID, family.mType, name)
+			continue
+		}
+		if seen[series] {
+			log.Printf("prometheus: skip %s %q, series %s is already exposed", metric.MType, metric.ID, series)
+			continue
+		}
+		seen[series] = true
+		family.lines = append(family.lines, line)
+	}
+
+	// Сортируем семейства и серии внутри них, чтобы вывод был детерминированным
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		family := families[name]
+		sort.Strings(family.lines)
+
+		sb.WriteString("# TYPE " + family.name + " " + family.mType + "\n")
+		for _, line := range family.lines {
+			sb.WriteString(line + "\n")
+		}
+	}
+	return sb.String()
+}
+
+// promSampleNames возвращает имена сэмплов семейства: histogram занимает также имена name_bucket, name_sum и name_count.
+func promSampleNames(name, mType string) []string {
+	if mType == "histogram" {
+		return []string{name, name + "_bucket", name + "_sum", name + "_count"}
+	}
+	return []string{name}
+}
+
+// promNameOwner возвращает другое семейство, которому уже принадлежит одно из имен сэмплов нового семейства name.
+func promNameOwner(owners map[string]string, name, mType string) string {
+	for _, sample := range promSampleNames(name, mType) {
+		if owner, taken := owners[sample]; taken {
+			return owner
+		}
+	}
+	return ""
+}
+
+// sanitizePromName приводит имя метрики к виду [a-zA-Z_:][a-zA-Z0-9_:]*,
+// заменяя недопустимые символы на "_".
+func sanitizePromName(name string) string {
+	if name == "" {
+		return "_"
+	}
+	var sb strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			sb.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				sb.WriteRune('_')
+			}
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('_')
+		}
+	}
+	return sb.String()
+}
+
+// formatPromHistogram форматирует серию histogram: накопительные бакеты name_bucket с меткой le,
+// name_sum и name_count. Сэмплы разделены переводом строки, последний без него.
+func formatPromHistogram(name string, labels []string, h *models.Histogram) string {
+	lines := make([]string, 0, len(h.Counts)+2)
+
+	var cumulative int64
+	for i, count := range h.Counts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(h.Bounds) {
+			le = formatPromFloat(h.Bounds[i])
+		}
+		lines = append(lines, name+"_bucket"+formatPromLabels(labels, "le", le)+" "+strconv.FormatInt(cumulative, 10))
+	}
+	lines = append(lines, name+"_sum"+formatPromLabels(labels)+" "+formatPromFloat(h.Sum))
+	lines = append(lines, name+"_count"+formatPromLabels(labels)+" "+strconv.FormatInt(h.Count, 10))
+
+	return strings.Join(lines, "\n")
+}
+
+// promLabelPairs возвращает отсортированные метки серии в виде key="value".
+// Имена меток приводятся к виду [a-zA-Z_][a-zA-Z0-9_]*, значения экранируются. Возвращает ошибку,
+// если имена меток совпадают после приведения или совпадают с зарезервированными reserved.
+func promLabelPairs(labels map[string]string, reserved ...string) ([]string, error) {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	names := make(map[string]string, len(labels))
+	pairs := make([]string, 0, len(labels))
+	for _, key := range keys {
+		name := strings.ReplaceAll(sanitizePromName(key), ":", "_")
+		if slices.Contains(reserved, name) {
+			return nil, fmt.Errorf("label %q is reserved", key)
+		}
+		if other, exists := names[name]; exists {
+			return nil, fmt.Errorf("labels %q and %q are both exposed as %s", other, key, name)
+		}
+		names[name] = key
+		pairs = append(pairs, name+`="`+promLabelEscaper.Replace(labels[key])+`"`)
+	}
+	sort.Strings(pairs)
+	return pairs, nil
+}
+
+// formatPromLabels форматирует метки серии из promLabelPairs в виде {key="value",...}.
+// extra - дополнительные пары ключ-значение (например, le для бакетов histogram), добавляются в конец.
+func formatPromLabels(pairs []string, extra ...string) string {
+	if len(pairs) == 0 && len(extra) == 0 {
+		return ""
+	}
+	all := append(make([]string, 0, len(pairs)+len(extra)/2), pairs...)
+	for i := 0; i+1 < len(extra); i += 2 {
+		all = append(all, extra[i]+`="`+promLabelEscaper.Replace(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(all, ",") + "}"
+}
+
+// promLabelEscaper экранирует значения меток согласно текстовому формату экспозиции.
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatPromFloat форматирует значение gauge, включая NaN и ±Inf, в понятном Prometheus виде.
+func formatPromFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,260 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/llaxzi/retryables/v2"
+
+	"github.com/gin-gonic/gin"
+
+	"metrics-service/internal/server/models"
+	"metrics-service/internal/server/remotewrite"
+	"metrics-service/internal/server/storage"
+	"metrics-service/internal/tenant"
+)
+
+const (
+	// maxRemoteWriteBody - максимальный размер сжатого тела запроса remote write.
+	maxRemoteWriteBody = 8 << 20
+	// maxRemoteWriteDecoded - максимальный размер запроса remote write после распаковки.
+	maxRemoteWriteDecoded = 64 << 20
+	// maxRemoteWriteTypes - максимальное количество запомненных типов семейств метрик.
+	// При переполнении типы сбрасываются.
+	maxRemoteWriteTypes = 100000
+)
+
+// IRemoteWriteHandler определяет интерфейс для приема метрик Prometheus remote write.
+type IRemoteWriteHandler interface {
+	Write(ctx *gin.Context)
+}
+
+// NewRemoteWriteHandler создает новый экземпляр IRemoteWriteHandler
+func NewRemoteWriteHandler(storage storage.Storage, retryer *retryables.Retryer, isSync bool) IRemoteWriteHandler {
+	return &RemoteWriteHandler{
+		storage:  storage,
+		retryer:  retryer,
+		isSync:   isSync,
+		types:    make(map[string]remotewrite.MetricType),
+		counters: newCumulativeState(),
+	}
+}
+
+// RemoteWriteHandler реализует интерфейс IRemoteWriteHandler.
+//
+// Prometheus передает накопленные значения counter, а хранилище складывает приращения, поэтому обработчик
+// запоминает последнее значение каждого ряда counter и записывает разницу. Уменьшение значения считается сбросом
+// счетчика. Первое значение нового ряда записывается целиком, а для ряда, уже существующего в хранилище
+// (например, после перезапуска сервера), только запоминается, чтобы не учесть его повторно.
+type RemoteWriteHandler struct {
+	storage storage.Storage
+	retryer *retryables.Retryer
+	isSync  bool
+
+	mu sync.Mutex
+	// types - типы семейств метрик из метаданных по арендатору и имени семейства.
+	types map[string]remotewrite.MetricType
+	// counters - последние значения рядов counter.
+	counters *cumulativeState
+}
+
+// remoteSeries - ряд запроса remote write, преобразованный в метрику хранилища.
+type remoteSeries struct {
+	name   string
+	labels map[string]string
+	// values - значения сэмплов в порядке времени без устаревших (NaN) и бесконечных.
+	values []float64
+}
+
+// Write принимает метрики Prometheus remote write 1.0.
+//
+// Тип метрики берется из метаданных семейства, переданных в этом или одном из прошлых запросов, иначе
+// определяется по имени: суффиксы _total и _bucket - counter, остальные - gauge. Для gauge записывается последнее
+// значение ряда. Коды ответа соответствуют ожиданиям Prometheus: 204 (No Content) при успехе,
+// 400 (Bad Request), 413 и 415 для запросов, которые нельзя повторять, 500 (Internal Server Error) при ошибке
+// хранилища - Prometheus повторит запрос.
+func (h *RemoteWriteHandler) Write(ctx *gin.Context) {
+	if encoding := ctx.GetHeader("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "snappy") {
+		ctx.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "unsupported content encoding, expected snappy"})
+		return
+	}
+	if !remoteWriteContentType(ctx.GetHeader("Content-Type")) {
+		ctx.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "unsupported content type, expected remote write 1.0 protobuf"})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(ctx.Request.Body, maxRemoteWriteBody+1))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(body) > maxRemoteWriteBody {
+		ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body is too large"})
+		return
+	}
+	req, err := remotewrite.Decode(body, maxRemoteWriteDecoded)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := tenant.FromContext(ctx)
+	h.learnTypes(name, req.Metadata)
+
+	series := make([]remoteSeries, 0, len(req.Series))
+	for _, ts := range req.Series {
+		s, err := newRemoteSeries(ts)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(s.values) > 0 {
+			series = append(series, s)
+		}
+	}
+
+	counters := h.counters.batch()
+	metrics, err := h.metrics(ctx, name, series, counters)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(metrics) > 0 {
+		err = h.retryer.Retry(func() error {
+			return h.storage.UpdateBatch(ctx, metrics)
+		})
+		if err != nil {
+			ctx.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		counters.commit()
+
+		// Сохраняем на диск при синхронном режиме
+		if h.isSync {
+			err = h.storage.Save()
+			if err != nil {
+				ctx.String(http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// learnTypes запоминает типы семейств метрик из метаданных запроса.
+func (h *RemoteWriteHandler) learnTypes(name string, metadata []remotewrite.Metadata) {
+	if len(metadata) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, m := range metadata {
+		if len(h.types) >= maxRemoteWriteTypes {
+			h.types = make(map[string]remotewrite.MetricType)
+		}
+		h.types[name+"\x00"+m.Family] = m.Type
+	}
+}
+
+// isCounter определяет тип ряда по метаданным семейства или по имени.
+func (h *RemoteWriteHandler) isCounter(name, metricName string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if metricType, ok := h.types[name+"\x00"+metricName]; ok {
+		return metricType == remotewrite.TypeCounter
+	}
+	// Составные ряды histogram и summary
+	for _, suffix := range []string{"_bucket", "_count", "_sum"} {
+		family, ok := strings.CutSuffix(metricName, suffix)
+		if !ok {
+			continue
+		}
+		if metricType, ok := h.types[name+"\x00"+family]; ok {
+			return metricType == remotewrite.TypeHistogram || metricType == remotewrite.TypeSummary
+		}
+	}
+	return strings.HasSuffix(metricName, "_total") || strings.HasSuffix(metricName, "_bucket")
+}
+
+// metrics преобразует ряды в метрики хранилища. Новые значения рядов counter запоминаются в counters.
+func (h *RemoteWriteHandler) metrics(ctx *gin.Context, name string, series []remoteSeries, counters *cumulativeBatch) ([]models.Metrics, error) {
+	metrics := make([]models.Metrics, 0, len(series))
+	for _, s := range series {
+		if !h.isCounter(name, s.name) {
+			value := s.values[len(s.values)-1]
+			metrics = append(metrics, models.Metrics{ID: s.name, MType: "gauge", Value: &value, Labels: s.labels})
+			continue
+		}
+
+		key := streamKey(name, "counter", s.name, s.labels)
+		stream, seen := counters.get(key)
+		last, values := stream.value, s.values
+		if !seen {
+			// Ряд, уже существующий в хранилище, начинается с первого значения, без его записи
+			exists, err := seriesExists(ctx, h.storage, h.retryer, models.Metrics{ID: s.name, MType: "counter", Labels: s.labels})
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				last, values = values[0], values[1:]
+			}
+		}
+
+		var delta int64
+		for _, value := range values {
+			delta += counterDelta(last, value)
+			last = value
+		}
+		counters.set(key, cumulativeStream{value: last})
+
+		metrics = append(metrics, models.Metrics{ID: s.name, MType: "counter", Delta: &delta, Labels: s.labels})
+	}
+	return metrics, nil
+}
+
+// newRemoteSeries извлекает из ряда имя, метки и значения.
+func newRemoteSeries(ts remotewrite.TimeSeries) (remoteSeries, error) {
+	s := remoteSeries{}
+	for _, label := range ts.Labels {
+		if label.Name == remotewrite.NameLabel {
+			s.name = label.Value
+			continue
+		}
+		if label.Name == "" {
+			return remoteSeries{}, errors.New("empty label name")
+		}
+		if s.labels == nil {
+			s.labels = make(map[string]string, len(ts.Labels))
+		}
+		s.labels[label.Name] = label.Value
+	}
+	if s.name == "" {
+		return remoteSeries{}, errors.New("series without " + remotewrite.NameLabel + " label")
+	}
+
+	for _, sample := range ts.Samples {
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+		s.values = append(s.values, sample.Value)
+	}
+	return s, nil
+}
+
+// remoteWriteContentType проверяет, что тело - WriteRequest remote write 1.0. Пустой тип допускается.
+func remoteWriteContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/x-protobuf" {
+		return false
+	}
+	proto, ok := params["proto"]
+	return !ok || proto == "prometheus.WriteRequest"
+}
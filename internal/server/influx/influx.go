@@ -0,0 +1,215 @@
+// Package influx разбирает строки InfluxDB line protocol:
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+//
+// В имени измерения экранируются запятые и пробелы, в тегах и ключах полей - запятые, знаки равенства и пробелы.
+// Значения полей: числа с плавающей точкой (1.5), целые (1i), беззнаковые (1u), логические (t, false)
+// и строки в двойных кавычках.
+package influx
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldType - тип значения поля.
+type FieldType int
+
+// Типы значений полей.
+const (
+	FieldFloat FieldType = iota
+	FieldInteger
+	FieldUnsigned
+	FieldBoolean
+	FieldString
+)
+
+// Field - поле точки.
+type Field struct {
+	Key  string
+	Type FieldType
+	// Float - значение полей FieldFloat и FieldUnsigned, 1 или 0 для FieldBoolean.
+	Float float64
+	// Int - значение поля FieldInteger.
+	Int int64
+	// String - значение поля FieldString.
+	String string
+}
+
+// Point - разобранная строка line protocol.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      []Field
+	// Time - время точки, нулевое, если в строке его нет.
+	Time time.Time
+}
+
+// ParsePrecision разбирает точность времени точек из query-параметра precision: ns (по умолчанию), us, ms или s.
+func ParsePrecision(value string) (time.Duration, error) {
+	switch value {
+	case "", "ns", "n":
+		return time.Nanosecond, nil
+	case "us", "u":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	default:
+		return 0, fmt.Errorf("invalid precision %q, expected ns, us, ms or s", value)
+	}
+}
+
+// ParseLine разбирает строку line protocol. precision - единица времени точки.
+func ParseLine(line string, precision time.Duration) (Point, error) {
+	var p Point
+
+	measurement, i := scanToken(line, 0, ", ", measurementEscapes)
+	if measurement == "" {
+		return Point{}, errors.New("missing measurement")
+	}
+	p.Measurement = measurement
+
+	// Теги
+	for i < len(line) && line[i] == ',' {
+		var key, value string
+		key, i = scanToken(line, i+1, ",= ", keyEscapes)
+		if key == "" || i >= len(line) || line[i] != '=' {
+			return Point{}, errors.New("invalid tag: expected key=value")
+		}
+		value, i = scanToken(line, i+1, ", ", keyEscapes)
+		if value == "" {
+			return Point{}, fmt.Errorf("empty value of tag %q", key)
+		}
+		if p.Tags == nil {
+			p.Tags = make(map[string]string)
+		}
+		p.Tags[key] = value
+	}
+
+	// Поля
+	if i >= len(line) || line[i] != ' ' {
+		return Point{}, errors.New("missing fields")
+	}
+	for {
+		var key string
+		key, i = scanToken(line, i+1, ",= ", keyEscapes)
+		if key == "" || i >= len(line) || line[i] != '=' {
+			return Point{}, errors.New("invalid field: expected key=value")
+		}
+		var field Field
+		var err error
+		field, i, err = scanField(line, i+1)
+		if err != nil {
+			return Point{}, fmt.Errorf("field %q: %w", key, err)
+		}
+		field.Key = key
+		p.Fields = append(p.Fields, field)
+		if i >= len(line) || line[i] != ',' {
+			break
+		}
+	}
+
+	// Время
+	if i < len(line) {
+		raw := strings.TrimSpace(line[i:])
+		if raw == "" {
+			return p, nil
+		}
+		ts, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return Point{}, fmt.Errorf("invalid timestamp %q", raw)
+		}
+		p.Time = time.Unix(0, 0).Add(time.Duration(ts) * precision)
+	}
+	return p, nil
+}
+
+// Символы, экранируемые обратной косой чертой.
+const (
+	measurementEscapes = ", "
+	keyEscapes         = ",= "
+)
+
+// scanToken читает из s начиная с i токен до первого неэкранированного символа из stops.
+// Обратная косая черта перед символом из escapes экранирует его, в остальных случаях остается в токене.
+// Возвращает токен без экранирования и позицию символа-разделителя (len(s), если его нет).
+func scanToken(s string, i int, stops, escapes string) (string, int) {
+	var b strings.Builder
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) && strings.IndexByte(escapes, s[i+1]) >= 0 {
+			i++
+			b.WriteByte(s[i])
+			continue
+		}
+		if strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), i
+}
+
+// scanField читает значение поля, начиная с позиции i, и возвращает позицию после него.
+func scanField(s string, i int) (Field, int, error) {
+	if i < len(s) && s[i] == '"' {
+		return scanString(s, i+1)
+	}
+
+	raw, next := scanToken(s, i, ", ", keyEscapes)
+	if raw == "" {
+		return Field{}, next, errors.New("missing value")
+	}
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return Field{Type: FieldBoolean, Float: 1}, next, nil
+	case "f", "F", "false", "False", "FALSE":
+		return Field{Type: FieldBoolean, Float: 0}, next, nil
+	}
+
+	switch raw[len(raw)-1] {
+	case 'i':
+		value, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return Field{}, next, fmt.Errorf("invalid integer %q", raw)
+		}
+		return Field{Type: FieldInteger, Int: value}, next, nil
+	case 'u':
+		value, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return Field{}, next, fmt.Errorf("invalid unsigned integer %q", raw)
+		}
+		return Field{Type: FieldUnsigned, Float: float64(value)}, next, nil
+	}
+
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return Field{}, next, fmt.Errorf("invalid float %q", raw)
+	}
+	return Field{Type: FieldFloat, Float: value}, next, nil
+}
+
+// scanString читает строковое значение поля после открывающей кавычки до закрывающей.
+// Внутри строки экранируются кавычки и обратная косая черта.
+func scanString(s string, i int) (Field, int, error) {
+	var b strings.Builder
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+			i++
+			b.WriteByte(s[i])
+			continue
+		}
+		if c == '"' {
+			return Field{Type: FieldString, String: b.String()}, i + 1, nil
+		}
+		b.WriteByte(c)
+	}
+	return Field{}, i, errors.New("unterminated string")
+}
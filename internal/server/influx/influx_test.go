@@ -0,0 +1,96 @@
+package influx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	testTable := []struct {
+		name      string
+		line      string
+		precision time.Duration
+		want      Point
+		wantErr   bool
+	}{
+		{
+			name: "Float field",
+			line: "cpu usage=0.5",
+			want: Point{Measurement: "cpu", Fields: []Field{{Key: "usage", Type: FieldFloat, Float: 0.5}}},
+		},
+		{
+			name: "Tags, typed fields and timestamp",
+			line: `disk,host=a,path=/ used=10i,free=5u,ok=t,label="x y" 1700000000000000000`,
+			want: Point{
+				Measurement: "disk",
+				Tags:        map[string]string{"host": "a", "path": "/"},
+				Fields: []Field{
+					{Key: "used", Type: FieldInteger, Int: 10},
+					{Key: "free", Type: FieldUnsigned, Float: 5},
+					{Key: "ok", Type: FieldBoolean, Float: 1},
+					{Key: "label", Type: FieldString, String: "x y"},
+				},
+				Time: time.Unix(1700000000, 0),
+			},
+		},
+		{
+			name:      "Precision",
+			line:      "cpu usage=1 1700000000",
+			precision: time.Second,
+			want:      Point{Measurement: "cpu", Fields: []Field{{Key: "usage", Type: FieldFloat, Float: 1}}, Time: time.Unix(1700000000, 0)},
+		},
+		{
+			name: "Escapes",
+			line: `my\ cpu,ho\,st=a\=b us\ er=1,msg="say \"hi\""`,
+			want: Point{
+				Measurement: "my cpu",
+				Tags:        map[string]string{"ho,st": "a=b"},
+				Fields:      []Field{{Key: "us er", Type: FieldFloat, Float: 1}, {Key: "msg", Type: FieldString, String: `say "hi"`}},
+			},
+		},
+		{name: "Missing fields", line: "cpu", wantErr: true},
+		{name: "Missing fields after tags", line: "cpu,host=a", wantErr: true},
+		{name: "Empty tag value", line: "cpu,host= usage=1", wantErr: true},
+		{name: "Missing field value", line: "cpu usage=", wantErr: true},
+		{name: "Invalid integer", line: "cpu usage=1.5i", wantErr: true},
+		{name: "NaN", line: "cpu usage=NaN", wantErr: true},
+		{name: "Unterminated string", line: `cpu msg="abc`, wantErr: true},
+		{name: "Invalid timestamp", line: "cpu usage=1 now", wantErr: true},
+		{name: "Missing measurement", line: ",host=a usage=1", wantErr: true},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			precision := test.precision
+			if precision == 0 {
+				precision = time.Nanosecond
+			}
+			point, err := ParseLine(test.line, precision)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want.Measurement, point.Measurement)
+			assert.Equal(t, test.want.Tags, point.Tags)
+			assert.Equal(t, test.want.Fields, point.Fields)
+			assert.True(t, test.want.Time.Equal(point.Time), "time %v, want %v", point.Time, test.want.Time)
+		})
+	}
+}
+
+func TestParsePrecision(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"": time.Nanosecond, "ns": time.Nanosecond, "us": time.Microsecond, "ms": time.Millisecond, "s": time.Second,
+	} {
+		got, err := ParsePrecision(value)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+
+	_, err := ParsePrecision("h")
+	assert.Error(t, err)
+}
@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"metrics-service/internal/auth"
+	apperrors "metrics-service/internal/server/errors"
+)
+
+// APIKeyHeader - заголовок с API-ключом, альтернатива "Authorization: Bearer <ключ>".
+const APIKeyHeader = "X-API-Key"
+
+// APIKeyNameKey - ключ gin.Context с именем API-ключа, которым аутентифицирован запрос.
+const APIKeyNameKey = "api_key"
+
+// APIKeyTenantKey - ключ gin.Context с арендатором, к которому привязан API-ключ запроса (см. WithTenant).
+const APIKeyTenantKey = "api_key_tenant"
+
+// WithAuth добавляет middleware, проверяющее API-ключ запроса и его право scope.
+//
+// Ключ передается в заголовке "Authorization: Bearer <ключ>" или APIKeyHeader. Без ключа или с неизвестным ключом
+// запрос отклоняется с 401 (Unauthorized), с ключом без права scope - с 403 (Forbidden).
+// Пока набор ключей не задан (см. SetAPIKeys), запросы пропускаются без проверки.
+func (m *Middleware) WithAuth(scope string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		keyring := m.getAPIKeys()
+		if keyring == nil {
+			ctx.Next()
+			return
+		}
+
+		key, ok := keyring.Authenticate(apiKey(ctx))
+		if !ok {
+			ctx.Header("WWW-Authenticate", `Bearer realm="metrics"`)
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": apperrors.ErrUnauthorized.Error()})
+			return
+		}
+		ctx.Set(APIKeyNameKey, key.Name)
+		ctx.Set(APIKeyTenantKey, key.Tenant)
+
+		if !key.HasScope(scope) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": apperrors.ErrForbidden.Error() + ": " + scope})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// SetAPIKeys меняет набор API-ключей для последующих запросов. nil отключает проверку,
+// пустой набор отклоняет все запросы.
+func (m *Middleware) SetAPIKeys(keyring *auth.Keyring) {
+	m.muAPIKeys.Lock()
+	defer m.muAPIKeys.Unlock()
+	m.apiKeys = keyring
+}
+
+func (m *Middleware) getAPIKeys() *auth.Keyring {
+	m.muAPIKeys.RLock()
+	defer m.muAPIKeys.RUnlock()
+	return m.apiKeys
+}
+
+// apiKey возвращает ключ из заголовка Authorization со схемой Bearer или из APIKeyHeader.
+func apiKey(ctx *gin.Context) string {
+	if scheme, token, ok := strings.Cut(ctx.GetHeader("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ctx.GetHeader(APIKeyHeader)
+}
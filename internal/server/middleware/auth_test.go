@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-service/internal/auth"
+)
+
+func TestMiddleware_WithAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	keyring, err := auth.NewKeyring([]auth.Key{
+		{Name: "agent-1", Hash: auth.Hash("write-token"), Scopes: []string{auth.ScopeWrite}},
+		{Name: "grafana", Hash: auth.Hash("read-token"), Scopes: []string{auth.ScopeRead}},
+	})
+	require.NoError(t, err)
+
+	m := NewMiddleware(nil)
+	r := gin.New()
+	r.POST("/update", m.WithAuth(auth.ScopeWrite), func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, ctx.GetString(APIKeyNameKey))
+	})
+
+	send := func(header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/update", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Без ключей проверка отключена
+	assert.Equal(t, http.StatusOK, send("", "").Code)
+
+	m.SetAPIKeys(keyring)
+	testTable := []struct {
+		name     string
+		header   string
+		value    string
+		wantCode int
+		wantBody string
+	}{
+		{"Bearer token", "Authorization", "Bearer write-token", http.StatusOK, "agent-1"},
+		{"API key header", APIKeyHeader, "write-token", http.StatusOK, "agent-1"},
+		{"Missing key", "", "", http.StatusUnauthorized, `{"error":"missing or invalid api key"}`},
+		{"Unknown key", "Authorization", "Bearer other-token", http.StatusUnauthorized, `{"error":"missing or invalid api key"}`},
+		{"Basic scheme", "Authorization", "Basic write-token", http.StatusUnauthorized, `{"error":"missing or invalid api key"}`},
+		{"Missing scope", "Authorization", "Bearer read-token", http.StatusForbidden, `{"error":"api key has no required scope: write"}`},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			w := send(test.header, test.value)
+			assert.Equal(t, test.wantCode, w.Code)
+			assert.Equal(t, test.wantBody, w.Body.String())
+			if test.wantCode == http.StatusUnauthorized {
+				assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	// Пустой набор ключей отклоняет все запросы
+	empty, err := auth.NewKeyring(nil)
+	require.NoError(t, err)
+	m.SetAPIKeys(empty)
+	assert.Equal(t, http.StatusUnauthorized, send("Authorization", "Bearer write-token").Code)
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"metrics-service/internal/encryption"
+	apperrors "metrics-service/internal/server/errors"
+)
+
+// maxEncryptedBody - максимальный размер зашифрованного тела запроса.
+const maxEncryptedBody = 32 << 20
+
+// WithDecryption добавляет middleware для расшифровки тел запросов закрытым ключом сервера.
+//
+// Зашифрованный запрос помечается заголовком encryption.Header. Middleware должно стоять раньше gzip и HMAC:
+// агент шифрует уже сжатое и подписанное тело. Расшифровка требует операций закрытым ключом, поэтому middleware
+// ставится на маршруты после проверок подсети и API-ключа. Запросы без заголовка пропускаются без изменений.
+// При privateKey == nil зашифрованные запросы отклоняются, тело больше maxEncryptedBody - с 413 (Request Entity Too Large).
+func (m *Middleware) WithDecryption(privateKey *rsa.PrivateKey) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		algorithm := ctx.GetHeader(encryption.Header)
+		if algorithm == "" {
+			ctx.Next()
+			return
+		}
+		if privateKey == nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "server is not configured to decrypt payloads"})
+			return
+		}
+		if algorithm != encryption.Algorithm {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unsupported payload encryption " + algorithm})
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxEncryptedBody))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			ctx.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body is too large"})
+			return
+		}
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": apperrors.ErrServer.Error()})
+			return
+		}
+
+		// Ошибка сообщает агенту, что тело зашифровано не тем ключом или повреждено
+		plaintext, err := encryption.Decrypt(privateKey, body)
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx.Request.Body = io.NopCloser(bytes.NewReader(plaintext))
+		ctx.Request.ContentLength = int64(len(plaintext))
+		ctx.Request.Header.Del(encryption.Header)
+		ctx.Next()
+	}
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-service/internal/encryption"
+)
+
+func TestMiddleware_WithDecryption(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	newRouter := func(privateKey *rsa.PrivateKey) *gin.Engine {
+		m := NewMiddleware(nil)
+		r := gin.New()
+		r.Use(m.WithDecryption(privateKey))
+		r.POST("/updates", func(ctx *gin.Context) {
+			body, _ := io.ReadAll(ctx.Request.Body)
+			ctx.String(http.StatusOK, string(body))
+		})
+		return r
+	}
+
+	plaintext := []byte("payload")
+	encrypted, err := encryption.Encrypt(&key.PublicKey, plaintext)
+	require.NoError(t, err)
+	foreign, err := encryption.Encrypt(&otherKey.PublicKey, plaintext)
+	require.NoError(t, err)
+
+	testTable := []struct {
+		name       string
+		privateKey *rsa.PrivateKey
+		algorithm  string
+		body       []byte
+		wantCode   int
+		wantBody   string
+	}{
+		{"Plain body", key, "", plaintext, http.StatusOK, "payload"},
+		{"Encrypted body", key, encryption.Algorithm, encrypted, http.StatusOK, "payload"},
+		{"Key mismatch", key, encryption.Algorithm, foreign, http.StatusBadRequest, encryption.ErrKeyMismatch.Error()},
+		{"Unknown algorithm", key, "rsa-pkcs1", encrypted, http.StatusBadRequest, "unsupported payload encryption"},
+		{"Server without key", nil, encryption.Algorithm, encrypted, http.StatusBadRequest, "not configured to decrypt"},
+		{"Too large", key, encryption.Algorithm, make([]byte, maxEncryptedBody+1), http.StatusRequestEntityTooLarge, "too large"},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewReader(test.body))
+			if test.algorithm != "" {
+				req.Header.Set(encryption.Header, test.algorithm)
+			}
+			w := httptest.NewRecorder()
+			newRouter(test.privateKey).ServeHTTP(w, req)
+			assert.Equal(t, test.wantCode, w.Code)
+			assert.Contains(t, w.Body.String(), test.wantBody)
+		})
+	}
+}
@@ -14,7 +14,7 @@ import (
 
 func TestMiddleware_WithGzip(t *testing.T) {
 	r := gin.Default()
-	m := NewMiddleware([]byte(""))
+	m := NewMiddleware(nil)
 
 	r.Use(m.WithGzip())
 
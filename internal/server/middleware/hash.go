@@ -2,68 +2,99 @@ package middleware
 
 import (
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
 
 	apperrors "metrics-service/internal/server/errors"
+	"metrics-service/internal/signature"
 )
 
-// responseWriter перехватывает тело ответа для последующего вычисления HMAC-хэша.
+// responseWriter задерживает тело ответа, чтобы заголовок с HMAC-хэшем был записан раньше тела.
 type responseWriter struct {
 	gin.ResponseWriter
 	body []byte
 }
 
-// Write сохраняет записываемые данные в body и передает их в оригинальный ResponseWriter.
+// Write сохраняет записываемые данные в body. В оригинальный ResponseWriter они передаются после подписи.
 func (rw *responseWriter) Write(p []byte) (n int, err error) {
 	rw.body = append(rw.body, p...)
-	return rw.ResponseWriter.Write(p)
+	return len(p), nil
 }
 
-// WithHMAC добавляет middleware для проверки HMAC-хэша запросов и формирования HMAC-хэша ответов.
+// WriteString сохраняет записываемую строку в body.
+func (rw *responseWriter) WriteString(s string) (n int, err error) {
+	return rw.Write([]byte(s))
+}
+
+// WithHMAC добавляет middleware для проверки подписи запросов и формирования HMAC-хэша ответов.
+//
+// Проверка включена, если задан хотя бы один ключ (см. SetHashKeys). Ключ выбирается по заголовку
+// signature.KeyIDHeader, без заголовка используется ключ по умолчанию. Подпись покрывает метод и URI запроса,
+// поэтому перехваченные заголовки нельзя использовать с другим путем. Запрос отклоняется с 400 (Bad Request),
+// если нет подписи, ключ неизвестен, время подписи отличается от времени сервера больше чем на maxSkew,
+// nonce уже встречался или подпись не совпадает. Подписи сравниваются за постоянное время.
 //
-// Если заголовок "HashSHA256" отсутствует, возвращается ошибка 400 (Bad Request).
-// Тело запроса проверяется на соответствие переданному хэшу. Если хэш не совпадает, запрос отклоняется.
-// После обработки запроса вычисляется HMAC-хэш ответа, и он добавляется в заголовок "HashSHA256".
-func (m *Middleware) WithHMAC() gin.HandlerFunc {
+// После обработки запроса вычисляется HMAC-хэш ответа тем же ключом, и он добавляется в заголовок signature.HashHeader.
+// Один обработчик следует использовать для всех подписанных маршрутов: кеш nonce у каждого обработчика свой.
+func (m *Middleware) WithHMAC(maxSkew time.Duration) gin.HandlerFunc {
+	// Nonce с временем подписи вне окна отклоняются по времени, поэтому дольше их хранить не нужно
+	nonces := newNonceCache(2 * maxSkew)
+
 	return func(ctx *gin.Context) {
-		if len(m.hashKey) < 1 {
+		// Ключи читаются один раз, чтобы запрос и ответ проверялись одним ключом при их замене
+		hashKeys := m.getHashKeys()
+		if len(hashKeys) < 1 {
 			ctx.Next()
 			return
 		}
 
-		hashHeader := ctx.GetHeader("HashSHA256")
+		hashHeader := ctx.GetHeader(signature.HashHeader)
 		if hashHeader == "" {
-			ctx.JSON(http.StatusBadRequest, gin.H{"error": apperrors.ErrHashHeaderMissing})
-			ctx.Abort()
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": apperrors.ErrHashHeaderMissing.Error()})
+			return
+		}
+
+		hashKey, ok := hashKeys[ctx.GetHeader(signature.KeyIDHeader)]
+		if !ok {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": apperrors.ErrHashKeyUnknown.Error()})
+			return
+		}
+
+		now := time.Now()
+		timestampHeader := ctx.GetHeader(signature.TimestampHeader)
+		timestamp, err := signature.ParseTimestamp(timestampHeader)
+		if err != nil || timestamp.Before(now.Add(-maxSkew)) || timestamp.After(now.Add(maxSkew)) {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": apperrors.ErrHashTimestamp.Error()})
+			return
+		}
+
+		nonce := ctx.GetHeader(signature.NonceHeader)
+		if nonce == "" || len(nonce) > signature.MaxNonceLen {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": apperrors.ErrHashNonceInvalid.Error()})
 			return
 		}
 
 		body, err := io.ReadAll(ctx.Request.Body)
 		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": apperrors.ErrServer})
-			ctx.Abort()
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": apperrors.ErrServer.Error()})
 			return
 		}
 
 		// Возвращаем тело запроса обратно в поток
 		ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
 
-		hashBody, err := m.generateHash(body)
-		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": apperrors.ErrServer})
-			ctx.Abort()
+		if !signature.Verify(hashKey, hashHeader, ctx.Request.Method, ctx.Request.RequestURI, timestampHeader, nonce, body) {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": apperrors.ErrHashHeaderInvalid.Error()})
 			return
 		}
 
-		if hashBody != hashHeader {
-			ctx.JSON(http.StatusBadRequest, gin.H{"error": apperrors.ErrHashHeaderInvalid})
-			ctx.Abort()
+		// Nonce запоминается только после проверки подписи, иначе чужие запросы могли бы заполнить кеш
+		if !nonces.add(ctx.GetHeader(signature.KeyIDHeader)+":"+nonce, now) {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": apperrors.ErrHashReplay.Error()})
 			return
 		}
 
@@ -73,21 +104,10 @@ func (m *Middleware) WithHMAC() gin.HandlerFunc {
 
 		ctx.Next()
 
-		hashResponse, err := m.generateHash(writer.body)
-		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": apperrors.ErrServer})
-			return
+		ctx.Writer = writer.ResponseWriter
+		ctx.Header(signature.HashHeader, signature.SignBody(hashKey, writer.body))
+		if _, err = ctx.Writer.Write(writer.body); err != nil {
+			m.Log.Error("failed to write signed response", zap.Error(err))
 		}
-
-		ctx.Header("HashSHA256", hashResponse)
-	}
-}
-
-func (m *Middleware) generateHash(src []byte) (string, error) {
-	h := hmac.New(sha256.New, m.hashKey)
-	_, err := h.Write(src)
-	if err != nil {
-		return "", err
 	}
-	return hex.EncodeToString(h.Sum(nil)), nil
 }
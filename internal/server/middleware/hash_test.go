@@ -2,38 +2,49 @@ package middleware
 
 import (
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"metrics-service/internal/signature"
 )
 
-func generateHMAC(data, key []byte) string {
-	h := hmac.New(sha256.New, key)
-	h.Write(data)
-	return hex.EncodeToString(h.Sum(nil))
+// signedRequest возвращает запрос с телом body, подписанный ключом key с идентификатором keyID.
+func signedRequest(body, key []byte, keyID string, signedAt time.Time, nonce string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/test", bytes.NewBuffer(body))
+	timestamp := signature.Timestamp(signedAt)
+	req.Header.Set(signature.TimestampHeader, timestamp)
+	req.Header.Set(signature.NonceHeader, nonce)
+	req.Header.Set(signature.HashHeader, signature.Sign(key, req.Method, req.RequestURI, timestamp, nonce, body))
+	if keyID != "" {
+		req.Header.Set(signature.KeyIDHeader, keyID)
+	}
+	return req
 }
 
-func BenchmarkWithHMAC(b *testing.B) {
+func newHMACRouter(m *Middleware) *gin.Engine {
 	gin.SetMode(gin.TestMode)
-	m := &Middleware{hashKey: []byte("secret-key")}
 	r := gin.New()
-	r.Use(m.WithHMAC())
+	r.Use(m.WithHMAC(time.Minute))
 	r.POST("/test", func(c *gin.Context) {
 		c.String(http.StatusOK, "Hello, World!")
 	})
+	return r
+}
 
+func BenchmarkWithHMAC(b *testing.B) {
+	key := []byte("secret-key")
+	r := newHMACRouter(&Middleware{hashKeys: map[string][]byte{"": key}})
 	body := []byte("test data")
-	hash := generateHMAC(body, m.hashKey)
 
 	b.Run("WithValidHMAC", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			req := httptest.NewRequest(http.MethodPost, "/test", bytes.NewBuffer(body))
-			req.Header.Set("HashSHA256", hash)
+			req := signedRequest(body, key, "", time.Now(), strconv.Itoa(i))
 
 			rec := httptest.NewRecorder()
 			r.ServeHTTP(rec, req)
@@ -42,11 +53,146 @@ func BenchmarkWithHMAC(b *testing.B) {
 
 	b.Run("WithInvalidHMAC", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			req := httptest.NewRequest(http.MethodPost, "/test", bytes.NewBuffer(body))
-			req.Header.Set("HashSHA256", "invalidhash")
+			req := signedRequest(body, key, "", time.Now(), strconv.Itoa(i))
+			req.Header.Set(signature.HashHeader, "invalidhash")
 
 			rec := httptest.NewRecorder()
 			r.ServeHTTP(rec, req)
 		}
 	})
 }
+
+func TestMiddleware_WithHMAC(t *testing.T) {
+	keys := map[string][]byte{"": []byte("default-key"), "k2": []byte("second-key")}
+	r := newHMACRouter(&Middleware{hashKeys: keys})
+	body := []byte("test data")
+	now := time.Now()
+
+	testTable := []struct {
+		name     string
+		req      func() *http.Request
+		wantCode int
+	}{
+		{"Default key", func() *http.Request {
+			return signedRequest(body, keys[""], "", now, "n1")
+		}, http.StatusOK},
+		{"Key by id", func() *http.Request {
+			return signedRequest(body, keys["k2"], "k2", now, "n2")
+		}, http.StatusOK},
+		{"Replayed nonce", func() *http.Request {
+			return signedRequest(body, keys[""], "", now, "n1")
+		}, http.StatusBadRequest},
+		{"Unknown key id", func() *http.Request {
+			return signedRequest(body, []byte("other-key"), "k3", now, "n3")
+		}, http.StatusBadRequest},
+		{"Wrong key", func() *http.Request {
+			return signedRequest(body, keys["k2"], "", now, "n4")
+		}, http.StatusBadRequest},
+		{"Stale timestamp", func() *http.Request {
+			return signedRequest(body, keys[""], "", now.Add(-2*time.Minute), "n5")
+		}, http.StatusBadRequest},
+		{"Future timestamp", func() *http.Request {
+			return signedRequest(body, keys[""], "", now.Add(2*time.Minute), "n6")
+		}, http.StatusBadRequest},
+		{"Tampered body", func() *http.Request {
+			req := signedRequest(body, keys[""], "", now, "n7")
+			req.Body = httptest.NewRequest(http.MethodPost, "/test", bytes.NewBufferString("other data")).Body
+			return req
+		}, http.StatusBadRequest},
+		{"Missing nonce", func() *http.Request {
+			req := signedRequest(body, keys[""], "", now, "n8")
+			req.Header.Del(signature.NonceHeader)
+			return req
+		}, http.StatusBadRequest},
+		{"Missing signature", func() *http.Request {
+			req := signedRequest(body, keys[""], "", now, "n9")
+			req.Header.Del(signature.HashHeader)
+			return req
+		}, http.StatusBadRequest},
+		// Отклоненный из-за неверной подписи запрос не занимает nonce
+		{"Nonce of rejected request", func() *http.Request {
+			return signedRequest(body, keys[""], "", now, "n4")
+		}, http.StatusOK},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, test.req())
+			assert.Equal(t, test.wantCode, rec.Code)
+			if test.wantCode == http.StatusOK {
+				assert.Equal(t, "Hello, World!", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestMiddleware_WithHMACResponse(t *testing.T) {
+	key := []byte("secret-key")
+	r := newHMACRouter(&Middleware{hashKeys: map[string][]byte{"": key}})
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, signedRequest([]byte("test data"), key, "", time.Now(), "n1"))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, signature.SignBody(key, []byte("Hello, World!")), rec.Header().Get(signature.HashHeader))
+
+	// Без ключей подпись не проверяется
+	r = newHMACRouter(&Middleware{})
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/test", bytes.NewBufferString("test data")))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get(signature.HashHeader))
+}
+
+func TestMiddleware_SetHashKeys(t *testing.T) {
+	m := &Middleware{hashKeys: map[string][]byte{"old": []byte("old-key")}}
+	r := newHMACRouter(m)
+
+	body := []byte("test data")
+	nonce := 0
+	send := func(keyID string, key []byte) int {
+		nonce++
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, signedRequest(body, key, keyID, time.Now(), strconv.Itoa(nonce)))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send("old", []byte("old-key")))
+	// Ротация: оба ключа действуют, пока агенты переходят на новый
+	m.SetHashKeys(map[string][]byte{"old": []byte("old-key"), "new": []byte("new-key")})
+	assert.Equal(t, http.StatusOK, send("old", []byte("old-key")))
+	assert.Equal(t, http.StatusOK, send("new", []byte("new-key")))
+	m.SetHashKeys(map[string][]byte{"new": []byte("new-key")})
+	assert.Equal(t, http.StatusBadRequest, send("old", []byte("old-key")))
+	assert.Equal(t, http.StatusOK, send("new", []byte("new-key")))
+}
+
+func TestMiddleware_WithHMACRewrittenPath(t *testing.T) {
+	key := []byte("secret-key")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/update/:metricType/:metricName/:metricVal", (&Middleware{hashKeys: map[string][]byte{"": key}}).WithHMAC(time.Minute), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	signed := func(target, nonce string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, target, nil)
+		timestamp := signature.Timestamp(time.Now())
+		req.Header.Set(signature.TimestampHeader, timestamp)
+		req.Header.Set(signature.NonceHeader, nonce)
+		req.Header.Set(signature.HashHeader, signature.Sign(key, req.Method, req.RequestURI, timestamp, nonce, nil))
+		return req
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, signed("/update/counter/requests/1", "n1"))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// Перехваченные заголовки с пустым телом не подходят к другой метрике или значению
+	intercepted := signed("/update/counter/requests/1", "n2")
+	rewritten := httptest.NewRequest(http.MethodPost, "/update/counter/requests/1000", nil)
+	rewritten.Header = intercepted.Header
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, rewritten)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// AgentIDKey - ключ gin.Context с идентификатором агента из клиентского сертификата.
+const AgentIDKey = "agent_id"
+
+// WithClientCert добавляет middleware, сопоставляющее клиентский сертификат mTLS идентификатору агента.
+//
+// Идентификатор - CommonName проверенного сертификата, он сохраняется в контексте под ключом AgentIDKey.
+// Без mTLS идентификатор не задается.
+func (m *Middleware) WithClientCert() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if state := ctx.Request.TLS; state != nil && len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+			if cn := state.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+				ctx.Set(AgentIDKey, cn)
+			}
+		}
+		ctx.Next()
+	}
+}
+
+// AgentID возвращает идентификатор агента, установленный WithClientCert, или пустую строку.
+func AgentID(ctx *gin.Context) string {
+	return ctx.GetString(AgentIDKey)
+}
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware_WithClientCert(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	m := NewMiddleware(nil)
+	r := gin.New()
+	r.Use(m.WithClientCert())
+	r.GET("/agent", func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, AgentID(ctx))
+	})
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "agent-1"}}
+	testTable := []struct {
+		name string
+		tls  *tls.ConnectionState
+		want string
+	}{
+		{"Plain HTTP", nil, ""},
+		{"TLS without client certificate", &tls.ConnectionState{}, ""},
+		{"Verified client certificate", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, "agent-1"},
+		// Непроверенный сертификат не дает идентичности
+		{"Unverified client certificate", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, ""},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/agent", nil)
+			req.TLS = test.tls
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			assert.Equal(t, test.want, w.Body.String())
+		})
+	}
+}
@@ -25,6 +25,21 @@ func (m *Middleware) InitializeZap(level string) error {
 	}
 
 	m.Log = zLogger
+	m.level = lvl
+	return nil
+}
+
+// SetLogLevel меняет уровень логирования. Логер, созданный InitializeZap, использует атомарный уровень,
+// поэтому новый уровень действует сразу для всех запросов. До InitializeZap создает логер.
+func (m *Middleware) SetLogLevel(level string) error {
+	if m.level == (zap.AtomicLevel{}) {
+		return m.InitializeZap(level)
+	}
+	lvl, err := zap.ParseAtomicLevel(level)
+	if err != nil {
+		return err
+	}
+	m.level.SetLevel(lvl.Level())
 	return nil
 }
 
@@ -42,11 +57,21 @@ func (m *Middleware) WithLogging() gin.HandlerFunc {
 
 		duration := time.Since(start)
 
-		m.Log.Info("got incoming HTTP request",
+		fields := []zap.Field{
 			zap.String("method", ctx.Request.Method),
 			zap.String("path", ctx.Request.URL.Path),
 			zap.String("duration", strconv.FormatFloat(duration.Seconds(), 'f', 3, 64)),
-		)
+		}
+		if agentID := AgentID(ctx); agentID != "" {
+			fields = append(fields, zap.String("agent", agentID))
+		}
+		if keyName := ctx.GetString(APIKeyNameKey); keyName != "" {
+			fields = append(fields, zap.String("api_key", keyName))
+		}
+		if tenantName := ctx.GetString(TenantKey); tenantName != "" {
+			fields = append(fields, zap.String("tenant", tenantName))
+		}
+		m.Log.Info("got incoming HTTP request", fields...)
 
 		m.Log.Info("sending HTTP response",
 			zap.String("status", strconv.Itoa(ctx.Writer.Status())),
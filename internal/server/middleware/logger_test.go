@@ -6,12 +6,15 @@ import (
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
 func BenchmarkWithLogging(b *testing.B) {
 	gin.SetMode(gin.TestMode)
 
-	m := NewMiddleware([]byte("some-secret"))
+	m := NewMiddleware(map[string][]byte{"": []byte("some-secret")})
 	_ = m.InitializeZap("debug")
 
 	loggingMiddleware := m.WithLogging()
@@ -28,3 +31,17 @@ func BenchmarkWithLogging(b *testing.B) {
 		router.ServeHTTP(w, req)
 	}
 }
+
+func TestMiddleware_SetLogLevel(t *testing.T) {
+	m := &Middleware{}
+	require.NoError(t, m.SetLogLevel("info"))
+	assert.False(t, m.Log.Core().Enabled(zap.DebugLevel))
+
+	// Новый уровень действует для уже созданного логера
+	log := m.Log
+	require.NoError(t, m.SetLogLevel("debug"))
+	assert.True(t, log.Core().Enabled(zap.DebugLevel))
+
+	assert.Error(t, m.SetLogLevel("verbose"))
+	assert.True(t, log.Core().Enabled(zap.DebugLevel))
+}
@@ -2,24 +2,64 @@
 package middleware
 
 import (
+	"crypto/rsa"
+	"net/netip"
+	"sync"
+	"time"
+
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
+
+	"metrics-service/internal/auth"
 )
 
 // IMiddleware определяет интерфейс для middleware сервиса.
 type IMiddleware interface {
 	WithLogging() gin.HandlerFunc
 	InitializeZap(level string) error
+	// SetLogLevel меняет уровень логирования без пересоздания логера.
+	SetLogLevel(level string) error
+	// SetHashKeys меняет ключи HMAC для последующих запросов.
+	SetHashKeys(hashKeys map[string][]byte)
+	WithHMAC(maxSkew time.Duration) gin.HandlerFunc
 	WithGzip() gin.HandlerFunc
+	WithClientCert() gin.HandlerFunc
+	WithDecryption(privateKey *rsa.PrivateKey) gin.HandlerFunc
+	WithAuth(scope string) gin.HandlerFunc
+	WithTrustedSubnet(subnets, trustedProxies []netip.Prefix) gin.HandlerFunc
+	WithTenant() gin.HandlerFunc
+	// SetAPIKeys меняет набор API-ключей для последующих запросов.
+	SetAPIKeys(keyring *auth.Keyring)
 }
 
 // Middleware реализует интерфейс  IMiddleware.
 type Middleware struct {
-	Log     *zap.Logger // Log Синглтон.
-	hashKey []byte
+	Log   *zap.Logger // Log Синглтон.
+	level zap.AtomicLevel
+
+	muHashKeys sync.RWMutex
+	// hashKeys - действующие ключи HMAC по идентификаторам, "" - ключ по умолчанию.
+	hashKeys map[string][]byte
+
+	muAPIKeys sync.RWMutex
+	apiKeys   *auth.Keyring
+}
+
+// NewMiddleware создает новый экземпляр IMiddleware с ключами HMAC hashKeys (идентификатор -> ключ).
+// Пустой набор ключей отключает проверку подписи.
+func NewMiddleware(hashKeys map[string][]byte) IMiddleware {
+	return &Middleware{Log: zap.NewNop(), hashKeys: hashKeys}
+}
+
+// SetHashKeys меняет ключи HMAC. Запросы, уже прошедшие проверку, подписываются прежним ключом.
+func (m *Middleware) SetHashKeys(hashKeys map[string][]byte) {
+	m.muHashKeys.Lock()
+	defer m.muHashKeys.Unlock()
+	m.hashKeys = hashKeys
 }
 
-// NewMiddleware создает новый экземпляр IMiddleware
-func NewMiddleware(hashKey []byte) IMiddleware {
-	return &Middleware{zap.NewNop(), hashKey}
+func (m *Middleware) getHashKeys() map[string][]byte {
+	m.muHashKeys.RLock()
+	defer m.muHashKeys.RUnlock()
+	return m.hashKeys
 }
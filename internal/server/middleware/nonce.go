@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+)
+
+// nonceCache хранит nonce подписанных запросов, пока их время подписи попадает в допустимое окно.
+//
+// Nonce добавляются в порядке времени, поэтому устаревшие nonce удаляются с начала очереди.
+type nonceCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	seen  map[string]struct{}
+	queue []seenNonce
+}
+
+// seenNonce - nonce в очереди на удаление.
+type seenNonce struct {
+	nonce  string
+	seenAt time.Time
+}
+
+func newNonceCache(ttl time.Duration) *nonceCache {
+	return &nonceCache{ttl: ttl, seen: make(map[string]struct{})}
+}
+
+// add запоминает nonce и возвращает false, если он уже встречался.
+func (c *nonceCache) add(nonce string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(now)
+	if _, exists := c.seen[nonce]; exists {
+		return false
+	}
+	c.seen[nonce] = struct{}{}
+	c.queue = append(c.queue, seenNonce{nonce: nonce, seenAt: now})
+	return true
+}
+
+// expire удаляет nonce старше ttl.
+func (c *nonceCache) expire(now time.Time) {
+	deadline := now.Add(-c.ttl)
+	i := 0
+	for ; i < len(c.queue) && c.queue[i].seenAt.Before(deadline); i++ {
+		delete(c.seen, c.queue[i].nonce)
+	}
+	if i > 0 {
+		c.queue = append(c.queue[:0], c.queue[i:]...)
+	}
+}
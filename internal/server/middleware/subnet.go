@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	apperrors "metrics-service/internal/server/errors"
+)
+
+// RealIPHeader - заголовок с IP-адресом агента.
+const RealIPHeader = "X-Real-IP"
+
+// WithTrustedSubnet добавляет middleware, пропускающее запросы только с адресов из подсетей subnets.
+//
+// Без trustedProxies адрес клиента берется из заголовка RealIPHeader, который заполняет агент. Клиенты, не
+// передающие заголовок (Prometheus remote write, Telegraf, OpenTelemetry Collector), проверяются по адресу соединения.
+// С trustedProxies адрес клиента - адрес соединения; RealIPHeader учитывается, только если соединение
+// установлено с адреса доверенного прокси. Запросы с адресом вне subnets или без адреса отклоняются с 403 (Forbidden).
+// Пустой subnets отключает проверку.
+func (m *Middleware) WithTrustedSubnet(subnets, trustedProxies []netip.Prefix) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if len(subnets) == 0 {
+			ctx.Next()
+			return
+		}
+
+		addr, ok := clientAddr(ctx.Request, trustedProxies)
+		if !ok || !containsAddr(subnets, addr) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": apperrors.ErrUntrustedSubnet.Error()})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// clientAddr возвращает адрес клиента запроса r.
+func clientAddr(r *http.Request, trustedProxies []netip.Prefix) (netip.Addr, bool) {
+	peer, peerErr := netip.ParseAddrPort(r.RemoteAddr)
+	if len(trustedProxies) > 0 {
+		if peerErr != nil {
+			return netip.Addr{}, false
+		}
+		if !containsAddr(trustedProxies, peer.Addr().Unmap()) {
+			return peer.Addr().Unmap(), true
+		}
+	}
+
+	header := strings.TrimSpace(r.Header.Get(RealIPHeader))
+	if header == "" && len(trustedProxies) == 0 {
+		if peerErr != nil {
+			return netip.Addr{}, false
+		}
+		return peer.Addr().Unmap(), true
+	}
+	addr, err := netip.ParseAddr(header)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSubnets разбирает список подсетей CIDR через запятую. Адрес без маски - подсеть из одного адреса.
+func ParseSubnets(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid subnet %q", item)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q", item)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
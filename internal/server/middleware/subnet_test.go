@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware_WithTrustedSubnet(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	subnets, err := ParseSubnets("10.0.0.0/8, 192.168.1.5")
+	require.NoError(t, err)
+	proxies, err := ParseSubnets("172.16.0.0/12")
+	require.NoError(t, err)
+
+	m := NewMiddleware(nil)
+	newRouter := func(subnets, proxies []netip.Prefix) *gin.Engine {
+		r := gin.New()
+		r.POST("/updates/", m.WithTrustedSubnet(subnets, proxies), func(ctx *gin.Context) {
+			ctx.Status(http.StatusOK)
+		})
+		return r
+	}
+
+	testTable := []struct {
+		name       string
+		proxies    bool
+		remoteAddr string
+		realIP     string
+		wantCode   int
+	}{
+		{"Agent in subnet", false, "203.0.113.1:5000", "10.1.2.3", http.StatusOK},
+		{"Single address", false, "203.0.113.1:5000", "192.168.1.5", http.StatusOK},
+		{"Agent outside subnet", false, "10.1.2.3:5000", "192.168.1.6", http.StatusForbidden},
+		// Сторонние клиенты без X-Real-IP проверяются по адресу соединения
+		{"Missing X-Real-IP, peer in subnet", false, "10.1.2.3:5000", "", http.StatusOK},
+		{"Missing X-Real-IP, peer outside subnet", false, "203.0.113.1:5000", "", http.StatusForbidden},
+		{"Invalid X-Real-IP", false, "10.1.2.3:5000", "agent", http.StatusForbidden},
+		// С доверенными прокси заголовок агента не учитывается
+		{"Direct peer in subnet", true, "10.1.2.3:5000", "203.0.113.1", http.StatusOK},
+		{"Direct peer spoofing X-Real-IP", true, "203.0.113.1:5000", "10.1.2.3", http.StatusForbidden},
+		{"Proxy forwards agent in subnet", true, "172.16.0.10:5000", "10.1.2.3", http.StatusOK},
+		{"Proxy forwards agent outside subnet", true, "172.16.0.10:5000", "203.0.113.1", http.StatusForbidden},
+		{"Proxy without X-Real-IP", true, "172.16.0.10:5000", "", http.StatusForbidden},
+		{"IPv4-mapped peer", true, "[::ffff:10.1.2.3]:5000", "", http.StatusOK},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			var r *gin.Engine
+			if test.proxies {
+				r = newRouter(subnets, proxies)
+			} else {
+				r = newRouter(subnets, nil)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+			req.RemoteAddr = test.remoteAddr
+			if test.realIP != "" {
+				req.Header.Set(RealIPHeader, test.realIP)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			assert.Equal(t, test.wantCode, w.Code)
+		})
+	}
+
+	// Без подсетей проверка отключена
+	w := httptest.NewRecorder()
+	newRouter(nil, nil).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestParseSubnets(t *testing.T) {
+	subnets, err := ParseSubnets(" 10.0.0.1/8,2001:db8::1 ,")
+	require.NoError(t, err)
+	if assert.Len(t, subnets, 2) {
+		assert.Equal(t, "10.0.0.0/8", subnets[0].String())
+		assert.Equal(t, "2001:db8::1/128", subnets[1].String())
+	}
+
+	subnets, err = ParseSubnets("")
+	require.NoError(t, err)
+	assert.Empty(t, subnets)
+
+	for _, value := range []string{"10.0.0.0/33", "localhost", "10.0.0/8"} {
+		_, err = ParseSubnets(value)
+		assert.Error(t, err, value)
+	}
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	apperrors "metrics-service/internal/server/errors"
+	"metrics-service/internal/tenant"
+)
+
+// TenantKey - ключ gin.Context с арендатором запроса.
+const TenantKey = "tenant"
+
+// WithTenant добавляет middleware, определяющее арендатора запроса и передающее его хранилищу через контекст запроса.
+//
+// Арендатор берется из API-ключа, привязанного к арендатору, иначе из заголовка tenant.Header, иначе используется
+// tenant.Default. Запрос с заголовком, не совпадающим с арендатором ключа, отклоняется с 403 (Forbidden),
+// с недопустимым именем арендатора - с 400 (Bad Request). Подключается после WithAuth.
+//
+// Обработчики передают хранилищу gin.Context, поэтому у роутера должен быть включен ContextWithFallback.
+func (m *Middleware) WithTenant() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		name := ctx.GetHeader(tenant.Header)
+		if keyTenant := ctx.GetString(APIKeyTenantKey); keyTenant != "" {
+			if name != "" && name != keyTenant {
+				ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": apperrors.ErrTenantForbidden.Error()})
+				return
+			}
+			name = keyTenant
+		}
+		if name == "" {
+			name = tenant.Default
+		}
+		if !tenant.Valid(name) {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": apperrors.ErrTenantInvalid.Error()})
+			return
+		}
+
+		ctx.Set(TenantKey, name)
+		ctx.Request = ctx.Request.WithContext(tenant.WithContext(ctx.Request.Context(), name))
+		ctx.Next()
+	}
+}
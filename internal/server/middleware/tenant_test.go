@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-service/internal/auth"
+	"metrics-service/internal/tenant"
+)
+
+func TestMiddleware_WithTenant(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	keyring, err := auth.NewKeyring([]auth.Key{
+		{Name: "team-a-agent", Hash: auth.Hash("team-a-token"), Scopes: []string{auth.ScopeRead}, Tenant: "team-a"},
+		{Name: "grafana", Hash: auth.Hash("read-token"), Scopes: []string{auth.ScopeRead}},
+	})
+	require.NoError(t, err)
+
+	m := NewMiddleware(nil)
+	m.SetAPIKeys(keyring)
+	r := gin.New()
+	r.ContextWithFallback = true
+	r.GET("/value", m.WithAuth(auth.ScopeRead), m.WithTenant(), func(ctx *gin.Context) {
+		// Хранилище получает gin.Context, арендатор должен быть виден через него
+		ctx.String(http.StatusOK, tenant.FromContext(ctx))
+	})
+
+	testTable := []struct {
+		name     string
+		token    string
+		tenant   string
+		wantCode int
+		wantBody string
+	}{
+		{"Default tenant", "read-token", "", http.StatusOK, tenant.Default},
+		{"Tenant from header", "read-token", "team-b", http.StatusOK, "team-b"},
+		{"Tenant from key", "team-a-token", "", http.StatusOK, "team-a"},
+		{"Same tenant in key and header", "team-a-token", "team-a", http.StatusOK, "team-a"},
+		{"Other tenant than key", "team-a-token", "team-b", http.StatusForbidden, `{"error":"api key is bound to another tenant"}`},
+		{"Invalid tenant", "read-token", "../team", http.StatusBadRequest, `{"error":"invalid tenant name"}`},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/value", nil)
+			req.Header.Set("Authorization", "Bearer "+test.token)
+			if test.tenant != "" {
+				req.Header.Set(tenant.Header, test.tenant)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			assert.Equal(t, test.wantCode, w.Code)
+			assert.Equal(t, test.wantBody, w.Body.String())
+		})
+	}
+}
@@ -7,6 +7,7 @@ package mocks
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	models "metrics-service/internal/server/models"
 
@@ -79,6 +80,36 @@ func (mr *MockStorageMockRecorder) Get(ctx, metricType, metricName interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockStorage)(nil).Get), ctx, metricType, metricName)
 }
 
+// GetByLabels mocks base method.
+func (m *MockStorage) GetByLabels(ctx context.Context, metricType, metricName string, labels map[string]string) ([]models.Metrics, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetByLabels", ctx, metricType, metricName, labels)
+	ret0, _ := ret[0].([]models.Metrics)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetByLabels indicates an expected call of GetByLabels.
+func (mr *MockStorageMockRecorder) GetByLabels(ctx, metricType, metricName, labels interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetByLabels", reflect.TypeOf((*MockStorage)(nil).GetByLabels), ctx, metricType, metricName, labels)
+}
+
+// GetHistory mocks base method.
+func (m *MockStorage) GetHistory(ctx context.Context, metricType, metricName string, labels map[string]string, from, to time.Time) ([]models.Sample, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetHistory", ctx, metricType, metricName, labels, from, to)
+	ret0, _ := ret[0].([]models.Sample)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetHistory indicates an expected call of GetHistory.
+func (mr *MockStorageMockRecorder) GetHistory(ctx, metricType, metricName, labels, from, to interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetHistory", reflect.TypeOf((*MockStorage)(nil).GetHistory), ctx, metricType, metricName, labels, from, to)
+}
+
 // GetJSON mocks base method.
 func (m *MockStorage) GetJSON(ctx context.Context, metric *models.Metrics) error {
 	m.ctrl.T.Helper()
@@ -108,6 +139,21 @@ func (mr *MockStorageMockRecorder) GetMetrics(ctx interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMetrics", reflect.TypeOf((*MockStorage)(nil).GetMetrics), ctx)
 }
 
+// GetMetricsJSON mocks base method.
+func (m *MockStorage) GetMetricsJSON(ctx context.Context) ([]models.Metrics, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetMetricsJSON", ctx)
+	ret0, _ := ret[0].([]models.Metrics)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetMetricsJSON indicates an expected call of GetMetricsJSON.
+func (mr *MockStorageMockRecorder) GetMetricsJSON(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMetricsJSON", reflect.TypeOf((*MockStorage)(nil).GetMetricsJSON), ctx)
+}
+
 // Ping mocks base method.
 func (m *MockStorage) Ping(ctx context.Context) error {
 	m.ctrl.T.Helper()
@@ -122,6 +168,20 @@ func (mr *MockStorageMockRecorder) Ping(ctx interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ping", reflect.TypeOf((*MockStorage)(nil).Ping), ctx)
 }
 
+// PruneHistory mocks base method.
+func (m *MockStorage) PruneHistory(ctx context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PruneHistory", ctx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PruneHistory indicates an expected call of PruneHistory.
+func (mr *MockStorageMockRecorder) PruneHistory(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PruneHistory", reflect.TypeOf((*MockStorage)(nil).PruneHistory), ctx)
+}
+
 // Save mocks base method.
 func (m *MockStorage) Save() error {
 	m.ctrl.T.Helper()
@@ -136,6 +196,18 @@ func (mr *MockStorageMockRecorder) Save() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Save", reflect.TypeOf((*MockStorage)(nil).Save))
 }
 
+// SetSeriesLimits mocks base method.
+func (m *MockStorage) SetSeriesLimits(maxSeries int, tenantMaxSeries map[string]int, maxTenants int) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetSeriesLimits", maxSeries, tenantMaxSeries, maxTenants)
+}
+
+// SetSeriesLimits indicates an expected call of SetSeriesLimits.
+func (mr *MockStorageMockRecorder) SetSeriesLimits(maxSeries, tenantMaxSeries, maxTenants interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetSeriesLimits", reflect.TypeOf((*MockStorage)(nil).SetSeriesLimits), maxSeries, tenantMaxSeries, maxTenants)
+}
+
 // Update mocks base method.
 func (m *MockStorage) Update(ctx context.Context, metricType, metricName, metricValStr string) error {
 	m.ctrl.T.Helper()
@@ -164,6 +236,20 @@ func (mr *MockStorageMockRecorder) UpdateBatch(ctx, metrics interface{}) *gomock
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateBatch", reflect.TypeOf((*MockStorage)(nil).UpdateBatch), ctx, metrics)
 }
 
+// UpdateBatchOnce mocks base method.
+func (m *MockStorage) UpdateBatchOnce(ctx context.Context, key string, metrics []models.Metrics) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateBatchOnce", ctx, key, metrics)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateBatchOnce indicates an expected call of UpdateBatchOnce.
+func (mr *MockStorageMockRecorder) UpdateBatchOnce(ctx, key, metrics interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateBatchOnce", reflect.TypeOf((*MockStorage)(nil).UpdateBatchOnce), ctx, key, metrics)
+}
+
 // UpdateJSON mocks base method.
 func (m *MockStorage) UpdateJSON(ctx context.Context, metric *models.Metrics) error {
 	m.ctrl.T.Helper()
@@ -1,9 +1,32 @@
 // Package models содержит модели данных.
 package models
 
+import "time"
+
 type Metrics struct {
-	ID    string   `json:"id"`              // имя метрики
-	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
-	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
-	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
+	ID           string            `json:"id"`                     // имя метрики
+	MType        string            `json:"type"`                   // параметр, принимающий значение gauge, counter или histogram
+	Delta        *int64            `json:"delta,omitempty"`        // значение метрики в случае передачи counter
+	Value        *float64          `json:"value,omitempty"`        // значение метрики в случае передачи gauge
+	Labels       map[string]string `json:"labels,omitempty"`       // метки серии, серия определяется именем, типом и метками
+	Histogram    *Histogram        `json:"histogram,omitempty"`    // бакеты и предварительно разложенные по ним значения histogram
+	Observations []float64         `json:"observations,omitempty"` // отдельные наблюдения histogram, раскладываются по бакетам на сервере
+}
+
+// Histogram - состояние метрики histogram.
+//
+// Bounds объявляются при первом обновлении метрики, последующие обновления
+// должны передавать те же границы или не передавать их вовсе.
+type Histogram struct {
+	Bounds []float64 `json:"bounds,omitempty"` // верхние границы бакетов по возрастанию, бакет +Inf подразумевается
+	Counts []int64   `json:"counts,omitempty"` // количество наблюдений в каждом бакете (не накопительно), len(Bounds)+1
+	Sum    float64   `json:"sum"`              // сумма наблюдений
+	Count  int64     `json:"count"`            // количество наблюдений
+}
+
+// Sample - значение метрики, принятое сервером в определенный момент времени.
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"`       // время приема значения
+	Delta     *int64    `json:"delta,omitempty"` // накопленное значение counter после обновления
+	Value     *float64  `json:"value,omitempty"` // значение gauge
 }
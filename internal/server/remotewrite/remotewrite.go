@@ -0,0 +1,253 @@
+// Package remotewrite разбирает запросы Prometheus remote write 1.0: WriteRequest в protobuf, сжатый snappy (block format).
+//
+// Разбираются только поля, нужные серверу: ряды с метками и сэмплами и метаданные семейств метрик.
+// Экземпляры (exemplars) и нативные histogram пропускаются.
+package remotewrite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// NameLabel - метка с именем метрики.
+const NameLabel = "__name__"
+
+// MetricType - тип семейства метрик из метаданных.
+type MetricType int32
+
+// Типы семейств метрик prometheus.MetricMetadata.MetricType.
+const (
+	TypeUnknown        MetricType = 0
+	TypeCounter        MetricType = 1
+	TypeGauge          MetricType = 2
+	TypeHistogram      MetricType = 3
+	TypeGaugeHistogram MetricType = 4
+	TypeSummary        MetricType = 5
+	TypeInfo           MetricType = 6
+	TypeStateset       MetricType = 7
+)
+
+// WriteRequest - запрос записи.
+type WriteRequest struct {
+	Series   []TimeSeries
+	Metadata []Metadata
+}
+
+// TimeSeries - ряд: метки, включая NameLabel, и сэмплы в порядке времени.
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// Label - метка ряда.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample - значение ряда, Timestamp в миллисекундах.
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// Metadata - метаданные семейства метрик.
+type Metadata struct {
+	Type   MetricType
+	Family string
+}
+
+// Decode распаковывает и разбирает тело запроса remote write. Запрос, размер которого после распаковки
+// больше maxSize байт, отклоняется до распаковки.
+func Decode(body []byte, maxSize int) (*WriteRequest, error) {
+	size, err := snappy.DecodedLen(body)
+	if err != nil {
+		return nil, fmt.Errorf("snappy: %w", err)
+	}
+	if size > maxSize {
+		return nil, fmt.Errorf("decoded size %d exceeds %d bytes", size, maxSize)
+	}
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("snappy: %w", err)
+	}
+	return Unmarshal(data)
+}
+
+// Unmarshal разбирает WriteRequest из protobuf.
+func Unmarshal(data []byte) (*WriteRequest, error) {
+	req := &WriteRequest{}
+	err := forEachField(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			series, err := unmarshalSeries(value)
+			if err != nil {
+				return fmt.Errorf("timeseries %d: %w", len(req.Series)+1, err)
+			}
+			req.Series = append(req.Series, series)
+		case num == 3 && typ == protowire.BytesType:
+			metadata, err := unmarshalMetadata(value)
+			if err != nil {
+				return fmt.Errorf("metadata %d: %w", len(req.Metadata)+1, err)
+			}
+			req.Metadata = append(req.Metadata, metadata)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// Encode кодирует запрос в protobuf и сжимает snappy, как это делает Prometheus.
+func Encode(req *WriteRequest) []byte {
+	return snappy.Encode(nil, Marshal(req))
+}
+
+// Marshal кодирует WriteRequest в protobuf.
+func Marshal(req *WriteRequest) []byte {
+	var b []byte
+	for _, series := range req.Series {
+		var sb []byte
+		for _, label := range series.Labels {
+			var lb []byte
+			lb = appendString(lb, 1, label.Name)
+			lb = appendString(lb, 2, label.Value)
+			sb = appendMessage(sb, 1, lb)
+		}
+		for _, sample := range series.Samples {
+			var smp []byte
+			smp = protowire.AppendTag(smp, 1, protowire.Fixed64Type)
+			smp = protowire.AppendFixed64(smp, math.Float64bits(sample.Value))
+			smp = protowire.AppendTag(smp, 2, protowire.VarintType)
+			smp = protowire.AppendVarint(smp, uint64(sample.Timestamp))
+			sb = appendMessage(sb, 2, smp)
+		}
+		b = appendMessage(b, 1, sb)
+	}
+	for _, metadata := range req.Metadata {
+		var mb []byte
+		mb = protowire.AppendTag(mb, 1, protowire.VarintType)
+		mb = protowire.AppendVarint(mb, uint64(metadata.Type))
+		mb = appendString(mb, 2, metadata.Family)
+		b = appendMessage(b, 3, mb)
+	}
+	return b
+}
+
+// internal
+
+var errTruncated = errors.New("truncated message")
+
+// forEachField вызывает fn для каждого поля сообщения. Для полей типа bytes value - содержимое поля,
+// для varint и fixed64 - закодированное значение.
+func forEachField(data []byte, fn func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return errTruncated
+		}
+		data = data[n:]
+
+		var value []byte
+		if typ == protowire.BytesType {
+			value, n = protowire.ConsumeBytes(data)
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n >= 0 {
+				value = data[:n]
+			}
+		}
+		if n < 0 {
+			return errTruncated
+		}
+		data = data[n:]
+
+		if err := fn(num, typ, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unmarshalSeries(data []byte) (TimeSeries, error) {
+	var series TimeSeries
+	err := forEachField(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			label, err := unmarshalLabel(value)
+			if err != nil {
+				return err
+			}
+			series.Labels = append(series.Labels, label)
+		case num == 2 && typ == protowire.BytesType:
+			sample, err := unmarshalSample(value)
+			if err != nil {
+				return err
+			}
+			series.Samples = append(series.Samples, sample)
+		}
+		return nil
+	})
+	return series, err
+}
+
+func unmarshalLabel(data []byte) (Label, error) {
+	var label Label
+	err := forEachField(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			label.Name = string(value)
+		case num == 2 && typ == protowire.BytesType:
+			label.Value = string(value)
+		}
+		return nil
+	})
+	return label, err
+}
+
+func unmarshalSample(data []byte) (Sample, error) {
+	var sample Sample
+	err := forEachField(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.Fixed64Type:
+			bits, _ := protowire.ConsumeFixed64(value)
+			sample.Value = math.Float64frombits(bits)
+		case num == 2 && typ == protowire.VarintType:
+			timestamp, _ := protowire.ConsumeVarint(value)
+			sample.Timestamp = int64(timestamp)
+		}
+		return nil
+	})
+	return sample, err
+}
+
+func unmarshalMetadata(data []byte) (Metadata, error) {
+	var metadata Metadata
+	err := forEachField(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			metricType, _ := protowire.ConsumeVarint(value)
+			metadata.Type = MetricType(metricType)
+		case num == 2 && typ == protowire.BytesType:
+			metadata.Family = string(value)
+		}
+		return nil
+	})
+	return metadata, err
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
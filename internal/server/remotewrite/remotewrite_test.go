@@ -0,0 +1,58 @@
+package remotewrite
+
+import (
+	"math"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestDecode(t *testing.T) {
+	want := &WriteRequest{
+		Series: []TimeSeries{
+			{
+				Labels:  []Label{{Name: NameLabel, Value: "http_requests_total"}, {Name: "code", Value: "200"}},
+				Samples: []Sample{{Value: 10, Timestamp: 1700000000000}, {Value: 12.5, Timestamp: 1700000015000}},
+			},
+			{Labels: []Label{{Name: NameLabel, Value: "up"}}, Samples: []Sample{{Value: 1, Timestamp: -1}}},
+		},
+		Metadata: []Metadata{{Type: TypeCounter, Family: "http_requests_total"}},
+	}
+
+	got, err := Decode(Encode(want), 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func TestDecode_UnknownFields(t *testing.T) {
+	// Экземпляры ряда (поле 3) и неизвестные поля запроса пропускаются
+	var series []byte
+	series = appendMessage(series, 1, appendString(appendString(nil, 1, NameLabel), 2, "up"))
+	series = appendMessage(series, 3, appendString(nil, 1, "exemplar"))
+	var req []byte
+	req = appendMessage(req, 1, series)
+	req = protowire.AppendTag(req, 15, protowire.VarintType)
+	req = protowire.AppendVarint(req, 42)
+
+	got, err := Unmarshal(req)
+	require.NoError(t, err)
+	require.Len(t, got.Series, 1)
+	assert.Equal(t, []Label{{Name: NameLabel, Value: "up"}}, got.Series[0].Labels)
+}
+
+func TestDecode_Errors(t *testing.T) {
+	_, err := Decode([]byte("not snappy"), 1<<20)
+	assert.Error(t, err)
+
+	// Обрезанное сообщение
+	data := Marshal(&WriteRequest{Series: []TimeSeries{{Samples: []Sample{{Value: math.Pi}}}}})
+	_, err = Decode(snappy.Encode(nil, data[:len(data)-3]), 1<<20)
+	assert.Error(t, err)
+
+	// Размер после распаковки больше лимита
+	_, err = Decode(snappy.Encode(nil, make([]byte, 1024)), 100)
+	assert.Error(t, err)
+}
@@ -0,0 +1,152 @@
+package statsd
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"metrics-service/internal/server/models"
+)
+
+// DefaultBuckets - границы бакетов histogram для таймеров StatsD в миллисекундах.
+var DefaultBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// maxWindowSeries - максимальное количество серий в окне агрегации. Строки новых серий сверх лимита отбрасываются.
+const maxWindowSeries = 10000
+
+// window накапливает строки StatsD до записи в хранилище.
+type window struct {
+	counters map[string]*counterAgg
+	gauges   map[string]*gaugeAgg
+	timers   map[string]*timerAgg
+}
+
+// counterAgg - сумма приращений счетчика с учетом частоты выборки.
+type counterAgg struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// gaugeAgg - значение gauge. Без absolute value - изменение значения, которое хранилось до окна.
+type gaugeAgg struct {
+	name     string
+	labels   map[string]string
+	value    float64
+	absolute bool
+}
+
+// timerAgg - наблюдения таймера, разложенные по бакетам, с учетом частоты выборки.
+type timerAgg struct {
+	name   string
+	labels map[string]string
+	counts []float64
+	sum    float64
+}
+
+func newWindow() *window {
+	return &window{
+		counters: make(map[string]*counterAgg),
+		gauges:   make(map[string]*gaugeAgg),
+		timers:   make(map[string]*timerAgg),
+	}
+}
+
+// size возвращает количество серий окна.
+func (w *window) size() int {
+	return len(w.counters) + len(w.gauges) + len(w.timers)
+}
+
+// add добавляет строку в окно. Возвращает false, если строка новой серии не поместилась в окно.
+func (w *window) add(l line, buckets []float64) bool {
+	key := seriesKey(l.name, l.labels)
+	full := w.size() >= maxWindowSeries
+
+	switch l.mtype {
+	case typeCounter:
+		agg, ok := w.counters[key]
+		if !ok {
+			if full {
+				return false
+			}
+			agg = &counterAgg{name: l.name, labels: l.labels}
+			w.counters[key] = agg
+		}
+		agg.value += l.value / l.rate
+	case typeGauge:
+		agg, ok := w.gauges[key]
+		if !ok {
+			if full {
+				return false
+			}
+			agg = &gaugeAgg{name: l.name, labels: l.labels}
+			w.gauges[key] = agg
+		}
+		if l.delta {
+			agg.value += l.value
+		} else {
+			agg.value, agg.absolute = l.value, true
+		}
+	default:
+		agg, ok := w.timers[key]
+		if !ok {
+			if full {
+				return false
+			}
+			agg = &timerAgg{name: l.name, labels: l.labels, counts: make([]float64, len(buckets)+1)}
+			w.timers[key] = agg
+		}
+		// Бакет i содержит наблюдения <= buckets[i], последний бакет - +Inf
+		agg.counts[sort.SearchFloat64s(buckets, l.value)] += 1 / l.rate
+		agg.sum += l.value / l.rate
+	}
+	return true
+}
+
+// metrics возвращает обновления окна для хранилища. Изменения gauge без абсолютного значения
+// возвращаются отдельно: их нужно сложить с текущими значениями хранилища.
+func (w *window) metrics(buckets []float64) (metrics []models.Metrics, gaugeDeltas []*gaugeAgg) {
+	metrics = make([]models.Metrics, 0, w.size())
+	for _, agg := range w.counters {
+		delta := int64(math.Round(agg.value))
+		metrics = append(metrics, models.Metrics{ID: agg.name, MType: "counter", Delta: &delta, Labels: agg.labels})
+	}
+	for _, agg := range w.gauges {
+		if !agg.absolute {
+			gaugeDeltas = append(gaugeDeltas, agg)
+			continue
+		}
+		value := agg.value
+		metrics = append(metrics, models.Metrics{ID: agg.name, MType: "gauge", Value: &value, Labels: agg.labels})
+	}
+	for _, agg := range w.timers {
+		histogram := &models.Histogram{Bounds: buckets, Counts: make([]int64, len(agg.counts)), Sum: agg.sum}
+		for i, count := range agg.counts {
+			histogram.Counts[i] = int64(math.Round(count))
+		}
+		metrics = append(metrics, models.Metrics{ID: agg.name, MType: "histogram", Histogram: histogram, Labels: agg.labels})
+	}
+	return metrics, gaugeDeltas
+}
+
+// seriesKey возвращает ключ серии по имени и тегам, не зависящий от порядка тегов.
+func seriesKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	for _, key := range keys {
+		b.WriteByte(0)
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(labels[key])
+	}
+	return b.String()
+}
@@ -0,0 +1,95 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Типы метрик StatsD.
+const (
+	typeCounter   = "c"
+	typeGauge     = "g"
+	typeTimer     = "ms"
+	typeHistogram = "h"
+	typeDist      = "d"
+)
+
+// line - разобранная строка StatsD вида name:value|type[|@rate][|#tag:value,...].
+type line struct {
+	name   string
+	value  float64
+	mtype  string
+	rate   float64           // частота выборки в (0, 1], 1 - без выборки
+	delta  bool              // gauge со знаком: значение добавляется к текущему
+	labels map[string]string // теги DogStatsD
+}
+
+// parseLine разбирает строку StatsD.
+func parseLine(s string) (line, error) {
+	pipe := strings.IndexByte(s, '|')
+	if pipe < 0 {
+		return line{}, errors.New("missing metric type")
+	}
+	colon := strings.LastIndexByte(s[:pipe], ':')
+	if colon < 1 {
+		return line{}, errors.New("missing metric name or value")
+	}
+
+	l := line{name: s[:colon], rate: 1}
+	if strings.ContainsAny(l.name, " \t") {
+		return line{}, fmt.Errorf("invalid metric name %q", l.name)
+	}
+
+	rawValue := s[colon+1 : pipe]
+	value, err := strconv.ParseFloat(rawValue, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return line{}, fmt.Errorf("invalid value %q", rawValue)
+	}
+	l.value = value
+
+	fields := strings.Split(s[pipe+1:], "|")
+	l.mtype = fields[0]
+	switch l.mtype {
+	case typeCounter, typeTimer, typeHistogram, typeDist:
+	case typeGauge:
+		// Знак у gauge означает изменение текущего значения, а не отрицательное значение
+		l.delta = rawValue[0] == '+' || rawValue[0] == '-'
+	default:
+		return line{}, fmt.Errorf("unsupported metric type %q", l.mtype)
+	}
+
+	for _, field := range fields[1:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			rate, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil || !(rate > 0 && rate <= 1) {
+				return line{}, fmt.Errorf("invalid sample rate %q", field)
+			}
+			l.rate = rate
+		case strings.HasPrefix(field, "#"):
+			l.labels, err = parseTags(field[1:])
+			if err != nil {
+				return line{}, err
+			}
+		default:
+			return line{}, fmt.Errorf("unsupported section %q", field)
+		}
+	}
+	return l, nil
+}
+
+// parseTags разбирает теги DogStatsD вида key:value,key2:value2. Тег без значения становится меткой с пустым значением.
+func parseTags(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, tag := range strings.Split(s, ",") {
+		key, value, _ := strings.Cut(tag, ":")
+		if key == "" {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
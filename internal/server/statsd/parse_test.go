@@ -0,0 +1,54 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want line
+	}{
+		{"counter", "requests:1|c", line{name: "requests", value: 1, mtype: typeCounter, rate: 1}},
+		{"sampled counter", "requests:2|c|@0.1", line{name: "requests", value: 2, mtype: typeCounter, rate: 0.1}},
+		{"gauge", "heap:42.5|g", line{name: "heap", value: 42.5, mtype: typeGauge, rate: 1}},
+		{"gauge increment", "heap:+5|g", line{name: "heap", value: 5, mtype: typeGauge, rate: 1, delta: true}},
+		{"gauge decrement", "heap:-5|g", line{name: "heap", value: -5, mtype: typeGauge, rate: 1, delta: true}},
+		{"timer", "latency:320|ms", line{name: "latency", value: 320, mtype: typeTimer, rate: 1}},
+		{"tags", "requests:1|c|#host:a,canary", line{name: "requests", value: 1, mtype: typeCounter, rate: 1,
+			labels: map[string]string{"host": "a", "canary": ""}}},
+		{"name with colon", "a:b:1|c", line{name: "a:b", value: 1, mtype: typeCounter, rate: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLine(tt.in)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseLine_Invalid(t *testing.T) {
+	for _, in := range []string{
+		"requests",
+		"requests:1",
+		":1|c",
+		"requests:x|c",
+		"requests:NaN|g",
+		"users:42|s",
+		"requests:1|c|@0",
+		"requests:1|c|@2",
+		"requests:1|c|#:a",
+		"requests:1|c|T1700000000",
+		"bad name:1|c",
+	} {
+		t.Run(in, func(t *testing.T) {
+			_, err := parseLine(in)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,377 @@
+// Package statsd принимает метрики в протоколе StatsD по UDP и TCP и записывает их в хранилище.
+//
+// Поддерживаются счетчики (name:1|c), gauge (name:42|g, изменения name:+5|g и name:-5|g), таймеры и histogram
+// (name:12|ms, |h, |d), частота выборки (|@0.1) и теги DogStatsD (|#key:value), которые становятся метками серии.
+// Строки накапливаются в окне агрегации и записываются в хранилище одним пакетом раз в FlushInterval.
+// Таймеры записываются как histogram с границами бакетов Buckets.
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/llaxzi/retryables/v2"
+
+	"metrics-service/internal/server/conns"
+	apperrors "metrics-service/internal/server/errors"
+	"metrics-service/internal/server/models"
+	"metrics-service/internal/server/storage"
+	"metrics-service/internal/tenant"
+)
+
+const (
+	// maxPacketSize - максимальный размер UDP-пакета и строки TCP.
+	maxPacketSize = 64 * 1024
+	// maxConns - максимальное количество одновременных TCP-соединений.
+	maxConns = 1024
+)
+
+// Config содержит параметры приемника StatsD.
+type Config struct {
+	// UDPAddress - адрес UDP, пустой адрес отключает прием по UDP.
+	UDPAddress string
+	// TCPAddress - адрес TCP, пустой адрес отключает прием по TCP.
+	TCPAddress string
+	// FlushInterval - окно агрегации перед записью в хранилище.
+	FlushInterval time.Duration
+	// Tenant - арендатор, в пространство которого записываются метрики, пустой - tenant.Default.
+	Tenant string
+	// TrustedSubnets - подсети, из которых принимаются метрики, пустой список - любые адреса.
+	TrustedSubnets []netip.Prefix
+	// IdleTimeout - время без данных, после которого TCP-соединение закрывается, 0 - conns.DefaultIdleTimeout.
+	IdleTimeout time.Duration
+	// Buckets - границы бакетов таймеров, nil - DefaultBuckets.
+	Buckets []float64
+	// SaveOnFlush - сохранять хранилище после каждой записи окна (синхронный режим сохранения сервера).
+	SaveOnFlush bool
+}
+
+// Stats - счетчики приемника с момента запуска.
+type Stats struct {
+	Packets     uint64 // принятые пакеты UDP и строки TCP
+	Lines       uint64 // разобранные строки
+	ParseErrors uint64 // строки с ошибкой разбора
+	Dropped     uint64 // отброшенные пакеты и строки: из недоверенных подсетей, сверх лимитов окна и соединений
+	Rejected    uint64 // серии окна, отклоненные хранилищем как некорректные
+	FlushErrors uint64 // неудачные записи окна в хранилище, метрики окна теряются
+}
+
+// Listener - приемник метрик StatsD.
+type Listener struct {
+	cfg     Config
+	storage storage.Storage
+	retryer *retryables.Retryer
+
+	mu     sync.Mutex
+	window *window
+
+	packets, lines, parseErrors, dropped, rejected, flushErrors atomic.Uint64
+	// reported - значения счетчиков, уже записанные в хранилище как метрики приемника.
+	reported Stats
+
+	udp   net.PacketConn
+	tcp   net.Listener
+	conns *conns.Tracker
+
+	wg      sync.WaitGroup // горутины приема
+	flushWg sync.WaitGroup // горутина записи окон
+	done    chan struct{}
+}
+
+// NewListener создает приемник StatsD, записывающий метрики в storage.
+func NewListener(cfg Config, storage storage.Storage, retryer *retryables.Retryer) *Listener {
+	if cfg.Buckets == nil {
+		cfg.Buckets = DefaultBuckets
+	}
+	if cfg.Tenant == "" {
+		cfg.Tenant = tenant.Default
+	}
+	return &Listener{
+		cfg:     cfg,
+		storage: storage,
+		retryer: retryer,
+		window:  newWindow(),
+		conns:   conns.NewTracker(maxConns, cfg.IdleTimeout),
+		done:    make(chan struct{}),
+	}
+}
+
+// Start открывает сокеты и запускает прием и периодическую запись метрик.
+func (l *Listener) Start() error {
+	if l.cfg.UDPAddress != "" {
+		udp, err := net.ListenPacket("udp", l.cfg.UDPAddress)
+		if err != nil {
+			return err
+		}
+		l.udp = udp
+	}
+	if l.cfg.TCPAddress != "" {
+		tcp, err := net.Listen("tcp", l.cfg.TCPAddress)
+		if err != nil {
+			if l.udp != nil {
+				l.udp.Close()
+			}
+			return err
+		}
+		l.tcp = tcp
+	}
+
+	if l.udp != nil {
+		l.wg.Add(1)
+		go l.serveUDP()
+		log.Printf("StatsD listening on udp %v", l.udp.LocalAddr())
+	}
+	if l.tcp != nil {
+		l.wg.Add(1)
+		go l.serveTCP()
+		log.Printf("StatsD listening on tcp %v", l.tcp.Addr())
+	}
+
+	l.flushWg.Add(1)
+	go l.flushLoop()
+	return nil
+}
+
+// Shutdown закрывает сокеты, дожидается обработки принятых данных и записывает последнее окно.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	if l.udp != nil {
+		l.udp.Close()
+	}
+	if l.tcp != nil {
+		l.tcp.Close()
+	}
+	l.conns.CloseAll()
+	l.wg.Wait()
+
+	close(l.done)
+	l.flushWg.Wait()
+	return l.flush(ctx)
+}
+
+// Stats возвращает счетчики приемника.
+func (l *Listener) Stats() Stats {
+	return Stats{
+		Packets:     l.packets.Load(),
+		Lines:       l.lines.Load(),
+		ParseErrors: l.parseErrors.Load(),
+		Dropped:     l.dropped.Load(),
+		Rejected:    l.rejected.Load(),
+		FlushErrors: l.flushErrors.Load(),
+	}
+}
+
+// internal
+
+func (l *Listener) serveUDP() {
+	defer l.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := l.udp.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("StatsD udp read failed: %v", err)
+			}
+			return
+		}
+		l.packets.Add(1)
+		if !conns.Trusted(addr, l.cfg.TrustedSubnets) {
+			l.dropped.Add(1)
+			continue
+		}
+		l.handlePacket(string(buf[:n]))
+	}
+}
+
+func (l *Listener) serveTCP() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.tcp.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("StatsD tcp accept failed: %v", err)
+			}
+			return
+		}
+		if !conns.Trusted(conn.RemoteAddr(), l.cfg.TrustedSubnets) || !l.conns.Add(conn) {
+			l.dropped.Add(1)
+			conn.Close()
+			continue
+		}
+		l.wg.Add(1)
+		go l.serveConn(conn)
+	}
+}
+
+// serveConn читает строки из TCP-соединения до его закрытия.
+func (l *Listener) serveConn(conn net.Conn) {
+	defer l.wg.Done()
+	defer l.conns.Remove(conn)
+
+	scanner := bufio.NewScanner(l.conns.Reader(conn))
+	scanner.Buffer(make([]byte, 4096), maxPacketSize)
+	for scanner.Scan() {
+		l.packets.Add(1)
+		l.handlePacket(scanner.Text())
+	}
+	err := scanner.Err()
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		log.Printf("StatsD tcp connection %v is idle, closing", conn.RemoteAddr())
+	case err != nil && !errors.Is(err, net.ErrClosed):
+		log.Printf("StatsD tcp connection %v failed: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// handlePacket разбирает строки пакета и добавляет их в окно агрегации.
+func (l *Listener) handlePacket(packet string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, raw := range strings.Split(packet, "\n") {
+		raw = strings.TrimSuffix(raw, "\r")
+		if raw == "" {
+			continue
+		}
+		parsed, err := parseLine(raw)
+		if err != nil {
+			l.parseErrors.Add(1)
+			continue
+		}
+		l.lines.Add(1)
+		if !l.window.add(parsed, l.cfg.Buckets) {
+			l.dropped.Add(1)
+		}
+	}
+}
+
+func (l *Listener) flushLoop() {
+	defer l.flushWg.Done()
+	ticker := time.NewTicker(l.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			if err := l.flush(context.Background()); err != nil {
+				log.Printf("StatsD flush failed: %v", err)
+			}
+		}
+	}
+}
+
+// flush записывает окно агрегации в хранилище, затем отдельным пакетом - приращения счетчиков приемника,
+// чтобы ошибка записи окна тоже была учтена.
+func (l *Listener) flush(ctx context.Context) error {
+	l.mu.Lock()
+	w := l.window
+	l.window = newWindow()
+	l.mu.Unlock()
+
+	ctx = tenant.WithContext(ctx, l.cfg.Tenant)
+	metrics, gaugeDeltas := w.metrics(l.cfg.Buckets)
+	for _, agg := range gaugeDeltas {
+		current := models.Metrics{ID: agg.name, MType: "gauge", Labels: agg.labels}
+		err := l.retryer.Retry(func() error {
+			return l.storage.GetJSON(ctx, &current)
+		})
+		if err != nil && !errors.Is(err, apperrors.ErrMetricNotExist) {
+			l.flushErrors.Add(1)
+			return err
+		}
+		value := agg.value
+		if current.Value != nil {
+			value += *current.Value
+		}
+		metrics = append(metrics, models.Metrics{ID: agg.name, MType: "gauge", Value: &value, Labels: agg.labels})
+	}
+
+	var err error
+	if len(metrics) > 0 {
+		if err = l.write(ctx, metrics); err != nil {
+			l.flushErrors.Add(1)
+		}
+	}
+
+	// Счетчики считаются записанными только после успешной записи, иначе их приращения войдут в следующую
+	stats, statsMetrics := l.statsMetrics()
+	if len(statsMetrics) > 0 {
+		statsErr := l.retryer.Retry(func() error {
+			return l.storage.UpdateBatch(ctx, statsMetrics)
+		})
+		if statsErr == nil {
+			l.reported = stats
+		}
+		err = errors.Join(err, statsErr)
+	}
+	if err != nil || len(metrics)+len(statsMetrics) == 0 {
+		return err
+	}
+	if l.cfg.SaveOnFlush {
+		return l.storage.Save()
+	}
+	return nil
+}
+
+// write записывает метрики окна одним пакетом. Хранилище отклоняет пакет с некорректной серией целиком,
+// поэтому тогда серии записываются по одной: некорректные отбрасываются и учитываются в Rejected, остальные записываются.
+func (l *Listener) write(ctx context.Context, metrics []models.Metrics) error {
+	err := l.retryer.Retry(func() error {
+		return l.storage.UpdateBatch(ctx, metrics)
+	})
+	if !invalidSeries(err) {
+		return err
+	}
+
+	for _, metric := range metrics {
+		err = l.retryer.Retry(func() error {
+			return l.storage.UpdateBatch(ctx, []models.Metrics{metric})
+		})
+		if invalidSeries(err) {
+			l.rejected.Add(1)
+			log.Printf("StatsD %s %q rejected: %v", metric.MType, metric.ID, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// invalidSeries проверяет, что хранилище отклонило серию как некорректную, а не из-за сбоя записи.
+func invalidSeries(err error) bool {
+	return errors.Is(err, apperrors.ErrInvalidHistogram) || errors.Is(err, apperrors.ErrHistogramBuckets) ||
+		errors.Is(err, apperrors.ErrSeriesLimit) || errors.Is(err, apperrors.ErrWrongMetricValue) ||
+		errors.Is(err, apperrors.ErrInvalidMetricType)
+}
+
+// statsMetrics возвращает счетчики приемника и их приращения с прошлой записи в виде метрик counter.
+func (l *Listener) statsMetrics() (Stats, []models.Metrics) {
+	stats := l.Stats()
+	var metrics []models.Metrics
+	for _, counter := range []struct {
+		name          string
+		value, former uint64
+	}{
+		{"statsd_parse_errors", stats.ParseErrors, l.reported.ParseErrors},
+		{"statsd_dropped", stats.Dropped, l.reported.Dropped},
+		{"statsd_rejected", stats.Rejected, l.reported.Rejected},
+		{"statsd_flush_errors", stats.FlushErrors, l.reported.FlushErrors},
+	} {
+		if counter.value == counter.former {
+			continue
+		}
+		delta := int64(counter.value - counter.former)
+		metrics = append(metrics, models.Metrics{ID: counter.name, MType: "counter", Delta: &delta})
+	}
+	return stats, metrics
+}
@@ -0,0 +1,178 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/llaxzi/retryables/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apperrors "metrics-service/internal/server/errors"
+	"metrics-service/internal/server/mocks"
+	"metrics-service/internal/server/models"
+	"metrics-service/internal/server/storage"
+	"metrics-service/internal/tenant"
+)
+
+func newTestListener(t *testing.T, cfg Config) (*Listener, storage.Storage) {
+	st, err := storage.NewStorage(storage.Config{})
+	require.NoError(t, err)
+	retryer := retryables.NewRetryer(nil)
+	retryer.SetCount(1)
+	retryer.SetConditionFunc(func(err error) bool { return errors.Is(err, apperrors.ErrPgConnExc) })
+	if cfg.FlushInterval == 0 {
+		cfg.FlushInterval = time.Hour
+	}
+	return NewListener(cfg, st, retryer), st
+}
+
+func getValue(t *testing.T, st storage.Storage, ctx context.Context, metricType, name string) string {
+	value, err := st.Get(ctx, metricType, name)
+	require.NoError(t, err)
+	return value
+}
+
+func TestListener_Flush(t *testing.T) {
+	l, st := newTestListener(t, Config{Buckets: []float64{10, 100}})
+	ctx := context.Background()
+
+	l.handlePacket("requests:1|c\nrequests:2|c|@0.5\nheap:10|g\nheap:+5|g\nlatency:5|ms\nlatency:50|ms|@0.5\nbroken\n")
+	require.NoError(t, l.flush(ctx))
+
+	assert.Equal(t, "5", getValue(t, st, ctx, "counter", "requests"))
+	assert.Equal(t, "15", getValue(t, st, ctx, "gauge", "heap"))
+	histogram := models.Metrics{ID: "latency", MType: "histogram"}
+	require.NoError(t, st.GetJSON(ctx, &histogram))
+	assert.Equal(t, []int64{1, 2, 0}, histogram.Histogram.Counts)
+	assert.Equal(t, 105.0, histogram.Histogram.Sum)
+
+	// Изменение gauge без абсолютного значения в окне применяется к значению хранилища
+	l.handlePacket("heap:-3|g\nfresh:-3|g")
+	require.NoError(t, l.flush(ctx))
+	assert.Equal(t, "12", getValue(t, st, ctx, "gauge", "heap"))
+	assert.Equal(t, "-3", getValue(t, st, ctx, "gauge", "fresh"))
+
+	// Ошибки разбора считаются и записываются как метрика приемника
+	stats := l.Stats()
+	assert.Equal(t, uint64(8), stats.Lines)
+	assert.Equal(t, uint64(1), stats.ParseErrors)
+	assert.Equal(t, "1", getValue(t, st, ctx, "counter", "statsd_parse_errors"))
+}
+
+func TestListener_RejectedSeries(t *testing.T) {
+	l, st := newTestListener(t, Config{})
+	ctx := context.Background()
+
+	// latency объявлена с другими бакетами, поэтому таймер отклоняется хранилищем
+	declared := models.Metrics{ID: "latency", MType: "histogram", Histogram: &models.Histogram{Bounds: []float64{1}}}
+	require.NoError(t, st.UpdateJSON(ctx, &declared))
+
+	for i := 0; i < 2; i++ {
+		l.handlePacket("latency:5|ms\nrequests:1|c")
+		require.NoError(t, l.flush(ctx))
+	}
+	assert.Equal(t, "2", getValue(t, st, ctx, "counter", "requests"))
+	assert.Equal(t, uint64(2), l.Stats().Rejected)
+	assert.Equal(t, "2", getValue(t, st, ctx, "counter", "statsd_rejected"))
+}
+
+func TestListener_FlushErrorReported(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	st := mocks.NewMockStorage(ctrl)
+	retryer := retryables.NewRetryer(nil)
+	retryer.SetCount(1)
+	retryer.SetConditionFunc(func(error) bool { return false })
+	l := NewListener(Config{FlushInterval: time.Hour}, st, retryer)
+	ctx := context.Background()
+
+	// Окно не записано, ошибка записи учитывается отдельным пакетом счетчиков приемника
+	gomock.InOrder(
+		st.EXPECT().UpdateBatch(gomock.Any(), gomock.Len(1)).Return(apperrors.ErrPgConnExc),
+		st.EXPECT().UpdateBatch(gomock.Any(), []models.Metrics{{ID: "statsd_flush_errors", MType: "counter", Delta: ptr(int64(1))}}).Return(apperrors.ErrPgConnExc),
+		st.EXPECT().UpdateBatch(gomock.Any(), []models.Metrics{{ID: "statsd_flush_errors", MType: "counter", Delta: ptr(int64(1))}}).Return(nil),
+	)
+	l.handlePacket("requests:1|c")
+	assert.Error(t, l.flush(ctx))
+	// Приращение, не записанное из-за ошибки, записывается при следующей записи
+	require.NoError(t, l.flush(ctx))
+	assert.Equal(t, uint64(1), l.reported.FlushErrors)
+}
+
+func ptr[T any](value T) *T {
+	return &value
+}
+
+func TestListener_Tags(t *testing.T) {
+	l, st := newTestListener(t, Config{Tenant: "legacy"})
+	ctx := tenant.WithContext(context.Background(), "legacy")
+
+	l.handlePacket("requests:1|c|#host:a\nrequests:1|c|#host:b\nrequests:1|c|#host:a")
+	require.NoError(t, l.flush(context.Background()))
+
+	metrics, err := st.GetByLabels(ctx, "counter", "requests", map[string]string{"host": "a"})
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, int64(2), *metrics[0].Delta)
+
+	// Метрики записаны в пространство арендатора
+	_, err = st.Get(context.Background(), "counter", "requests")
+	assert.Error(t, err)
+}
+
+func TestListener_WindowLimit(t *testing.T) {
+	l, _ := newTestListener(t, Config{})
+	for i := 0; i < maxWindowSeries; i++ {
+		l.window.counters[string(rune(i))] = &counterAgg{}
+	}
+	l.handlePacket("new:1|c")
+	assert.Equal(t, uint64(1), l.Stats().Dropped)
+}
+
+func TestListener_Network(t *testing.T) {
+	l, st := newTestListener(t, Config{UDPAddress: "127.0.0.1:0", TCPAddress: "127.0.0.1:0"})
+	require.NoError(t, l.Start())
+
+	udp, err := net.Dial("udp", l.udp.LocalAddr().String())
+	require.NoError(t, err)
+	defer udp.Close()
+	_, err = udp.Write([]byte("udp_requests:1|c"))
+	require.NoError(t, err)
+
+	tcp, err := net.Dial("tcp", l.tcp.Addr().String())
+	require.NoError(t, err)
+	_, err = tcp.Write([]byte("tcp_requests:2|c\ntcp_requests:3|c\n"))
+	require.NoError(t, err)
+	require.NoError(t, tcp.Close())
+
+	// Shutdown дожидается принятых данных и записывает последнее окно
+	require.Eventually(t, func() bool { return l.Stats().Lines == 3 }, time.Second, 10*time.Millisecond)
+	require.NoError(t, l.Shutdown(context.Background()))
+
+	ctx := context.Background()
+	assert.Equal(t, "1", getValue(t, st, ctx, "counter", "udp_requests"))
+	assert.Equal(t, "5", getValue(t, st, ctx, "counter", "tcp_requests"))
+}
+
+func TestListener_TrustedSubnets(t *testing.T) {
+	l, _ := newTestListener(t, Config{
+		UDPAddress:     "127.0.0.1:0",
+		TrustedSubnets: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	require.NoError(t, l.Start())
+	defer l.Shutdown(context.Background())
+
+	udp, err := net.Dial("udp", l.udp.LocalAddr().String())
+	require.NoError(t, err)
+	defer udp.Close()
+	_, err = udp.Write([]byte("udp_requests:1|c"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return l.Stats().Dropped == 1 }, time.Second, 10*time.Millisecond)
+	assert.Zero(t, l.Stats().Lines)
+}
@@ -3,10 +3,12 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/jackc/pgerrcode"
@@ -14,59 +16,100 @@ import (
 
 	apperrors "metrics-service/internal/server/errors"
 	"metrics-service/internal/server/models"
+	"metrics-service/internal/server/storage/migrations"
+	"metrics-service/internal/tenant"
 )
 
 const (
-	timeout = 1
+	// defaultTimeout - время на запрос к бд в секундах, если в Config не задано другое.
+	defaultTimeout = 1
+	// migrationTimeout - время на применение миграций, включая ожидание lock другой реплики.
+	migrationTimeout = 60
 )
 
 // repository реализует Storage в виде соединения с базой данных Postgres
 type repository struct {
-	db *sql.DB
+	db               *sql.DB
+	historyRetention time.Duration // время хранения истории значений, 0 - история не ведется
+	idempotencyTTL   time.Duration // время хранения ключей идемпотентности пакетов
+	timeout          time.Duration // время на запрос к бд
+
+	limitsMu sync.RWMutex
+	limits   seriesLimits // лимиты количества серий арендаторов
 }
 
 func (r *repository) Update(ctx context.Context, metricType, metricName, metricValStr string) error {
-	var delta *int64
-	var value *float64
+	metric := models.Metrics{ID: metricName, MType: metricType}
+
 	switch metricType {
 	case "counter":
 		metricVal, err := strconv.ParseInt(metricValStr, 10, 64)
 		if err != nil {
 			return apperrors.ErrWrongMetricValue
 		}
-		delta = &metricVal
-		value = nil
+		metric.Delta = &metricVal
 	case "gauge":
 		metricVal, err := strconv.ParseFloat(metricValStr, 64)
 		if err != nil {
 			return apperrors.ErrWrongMetricValue
 		}
-		value = &metricVal
-
-	}
-	metrics := []models.Metrics{
-		{
-			ID:    metricName,
-			MType: metricType,
-			Delta: delta,
-			Value: value,
-		},
+		metric.Value = &metricVal
+	case "histogram":
+		// Значение в URL - одно наблюдение для histogram с уже объявленными бакетами
+		metricVal, err := strconv.ParseFloat(metricValStr, 64)
+		if err != nil {
+			return apperrors.ErrWrongMetricValue
+		}
+		metric.Observations = []float64{metricVal}
+	default:
+		return apperrors.ErrInvalidMetricType
 	}
-	return r.UpdateBatch(ctx, metrics)
+	return r.updateBatch(ctx, "", []models.Metrics{metric})
 }
 
+// UpdateJSON обновляет метрику и записывает в metric ее актуальное значение.
 func (r *repository) UpdateJSON(ctx context.Context, metric *models.Metrics) error {
 	metrics := []models.Metrics{*metric}
-	return r.UpdateBatch(ctx, metrics)
+	err := r.updateBatch(ctx, "", metrics)
+	if err != nil {
+		return err
+	}
+	*metric = metrics[0]
+	return nil
 }
 
 // UpdateBatch выполняет batch вставку в бд
 func (r *repository) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	// updateBatch записывает актуальные значения в элементы среза, срез вызывающего не меняем
+	return r.updateBatch(ctx, "", append([]models.Metrics(nil), metrics...))
+}
+
+// UpdateBatchOnce выполняет batch вставку в бд, если пакет с ключом key еще не применялся.
+// Ключ записывается в той же транзакции, что и пакет, поэтому пакет применяется ровно один раз.
+func (r *repository) UpdateBatchOnce(ctx context.Context, key string, metrics []models.Metrics) error {
+	return r.updateBatch(ctx, key, append([]models.Metrics(nil), metrics...))
+}
+
+// updateBatch выполняет batch вставку в бд и записывает в элементы metrics актуальные значения серий.
+// Непустой key - ключ идемпотентности пакета.
+func (r *repository) updateBatch(ctx context.Context, key string, metrics []models.Metrics) error {
 	if len(metrics) < 1 {
 		return nil
 	}
+	// Проверяем пакет до начала транзакции, как и in-memory хранилище
+	for _, metric := range metrics {
+		if err := validateMetric(metric); err != nil {
+			return err
+		}
+	}
 
-	ctx, cancel := context.WithTimeout(ctx, timeout*time.Second)
+	updates, err := aggregateUpdates(metrics)
+	if err != nil {
+		log.Printf("failed to aggregate batch: %v", err)
+		return apperrors.ErrServer
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
 	defer cancel()
 
 	tx, err := r.db.BeginTx(ctx, nil)
@@ -77,48 +120,86 @@ func (r *repository) UpdateBatch(ctx context.Context, metrics []models.Metrics)
 		return fmt.Errorf("failed to start tx: %w", err)
 	}
 
-	query := "INSERT INTO public.metrics(metric_id, metric_type, delta, value) VALUES ($1, $2, $3, $4)"
-	query += " ON CONFLICT (metric_id) DO UPDATE SET delta = metrics.delta + EXCLUDED.delta, value = EXCLUDED.value;"
+	if key != "" {
+		if err = r.claimKey(ctx, tx, key); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
 
-	stmt, err := tx.PrepareContext(ctx, query)
-	if err != nil {
+	if err = r.checkSeriesLimit(ctx, tx, metrics); err != nil {
 		tx.Rollback()
-		if r.isPgConnErr(err) {
-			return apperrors.ErrPgConnExc
-		}
-		log.Printf("failed to prepare statement: %v", err)
-		return apperrors.ErrServer
+		return err
 	}
-	defer stmt.Close()
 
-	for _, metric := range metrics {
-		_, err = stmt.ExecContext(ctx, metric.ID, metric.MType, metric.Delta, metric.Value)
+	for i := range metrics {
+		metric := &metrics[i]
+		if metric.MType != "histogram" {
+			continue
+		}
+		var labels string
+		labels, err = marshalLabels(metric.Labels)
 		if err != nil {
 			tx.Rollback()
-			if r.isPgConnErr(err) {
-				return apperrors.ErrPgConnExc
-			}
-			log.Printf("failed to execute statement for metric %s: %v", metric.ID, err)
+			log.Printf("failed to marshal labels for metric %s: %v", metric.ID, err)
 			return apperrors.ErrServer
 		}
+		var histogram *models.Histogram
+		histogram, err = r.updateHistogram(ctx, tx, *metric, labels)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		metric.Histogram = histogram
+		metric.Observations = nil
+	}
+
+	// Одиночное обновление выполняется обычным upsert, для пакета массивы unnest дешевле построчных запросов
+	if len(updates) == 1 {
+		err = r.upsertLoop(ctx, tx, updates)
+	} else if len(updates) > 1 {
+		err = r.upsertBulk(ctx, tx, updates)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, update := range updates {
+		for _, i := range update.indices {
+			metrics[i].Delta, metrics[i].Value = update.delta, update.value
+		}
+	}
+
+	if r.historyRetention > 0 && len(updates) > 0 {
+		if err = r.insertHistory(ctx, tx, updates); err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
 	return tx.Commit()
 }
 
 func (r *repository) Get(ctx context.Context, metricType, metricName string) (string, error) {
-	ctx, cancel := context.WithTimeout(ctx, timeout*time.Second)
+	if !validMetricType(metricType) {
+		return "", apperrors.ErrInvalidMetricType
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
 	defer cancel()
 
 	var delta *int64
 	var value *float64
+	var rawHistogram []byte
 
-	query := `SELECT metric_id, metric_type, delta, value FROM public.metrics WHERE metric_type = $1 AND metric_id = $2`
-	row := r.db.QueryRowContext(ctx, query, metricType, metricName)
-	err := row.Scan(metricName, metricType, &delta, &value)
+	query := `SELECT delta, value, histogram FROM public.metrics
+		WHERE tenant = $1 AND metric_type = $2 AND metric_id = $3 AND labels = '{}'::jsonb`
+	row := r.db.QueryRowContext(ctx, query, tenant.FromContext(ctx), metricType, metricName)
+	err := row.Scan(&delta, &value, &rawHistogram)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return "", fmt.Errorf("metric not found: %w", err)
+			return "", apperrors.ErrMetricNotExist
 		}
 		if r.isPgConnErr(err) {
 			return "", apperrors.ErrPgConnExc
@@ -138,6 +219,12 @@ func (r *repository) Get(ctx context.Context, metricType, metricName string) (st
 			return "", apperrors.ErrWrongMetricValue
 		}
 		return strconv.FormatFloat(*value, 'f', -1, 64), nil
+	case "histogram":
+		histogram, err := unmarshalHistogram(rawHistogram)
+		if err != nil || histogram == nil {
+			return "", apperrors.ErrWrongMetricValue
+		}
+		return formatHistogram(histogram), nil
 	default:
 		return "", apperrors.ErrInvalidMetricType
 	}
@@ -145,12 +232,24 @@ func (r *repository) Get(ctx context.Context, metricType, metricName string) (st
 }
 
 func (r *repository) GetJSON(ctx context.Context, metric *models.Metrics) error {
-	ctx, cancel := context.WithTimeout(ctx, timeout*time.Second)
+	if !validMetricType(metric.MType) {
+		return apperrors.ErrInvalidMetricType
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
 	defer cancel()
 
-	query := `SELECT metric_id, metric_type, delta, value FROM public.metrics WHERE metric_type = $1 AND metric_id = $2`
-	row := r.db.QueryRowContext(ctx, query, metric.MType, metric.ID)
-	err := row.Scan(&metric.ID, &metric.MType, &metric.Delta, &metric.Value)
+	labels, err := marshalLabels(metric.Labels)
+	if err != nil {
+		log.Printf("failed to marshal labels: %v", err)
+		return apperrors.ErrServer
+	}
+
+	var rawHistogram []byte
+	query := `SELECT metric_id, metric_type, delta, value, histogram FROM public.metrics
+		WHERE tenant = $1 AND metric_type = $2 AND metric_id = $3 AND labels = $4`
+	row := r.db.QueryRowContext(ctx, query, tenant.FromContext(ctx), metric.MType, metric.ID, labels)
+	err = row.Scan(&metric.ID, &metric.MType, &metric.Delta, &metric.Value, &rawHistogram)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return apperrors.ErrMetricNotExist
@@ -161,15 +260,20 @@ func (r *repository) GetJSON(ctx context.Context, metric *models.Metrics) error
 		log.Printf("failed to scan metric: %v", err)
 		return apperrors.ErrServer
 	}
+	metric.Histogram, err = unmarshalHistogram(rawHistogram)
+	if err != nil {
+		log.Printf("failed to unmarshal histogram: %v", err)
+		return apperrors.ErrServer
+	}
 	return nil
 }
 
 func (r *repository) GetMetrics(ctx context.Context) ([][]string, error) {
-	ctx, cancel := context.WithTimeout(ctx, timeout*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
 	defer cancel()
 
-	query := `SELECT metric_id, metric_type, delta, value FROM public.metrics`
-	rows, err := r.db.QueryContext(ctx, query)
+	query := `SELECT metric_id, metric_type, delta, value, labels, histogram FROM public.metrics WHERE tenant = $1`
+	rows, err := r.db.QueryContext(ctx, query, tenant.FromContext(ctx))
 	if err != nil {
 		if r.isPgConnErr(err) {
 			return nil, apperrors.ErrPgConnExc
@@ -186,23 +290,40 @@ func (r *repository) GetMetrics(ctx context.Context) ([][]string, error) {
 		var metricType string
 		var delta sql.NullInt64
 		var value sql.NullFloat64
+		var rawLabels []byte
+		var rawHistogram []byte
 
-		err = rows.Scan(&metricID, &metricType, &delta, &value)
+		err = rows.Scan(&metricID, &metricType, &delta, &value, &rawLabels, &rawHistogram)
 		if err != nil {
 			log.Printf("failed to scan row: %v", err)
 			return nil, apperrors.ErrServer
 		}
+		var labels map[string]string
+		labels, err = unmarshalLabels(rawLabels)
+		if err != nil {
+			log.Printf("failed to unmarshal labels: %v", err)
+			return nil, apperrors.ErrServer
+		}
+
+		var histogram *models.Histogram
+		histogram, err = unmarshalHistogram(rawHistogram)
+		if err != nil {
+			log.Printf("failed to unmarshal histogram: %v", err)
+			return nil, apperrors.ErrServer
+		}
 
 		var metricValue string
 		if metricType == "gauge" && value.Valid {
-			metricValue = fmt.Sprintf("%f", value.Float64)
+			metricValue = strconv.FormatFloat(value.Float64, 'f', -1, 64)
 		} else if metricType == "counter" && delta.Valid {
-			metricValue = fmt.Sprintf("%d", delta.Int64)
+			metricValue = strconv.FormatInt(delta.Int64, 10)
+		} else if metricType == "histogram" && histogram != nil {
+			metricValue = formatHistogram(histogram)
 		} else {
 			metricValue = "null"
 		}
 
-		metrics = append(metrics, []string{metricID, metricValue})
+		metrics = append(metrics, []string{formatSeries(metricID, labels), metricValue})
 	}
 
 	if err = rows.Err(); err != nil {
@@ -213,78 +334,176 @@ func (r *repository) GetMetrics(ctx context.Context) ([][]string, error) {
 	return metrics, nil
 }
 
-func (r *repository) Ping(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, timeout*time.Second)
+func (r *repository) GetMetricsJSON(ctx context.Context) ([]models.Metrics, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
 	defer cancel()
-	err := r.db.PingContext(ctx)
+
+	query := `SELECT metric_id, metric_type, delta, value, labels, histogram FROM public.metrics WHERE tenant = $1`
+	rows, err := r.db.QueryContext(ctx, query, tenant.FromContext(ctx))
 	if err != nil {
 		if r.isPgConnErr(err) {
-			return apperrors.ErrPgConnExc
+			return nil, apperrors.ErrPgConnExc
 		}
-		log.Printf("err on ping: %v", err)
-		return apperrors.ErrServer
+		log.Printf("failed to query metrics: %v", err)
+		return nil, apperrors.ErrServer
 	}
-	return nil
+	defer rows.Close()
+
+	return r.scanMetrics(rows)
 }
 
-// Bootstrap устанавливает бд в debug окружении
-func (r *repository) Bootstrap(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, timeout*time.Second)
+func (r *repository) GetByLabels(ctx context.Context, metricType, metricName string, labels map[string]string) ([]models.Metrics, error) {
+	if !validMetricType(metricType) {
+		return nil, apperrors.ErrInvalidMetricType
+	}
+
+	matcher, err := marshalLabels(labels)
+	if err != nil {
+		log.Printf("failed to marshal labels: %v", err)
+		return nil, apperrors.ErrServer
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
 	defer cancel()
 
-	tx, err := r.db.BeginTx(ctx, nil)
+	// Оператор @> проверяет, что метки серии содержат все пары из matcher
+	query := `SELECT metric_id, metric_type, delta, value, labels, histogram FROM public.metrics
+		WHERE tenant = $1 AND metric_type = $2 AND ($3 = '' OR metric_id = $3) AND labels @> $4`
+	rows, err := r.db.QueryContext(ctx, query, tenant.FromContext(ctx), metricType, metricName, matcher)
 	if err != nil {
 		if r.isPgConnErr(err) {
-			return apperrors.ErrPgConnExc
+			return nil, apperrors.ErrPgConnExc
 		}
-		return fmt.Errorf("failed to start tx: %w", err)
+		log.Printf("failed to query metrics: %v", err)
+		return nil, apperrors.ErrServer
 	}
-	//Удаляем enum тип и таблицу, если существуют
-	dropTableQuery := `DROP TABLE IF EXISTS public.metrics;`
-	_, err = tx.ExecContext(ctx, dropTableQuery)
+	defer rows.Close()
+
+	return r.scanMetrics(rows)
+}
+
+func (r *repository) GetHistory(ctx context.Context, metricType, metricName string, labels map[string]string, from, to time.Time) ([]models.Sample, error) {
+	if metricType != "counter" && metricType != "gauge" {
+		return nil, apperrors.ErrInvalidMetricType
+	}
+
+	rawLabels, err := marshalLabels(labels)
+	if err != nil {
+		log.Printf("failed to marshal labels: %v", err)
+		return nil, apperrors.ErrServer
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	name := tenant.FromContext(ctx)
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM public.metrics WHERE tenant = $1 AND metric_type = $2 AND metric_id = $3 AND labels = $4)`
+	err = r.db.QueryRowContext(ctx, query, name, metricType, metricName, rawLabels).Scan(&exists)
 	if err != nil {
-		tx.Rollback()
 		if r.isPgConnErr(err) {
-			return apperrors.ErrPgConnExc
+			return nil, apperrors.ErrPgConnExc
 		}
-		return fmt.Errorf("failed to drop table metrics: %w", err)
+		log.Printf("failed to check metric: %v", err)
+		return nil, apperrors.ErrServer
 	}
-	dropTypeQuery := `DROP TYPE IF EXISTS MType;`
-	_, err = tx.ExecContext(ctx, dropTypeQuery)
+	if !exists {
+		return nil, apperrors.ErrMetricNotExist
+	}
+
+	// Записи старше окна хранения остаются в таблице до очередной очистки
+	if expired := time.Now().Add(-r.historyRetention); from.Before(expired) {
+		from = expired
+	}
+
+	query = `SELECT created_at, delta, value FROM public.metrics_history
+		WHERE tenant = $1 AND metric_type = $2 AND metric_id = $3 AND labels = $4 AND created_at BETWEEN $5 AND $6
+		ORDER BY created_at`
+	rows, err := r.db.QueryContext(ctx, query, name, metricType, metricName, rawLabels, from, to)
+	if err != nil {
+		if r.isPgConnErr(err) {
+			return nil, apperrors.ErrPgConnExc
+		}
+		log.Printf("failed to query history: %v", err)
+		return nil, apperrors.ErrServer
+	}
+	defer rows.Close()
+
+	samples := make([]models.Sample, 0)
+
+	for rows.Next() {
+		var sample models.Sample
+		err = rows.Scan(&sample.Timestamp, &sample.Delta, &sample.Value)
+		if err != nil {
+			log.Printf("failed to scan row: %v", err)
+			return nil, apperrors.ErrServer
+		}
+		samples = append(samples, sample)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("row iteration error: %v", err)
+		return nil, apperrors.ErrServer
+	}
+
+	return samples, nil
+}
+
+func (r *repository) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	err := r.db.PingContext(ctx)
 	if err != nil {
-		tx.Rollback()
 		if r.isPgConnErr(err) {
 			return apperrors.ErrPgConnExc
 		}
-		return fmt.Errorf("failed to drop type MType: %w", err)
+		log.Printf("err on ping: %v", err)
+		return apperrors.ErrServer
 	}
+	return nil
+}
 
-	// Создаем enum тип
-	createTypeQuery := `CREATE TYPE MType AS ENUM ('gauge', 'counter');`
-	_, err = tx.ExecContext(ctx, createTypeQuery)
+// Bootstrap применяет непримененные миграции схемы бд.
+func (r *repository) Bootstrap(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, migrationTimeout*time.Second)
+	defer cancel()
+
+	migrator, err := migrations.NewMigrator(r.db)
+	if err != nil {
+		return fmt.Errorf("failed to load migrations: %w", err)
+	}
+	applied, err := migrator.Up(ctx)
 	if err != nil {
-		tx.Rollback()
 		if r.isPgConnErr(err) {
 			return apperrors.ErrPgConnExc
 		}
-		return fmt.Errorf("failed to create enum MType: %w", err)
+		return err
 	}
+	if applied > 0 {
+		log.Printf("Applied %d migrations", applied)
+	}
+	return nil
+}
 
-	// Создаем таблицу
-	createTableQuery := `CREATE TABLE IF NOT EXISTS public.metrics (
-		metric_id VARCHAR(100) PRIMARY KEY,
-		metric_type MType,
-		delta BIGINT,
-		value DOUBLE PRECISION);`
-	_, err = tx.ExecContext(ctx, createTableQuery)
+// PruneHistory удаляет записи истории старше окна хранения всех арендаторов.
+// Удаление выполняется периодически, а не в транзакции каждого пакета, чтобы не замедлять запись.
+func (r *repository) PruneHistory(ctx context.Context) error {
+	if r.historyRetention <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	_, err := r.db.ExecContext(ctx, "DELETE FROM public.metrics_history WHERE created_at < $1;", time.Now().Add(-r.historyRetention))
 	if err != nil {
-		tx.Rollback()
 		if r.isPgConnErr(err) {
 			return apperrors.ErrPgConnExc
 		}
-		return fmt.Errorf("failed to create table metrics: %w", err)
+		log.Printf("failed to delete expired history: %v", err)
+		return apperrors.ErrServer
 	}
-	return tx.Commit()
+	return nil
 }
 
 func (r *repository) Save() error {
@@ -295,8 +514,152 @@ func (r *repository) Close() error {
 	return r.db.Close()
 }
 
+// SetSeriesLimits меняет лимиты количества серий арендаторов. Количество арендаторов в Postgres не ограничивается.
+func (r *repository) SetSeriesLimits(maxSeries int, tenantMaxSeries map[string]int, _ int) {
+	r.limitsMu.Lock()
+	defer r.limitsMu.Unlock()
+	r.limits = seriesLimits{max: maxSeries, tenants: tenantMaxSeries}
+}
+
 // internal
 
+// scanMetrics считывает строки вида (metric_id, metric_type, delta, value, labels, histogram) в срез models.Metrics.
+func (r *repository) scanMetrics(rows *sql.Rows) ([]models.Metrics, error) {
+	metrics := make([]models.Metrics, 0)
+
+	for rows.Next() {
+		var metric models.Metrics
+		var rawLabels []byte
+		var rawHistogram []byte
+		err := rows.Scan(&metric.ID, &metric.MType, &metric.Delta, &metric.Value, &rawLabels, &rawHistogram)
+		if err != nil {
+			log.Printf("failed to scan row: %v", err)
+			return nil, apperrors.ErrServer
+		}
+		metric.Labels, err = unmarshalLabels(rawLabels)
+		if err != nil {
+			log.Printf("failed to unmarshal labels: %v", err)
+			return nil, apperrors.ErrServer
+		}
+		metric.Histogram, err = unmarshalHistogram(rawHistogram)
+		if err != nil {
+			log.Printf("failed to unmarshal histogram: %v", err)
+			return nil, apperrors.ErrServer
+		}
+		metrics = append(metrics, metric)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("row iteration error: %v", err)
+		return nil, apperrors.ErrServer
+	}
+
+	return metrics, nil
+}
+
+// updateHistogram применяет обновление к серии histogram в рамках транзакции tx.
+// Строка серии блокируется на время транзакции, чтобы параллельные обновления не потеряли наблюдения.
+func (r *repository) updateHistogram(ctx context.Context, tx *sql.Tx, metric models.Metrics, labels string) (*models.Histogram, error) {
+	name := tenant.FromContext(ctx)
+	var rawHistogram []byte
+	query := `SELECT histogram FROM public.metrics
+		WHERE tenant = $1 AND metric_type = 'histogram' AND metric_id = $2 AND labels = $3 FOR UPDATE`
+	err := tx.QueryRowContext(ctx, query, name, metric.ID, labels).Scan(&rawHistogram)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		if r.isPgConnErr(err) {
+			return nil, apperrors.ErrPgConnExc
+		}
+		log.Printf("failed to select histogram %s: %v", metric.ID, err)
+		return nil, apperrors.ErrServer
+	}
+
+	current, err := unmarshalHistogram(rawHistogram)
+	if err != nil {
+		log.Printf("failed to unmarshal histogram %s: %v", metric.ID, err)
+		return nil, apperrors.ErrServer
+	}
+	histogram, err := applyHistogram(current, metric)
+	if err != nil {
+		return nil, err
+	}
+	rawHistogram, err = json.Marshal(histogram)
+	if err != nil {
+		log.Printf("failed to marshal histogram %s: %v", metric.ID, err)
+		return nil, apperrors.ErrServer
+	}
+
+	query = `INSERT INTO public.metrics(tenant, metric_id, metric_type, labels, histogram) VALUES ($1, $2, 'histogram', $3, $4)
+		ON CONFLICT (tenant, metric_id, metric_type, labels) DO UPDATE SET histogram = EXCLUDED.histogram`
+	_, err = tx.ExecContext(ctx, query, name, metric.ID, labels, string(rawHistogram))
+	if err != nil {
+		if r.isPgConnErr(err) {
+			return nil, apperrors.ErrPgConnExc
+		}
+		log.Printf("failed to save histogram %s: %v", metric.ID, err)
+		return nil, apperrors.ErrServer
+	}
+	return histogram, nil
+}
+
+// validMetricType проверяет, что тип метрики поддерживается хранилищем.
+func validMetricType(metricType string) bool {
+	return metricType == "counter" || metricType == "gauge" || metricType == "histogram"
+}
+
+// validateMetric проверяет, что у метрики известный тип и задано значение этого типа.
+func validateMetric(metric models.Metrics) error {
+	switch metric.MType {
+	case "counter":
+		if metric.Delta == nil {
+			return apperrors.ErrWrongMetricValue
+		}
+	case "gauge":
+		if metric.Value == nil {
+			return apperrors.ErrWrongMetricValue
+		}
+	case "histogram":
+	default:
+		return fmt.Errorf("%w, metric: %v", apperrors.ErrInvalidMetricType, metric)
+	}
+	return nil
+}
+
+// unmarshalHistogram декодирует колонку histogram, NULL возвращается как nil.
+func unmarshalHistogram(raw []byte) (*models.Histogram, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	var histogram models.Histogram
+	if err := json.Unmarshal(raw, &histogram); err != nil {
+		return nil, err
+	}
+	return &histogram, nil
+}
+
+// marshalLabels кодирует метки в JSON для колонки labels, пустой набор меток кодируется как {}.
+func marshalLabels(labels map[string]string) (string, error) {
+	if len(labels) == 0 {
+		return "{}", nil
+	}
+	raw, err := json.Marshal(labels)
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
+
+// unmarshalLabels декодирует колонку labels, пустой набор меток возвращается как nil.
+func unmarshalLabels(raw []byte) (map[string]string, error) {
+	var labels map[string]string
+	if err := json.Unmarshal(raw, &labels); err != nil {
+		return nil, err
+	}
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	return labels, nil
+}
+
 func (r *repository) isPgConnErr(err error) bool {
 	var pgErr *pgconn.PgError
 	return errors.As(err, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code)
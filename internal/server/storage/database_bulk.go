@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	apperrors "metrics-service/internal/server/errors"
+	"metrics-service/internal/server/models"
+	"metrics-service/internal/tenant"
+)
+
+// scalarUpdate - обновление серии counter или gauge, агрегированное по пакету.
+type scalarUpdate struct {
+	id     string
+	mtype  string
+	labels string // метки в JSON, см. marshalLabels
+	delta  *int64
+	value  *float64
+
+	indices []int // элементы пакета, относящиеся к серии
+}
+
+// aggregateUpdates объединяет обновления одной серии в пакете: дельты counter суммируются,
+// для gauge остается последнее значение. Upsert не может изменить одну строку дважды за запрос,
+// поэтому пакет с повторяющимися сериями без агрегации не вставить одним запросом.
+// Серии возвращаются в порядке первого появления в пакете.
+func aggregateUpdates(metrics []models.Metrics) ([]*scalarUpdate, error) {
+	updates := make([]*scalarUpdate, 0, len(metrics))
+	bySeries := make(map[string]*scalarUpdate, len(metrics))
+
+	for i, metric := range metrics {
+		if metric.MType != "counter" && metric.MType != "gauge" {
+			continue
+		}
+		labels, err := marshalLabels(metric.Labels)
+		if err != nil {
+			return nil, err
+		}
+
+		key := metric.MType + labelSep + metric.ID + labelSep + labels
+		update, exists := bySeries[key]
+		if !exists {
+			update = &scalarUpdate{id: metric.ID, mtype: metric.MType, labels: labels}
+			bySeries[key] = update
+			updates = append(updates, update)
+		}
+		update.indices = append(update.indices, i)
+
+		if metric.MType == "counter" {
+			delta := *metric.Delta
+			if update.delta != nil {
+				delta += *update.delta
+			}
+			update.delta = &delta
+		} else {
+			value := *metric.Value
+			update.value = &value
+		}
+	}
+	return updates, nil
+}
+
+// upsertLoop выполняет upsert каждой серии отдельным запросом и записывает в updates актуальные значения.
+func (r *repository) upsertLoop(ctx context.Context, tx *sql.Tx, updates []*scalarUpdate) error {
+	query := "INSERT INTO public.metrics(tenant, metric_id, metric_type, delta, value, labels) VALUES ($1, $2, $3, $4, $5, $6)"
+	query += " ON CONFLICT (tenant, metric_id, metric_type, labels) DO UPDATE SET delta = metrics.delta + EXCLUDED.delta, value = EXCLUDED.value"
+	query += " RETURNING delta, value;"
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		if r.isPgConnErr(err) {
+			return apperrors.ErrPgConnExc
+		}
+		log.Printf("failed to prepare statement: %v", err)
+		return apperrors.ErrServer
+	}
+	defer stmt.Close()
+
+	name := tenant.FromContext(ctx)
+	for _, update := range updates {
+		var delta sql.NullInt64
+		var value sql.NullFloat64
+		err = stmt.QueryRowContext(ctx, name, update.id, update.mtype, update.delta, update.value, update.labels).Scan(&delta, &value)
+		if err != nil {
+			if r.isPgConnErr(err) {
+				return apperrors.ErrPgConnExc
+			}
+			log.Printf("failed to execute statement for metric %s: %v", update.id, err)
+			return apperrors.ErrServer
+		}
+		update.setResult(delta, value)
+	}
+	return nil
+}
+
+// upsertBulk выполняет upsert всех серий одним запросом через unnest массивов и записывает в updates актуальные значения.
+func (r *repository) upsertBulk(ctx context.Context, tx *sql.Tx, updates []*scalarUpdate) error {
+	ids := make([]string, len(updates))
+	types := make([]string, len(updates))
+	deltas := make([]*int64, len(updates))
+	values := make([]*float64, len(updates))
+	labels := make([]string, len(updates))
+	for i, update := range updates {
+		ids[i], types[i], deltas[i], values[i], labels[i] = update.id, update.mtype, update.delta, update.value, update.labels
+	}
+
+	// RETURNING видит только строки таблицы, поэтому номер элемента восстанавливается соединением с входными данными
+	query := `WITH input AS (
+			SELECT * FROM unnest($1::text[], $2::text[], $3::bigint[], $4::double precision[], $5::text[])
+				WITH ORDINALITY AS t(metric_id, metric_type, delta, value, labels, idx)
+		), upserted AS (
+			INSERT INTO public.metrics(tenant, metric_id, metric_type, delta, value, labels)
+			SELECT $6, metric_id, metric_type::MType, delta, value, labels::jsonb FROM input
+			ON CONFLICT (tenant, metric_id, metric_type, labels) DO UPDATE SET delta = metrics.delta + EXCLUDED.delta, value = EXCLUDED.value
+			RETURNING metric_id, metric_type, labels, delta, value
+		)
+		SELECT input.idx, upserted.delta, upserted.value FROM upserted
+		JOIN input ON upserted.metric_id = input.metric_id
+			AND upserted.metric_type = input.metric_type::MType
+			AND upserted.labels = input.labels::jsonb`
+
+	rows, err := tx.QueryContext(ctx, query, ids, types, deltas, values, labels, tenant.FromContext(ctx))
+	if err != nil {
+		if r.isPgConnErr(err) {
+			return apperrors.ErrPgConnExc
+		}
+		log.Printf("failed to execute bulk upsert: %v", err)
+		return apperrors.ErrServer
+	}
+	defer rows.Close()
+
+	returned := 0
+	for rows.Next() {
+		var idx int
+		var delta sql.NullInt64
+		var value sql.NullFloat64
+		if err = rows.Scan(&idx, &delta, &value); err != nil {
+			log.Printf("failed to scan bulk upsert result: %v", err)
+			return apperrors.ErrServer
+		}
+		if idx < 1 || idx > len(updates) {
+			log.Printf("bulk upsert returned unexpected index %d", idx)
+			return apperrors.ErrServer
+		}
+		updates[idx-1].setResult(delta, value)
+		returned++
+	}
+	if err = rows.Err(); err != nil {
+		if r.isPgConnErr(err) {
+			return apperrors.ErrPgConnExc
+		}
+		log.Printf("bulk upsert iteration error: %v", err)
+		return apperrors.ErrServer
+	}
+	if returned != len(updates) {
+		log.Printf("bulk upsert returned %d rows, expected %d", returned, len(updates))
+		return apperrors.ErrServer
+	}
+	return nil
+}
+
+// insertHistory записывает актуальные значения серий в историю. Устаревшие записи удаляет PruneHistory.
+// Повторяющиеся в пакете обновления серии агрегируются, поэтому на серию приходится одна запись за пакет.
+func (r *repository) insertHistory(ctx context.Context, tx *sql.Tx, updates []*scalarUpdate) error {
+	ids := make([]string, len(updates))
+	types := make([]string, len(updates))
+	deltas := make([]*int64, len(updates))
+	values := make([]*float64, len(updates))
+	labels := make([]string, len(updates))
+	for i, update := range updates {
+		ids[i], types[i], deltas[i], values[i], labels[i] = update.id, update.mtype, update.delta, update.value, update.labels
+	}
+
+	query := `INSERT INTO public.metrics_history(tenant, metric_id, metric_type, delta, value, labels)
+		SELECT $6, metric_id, metric_type::MType, delta, value, labels::jsonb
+		FROM unnest($1::text[], $2::text[], $3::bigint[], $4::double precision[], $5::text[]) AS t(metric_id, metric_type, delta, value, labels)`
+	_, err := tx.ExecContext(ctx, query, ids, types, deltas, values, labels, tenant.FromContext(ctx))
+	if err != nil {
+		if r.isPgConnErr(err) {
+			return apperrors.ErrPgConnExc
+		}
+		log.Printf("failed to save history: %v", err)
+		return apperrors.ErrServer
+	}
+	return nil
+}
+
+// claimKey записывает ключ идемпотентности пакета и удаляет устаревшие ключи.
+// Если ключ уже записан, возвращает apperrors.ErrDuplicateBatch. Параллельная транзакция с тем же ключом
+// ждет завершения первой на уникальном индексе, поэтому пакет не применяется дважды.
+func (r *repository) claimKey(ctx context.Context, tx *sql.Tx, key string) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM public.idempotency_keys WHERE created_at < $1;", time.Now().Add(-r.idempotencyTTL))
+	if err != nil {
+		if r.isPgConnErr(err) {
+			return apperrors.ErrPgConnExc
+		}
+		log.Printf("failed to delete expired idempotency keys: %v", err)
+		return apperrors.ErrServer
+	}
+
+	query := "INSERT INTO public.idempotency_keys(tenant, key) VALUES ($1, $2) ON CONFLICT (tenant, key) DO NOTHING;"
+	result, err := tx.ExecContext(ctx, query, tenant.FromContext(ctx), key)
+	if err != nil {
+		if r.isPgConnErr(err) {
+			return apperrors.ErrPgConnExc
+		}
+		log.Printf("failed to save idempotency key: %v", err)
+		return apperrors.ErrServer
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		log.Printf("failed to get rows affected: %v", err)
+		return apperrors.ErrServer
+	}
+	if inserted == 0 {
+		return apperrors.ErrDuplicateBatch
+	}
+	return nil
+}
+
+// checkSeriesLimit проверяет, что новые серии пакета не превысят лимит количества серий арендатора,
+// иначе пакет отклоняется целиком с apperrors.ErrSeriesLimit. Транзакции не видят незафиксированных
+// серий друг друга, поэтому параллельные пакеты могут превысить лимит на количество своих новых серий.
+func (r *repository) checkSeriesLimit(ctx context.Context, tx *sql.Tx, metrics []models.Metrics) error {
+	name := tenant.FromContext(ctx)
+	r.limitsMu.RLock()
+	limit := r.limits.of(name)
+	r.limitsMu.RUnlock()
+	if limit <= 0 {
+		return nil
+	}
+
+	ids := make([]string, 0, len(metrics))
+	types := make([]string, 0, len(metrics))
+	labels := make([]string, 0, len(metrics))
+	seen := make(map[string]struct{}, len(metrics))
+	for _, metric := range metrics {
+		rawLabels, err := marshalLabels(metric.Labels)
+		if err != nil {
+			log.Printf("failed to marshal labels for metric %s: %v", metric.ID, err)
+			return apperrors.ErrServer
+		}
+		key := metric.MType + labelSep + metric.ID + labelSep + rawLabels
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		ids, types, labels = append(ids, metric.ID), append(types, metric.MType), append(labels, rawLabels)
+	}
+
+	query := `SELECT
+			(SELECT count(*) FROM public.metrics WHERE tenant = $1),
+			(SELECT count(*) FROM unnest($2::text[], $3::text[], $4::text[]) AS t(metric_id, metric_type, labels)
+				WHERE NOT EXISTS (SELECT 1 FROM public.metrics m
+					WHERE m.tenant = $1 AND m.metric_id = t.metric_id AND m.metric_type = t.metric_type::MType AND m.labels = t.labels::jsonb))`
+	var existing, added int
+	err := tx.QueryRowContext(ctx, query, name, ids, types, labels).Scan(&existing, &added)
+	if err != nil {
+		if r.isPgConnErr(err) {
+			return apperrors.ErrPgConnExc
+		}
+		log.Printf("failed to count series of tenant %s: %v", name, err)
+		return apperrors.ErrServer
+	}
+	if added > 0 && existing+added > limit {
+		return apperrors.ErrSeriesLimit
+	}
+	return nil
+}
+
+// setResult записывает актуальные значения серии после upsert.
+func (u *scalarUpdate) setResult(delta sql.NullInt64, value sql.NullFloat64) {
+	u.delta, u.value = nil, nil
+	if delta.Valid {
+		u.delta = &delta.Int64
+	}
+	if value.Valid {
+		u.value = &value.Float64
+	}
+}
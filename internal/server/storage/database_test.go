@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apperrors "metrics-service/internal/server/errors"
+	"metrics-service/internal/server/models"
+)
+
+func TestValidateMetric(t *testing.T) {
+	delta := int64(1)
+	value := 1.5
+
+	tests := []struct {
+		name    string
+		metric  models.Metrics
+		wantErr error
+	}{
+		{"counter", models.Metrics{ID: "c", MType: "counter", Delta: &delta}, nil},
+		{"counter without delta", models.Metrics{ID: "c", MType: "counter", Value: &value}, apperrors.ErrWrongMetricValue},
+		{"gauge", models.Metrics{ID: "g", MType: "gauge", Value: &value}, nil},
+		{"gauge without value", models.Metrics{ID: "g", MType: "gauge", Delta: &delta}, apperrors.ErrWrongMetricValue},
+		{"histogram", models.Metrics{ID: "h", MType: "histogram", Observations: []float64{1}}, nil},
+		{"unknown type", models.Metrics{ID: "u", MType: "summary", Value: &value}, apperrors.ErrInvalidMetricType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMetric(tt.metric)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestAggregateUpdates(t *testing.T) {
+	d1, d2 := int64(1), int64(2)
+	v1, v2 := 1.5, 2.5
+
+	metrics := []models.Metrics{
+		{ID: "c", MType: "counter", Delta: &d1},
+		{ID: "g", MType: "gauge", Value: &v1},
+		{ID: "c", MType: "counter", Delta: &d2},
+		{ID: "c", MType: "gauge", Value: &v2},
+		{ID: "c", MType: "counter", Delta: &d2, Labels: map[string]string{"host": "a"}},
+		{ID: "g", MType: "gauge", Value: &v2},
+		{ID: "h", MType: "histogram", Observations: []float64{1}},
+	}
+	updates, err := aggregateUpdates(metrics)
+	require.NoError(t, err)
+	require.Len(t, updates, 4)
+
+	assert.Equal(t, "counter", updates[0].mtype)
+	assert.Equal(t, int64(3), *updates[0].delta)
+	assert.Nil(t, updates[0].value)
+	assert.Equal(t, []int{0, 2}, updates[0].indices)
+
+	assert.Equal(t, 2.5, *updates[1].value)
+	assert.Equal(t, []int{1, 5}, updates[1].indices)
+
+	assert.Equal(t, "gauge", updates[2].mtype)
+	assert.Equal(t, "c", updates[2].id)
+
+	assert.Equal(t, `{"host":"a"}`, updates[3].labels)
+
+	// Агрегация не меняет исходные значения пакета
+	assert.Equal(t, int64(1), d1)
+}
+
+// BenchmarkUpsert сравнивает построчный upsert с пакетным через unnest.
+// Требует Postgres: go test -bench Upsert -run ^$ с переменной окружения TEST_DATABASE_DSN.
+func BenchmarkUpsert(b *testing.B) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		b.Skip("TEST_DATABASE_DSN is not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	require.NoError(b, err)
+	defer db.Close()
+
+	r := &repository{db: db, timeout: 10 * time.Second}
+	require.NoError(b, r.Bootstrap(context.Background()))
+
+	for _, size := range []int{35, 350} {
+		metrics := make([]models.Metrics, size)
+		for i := range metrics {
+			delta := int64(i)
+			value := float64(i)
+			if i%2 == 0 {
+				metrics[i] = models.Metrics{ID: "bench_counter_" + strconv.Itoa(i), MType: "counter", Delta: &delta}
+			} else {
+				metrics[i] = models.Metrics{ID: "bench_gauge_" + strconv.Itoa(i), MType: "gauge", Value: &value}
+			}
+		}
+		for _, bc := range []struct {
+			name   string
+			upsert func(ctx context.Context, tx *sql.Tx, updates []*scalarUpdate) error
+		}{
+			{"loop", r.upsertLoop},
+			{"bulk", r.upsertBulk},
+		} {
+			b.Run(bc.name+"/"+strconv.Itoa(size), func(b *testing.B) {
+				ctx := context.Background()
+				for i := 0; i < b.N; i++ {
+					// upsert записывает в updates актуальные значения, поэтому пакет агрегируется заново
+					updates, err := aggregateUpdates(metrics)
+					require.NoError(b, err)
+					tx, err := db.BeginTx(ctx, nil)
+					require.NoError(b, err)
+					require.NoError(b, bc.upsert(ctx, tx, updates))
+					require.NoError(b, tx.Commit())
+				}
+			})
+		}
+	}
+}
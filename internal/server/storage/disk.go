@@ -1,75 +1,228 @@
 package storage
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
+	apperrors "metrics-service/internal/server/errors"
 	"metrics-service/internal/server/models"
 )
 
+/*
+Формат снапшота: строка заголовка SnapshotHeader в JSON, затем строка с массивом метрик в JSON.
+Снапшот пишется во временный файл, синхронизируется с диском и атомарно переименовывается в filePath.
+Предыдущие снапшоты сдвигаются в filePath.1, filePath.2, ... (хранится не более keep снапшотов).
+*/
+
+// snapshotVersion - текущая версия формата снапшота.
+const snapshotVersion = 1
+
+var errEmptySnapshot = fmt.Errorf("%w: empty file", apperrors.ErrSnapshotCorrupted)
+
+// SnapshotHeader - заголовок файла снапшота.
+type SnapshotHeader struct {
+	Version   int       `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+	Checksum  string    `json:"checksum"` // sha256 строки с метриками в hex
+	WALSeq    uint64    `json:"wal_seq"`  // номер последней записи журнала, вошедшей в снапшот
+}
+
 // DiskWriter определяет интерфейс для сохранения метрик на диск.
 type DiskWriter interface {
-	Save(metrics []models.Metrics) error
+	// Save сохраняет снапшот метрик. walSeq - номер последней записи журнала, вошедшей в снапшот.
+	Save(metrics []models.Metrics, walSeq uint64) error
 }
 
 // diskWriter реализует интерфейс DiskWriter и сохраняет метрики в JSON-файл.
 type diskWriter struct {
 	filePath string
-	encoder  *json.Encoder
+	keep     int
 }
 
 // NewDiskWriter создает новый экземпляр DiskWriter.
-func NewDiskWriter(filePath string) (DiskWriter, error) {
-	return &diskWriter{filePath: filePath}, nil
+//
+// keep - количество хранимых снапшотов, включая текущий. При keep < 1 хранится один снапшот.
+func NewDiskWriter(filePath string, keep int) (DiskWriter, error) {
+	if keep < 1 {
+		keep = 1
+	}
+	return &diskWriter{filePath: filePath, keep: keep}, nil
 }
 
-// Save сохраняет массив метрик в файл в формате JSON.
-func (w *diskWriter) Save(metrics []models.Metrics) error {
-	file, err := os.OpenFile(w.filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+// Save атомарно сохраняет снапшот метрик на диск.
+func (w *diskWriter) Save(metrics []models.Metrics, walSeq uint64) error {
+	body, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+	checksum := sha256.Sum256(body)
+	header, err := json.Marshal(SnapshotHeader{
+		Version:   snapshotVersion,
+		Timestamp: time.Now().UTC(),
+		Checksum:  hex.EncodeToString(checksum[:]),
+		WALSeq:    walSeq,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmpPath := w.filePath + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
-	w.encoder = json.NewEncoder(file)
-	defer file.Close()
-	return w.encoder.Encode(&metrics)
+	writer := bufio.NewWriter(file)
+	for _, part := range [][]byte{header, body} {
+		writer.Write(part)
+		writer.WriteByte('\n')
+	}
+	if err = writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	// Сдвигаем предыдущие снапшоты, самый старый перезаписывается
+	for i := w.keep - 1; i >= 1; i-- {
+		err = os.Rename(snapshotPath(w.filePath, i-1), snapshotPath(w.filePath, i))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err = os.Rename(tmpPath, w.filePath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(w.filePath))
 }
 
 // DiskReader определяет интерфейс для загрузки метрик с диска.
 type DiskReader interface {
-	Load(m *metricsStorage) error
-	Close() error
+	// Load загружает в хранилище самый новый целый снапшот и возвращает номер последней записи журнала, вошедшей в него.
+	Load(m *metricsStorage) (uint64, error)
 }
 
-// diskReader реализует интерфейс DiskReader и загружает метрики из JSON-файла.
+// diskReader реализует интерфейс DiskReader и загружает метрики из JSON-файлов снапшотов.
 type diskReader struct {
-	file    *os.File
-	decoder *json.Decoder
+	filePath string
+	keep     int
 }
 
 // NewDiskReader создает новый экземпляр diskReader.
-func NewDiskReader(filePath string) (DiskReader, error) {
-	file, err := os.OpenFile(filePath, os.O_RDONLY|os.O_CREATE, 0666)
-	if err != nil {
-		return nil, err
+//
+// keep - количество хранимых снапшотов, среди которых ищется целый.
+func NewDiskReader(filePath string, keep int) (DiskReader, error) {
+	if keep < 1 {
+		keep = 1
 	}
-	return &diskReader{file, json.NewDecoder(file)}, nil
+	return &diskReader{filePath: filePath, keep: keep}, nil
 }
 
-// Load загружает метрики из файла и записывает их в хранилище.
-func (r *diskReader) Load(m *metricsStorage) error {
-	var metrics []models.Metrics
+// Load загружает метрики из самого нового целого снапшота и записывает их в хранилище.
+//
+// Отсутствие снапшотов не является ошибкой. Если снапшоты есть, но все повреждены, возвращается ErrSnapshotCorrupted.
+func (r *diskReader) Load(m *metricsStorage) (uint64, error) {
+	found := false
+	for i := 0; i < r.keep; i++ {
+		path := snapshotPath(r.filePath, i)
+		header, metrics, err := readSnapshot(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		// Пустой файл создавался старыми версиями сервера до первого сохранения
+		if errors.Is(err, errEmptySnapshot) {
+			log.Printf("Skipping empty snapshot %v", path)
+			continue
+		}
+		found = true
+		if err != nil {
+			log.Printf("Skipping snapshot %v: %v", path, err)
+			continue
+		}
+		if i > 0 {
+			log.Printf("Falling back to snapshot %v from %v", path, header.Timestamp)
+		}
+		m.setMetricsJSON(metrics)
+		return header.WALSeq, nil
+	}
+	if found {
+		return 0, fmt.Errorf("%w: no valid snapshot of %v", apperrors.ErrSnapshotCorrupted, r.filePath)
+	}
+	return 0, nil
+}
 
-	if err := r.decoder.Decode(&metrics); err != nil {
-		if err.Error() == "EOF" {
-			return nil
+// readSnapshot читает и проверяет файл снапшота.
+// Файл без заголовка (массив метрик) читается как снапшот старого формата.
+func readSnapshot(path string) (SnapshotHeader, []models.Metrics, error) {
+	var header SnapshotHeader
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return header, nil, err
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return header, nil, errEmptySnapshot
+	}
+
+	var metrics []models.Metrics
+	if data[0] == '[' {
+		if err = json.Unmarshal(data, &metrics); err != nil {
+			return header, nil, fmt.Errorf("%w: %v", apperrors.ErrSnapshotCorrupted, err)
 		}
-		return err
+		return header, metrics, nil
+	}
+
+	headerLine, body, ok := bytes.Cut(data, []byte{'\n'})
+	if !ok {
+		return header, nil, fmt.Errorf("%w: missing body", apperrors.ErrSnapshotCorrupted)
+	}
+	if err = json.Unmarshal(headerLine, &header); err != nil {
+		return header, nil, fmt.Errorf("%w: invalid header: %v", apperrors.ErrSnapshotCorrupted, err)
+	}
+	if header.Version != snapshotVersion {
+		return header, nil, fmt.Errorf("%w: unsupported version %d", apperrors.ErrSnapshotCorrupted, header.Version)
+	}
+	checksum := sha256.Sum256(body)
+	if hex.EncodeToString(checksum[:]) != header.Checksum {
+		return header, nil, fmt.Errorf("%w: checksum mismatch", apperrors.ErrSnapshotCorrupted)
+	}
+	if err = json.Unmarshal(body, &metrics); err != nil {
+		return header, nil, fmt.Errorf("%w: %v", apperrors.ErrSnapshotCorrupted, err)
 	}
-	m.setMetricsJSON(metrics)
-	return nil
+	return header, metrics, nil
 }
 
-// Close закрывает файл после чтения.
-func (r *diskReader) Close() error {
-	return r.file.Close()
+// snapshotPath возвращает путь к i-му снапшоту: 0 - текущий, 1 - предыдущий и т.д.
+func snapshotPath(filePath string, i int) string {
+	if i == 0 {
+		return filePath
+	}
+	return filePath + "." + strconv.Itoa(i)
+}
+
+// syncDir синхронизирует каталог, чтобы переименование файла пережило падение ОС.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
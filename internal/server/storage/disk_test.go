@@ -1,34 +1,96 @@
 package storage
 
 import (
-	"sync"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apperrors "metrics-service/internal/server/errors"
+	"metrics-service/internal/server/models"
 )
 
 func TestDiskStorage(t *testing.T) {
-	fName := `metrics.json`
+	fName := filepath.Join(t.TempDir(), "metrics.json")
 
-	metricsSt := &metricsStorage{sync.RWMutex{}, sync.RWMutex{}, make(map[string]float64), make(map[string]int64), nil}
-	metricsSt.setGauge("nameG", 10)
-	metricsSt.setCounter("nameC", 2)
+	metricsSt := newMetricsStorage(nil, 0)
+	metricsSt.setGauge("nameG", nil, 10)
+	metricsSt.setGauge("nameG", map[string]string{"host": "a"}, 11)
+	metricsSt.setCounter("nameC", nil, 2)
+	metricsSt.setHistogram("nameH", nil, &models.Histogram{Bounds: []float64{1}, Counts: []int64{2, 1}, Sum: 3.5, Count: 3})
 
-	diskW, _ := NewDiskWriter(fName)
-	err := diskW.Save(metricsSt.getMetricsJSON())
+	diskW, _ := NewDiskWriter(fName, 1)
+	err := diskW.Save(metricsSt.getMetricsJSON(), 7)
 	if err != nil {
 		t.Error(err)
 	}
 	saveResult := metricsSt.getMetricsJSON()
 
-	metricsSt = &metricsStorage{sync.RWMutex{}, sync.RWMutex{}, make(map[string]float64), make(map[string]int64), nil}
-	diskR, _ := NewDiskReader(fName)
-	err = diskR.Load(metricsSt)
+	metricsSt = newMetricsStorage(nil, 0)
+	diskR, _ := NewDiskReader(fName, 1)
+	walSeq, err := diskR.Load(metricsSt)
 	if err != nil {
 		t.Error(err)
 	}
 	loadResult := metricsSt.getMetricsJSON()
-	diskR.Close()
 
-	assert.Equal(t, saveResult, loadResult)
+	assert.Equal(t, uint64(7), walSeq)
+	assert.ElementsMatch(t, saveResult, loadResult)
+
+	_, err = os.Stat(fName + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDiskStorageFallback(t *testing.T) {
+	dir := t.TempDir()
+	fName := filepath.Join(dir, "metrics.json")
+
+	diskW, _ := NewDiskWriter(fName, 3)
+	for i := int64(1); i <= 4; i++ {
+		delta := i
+		require.NoError(t, diskW.Save([]models.Metrics{{ID: "nameC", MType: "counter", Delta: &delta}}, uint64(i)))
+	}
+
+	// Хранится не более трех снапшотов
+	_, err := os.Stat(fName + ".2")
+	require.NoError(t, err)
+	_, err = os.Stat(fName + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// Портим текущий снапшот так, чтобы JSON остался валидным
+	data, err := os.ReadFile(fName)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(fName, []byte(string(data[:len(data)-4])+"9}]\n"), 0666))
+
+	metricsSt := newMetricsStorage(nil, 0)
+	diskR, _ := NewDiskReader(fName, 3)
+	walSeq, err := diskR.Load(metricsSt)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), walSeq)
+	value, exists := metricsSt.getCounter("nameC", nil)
+	assert.True(t, exists)
+	assert.Equal(t, int64(3), value)
+
+	// Все снапшоты повреждены
+	for _, path := range []string{fName + ".1", fName + ".2"} {
+		require.NoError(t, os.WriteFile(path, []byte(`{"version":1}`), 0666))
+	}
+	_, err = diskR.Load(newMetricsStorage(nil, 0))
+	assert.ErrorIs(t, err, apperrors.ErrSnapshotCorrupted)
+}
+
+func TestDiskStorageLegacy(t *testing.T) {
+	fName := filepath.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, os.WriteFile(fName, []byte(`[{"id":"nameG","type":"gauge","value":1.5}]`+"\n"), 0666))
+
+	metricsSt := newMetricsStorage(nil, 0)
+	diskR, _ := NewDiskReader(fName, 3)
+	walSeq, err := diskR.Load(metricsSt)
+	require.NoError(t, err)
+	assert.Zero(t, walSeq)
+	value, exists := metricsSt.getGauge("nameG", nil)
+	assert.True(t, exists)
+	assert.Equal(t, 1.5, value)
 }
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	apperrors "metrics-service/internal/server/errors"
+	"metrics-service/internal/server/models"
+)
+
+// applyHistogram применяет обновление metric к текущему состоянию histogram и возвращает новое состояние.
+//
+// current == nil означает, что серия еще не объявлена: в этом случае metric должна содержать границы бакетов.
+// Обновление может содержать предварительно разложенные по бакетам значения (Histogram.Counts)
+// и/или отдельные наблюдения (Observations). current не изменяется.
+func applyHistogram(current *models.Histogram, metric models.Metrics) (*models.Histogram, error) {
+	var bounds []float64
+	if current != nil {
+		bounds = current.Bounds
+	}
+
+	if metric.Histogram != nil && len(metric.Histogram.Bounds) > 0 {
+		if err := validateBounds(metric.Histogram.Bounds); err != nil {
+			return nil, err
+		}
+		if current != nil && !equalBounds(current.Bounds, metric.Histogram.Bounds) {
+			return nil, fmt.Errorf("%w: metric %s declared with %v, got %v",
+				apperrors.ErrHistogramBuckets, metric.ID, current.Bounds, metric.Histogram.Bounds)
+		}
+		bounds = metric.Histogram.Bounds
+	}
+	if len(bounds) == 0 {
+		return nil, fmt.Errorf("%w: buckets of metric %s are not declared", apperrors.ErrInvalidHistogram, metric.ID)
+	}
+
+	result := copyHistogram(current)
+	if result == nil {
+		result = &models.Histogram{
+			Bounds: append([]float64(nil), bounds...),
+			Counts: make([]int64, len(bounds)+1),
+		}
+	}
+
+	if metric.Histogram != nil && len(metric.Histogram.Counts) > 0 {
+		if math.IsNaN(metric.Histogram.Sum) || math.IsInf(metric.Histogram.Sum, 0) {
+			return nil, fmt.Errorf("%w: sum of metric %s must be finite", apperrors.ErrInvalidHistogram, metric.ID)
+		}
+		if len(metric.Histogram.Counts) != len(bounds)+1 {
+			return nil, fmt.Errorf("%w: metric %s expects %d bucket counts, got %d",
+				apperrors.ErrInvalidHistogram, metric.ID, len(bounds)+1, len(metric.Histogram.Counts))
+		}
+		for i, count := range metric.Histogram.Counts {
+			if count < 0 {
+				return nil, fmt.Errorf("%w: negative bucket count in metric %s", apperrors.ErrInvalidHistogram, metric.ID)
+			}
+			result.Counts[i] += count
+			result.Count += count
+		}
+		result.Sum += metric.Histogram.Sum
+	}
+
+	for _, observation := range metric.Observations {
+		if math.IsNaN(observation) || math.IsInf(observation, 0) {
+			return nil, fmt.Errorf("%w: observation of metric %s must be finite, got %v", apperrors.ErrInvalidHistogram, metric.ID, observation)
+		}
+		// Бакет i содержит наблюдения <= bounds[i], последний бакет - +Inf
+		result.Counts[sort.SearchFloat64s(bounds, observation)]++
+		result.Sum += observation
+		result.Count++
+	}
+	// Сумма конечных значений может переполниться, а бесконечность не сериализуется в JSON снапшота
+	if math.IsInf(result.Sum, 0) {
+		return nil, fmt.Errorf("%w: sum of metric %s overflows", apperrors.ErrInvalidHistogram, metric.ID)
+	}
+
+	return result, nil
+}
+
+// validateBounds проверяет, что границы бакетов конечны и строго возрастают.
+func validateBounds(bounds []float64) error {
+	for i, bound := range bounds {
+		if math.IsNaN(bound) || math.IsInf(bound, 0) {
+			return fmt.Errorf("%w: bucket bound must be finite, got %v", apperrors.ErrInvalidHistogram, bound)
+		}
+		if i > 0 && bound <= bounds[i-1] {
+			return fmt.Errorf("%w: bucket bounds must be strictly ascending", apperrors.ErrInvalidHistogram)
+		}
+	}
+	return nil
+}
+
+func equalBounds(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// copyHistogram возвращает глубокую копию состояния histogram.
+func copyHistogram(h *models.Histogram) *models.Histogram {
+	if h == nil {
+		return nil
+	}
+	return &models.Histogram{
+		Bounds: append([]float64(nil), h.Bounds...),
+		Counts: append([]int64(nil), h.Counts...),
+		Sum:    h.Sum,
+		Count:  h.Count,
+	}
+}
+
+// formatHistogram форматирует состояние histogram в виде строки "count=N sum=S buckets=[le:count ...]".
+func formatHistogram(h *models.Histogram) string {
+	buckets := make([]string, 0, len(h.Counts))
+	for i, count := range h.Counts {
+		le := "+Inf"
+		if i < len(h.Bounds) {
+			le = strconv.FormatFloat(h.Bounds[i], 'f', -1, 64)
+		}
+		buckets = append(buckets, le+":"+strconv.FormatInt(count, 10))
+	}
+	return "count=" + strconv.FormatInt(h.Count, 10) +
+		" sum=" + strconv.FormatFloat(h.Sum, 'f', -1, 64) +
+		" buckets=[" + strings.Join(buckets, " ") + "]"
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultIdempotencyTTL - время хранения ключей идемпотентности пакетов по умолчанию.
+const defaultIdempotencyTTL = time.Hour
+
+// MaxIdempotencyKeyLen - максимальная длина ключа идемпотентности пакета.
+const MaxIdempotencyKeyLen = 200
+
+// idempotencyKeys хранит ключи недавно примененных пакетов in-memory хранилища.
+//
+// Ключи добавляются в порядке времени, поэтому устаревшие ключи удаляются с начала очереди.
+type idempotencyKeys struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	keys  map[string]time.Time
+	queue []idempotencyKey
+}
+
+// idempotencyKey - ключ в очереди на удаление.
+type idempotencyKey struct {
+	key     string
+	addedAt time.Time
+}
+
+func newIdempotencyKeys(ttl time.Duration) *idempotencyKeys {
+	return &idempotencyKeys{ttl: ttl, keys: make(map[string]time.Time)}
+}
+
+// reserve запоминает ключ и возвращает false, если ключ уже был запомнен и еще не устарел.
+func (k *idempotencyKeys) reserve(key string, now time.Time) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.expire(now)
+	if _, exists := k.keys[key]; exists {
+		return false
+	}
+	k.keys[key] = now
+	k.queue = append(k.queue, idempotencyKey{key: key, addedAt: now})
+	return true
+}
+
+// release забывает ключ пакета, который не удалось применить, чтобы повтор пакета был применен.
+func (k *idempotencyKeys) release(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.keys, key)
+}
+
+// expire удаляет ключи старше ttl.
+func (k *idempotencyKeys) expire(now time.Time) {
+	deadline := now.Add(-k.ttl)
+	i := 0
+	for ; i < len(k.queue) && k.queue[i].addedAt.Before(deadline); i++ {
+		item := k.queue[i]
+		// Ключ мог быть освобожден и запомнен заново, тогда его время в карте новее
+		if addedAt, exists := k.keys[item.key]; exists && addedAt.Equal(item.addedAt) {
+			delete(k.keys, item.key)
+		}
+	}
+	if i > 0 {
+		k.queue = append(k.queue[:0], k.queue[i:]...)
+	}
+}
@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	keys := newIdempotencyKeys(time.Minute)
+	now := time.Now()
+
+	assert.True(t, keys.reserve("a", now))
+	assert.False(t, keys.reserve("a", now.Add(time.Second)))
+
+	// Освобожденный ключ можно запомнить снова
+	keys.release("a")
+	assert.True(t, keys.reserve("a", now.Add(2*time.Second)))
+	assert.True(t, keys.reserve("b", now.Add(30*time.Second)))
+
+	// Устаревшие ключи забываются, остальные остаются
+	later := now.Add(time.Minute + 10*time.Second)
+	assert.True(t, keys.reserve("a", later))
+	assert.False(t, keys.reserve("b", later))
+	assert.Len(t, keys.queue, 2)
+}
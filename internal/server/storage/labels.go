@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// labelSep разделяет части ключа серии. Не встречается в валидном UTF-8, поэтому ключи разных серий не совпадают.
+const labelSep = "\xff"
+
+// seriesKey возвращает ключ серии метрики: имя и отсортированный набор меток.
+func seriesKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	var sb strings.Builder
+	sb.WriteString(name)
+	for _, key := range sortedLabelKeys(labels) {
+		sb.WriteString(labelSep + key + labelSep + labels[key])
+	}
+	return sb.String()
+}
+
+// formatSeries возвращает человекочитаемое имя серии вида name{key="value",...}.
+func formatSeries(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	pairs := make([]string, 0, len(labels))
+	for _, key := range sortedLabelKeys(labels) {
+		pairs = append(pairs, key+"="+strconv.Quote(labels[key]))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// matchLabels проверяет, что labels содержит все пары ключ-значение из matcher.
+func matchLabels(labels, matcher map[string]string) bool {
+	for key, value := range matcher {
+		if actual, exists := labels[key]; !exists || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// copyLabels возвращает копию набора меток, чтобы хранилище не зависело от мапы вызывающего.
+func copyLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	labelsCopy := make(map[string]string, len(labels))
+	for key, value := range labels {
+		labelsCopy[key] = value
+	}
+	return labelsCopy
+}
+
+func sortedLabelKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
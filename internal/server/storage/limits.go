@@ -0,0 +1,68 @@
+package storage
+
+import "sync/atomic"
+
+// seriesLimit ограничивает количество серий арендатора в in-memory хранилище.
+// Серии удаляются только при откате пакета, поэтому достаточно счетчика созданных серий.
+// Серии считаются и без ограничения, чтобы лимит можно было включить без перезапуска (см. set).
+type seriesLimit struct {
+	max   atomic.Int64 // 0 - без ограничения
+	count atomic.Int64
+}
+
+// newSeriesLimit создает лимит в max серий для хранилища, в котором уже есть count серий.
+// При max <= 0 количество серий не ограничено.
+func newSeriesLimit(max, count int) *seriesLimit {
+	l := &seriesLimit{}
+	l.set(max)
+	l.count.Store(int64(count))
+	return l
+}
+
+// set меняет лимит. Если серий уже больше нового лимита, они сохраняются, но новые серии не создаются.
+func (l *seriesLimit) set(max int) {
+	l.max.Store(int64(max))
+}
+
+// admit занимает место для новой серии и сообщает, не превышен ли лимит. Для nil лимита всегда true.
+func (l *seriesLimit) admit() bool {
+	if l == nil {
+		return true
+	}
+	for {
+		n := l.count.Load()
+		if max := l.max.Load(); max > 0 && n >= max {
+			return false
+		}
+		if l.count.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// release освобождает место серии, созданной отмененным пакетом. Для nil лимита ничего не делает.
+func (l *seriesLimit) release() {
+	if l == nil {
+		return
+	}
+	l.count.Add(-1)
+}
+
+// seriesLimits - лимиты количества серий арендаторов.
+type seriesLimits struct {
+	max     int            // лимит по умолчанию, 0 - без ограничения
+	tenants map[string]int // лимиты отдельных арендаторов
+}
+
+// of возвращает лимит количества серий арендатора name, 0 - без ограничения.
+func (l seriesLimits) of(name string) int {
+	if limit, ok := l.tenants[name]; ok {
+		return limit
+	}
+	return l.max
+}
+
+// seriesLimits возвращает лимиты количества серий арендаторов из конфигурации.
+func (c Config) seriesLimits() seriesLimits {
+	return seriesLimits{max: c.MaxSeries, tenants: c.TenantMaxSeries}
+}
@@ -3,8 +3,10 @@ package storage
 import (
 	"context"
 	"fmt"
+	"log"
 	"strconv"
 	"sync"
+	"time"
 
 	apperrors "metrics-service/internal/server/errors"
 	"metrics-service/internal/server/models"
@@ -14,52 +16,140 @@ import (
 Хранилище метрик
 gauge - метрика текущего состояния системы. Новое значение всегда заменяет старое
 counter - метрика-счетчик событий (кол-во запросов и ошибок). Новое значение добавляется к существующему
+histogram - распределение наблюдений по бакетам (например, задержки запросов). Наблюдения накапливаются
+
+Серии разбиты на шарды по хешу имени метрики, у каждого шарда свой мьютекс,
+поэтому обновления разных метрик не конкурируют за одну блокировку.
 */
 
+// defaultShardCount - количество шардов in-memory хранилища.
+const defaultShardCount = 32
+
 // metricsStorage реализует Storage в виде inline-memory хранилища
 type metricsStorage struct {
-	muGauge   sync.RWMutex
-	muCounter sync.RWMutex
-	gauge     map[string]float64
-	counter   map[string]int64
-	diskW     DiskWriter
+	shards []*shard
+	diskW  DiskWriter
+
+	// wal - журнал упреждающей записи, nil если журнал отключен.
+	// muCheckpoint разделяет запись обновлений (RLock) и ротацию журнала в Save (Lock),
+	// чтобы каждое обновление попало либо в снапшот, либо в новый сегмент журнала. Чтение его не блокирует.
+	wal          WAL
+	muCheckpoint sync.RWMutex
+	muSave       sync.Mutex
+
+	// keys - ключи идемпотентности недавно примененных пакетов.
+	keys *idempotencyKeys
+
+	// limit - лимит количества серий, nil - серии не считаются и не ограничены.
+	limit *seriesLimit
+
+	historyRetention time.Duration
 }
 
-func (m *metricsStorage) UpdateJSON(ctx context.Context, metric *models.Metrics) error {
-	switch metric.MType {
-	case "counter":
-		m.setCounter(metric.ID, *metric.Delta)
-		actualVal, exists := m.getCounter(metric.ID)
-		if !exists {
-			return apperrors.ErrServer
-		}
-		*metric.Delta = actualVal
-	case "gauge":
-		m.setGauge(metric.ID, *metric.Value)
-		actualVal, exists := m.getGauge(metric.ID)
-		if !exists {
-			return apperrors.ErrServer
+// shard - часть хранилища с сериями метрик, имена которых попадают в шард по хешу.
+type shard struct {
+	mu        sync.RWMutex
+	gauge     map[string]gaugeSeries     // ключ - seriesKey имени и меток
+	counter   map[string]counterSeries   // ключ - seriesKey имени и меток
+	histogram map[string]histogramSeries // ключ - seriesKey имени и меток
+	history   map[string][]models.Sample // ключ - тип и ключ серии, сэмплы упорядочены по времени
+}
+
+// gaugeSeries - серия gauge: имя, набор меток и текущее значение.
+type gaugeSeries struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// counterSeries - серия counter: имя, набор меток и накопленное значение.
+type counterSeries struct {
+	name   string
+	labels map[string]string
+	value  int64
+}
+
+// histogramSeries - серия histogram: имя, набор меток и накопленное распределение.
+type histogramSeries struct {
+	name   string
+	labels map[string]string
+	value  *models.Histogram
+}
+
+// seriesSnapshot - значение серии в снимке хранилища.
+//
+// labels и histogram разделяются с хранилищем: хранилище их не изменяет, а заменяет новыми,
+// поэтому снимок не копирует их под блокировкой. Получатель снимка не должен их изменять.
+type seriesSnapshot struct {
+	mtype     string
+	name      string
+	labels    map[string]string
+	delta     int64
+	value     float64
+	histogram *models.Histogram
+}
+
+// newMetricsStorage создает пустое in-memory хранилище.
+//
+// historyRetention - время хранения истории значений, при historyRetention <= 0 история не ведется.
+func newMetricsStorage(diskW DiskWriter, historyRetention time.Duration) *metricsStorage {
+	return newShardedStorage(diskW, historyRetention, defaultShardCount)
+}
+
+// newShardedStorage создает пустое in-memory хранилище из shardCount шардов.
+func newShardedStorage(diskW DiskWriter, historyRetention time.Duration, shardCount int) *metricsStorage {
+	shards := make([]*shard, shardCount)
+	for i := range shards {
+		shards[i] = &shard{
+			gauge:     make(map[string]gaugeSeries),
+			counter:   make(map[string]counterSeries),
+			histogram: make(map[string]histogramSeries),
+			history:   make(map[string][]models.Sample),
 		}
-		*metric.Value = actualVal
 	}
-	return nil
+	return &metricsStorage{
+		shards:           shards,
+		diskW:            diskW,
+		keys:             newIdempotencyKeys(defaultIdempotencyTTL),
+		historyRetention: historyRetention,
+	}
+}
+
+func (m *metricsStorage) UpdateJSON(ctx context.Context, metric *models.Metrics) error {
+	m.muCheckpoint.RLock()
+	defer m.muCheckpoint.RUnlock()
+
+	if err := m.appendWAL("", []models.Metrics{*metric}); err != nil {
+		return err
+	}
+
+	s := m.shardFor(metric.ID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.apply(metric, m.historyNow(true), m.historyRetention, m.limit)
 }
 
 func (m *metricsStorage) Get(ctx context.Context, metricType, metricName string) (string, error) {
 	switch metricType {
 	case "counter":
-		metricVal, exists := m.getCounter(metricName)
+		metricVal, exists := m.getCounter(metricName, nil)
 		if !exists {
 			return "", apperrors.ErrMetricNotExist
 		}
 		return strconv.FormatInt(metricVal, 10), nil
 	case "gauge":
-		metricVal, exists := m.getGauge(metricName)
+		metricVal, exists := m.getGauge(metricName, nil)
 
 		if !exists {
 			return "", apperrors.ErrMetricNotExist
 		}
 		return strconv.FormatFloat(metricVal, 'f', -1, 64), nil
+	case "histogram":
+		metricVal, exists := m.getHistogram(metricName, nil)
+		if !exists {
+			return "", apperrors.ErrMetricNotExist
+		}
+		return formatHistogram(metricVal), nil
 	default:
 		return "", apperrors.ErrInvalidMetricType
 	}
@@ -68,87 +158,228 @@ func (m *metricsStorage) Get(ctx context.Context, metricType, metricName string)
 func (m *metricsStorage) GetJSON(ctx context.Context, metric *models.Metrics) error {
 	switch metric.MType {
 	case "counter":
-		metricVal, exists := m.getCounter(metric.ID)
+		metricVal, exists := m.getCounter(metric.ID, metric.Labels)
 		if !exists {
 			return apperrors.ErrMetricNotExist
 		}
 		metric.Delta = &metricVal
 	case "gauge":
-		metricVal, exists := m.getGauge(metric.ID)
+		metricVal, exists := m.getGauge(metric.ID, metric.Labels)
 
 		if !exists {
 			return apperrors.ErrMetricNotExist
 		}
 		metric.Value = &metricVal
+	case "histogram":
+		metricVal, exists := m.getHistogram(metric.ID, metric.Labels)
+		if !exists {
+			return apperrors.ErrMetricNotExist
+		}
+		metric.Histogram = metricVal
 	}
 	return nil
 }
 
+func (m *metricsStorage) GetByLabels(ctx context.Context, metricType, metricName string, labels map[string]string) ([]models.Metrics, error) {
+	if metricType != "counter" && metricType != "gauge" && metricType != "histogram" {
+		return nil, apperrors.ErrInvalidMetricType
+	}
+
+	// Все серии одного имени лежат в одном шарде
+	shards := m.shards
+	if metricName != "" {
+		shards = []*shard{m.shardFor(metricName)}
+	}
+
+	metrics := make([]models.Metrics, 0)
+	for _, s := range shards {
+		for _, series := range s.snapshot(metricType) {
+			if (metricName == "" || series.name == metricName) && matchLabels(series.labels, labels) {
+				metrics = append(metrics, series.toMetrics())
+			}
+		}
+	}
+	return metrics, nil
+}
+
 func (m *metricsStorage) Update(ctx context.Context, metricType, metricName, metricValStr string) error {
-	// Обновляем значение метрики в зависимости от типа
+	metric := models.Metrics{ID: metricName, MType: metricType}
+
+	// Разбираем значение метрики в зависимости от типа
 	switch metricType {
 	case "counter":
 		metricVal, err := strconv.ParseInt(metricValStr, 10, 64)
 		if err != nil {
 			return apperrors.ErrWrongMetricValue
 		}
-		m.setCounter(metricName, metricVal)
+		metric.Delta = &metricVal
 
 	case "gauge":
 		metricVal, err := strconv.ParseFloat(metricValStr, 64)
 		if err != nil {
 			return apperrors.ErrWrongMetricValue
 		}
-		m.setGauge(metricName, metricVal)
+		metric.Value = &metricVal
+
+	case "histogram":
+		// Значение в URL - одно наблюдение для histogram с уже объявленными бакетами
+		metricVal, err := strconv.ParseFloat(metricValStr, 64)
+		if err != nil {
+			return apperrors.ErrWrongMetricValue
+		}
+		metric.Observations = []float64{metricVal}
 
 	default:
 		return apperrors.ErrInvalidMetricType
 	}
-	return nil
+
+	return m.UpdateBatch(ctx, []models.Metrics{metric})
 }
 
 func (m *metricsStorage) GetMetrics(ctx context.Context) ([][]string, error) {
-
-	m.muGauge.RLock()
-	defer m.muGauge.RUnlock()
-	m.muCounter.RLock()
-	defer m.muCounter.RUnlock()
+	series := m.snapshot()
 
 	// Используем срез срезов, чтобы хранить одинаковые ключи разных типов
-	metrics := make([][]string, 0, len(m.gauge)+len(m.counter)) // len m.gauge и m.counter закрыты мьютексом
-
-	for metricName, metricVal := range m.counter {
-		metrics = append(metrics, []string{metricName, strconv.FormatInt(metricVal, 10)})
-	}
-	for metricName, metricVal := range m.gauge {
-		metrics = append(metrics, []string{metricName, strconv.FormatFloat(metricVal, 'f', -1, 64)})
+	metrics := make([][]string, 0, len(series))
+	for _, s := range series {
+		var value string
+		switch s.mtype {
+		case "counter":
+			value = strconv.FormatInt(s.delta, 10)
+		case "gauge":
+			value = strconv.FormatFloat(s.value, 'f', -1, 64)
+		case "histogram":
+			value = formatHistogram(s.histogram)
+		}
+		metrics = append(metrics, []string{formatSeries(s.name, s.labels), value})
 	}
 	return metrics, nil
 }
 
+func (m *metricsStorage) GetMetricsJSON(ctx context.Context) ([]models.Metrics, error) {
+	return m.getMetricsJSON(), nil
+}
+
 func (m *metricsStorage) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
-	for _, metric := range metrics {
-		switch metric.MType {
-		case "gauge":
-			m.setGauge(metric.ID, *metric.Value)
-		case "counter":
-			m.setCounter(metric.ID, *metric.Delta)
-		default:
-			return fmt.Errorf("%w, metric: %v", apperrors.ErrInvalidMetricType, metric)
+	m.muCheckpoint.RLock()
+	defer m.muCheckpoint.RUnlock()
+
+	if err := m.appendWAL("", metrics); err != nil {
+		return err
+	}
+	return m.applyBatch(metrics, true)
+}
+
+// UpdateBatchOnce применяет пакет, если пакет с ключом key еще не применялся за время хранения ключей.
+// Ключ записывается в журнал вместе с пакетом, поэтому переживает перезапуск до следующего снапшота.
+func (m *metricsStorage) UpdateBatchOnce(ctx context.Context, key string, metrics []models.Metrics) error {
+	if !m.keys.reserve(key, time.Now()) {
+		return apperrors.ErrDuplicateBatch
+	}
+
+	m.muCheckpoint.RLock()
+	defer m.muCheckpoint.RUnlock()
+
+	if err := m.appendWAL(key, metrics); err != nil {
+		m.keys.release(key)
+		return err
+	}
+	// Пакет с ошибкой не применяется, поэтому ключ освобождается и повтор пакета будет применен, как в Postgres
+	if err := m.applyBatch(metrics, true); err != nil {
+		m.keys.release(key)
+		return err
+	}
+	return nil
+}
+
+func (m *metricsStorage) GetHistory(ctx context.Context, metricType, metricName string, labels map[string]string, from, to time.Time) ([]models.Sample, error) {
+	key := seriesKey(metricName, labels)
+	s := m.shardFor(metricName)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var exists bool
+	switch metricType {
+	case "counter":
+		_, exists = s.counter[key]
+	case "gauge":
+		_, exists = s.gauge[key]
+	default:
+		return nil, apperrors.ErrInvalidMetricType
+	}
+	if !exists {
+		return nil, apperrors.ErrMetricNotExist
+	}
+
+	// Сэмплы серии, которая давно не обновлялась, удаляются только периодической очисткой
+	if expired := time.Now().Add(-m.historyRetention); from.Before(expired) {
+		from = expired
+	}
+
+	samples := make([]models.Sample, 0)
+	for _, sample := range s.history[historyKey(metricType, metricName, labels)] {
+		if sample.Timestamp.Before(from) || sample.Timestamp.After(to) {
+			continue
 		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// PruneHistory удаляет из истории всех серий сэмплы, вышедшие за окно хранения.
+// Без нее история серий, которые больше не обновляются, хранилась бы бессрочно.
+func (m *metricsStorage) PruneHistory(ctx context.Context) error {
+	if m.historyRetention <= 0 {
+		return nil
+	}
+	expired := time.Now().Add(-m.historyRetention)
+	for _, s := range m.shards {
+		s.mu.Lock()
+		s.pruneHistory(expired)
+		s.mu.Unlock()
 	}
 	return nil
 }
 
+// Save сохраняет снапшот хранилища на диск.
+//
+// При включенном журнале снимок состояния и ротация журнала выполняются атомарно относительно обновлений,
+// после успешной записи снапшота отложенный сегмент журнала удаляется. Снапшот хранит номер
+// последней вошедшей в него записи журнала, поэтому при падении до удаления сегмента
+// записи сегмента не применяются к снапшоту повторно.
 func (m *metricsStorage) Save() error {
 	if m.diskW == nil {
 		return nil
 	}
-	err := m.diskW.Save(m.getMetricsJSON())
+
+	m.muSave.Lock()
+	defer m.muSave.Unlock()
+
+	var walSeq uint64
+	m.muCheckpoint.Lock()
+	series := m.snapshot()
+	if m.wal != nil {
+		walSeq = m.wal.LastSeq()
+		if err := m.wal.Rotate(); err != nil {
+			m.muCheckpoint.Unlock()
+			log.Printf("Failed to rotate WAL: %v", err)
+			return apperrors.ErrServer
+		}
+	}
+	m.muCheckpoint.Unlock()
+
+	err := m.diskW.Save(snapshotMetrics(series), walSeq)
 	if err != nil {
-		// TODO: logging
+		log.Printf("Failed to save snapshot: %v", err)
 		return apperrors.ErrServer
 	}
+
+	if m.wal != nil {
+		if err = m.wal.RemoveRotated(); err != nil {
+			log.Printf("Failed to remove rotated WAL: %v", err)
+			return apperrors.ErrServer
+		}
+	}
 	return nil
 }
 
@@ -163,44 +394,487 @@ func (m *metricsStorage) Bootstrap(ctx context.Context) error {
 }
 
 func (m *metricsStorage) Close() error {
-	return nil
+	if m.wal == nil {
+		return nil
+	}
+	return m.wal.Close()
 }
 
 // internal
 
-func (m *metricsStorage) setGauge(key string, value float64) {
-	m.muGauge.Lock()
-	defer m.muGauge.Unlock()
-	m.gauge[key] = value
+// shardFor возвращает шард, в котором хранятся серии метрики name.
+func (m *metricsStorage) shardFor(name string) *shard {
+	return m.shards[m.shardIndex(name)]
 }
 
-func (m *metricsStorage) getGauge(key string) (float64, bool) {
-	m.muGauge.RLock()
-	defer m.muGauge.RUnlock()
-	val, exists := m.gauge[key]
-	return val, exists
+// shardIndex возвращает номер шарда по хешу FNV-1a имени метрики.
+func (m *metricsStorage) shardIndex(name string) int {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+	hash := uint32(offset32)
+	for i := 0; i < len(name); i++ {
+		hash ^= uint32(name[i])
+		hash *= prime32
+	}
+	return int(hash % uint32(len(m.shards)))
 }
 
-func (m *metricsStorage) setCounter(key string, value int64) {
-	m.muCounter.Lock()
-	defer m.muCounter.Unlock()
-	m.counter[key] += value
+// historyNow возвращает время сэмпла истории, нулевое время означает, что история не записывается.
+func (m *metricsStorage) historyNow(recordHistory bool) time.Time {
+	if !recordHistory || m.historyRetention <= 0 {
+		return time.Time{}
+	}
+	return time.Now()
 }
 
-func (m *metricsStorage) getCounter(key string) (int64, bool) {
-	m.muCounter.RLock()
-	defer m.muCounter.RUnlock()
-	val, exists := m.counter[key]
-	return val, exists
+// appendWAL записывает пакет обновлений с ключом идемпотентности key в журнал, если журнал включен.
+func (m *metricsStorage) appendWAL(key string, metrics []models.Metrics) error {
+	if m.wal == nil {
+		return nil
+	}
+	if err := m.wal.Append(key, metrics); err != nil {
+		log.Printf("Failed to append to WAL: %v", err)
+		return apperrors.ErrServer
+	}
+	return nil
+}
+
+// applyBatch применяет пакет обновлений целиком или, при ошибке одного из обновлений, не применяет совсем,
+// как транзакция Postgres. Возвращает ошибку первого по порядку обновления с ошибкой.
+//
+// Пакет группируется по шардам с сохранением порядка обновлений внутри шарда, каждый шард блокируется один раз.
+// Шарды пакета блокируются по возрастанию номера и освобождаются после применения всего пакета, поэтому snapshot,
+// блокирующий шарды в том же порядке, видит пакет целиком или не видит совсем. Пакеты, затрагивающие разные шарды,
+// обрабатываются параллельно.
+func (m *metricsStorage) applyBatch(metrics []models.Metrics, recordHistory bool) error {
+	// Группируем пакет по шардам сортировкой подсчетом, порядок внутри шарда сохраняется
+	shardOf := make([]int, len(metrics))
+	starts := make([]int, len(m.shards)+1)
+	for i, metric := range metrics {
+		shardOf[i] = m.shardIndex(metric.ID)
+		starts[shardOf[i]+1]++
+	}
+	for i := 1; i < len(starts); i++ {
+		starts[i] += starts[i-1]
+	}
+	order := make([]int, len(metrics))
+	next := append([]int(nil), starts[:len(m.shards)]...)
+	for i, shardIdx := range shardOf {
+		order[next[shardIdx]] = i
+		next[shardIdx]++
+	}
+
+	now := m.historyNow(recordHistory)
+	var firstErr error
+	firstErrIdx := len(metrics)
+	undo := newBatchUndo()
+	locked := make([]*shard, 0, len(m.shards))
+	for shardIdx, s := range m.shards {
+		if starts[shardIdx] == starts[shardIdx+1] {
+			continue
+		}
+		s.mu.Lock()
+		locked = append(locked, s)
+		for _, idx := range order[starts[shardIdx]:starts[shardIdx+1]] {
+			metric := metrics[idx]
+			undo.save(s, &metric)
+			if err := s.apply(&metric, now, m.historyRetention, m.limit); err != nil && idx < firstErrIdx {
+				firstErr, firstErrIdx = err, idx
+			}
+		}
+	}
+	// Шарды пакета еще заблокированы, поэтому откат не виден ни снимкам, ни другим пакетам
+	if firstErr != nil {
+		undo.rollback(m.limit)
+	}
+	for _, s := range locked {
+		s.mu.Unlock()
+	}
+	return firstErr
+}
+
+// batchUndo хранит прежнее состояние серий, измененных пакетом, для отката пакета с ошибкой.
+type batchUndo struct {
+	saved   map[string]bool
+	records []undoRecord
+}
+
+// undoRecord - состояние серии и ее истории до первого обновления пакета.
+type undoRecord struct {
+	s          *shard
+	mtype      string
+	key        string
+	existed    bool
+	gauge      gaugeSeries
+	counter    counterSeries
+	histogram  histogramSeries
+	historyKey string
+	history    []models.Sample
+	hadHistory bool
+}
+
+func newBatchUndo() *batchUndo {
+	return &batchUndo{saved: make(map[string]bool)}
+}
+
+// save запоминает состояние серии metric, если пакет еще не изменял ее. Вызывается под блокировкой шарда.
+func (u *batchUndo) save(s *shard, metric *models.Metrics) {
+	key := seriesKey(metric.ID, metric.Labels)
+	record := undoRecord{s: s, mtype: metric.MType, key: key, historyKey: historyKey(metric.MType, metric.ID, metric.Labels)}
+	if u.saved[record.historyKey] {
+		return
+	}
+	switch metric.MType {
+	case "counter":
+		record.counter, record.existed = s.counter[key]
+	case "gauge":
+		record.gauge, record.existed = s.gauge[key]
+	case "histogram":
+		record.histogram, record.existed = s.histogram[key]
+	default:
+		return
+	}
+	record.history, record.hadHistory = s.history[record.historyKey]
+	u.saved[record.historyKey] = true
+	u.records = append(u.records, record)
+}
+
+// rollback возвращает серии в состояние до пакета и освобождает в limit места созданных пакетом серий.
+// Вызывается под блокировкой всех шардов пакета.
+func (u *batchUndo) rollback(limit *seriesLimit) {
+	for _, r := range u.records {
+		var created bool
+		switch r.mtype {
+		case "counter":
+			_, created = r.s.counter[r.key]
+			if r.existed {
+				r.s.counter[r.key] = r.counter
+			} else {
+				delete(r.s.counter, r.key)
+			}
+		case "gauge":
+			_, created = r.s.gauge[r.key]
+			if r.existed {
+				r.s.gauge[r.key] = r.gauge
+			} else {
+				delete(r.s.gauge, r.key)
+			}
+		case "histogram":
+			_, created = r.s.histogram[r.key]
+			if r.existed {
+				r.s.histogram[r.key] = r.histogram
+			} else {
+				delete(r.s.histogram, r.key)
+			}
+		}
+		if created && !r.existed {
+			limit.release()
+		}
+
+		// Сэмплы добавляются в конец, поэтому прежний срез истории не изменен
+		if r.hadHistory {
+			r.s.history[r.historyKey] = r.history
+		} else {
+			delete(r.s.history, r.historyKey)
+		}
+	}
+}
+
+// replay применяет пакет обновлений из журнала. Ошибки пакета повторяют ошибки исходного запроса,
+// поэтому они не прерывают восстановление. Ключ идемпотентности запоминается заново только для примененного
+// пакета: ключ пакета с ошибкой был освобожден, и его повтор после перезапуска должен примениться.
+func (m *metricsStorage) replay(key string, metrics []models.Metrics) {
+	if err := m.applyBatch(metrics, false); err != nil || key == "" {
+		return
+	}
+	m.keys.reserve(key, time.Now())
+}
+
+// seriesCount возвращает количество серий хранилища.
+func (m *metricsStorage) seriesCount() int {
+	count := 0
+	for _, s := range m.shards {
+		s.mu.RLock()
+		count += len(s.gauge) + len(s.counter) + len(s.histogram)
+		s.mu.RUnlock()
+	}
+	return count
+}
+
+// snapshot возвращает согласованный снимок всех серий хранилища: каждый пакет обновлений виден целиком или не виден совсем.
+//
+// Шарды блокируются на чтение по возрастанию номера и освобождаются после копирования последнего, как пакет
+// в applyBatch. Снимок не ждет записи обновлений в журнал и задерживает только обновления уже скопированных шардов
+// на время поверхностного копирования значений. Форматирование и сериализация снимка выполняются без блокировок.
+func (m *metricsStorage) snapshot() []seriesSnapshot {
+	series := make([]seriesSnapshot, 0, m.seriesCount())
+	for _, s := range m.shards {
+		s.mu.RLock()
+		series = s.appendSnapshotLocked(series, "")
+	}
+	for _, s := range m.shards {
+		s.mu.RUnlock()
+	}
+	return series
+}
+
+// snapshot возвращает снимок серий шарда типа metricType, пустой тип - серии всех типов.
+func (s *shard) snapshot(metricType string) []seriesSnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.appendSnapshotLocked(nil, metricType)
+}
+
+// appendSnapshotLocked добавляет в series серии шарда типа metricType. Вызывается под блокировкой шарда.
+func (s *shard) appendSnapshotLocked(series []seriesSnapshot, metricType string) []seriesSnapshot {
+	if metricType == "" || metricType == "gauge" {
+		for _, g := range s.gauge {
+			series = append(series, seriesSnapshot{mtype: "gauge", name: g.name, labels: g.labels, value: g.value})
+		}
+	}
+	if metricType == "" || metricType == "counter" {
+		for _, c := range s.counter {
+			series = append(series, seriesSnapshot{mtype: "counter", name: c.name, labels: c.labels, delta: c.value})
+		}
+	}
+	if metricType == "" || metricType == "histogram" {
+		for _, h := range s.histogram {
+			series = append(series, seriesSnapshot{mtype: "histogram", name: h.name, labels: h.labels, histogram: h.value})
+		}
+	}
+	return series
+}
+
+// toMetrics возвращает серию снимка в виде models.Metrics с собственными копиями меток и histogram.
+func (s seriesSnapshot) toMetrics() models.Metrics {
+	metric := models.Metrics{ID: s.name, MType: s.mtype, Labels: copyLabels(s.labels)}
+	switch s.mtype {
+	case "counter":
+		delta := s.delta
+		metric.Delta = &delta
+	case "gauge":
+		value := s.value
+		metric.Value = &value
+	case "histogram":
+		metric.Histogram = copyHistogram(s.histogram)
+	}
+	return metric
+}
+
+func snapshotMetrics(series []seriesSnapshot) []models.Metrics {
+	metrics := make([]models.Metrics, 0, len(series))
+	for _, s := range series {
+		metrics = append(metrics, s.toMetrics())
+	}
+	return metrics
+}
+
+// apply применяет обновление к шарду и записывает в metric актуальное значение серии.
+// Вызывается под блокировкой шарда.
+//
+// Нулевое now отключает запись истории: при воспроизведении журнала время исходных обновлений неизвестно.
+// Новая серия создается, только если ее допускает limit.
+func (s *shard) apply(metric *models.Metrics, now time.Time, retention time.Duration, limit *seriesLimit) error {
+	switch metric.MType {
+	case "counter":
+		if metric.Delta == nil {
+			return apperrors.ErrWrongMetricValue
+		}
+		if !s.admit(metric.MType, seriesKey(metric.ID, metric.Labels), limit) {
+			return apperrors.ErrSeriesLimit
+		}
+		actualVal := s.addCounter(metric.ID, metric.Labels, *metric.Delta)
+		metric.Delta = &actualVal
+		if !now.IsZero() {
+			s.addSample(metric.MType, metric.ID, metric.Labels, models.Sample{Timestamp: now, Delta: &actualVal}, retention)
+		}
+	case "gauge":
+		if metric.Value == nil {
+			return apperrors.ErrWrongMetricValue
+		}
+		if !s.admit(metric.MType, seriesKey(metric.ID, metric.Labels), limit) {
+			return apperrors.ErrSeriesLimit
+		}
+		actualVal := *metric.Value
+		s.setGauge(metric.ID, metric.Labels, actualVal)
+		metric.Value = &actualVal
+		if !now.IsZero() {
+			s.addSample(metric.MType, metric.ID, metric.Labels, models.Sample{Timestamp: now, Value: &actualVal}, retention)
+		}
+	case "histogram":
+		actualVal, err := s.updateHistogram(*metric, limit)
+		if err != nil {
+			return err
+		}
+		metric.Histogram = actualVal
+		metric.Observations = nil
+	default:
+		return fmt.Errorf("%w, metric: %v", apperrors.ErrInvalidMetricType, *metric)
+	}
+	return nil
+}
+
+// setGauge заменяет значение серии gauge. Вызывается под блокировкой шарда.
+func (s *shard) setGauge(name string, labels map[string]string, value float64) {
+	key := seriesKey(name, labels)
+	series, exists := s.gauge[key]
+	if !exists {
+		series = gaugeSeries{name: name, labels: copyLabels(labels)}
+	}
+	series.value = value
+	s.gauge[key] = series
+}
+
+// addCounter добавляет value к счетчику и возвращает его актуальное значение. Вызывается под блокировкой шарда.
+func (s *shard) addCounter(name string, labels map[string]string, value int64) int64 {
+	key := seriesKey(name, labels)
+	series, exists := s.counter[key]
+	if !exists {
+		series = counterSeries{name: name, labels: copyLabels(labels)}
+	}
+	series.value += value
+	s.counter[key] = series
+	return series.value
+}
+
+// admit сообщает, можно ли записать серию типа metricType с ключом key: существующая серия обновляется всегда,
+// новая занимает место в limit. Вызывается под блокировкой шарда.
+func (s *shard) admit(metricType, key string, limit *seriesLimit) bool {
+	if limit == nil {
+		return true
+	}
+	var exists bool
+	switch metricType {
+	case "counter":
+		_, exists = s.counter[key]
+	case "gauge":
+		_, exists = s.gauge[key]
+	case "histogram":
+		_, exists = s.histogram[key]
+	}
+	return exists || limit.admit()
+}
+
+// updateHistogram применяет обновление к серии histogram и возвращает копию ее актуального состояния.
+// Вызывается под блокировкой шарда.
+func (s *shard) updateHistogram(metric models.Metrics, limit *seriesLimit) (*models.Histogram, error) {
+	key := seriesKey(metric.ID, metric.Labels)
+	series, exists := s.histogram[key]
+	if !exists {
+		series = histogramSeries{name: metric.ID, labels: copyLabels(metric.Labels)}
+	}
+	// applyHistogram возвращает новое состояние, прежнее остается неизменным для снимков
+	value, err := applyHistogram(series.value, metric)
+	if err != nil {
+		return nil, err
+	}
+	// Место в лимите занимает только принятое обновление
+	if !exists && !s.admit(metric.MType, key, limit) {
+		return nil, apperrors.ErrSeriesLimit
+	}
+	series.value = value
+	s.histogram[key] = series
+	return copyHistogram(value), nil
+}
+
+// addSample записывает значение метрики в историю и удаляет сэмплы, вышедшие за окно хранения.
+// Вызывается под блокировкой шарда.
+func (s *shard) addSample(metricType, metricName string, labels map[string]string, sample models.Sample, retention time.Duration) {
+	key := historyKey(metricType, metricName, labels)
+
+	samples := expireSamples(s.history[key], sample.Timestamp.Add(-retention))
+	s.history[key] = append(samples, sample)
+}
+
+// pruneHistory удаляет сэмплы старше expired и историю серий без сэмплов. Вызывается под блокировкой шарда.
+func (s *shard) pruneHistory(expired time.Time) {
+	for key, samples := range s.history {
+		kept := expireSamples(samples, expired)
+		switch {
+		case len(kept) == 0:
+			delete(s.history, key)
+		case len(kept) < len(samples):
+			// Копия освобождает память удаленных сэмплов
+			s.history[key] = append([]models.Sample(nil), kept...)
+		}
+	}
+}
+
+// expireSamples возвращает сэмплы не старше expired.
+func expireSamples(samples []models.Sample, expired time.Time) []models.Sample {
+	// Сэмплы упорядочены по времени, поэтому устаревшие всегда в начале
+	i := 0
+	for i < len(samples) && samples[i].Timestamp.Before(expired) {
+		i++
+	}
+	return samples[i:]
+}
+
+func historyKey(metricType, metricName string, labels map[string]string) string {
+	return metricType + ":" + seriesKey(metricName, labels)
+}
+
+func (m *metricsStorage) setGauge(name string, labels map[string]string, value float64) {
+	s := m.shardFor(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setGauge(name, labels, value)
+}
+
+func (m *metricsStorage) getGauge(name string, labels map[string]string) (float64, bool) {
+	s := m.shardFor(name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	series, exists := s.gauge[seriesKey(name, labels)]
+	return series.value, exists
+}
+
+// setCounter добавляет value к счетчику и возвращает его актуальное значение.
+func (m *metricsStorage) setCounter(name string, labels map[string]string, value int64) int64 {
+	s := m.shardFor(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addCounter(name, labels, value)
+}
+
+func (m *metricsStorage) getCounter(name string, labels map[string]string) (int64, bool) {
+	s := m.shardFor(name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	series, exists := s.counter[seriesKey(name, labels)]
+	return series.value, exists
+}
+
+// setHistogram заменяет состояние серии histogram, используется при загрузке с диска.
+func (m *metricsStorage) setHistogram(name string, labels map[string]string, value *models.Histogram) {
+	s := m.shardFor(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.histogram[seriesKey(name, labels)] = histogramSeries{name: name, labels: copyLabels(labels), value: copyHistogram(value)}
+}
+
+func (m *metricsStorage) getHistogram(name string, labels map[string]string) (*models.Histogram, bool) {
+	s := m.shardFor(name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	series, exists := s.histogram[seriesKey(name, labels)]
+	return copyHistogram(series.value), exists
 }
 
 func (m *metricsStorage) setMetricsJSON(metrics []models.Metrics) {
 	for _, metric := range metrics {
 		switch metric.MType {
 		case "gauge":
-			m.setGauge(metric.ID, *metric.Value)
+			m.setGauge(metric.ID, metric.Labels, *metric.Value)
 		case "counter":
-			m.setCounter(metric.ID, *metric.Delta)
+			m.setCounter(metric.ID, metric.Labels, *metric.Delta)
+		case "histogram":
+			if metric.Histogram == nil || validateBounds(metric.Histogram.Bounds) != nil || len(metric.Histogram.Counts) != len(metric.Histogram.Bounds)+1 {
+				continue
+			}
+			m.setHistogram(metric.ID, metric.Labels, metric.Histogram)
 		default:
 			continue
 		}
@@ -208,18 +882,5 @@ func (m *metricsStorage) setMetricsJSON(metrics []models.Metrics) {
 }
 
 func (m *metricsStorage) getMetricsJSON() []models.Metrics {
-	var metrics []models.Metrics
-
-	m.muGauge.RLock()
-	defer m.muGauge.RUnlock()
-	m.muCounter.RLock()
-	defer m.muCounter.RUnlock()
-
-	for name, val := range m.gauge {
-		metrics = append(metrics, models.Metrics{ID: name, MType: "gauge", Value: &val})
-	}
-	for name, val := range m.counter {
-		metrics = append(metrics, models.Metrics{ID: name, MType: "counter", Delta: &val})
-	}
-	return metrics
+	return snapshotMetrics(m.snapshot())
 }
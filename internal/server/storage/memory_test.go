@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apperrors "metrics-service/internal/server/errors"
+	"metrics-service/internal/server/models"
+)
+
+func TestMetricsStorageSnapshotConsistency(t *testing.T) {
+	st := newMetricsStorage(nil, 0)
+	ctx := context.Background()
+
+	// Имена должны попасть в разные шарды, иначе тест не проверяет согласованность между шардами
+	nameA, nameB := "consistencyA", "consistencyB"
+	for i := 0; st.shardIndex(nameA) == st.shardIndex(nameB); i++ {
+		nameB = "consistencyB" + strconv.Itoa(i)
+	}
+
+	delta := int64(1)
+	batch := []models.Metrics{
+		{ID: nameA, MType: "counter", Delta: &delta},
+		{ID: nameB, MType: "counter", Delta: &delta},
+	}
+
+	var wg sync.WaitGroup
+	var done atomic.Bool
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !done.Load() {
+				assert.NoError(t, st.UpdateBatch(ctx, batch))
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		values := make(map[string]int64)
+		for _, metric := range st.getMetricsJSON() {
+			values[metric.ID] = *metric.Delta
+		}
+		require.Equal(t, values[nameA], values[nameB], "snapshot sees a partially applied batch")
+	}
+	done.Store(true)
+	wg.Wait()
+}
+
+// BenchmarkMetricsStorage измеряет параллельные UpdateBatch вместе с чтением GetMetrics.
+// Хранилище из одного шарда соответствует прежней схеме с общими мьютексами.
+//
+// read_every - доля чтений среди операций горутин, reader=parallel - отдельная горутина, непрерывно вызывающая
+// GetMetrics. Для обновлений сообщается 99-й перцентиль задержки. Вариант wal=always пишет журнал с fsync
+// на каждое обновление: чтение не должно ждать fsync.
+func BenchmarkMetricsStorage(b *testing.B) {
+	const batchSize = 35
+
+	type mode struct {
+		readEvery int
+		parallel  bool
+		wal       bool
+	}
+	modes := []mode{{readEvery: 0}, {readEvery: 10}, {parallel: true}, {parallel: true, wal: true}}
+
+	for _, shardCount := range []int{1, defaultShardCount} {
+		for _, md := range modes {
+			name := "shards=" + strconv.Itoa(shardCount) + "/read_every=" + strconv.Itoa(md.readEvery)
+			if md.parallel {
+				name = "shards=" + strconv.Itoa(shardCount) + "/reader=parallel"
+			}
+			if md.wal {
+				name += "/wal=always"
+			}
+			b.Run(name, func(b *testing.B) {
+				st := newShardedStorage(nil, 0, shardCount)
+				if md.wal {
+					w, err := NewWAL(filepath.Join(b.TempDir(), "metrics.json.wal"), WALSyncAlways, 0)
+					require.NoError(b, err)
+					defer w.Close()
+					st.wal = w
+				}
+				ctx := context.Background()
+				var agent atomic.Int64
+
+				var readerWg sync.WaitGroup
+				readerDone := make(chan struct{})
+				if md.parallel {
+					readerWg.Add(1)
+					go func() {
+						defer readerWg.Done()
+						for {
+							select {
+							case <-readerDone:
+								return
+							default:
+							}
+							if _, err := st.GetMetrics(ctx); err != nil {
+								b.Error(err)
+							}
+						}
+					}()
+				}
+
+				var muLatencies sync.Mutex
+				var latencies []time.Duration
+
+				b.RunParallel(func(pb *testing.PB) {
+					// Каждая горутина - отдельный агент со своим набором метрик
+					prefix := "agent" + strconv.FormatInt(agent.Add(1), 10) + "_"
+					batch := make([]models.Metrics, batchSize)
+					for i := range batch {
+						delta := int64(1)
+						value := float64(i)
+						if i%2 == 0 {
+							batch[i] = models.Metrics{ID: prefix + "counter" + strconv.Itoa(i), MType: "counter", Delta: &delta}
+						} else {
+							batch[i] = models.Metrics{ID: prefix + "gauge" + strconv.Itoa(i), MType: "gauge", Value: &value}
+						}
+					}
+
+					var local []time.Duration
+					ops := 0
+					for pb.Next() {
+						ops++
+						if md.readEvery > 0 && ops%md.readEvery == 0 {
+							if _, err := st.GetMetrics(ctx); err != nil {
+								b.Error(err)
+							}
+							continue
+						}
+						start := time.Now()
+						if err := st.UpdateBatch(ctx, batch); err != nil {
+							b.Error(err)
+						}
+						local = append(local, time.Since(start))
+					}
+
+					muLatencies.Lock()
+					latencies = append(latencies, local...)
+					muLatencies.Unlock()
+				})
+
+				close(readerDone)
+				readerWg.Wait()
+
+				if len(latencies) > 0 {
+					sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+					b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-update-ns")
+				}
+			})
+		}
+	}
+}
+
+func TestMetricsStorageHistoryRetention(t *testing.T) {
+	st := newMetricsStorage(nil, time.Hour)
+	ctx := context.Background()
+
+	value := 1.0
+	require.NoError(t, st.UpdateJSON(ctx, &models.Metrics{ID: "idle", MType: "gauge", Value: &value}))
+
+	// Серия больше не обновляется, ее сэмпл выходит за окно хранения
+	s := st.shardFor("idle")
+	key := historyKey("gauge", "idle", nil)
+	s.history[key][0].Timestamp = time.Now().Add(-2 * time.Hour)
+
+	samples, err := st.GetHistory(ctx, "gauge", "idle", nil, time.Time{}, time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, samples)
+
+	require.NoError(t, st.PruneHistory(ctx))
+	assert.NotContains(t, s.history, key)
+}
+
+func TestMetricsStorageBatchAtomic(t *testing.T) {
+	st := newMetricsStorage(nil, time.Hour)
+	ctx := context.Background()
+
+	delta := int64(2)
+	value := 1.5
+	require.NoError(t, st.UpdateBatch(ctx, []models.Metrics{{ID: "nameC", MType: "counter", Delta: &delta}}))
+
+	// Observations без объявленных бакетов - ошибка, пакет не применяется целиком
+	batch := []models.Metrics{
+		{ID: "nameC", MType: "counter", Delta: &delta},
+		{ID: "nameG", MType: "gauge", Value: &value},
+		{ID: "nameH", MType: "histogram", Observations: []float64{1}},
+	}
+	assert.Error(t, st.UpdateBatchOnce(ctx, "agent-1", batch))
+
+	counter, exists := st.getCounter("nameC", nil)
+	require.True(t, exists)
+	assert.Equal(t, int64(2), counter)
+	_, exists = st.getGauge("nameG", nil)
+	assert.False(t, exists)
+	samples, err := st.GetHistory(ctx, "counter", "nameC", nil, time.Time{}, time.Now())
+	require.NoError(t, err)
+	assert.Len(t, samples, 1)
+
+	// Ключ пакета с ошибкой освобожден, исправленный повтор применяется
+	batch[2].Histogram = &models.Histogram{Bounds: []float64{1}}
+	require.NoError(t, st.UpdateBatchOnce(ctx, "agent-1", batch))
+	counter, _ = st.getCounter("nameC", nil)
+	assert.Equal(t, int64(4), counter)
+}
+
+func TestMetricsStorageHistogramSum(t *testing.T) {
+	st := newMetricsStorage(nil, 0)
+	ctx := context.Background()
+
+	for _, sum := range []float64{math.NaN(), math.Inf(1)} {
+		metric := models.Metrics{ID: "latency", MType: "histogram", Histogram: &models.Histogram{Bounds: []float64{1}, Counts: []int64{1, 0}, Sum: sum}}
+		assert.ErrorIs(t, st.UpdateJSON(ctx, &metric), apperrors.ErrInvalidHistogram)
+	}
+	for _, observation := range []float64{math.Inf(1), math.Inf(-1)} {
+		metric := models.Metrics{ID: "latency", MType: "histogram", Histogram: &models.Histogram{Bounds: []float64{1}}, Observations: []float64{observation}}
+		assert.ErrorIs(t, st.UpdateJSON(ctx, &metric), apperrors.ErrInvalidHistogram)
+	}
+	// Переполнение суммы конечных наблюдений
+	metric := models.Metrics{ID: "latency", MType: "histogram", Histogram: &models.Histogram{Bounds: []float64{1}}, Observations: []float64{math.MaxFloat64, math.MaxFloat64}}
+	assert.ErrorIs(t, st.UpdateJSON(ctx, &metric), apperrors.ErrInvalidHistogram)
+	_, exists := st.getHistogram("latency", nil)
+	assert.False(t, exists)
+
+	// Наблюдение по URL в объявленную histogram, сумма остается конечной и снапшот сериализуется
+	metric = models.Metrics{ID: "latency", MType: "histogram", Histogram: &models.Histogram{Bounds: []float64{1}}, Observations: []float64{0.5}}
+	require.NoError(t, st.UpdateJSON(ctx, &metric))
+	assert.ErrorIs(t, st.Update(ctx, "histogram", "latency", "+Inf"), apperrors.ErrInvalidHistogram)
+	histogram, _ := st.getHistogram("latency", nil)
+	assert.Equal(t, 0.5, histogram.Sum)
+	_, err := json.Marshal(st.getMetricsJSON())
+	assert.NoError(t, err)
+}
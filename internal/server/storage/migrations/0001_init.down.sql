@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.metrics;
+DROP TYPE IF EXISTS MType;
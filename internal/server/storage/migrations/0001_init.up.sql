@@ -0,0 +1,16 @@
+-- Исходная схема: таблица метрик без меток, тип метрики из enum MType.
+-- Миграция идемпотентна, чтобы подхватить базы, созданные до появления миграций.
+DO $$
+BEGIN
+	CREATE TYPE MType AS ENUM ('gauge', 'counter');
+EXCEPTION
+	WHEN duplicate_object THEN NULL;
+END
+$$;
+
+CREATE TABLE IF NOT EXISTS public.metrics (
+	metric_id VARCHAR(100) PRIMARY KEY,
+	metric_type MType,
+	delta BIGINT,
+	value DOUBLE PRECISION
+);
@@ -0,0 +1,9 @@
+-- Без меток имя метрики снова уникально: серии с метками и дубли имени другого типа удаляются.
+DELETE FROM public.metrics WHERE labels <> '{}'::jsonb;
+DELETE FROM public.metrics a USING public.metrics b
+	WHERE a.metric_id = b.metric_id AND a.metric_type > b.metric_type;
+
+ALTER TABLE public.metrics DROP CONSTRAINT metrics_pkey;
+ALTER TABLE public.metrics ADD PRIMARY KEY (metric_id);
+ALTER TABLE public.metrics ALTER COLUMN metric_type DROP NOT NULL;
+ALTER TABLE public.metrics DROP COLUMN labels;
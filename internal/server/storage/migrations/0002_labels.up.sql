@@ -0,0 +1,8 @@
+-- Серия метрики определяется именем, типом и набором меток.
+ALTER TABLE public.metrics ADD COLUMN labels JSONB NOT NULL DEFAULT '{}'::jsonb;
+
+DELETE FROM public.metrics WHERE metric_type IS NULL;
+ALTER TABLE public.metrics ALTER COLUMN metric_type SET NOT NULL;
+
+ALTER TABLE public.metrics DROP CONSTRAINT metrics_pkey;
+ALTER TABLE public.metrics ADD PRIMARY KEY (metric_id, metric_type, labels);
@@ -0,0 +1,12 @@
+-- История значений метрик, записи старше срока хранения периодически удаляются сервером.
+CREATE TABLE public.metrics_history (
+	metric_id VARCHAR(100) NOT NULL,
+	metric_type MType NOT NULL,
+	delta BIGINT,
+	value DOUBLE PRECISION,
+	labels JSONB NOT NULL DEFAULT '{}'::jsonb,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX metrics_history_metric_idx
+	ON public.metrics_history (metric_type, metric_id, labels, created_at);
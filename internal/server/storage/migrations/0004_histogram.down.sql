@@ -0,0 +1,10 @@
+-- Значение enum нельзя удалить, поэтому тип пересоздается без histogram.
+DELETE FROM public.metrics WHERE metric_type = 'histogram';
+DELETE FROM public.metrics_history WHERE metric_type = 'histogram';
+ALTER TABLE public.metrics DROP COLUMN histogram;
+
+CREATE TYPE MType_old AS ENUM ('gauge', 'counter');
+ALTER TABLE public.metrics ALTER COLUMN metric_type TYPE MType_old USING metric_type::text::MType_old;
+ALTER TABLE public.metrics_history ALTER COLUMN metric_type TYPE MType_old USING metric_type::text::MType_old;
+DROP TYPE MType;
+ALTER TYPE MType_old RENAME TO MType;
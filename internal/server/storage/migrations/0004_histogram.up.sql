@@ -0,0 +1,3 @@
+-- Тип histogram хранит распределение наблюдений в JSONB.
+ALTER TYPE MType ADD VALUE IF NOT EXISTS 'histogram';
+ALTER TABLE public.metrics ADD COLUMN histogram JSONB;
@@ -0,0 +1,2 @@
+-- Удаленные при миграции строки не восстанавливаются.
+ALTER TABLE public.metrics DROP CONSTRAINT IF EXISTS metrics_type_value_check;
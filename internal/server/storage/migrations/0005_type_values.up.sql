@@ -0,0 +1,22 @@
+-- До разделения серий по типу upsert конфликтовал только по metric_id: запись gauge в строку counter
+-- обнуляла delta и записывала value, запись counter в строку gauge обнуляла value.
+-- Сохранившиеся значения gauge из таких строк переносим в отдельные серии gauge, остальные испорченные строки удаляем.
+INSERT INTO public.metrics(metric_id, metric_type, value, labels)
+	SELECT metric_id, 'gauge', value, labels FROM public.metrics
+	WHERE metric_type = 'counter' AND value IS NOT NULL
+ON CONFLICT (metric_id, metric_type, labels) DO NOTHING;
+
+UPDATE public.metrics SET value = NULL WHERE metric_type = 'counter';
+UPDATE public.metrics SET delta = NULL WHERE metric_type = 'gauge';
+UPDATE public.metrics SET delta = NULL, value = NULL WHERE metric_type = 'histogram';
+DELETE FROM public.metrics
+	WHERE metric_type = 'counter' AND delta IS NULL
+		OR metric_type = 'gauge' AND value IS NULL
+		OR metric_type = 'histogram' AND histogram IS NULL;
+
+-- Каждый тип хранит значение только в своей колонке
+ALTER TABLE public.metrics ADD CONSTRAINT metrics_type_value_check CHECK (
+	metric_type = 'counter' AND delta IS NOT NULL AND value IS NULL AND histogram IS NULL
+	OR metric_type = 'gauge' AND value IS NOT NULL AND delta IS NULL AND histogram IS NULL
+	OR metric_type = 'histogram' AND histogram IS NOT NULL AND delta IS NULL AND value IS NULL
+);
@@ -0,0 +1,7 @@
+-- Ключи идемпотентности примененных пакетов, устаревшие ключи удаляются при обновлении.
+CREATE TABLE public.idempotency_keys (
+	key VARCHAR(200) PRIMARY KEY,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX idempotency_keys_created_at_idx ON public.idempotency_keys (created_at);
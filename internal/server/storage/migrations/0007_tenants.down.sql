@@ -0,0 +1,16 @@
+-- Без арендаторов остаются только данные арендатора по умолчанию.
+DELETE FROM public.idempotency_keys WHERE tenant <> 'default';
+ALTER TABLE public.idempotency_keys DROP CONSTRAINT idempotency_keys_pkey;
+ALTER TABLE public.idempotency_keys ADD PRIMARY KEY (key);
+ALTER TABLE public.idempotency_keys DROP COLUMN tenant;
+
+DELETE FROM public.metrics_history WHERE tenant <> 'default';
+DROP INDEX public.metrics_history_metric_idx;
+CREATE INDEX metrics_history_metric_idx
+	ON public.metrics_history (metric_type, metric_id, labels, created_at);
+ALTER TABLE public.metrics_history DROP COLUMN tenant;
+
+DELETE FROM public.metrics WHERE tenant <> 'default';
+ALTER TABLE public.metrics DROP CONSTRAINT metrics_pkey;
+ALTER TABLE public.metrics ADD PRIMARY KEY (metric_id, metric_type, labels);
+ALTER TABLE public.metrics DROP COLUMN tenant;
@@ -0,0 +1,13 @@
+-- Серии, история и ключи идемпотентности принадлежат арендатору, прежние данные - арендатору по умолчанию.
+ALTER TABLE public.metrics ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+ALTER TABLE public.metrics DROP CONSTRAINT metrics_pkey;
+ALTER TABLE public.metrics ADD PRIMARY KEY (tenant, metric_id, metric_type, labels);
+
+ALTER TABLE public.metrics_history ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+DROP INDEX public.metrics_history_metric_idx;
+CREATE INDEX metrics_history_metric_idx
+	ON public.metrics_history (tenant, metric_type, metric_id, labels, created_at);
+
+ALTER TABLE public.idempotency_keys ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+ALTER TABLE public.idempotency_keys DROP CONSTRAINT idempotency_keys_pkey;
+ALTER TABLE public.idempotency_keys ADD PRIMARY KEY (tenant, key);
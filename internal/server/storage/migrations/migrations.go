@@ -0,0 +1,265 @@
+// Package migrations содержит версионированные миграции схемы Postgres и их применение.
+//
+// Миграции хранятся в файлах NNNN_name.up.sql и NNNN_name.down.sql, встроенных в бинарник.
+// Примененные версии записываются в таблицу schema_version. На время применения берется
+// advisory lock, поэтому несколько реплик сервера могут запускать миграции одновременно.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed *.sql
+var migrationsFS embed.FS
+
+// lockKey - ключ advisory lock миграций.
+const lockKey = 7273546
+
+// Migration - миграция схемы.
+type Migration struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+}
+
+// MigrationStatus - состояние миграции в базе.
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator определяет интерфейс применения миграций.
+type Migrator interface {
+	// Up применяет все непримененные миграции и возвращает их количество.
+	Up(ctx context.Context) (int, error)
+	// Down откатывает последнюю примененную миграцию и возвращает ее версию, 0 - если откатывать нечего.
+	Down(ctx context.Context) (int, error)
+	// Status возвращает состояние всех миграций.
+	Status(ctx context.Context) ([]MigrationStatus, error)
+}
+
+// migrator реализует интерфейс Migrator для Postgres.
+type migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// NewMigrator создает новый экземпляр Migrator со встроенными миграциями.
+func NewMigrator(db *sql.DB) (Migrator, error) {
+	migrations, err := load(migrationsFS)
+	if err != nil {
+		return nil, err
+	}
+	return &migrator{db: db, migrations: migrations}, nil
+}
+
+// Up применяет все непримененные миграции по возрастанию версии, каждую в отдельной транзакции.
+func (m *migrator) Up(ctx context.Context) (int, error) {
+	applied := 0
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if _, exists := versions[migration.Version]; exists {
+				continue
+			}
+			err = execTx(ctx, conn, migration.up,
+				`INSERT INTO public.schema_version(version, name) VALUES ($1, $2)`, migration.Version, migration.Name)
+			if err != nil {
+				return fmt.Errorf("failed to apply migration %04d_%s: %w", migration.Version, migration.Name, err)
+			}
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down откатывает последнюю примененную миграцию.
+func (m *migrator) Down(ctx context.Context) (int, error) {
+	reverted := 0
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+			if _, exists := versions[migration.Version]; !exists {
+				continue
+			}
+			err = execTx(ctx, conn, migration.down,
+				`DELETE FROM public.schema_version WHERE version = $1`, migration.Version)
+			if err != nil {
+				return fmt.Errorf("failed to revert migration %04d_%s: %w", migration.Version, migration.Name, err)
+			}
+			reverted = migration.Version
+			return nil
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Status возвращает состояние всех миграций.
+func (m *migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			appliedAt, exists := versions[migration.Version]
+			statuses = append(statuses, MigrationStatus{Migration: migration, Applied: exists, AppliedAt: appliedAt})
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// withLock выполняет fn на отдельном соединении под advisory lock миграций.
+// Advisory lock принадлежит сессии, поэтому все запросы миграций идут через одно соединение.
+func (m *migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey)
+	if err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	// Снимаем lock и при отмене ctx, иначе он останется на соединении в пуле
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockKey)
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS public.schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now());`)
+	if err != nil {
+		return fmt.Errorf("failed to create table schema_version: %w", err)
+	}
+	return fn(conn)
+}
+
+// appliedVersions возвращает примененные версии и время их применения.
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM public.schema_version`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schema_version: %w", err)
+	}
+	defer rows.Close()
+
+	versions := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan schema_version: %w", err)
+		}
+		versions[version] = appliedAt
+	}
+	return versions, rows.Err()
+}
+
+// execTx выполняет скрипт миграции и запись в schema_version в одной транзакции.
+func execTx(ctx context.Context, conn *sql.Conn, script, versionQuery string, args ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, script); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, versionQuery, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// load читает миграции из fsys и проверяет, что версии идут подряд с 1 и у каждой есть up и down.
+func load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		base, ok := strings.CutSuffix(fileName, ".sql")
+		if !ok {
+			continue
+		}
+		base, direction, ok := cutLast(base, ".")
+		if !ok || direction != "up" && direction != "down" {
+			return nil, fmt.Errorf("invalid migration file name %q", fileName)
+		}
+		rawVersion, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name %q", fileName)
+		}
+		version, err := strconv.Atoi(rawVersion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %q: %w", fileName, err)
+		}
+
+		script, err := fs.ReadFile(fsys, fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		migration, exists := byVersion[version]
+		if !exists {
+			migration = &Migration{Version: version, Name: name}
+			byVersion[version] = migration
+		} else if migration.Name != name {
+			return nil, fmt.Errorf("migration %d has different names: %q and %q", version, migration.Name, name)
+		}
+		if direction == "up" {
+			migration.up = string(script)
+		} else {
+			migration.down = string(script)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.up == "" || migration.down == "" {
+			return nil, fmt.Errorf("migration %04d_%s must have both up and down scripts", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			return nil, fmt.Errorf("migration versions must be sequential from 1, got %d at position %d", migration.Version, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,49 @@
+package migrations
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	migrations, err := load(migrationsFS)
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	assert.Equal(t, "init", migrations[0].Name)
+
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+	}{
+		{
+			name: "missing down",
+			files: fstest.MapFS{
+				"0001_init.up.sql": {Data: []byte("SELECT 1;")},
+			},
+		},
+		{
+			name: "gap in versions",
+			files: fstest.MapFS{
+				"0001_init.up.sql":   {Data: []byte("SELECT 1;")},
+				"0001_init.down.sql": {Data: []byte("SELECT 1;")},
+				"0003_next.up.sql":   {Data: []byte("SELECT 1;")},
+				"0003_next.down.sql": {Data: []byte("SELECT 1;")},
+			},
+		},
+		{
+			name: "invalid direction",
+			files: fstest.MapFS{
+				"0001_init.sideways.sql": {Data: []byte("SELECT 1;")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := load(tt.files)
+			assert.Error(t, err)
+		})
+	}
+}
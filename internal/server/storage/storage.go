@@ -4,12 +4,17 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"log"
-	"sync"
+	"os"
+	"path/filepath"
+	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 
+	apperrors "metrics-service/internal/server/errors"
 	"metrics-service/internal/server/models"
+	"metrics-service/internal/tenant"
 )
 
 // Storage определяет интерфейс хранилища метрик.
@@ -18,62 +23,164 @@ type Storage interface {
 	Update(ctx context.Context, metricType, metricName, metricValStr string) error
 	// UpdateJSON обновляет метрику в хранилище, получая её в виде структуры models.Metrics.
 	UpdateJSON(ctx context.Context, metric *models.Metrics) error
-	// UpdateBatch выполняет пакетное обновление метрик.
+	// UpdateBatch выполняет пакетное обновление метрик. При ошибке любого обновления пакет не применяется.
 	UpdateBatch(ctx context.Context, metrics []models.Metrics) error
+	// UpdateBatchOnce выполняет пакетное обновление метрик, если пакет с ключом идемпотентности key еще не применялся.
+	// Для уже примененного пакета возвращает apperrors.ErrDuplicateBatch.
+	UpdateBatchOnce(ctx context.Context, key string, metrics []models.Metrics) error
 	// Get получает значение метрики по её имени и типу.
 	Get(ctx context.Context, metricType, metricName string) (string, error)
 	// GetJSON получает значение метрики по структуре models.Metrics
 	GetJSON(ctx context.Context, metric *models.Metrics) error
+	// GetByLabels получает все серии метрик типа metricType, метки которых содержат labels.
+	// Пустой metricName означает серии с любым именем.
+	GetByLabels(ctx context.Context, metricType, metricName string, labels map[string]string) ([]models.Metrics, error)
 	// GetMetrics получает все метрики.
 	GetMetrics(ctx context.Context) ([][]string, error)
+	// GetMetricsJSON получает все метрики в виде структур models.Metrics с указанием типа.
+	GetMetricsJSON(ctx context.Context) ([]models.Metrics, error)
+	// GetHistory получает значения серии метрики, принятые в интервале [from, to].
+	GetHistory(ctx context.Context, metricType, metricName string, labels map[string]string, from, to time.Time) ([]models.Sample, error)
+	// PruneHistory удаляет значения истории, вышедшие за окно хранения.
+	PruneHistory(ctx context.Context) error
 	// Ping проверяет соединение с базой данных.
 	Ping(ctx context.Context) error
-	// Bootstrap подготавливает окружение хранилища (используется в debug-окружении).
+	// Bootstrap подготавливает хранилище к работе (применяет миграции схемы бд).
 	Bootstrap(ctx context.Context) error
 	// Save сохраняет метрики, если имплементация хранилища требует ручного сохранения.
 	Save() error
 	// Close закрывает соединение с хранилищем, если имплементация хранилища требует закрытия соединения.
 	Close() error
+	// SetSeriesLimits меняет лимиты количества серий и арендаторов, заданные в Config полями MaxSeries,
+	// TenantMaxSeries и MaxTenants. Серии сверх нового лимита сохраняются, но новые серии не создаются.
+	SetSeriesLimits(maxSeries int, tenantMaxSeries map[string]int, maxTenants int)
 }
 
-// NewStorage создает новый экземпляр Storage
-func NewStorage(flagDatabaseDSN, flagFileStoragePath string, flagRestore bool, flagStoreInterval int) (Storage, error) {
+// Config содержит параметры создания хранилища.
+type Config struct {
+	// DatabaseDSN - строка подключения к Postgres. Если задана, используется Postgres, иначе in-memory хранилище.
+	DatabaseDSN string
+	// DatabaseTimeout - время на запрос к Postgres в секундах, при 0 используется defaultTimeout.
+	DatabaseTimeout int
+	// FileStoragePath - путь к файлу снапшота in-memory хранилища, пустой путь отключает сохранение на диск.
+	FileStoragePath string
+	// Restore - загружать ли метрики со снапшота и журнала при старте.
+	Restore bool
+	// StoreInterval - период сохранения снапшота в секундах.
+	StoreInterval int
+	// SnapshotKeep - количество хранимых снапшотов, при восстановлении используется самый новый целый.
+	SnapshotKeep int
+	// HistoryRetention - время хранения истории значений метрик в секундах, 0 отключает историю.
+	HistoryRetention int
+	// IdempotencyTTL - время хранения ключей идемпотентности пакетов в секундах, при 0 используется defaultIdempotencyTTL.
+	IdempotencyTTL int
+	// WALSync - режим синхронизации журнала упреждающей записи (WALSyncOff отключает журнал).
+	WALSync string
+	// MaxSeries - максимальное количество серий одного арендатора, 0 - без ограничения.
+	MaxSeries int
+	// TenantMaxSeries - лимиты количества серий отдельных арендаторов, заменяющие MaxSeries (0 - без ограничения).
+	TenantMaxSeries map[string]int
+	// MaxTenants - максимальное количество арендаторов in-memory хранилища, 0 - без ограничения.
+	// Арендаторы из TenantMaxSeries создаются и сверх него.
+	MaxTenants int
+}
 
-	if flagDatabaseDSN != "" {
-		db, err := sql.Open("pgx", flagDatabaseDSN)
+// NewStorage создает новый экземпляр Storage
+//
+// Метрики каждого арендатора (см. пакет tenant) хранятся отдельно: у in-memory хранилища свои снапшоты
+// и журнал на арендатора, в Postgres - колонка tenant. Арендатор операции берется из контекста.
+func NewStorage(cfg Config) (Storage, error) {
+	if cfg.DatabaseDSN != "" {
+		db, err := sql.Open("pgx", cfg.DatabaseDSN)
 		if err != nil {
 			return nil, err
 		}
-		return &repository{db}, nil
+		dbTimeout := cfg.DatabaseTimeout
+		if dbTimeout <= 0 {
+			dbTimeout = defaultTimeout
+		}
+		return &repository{
+			db:               db,
+			historyRetention: time.Duration(cfg.HistoryRetention) * time.Second,
+			idempotencyTTL:   cfg.idempotencyTTL(),
+			timeout:          time.Duration(dbTimeout) * time.Second,
+			limits:           cfg.seriesLimits(),
+		}, nil
 	}
 
+	return newTenantStorage(cfg)
+}
+
+// openMemoryStorage создает in-memory хранилище арендатора name и восстанавливает его с диска, если задано в cfg.
+func openMemoryStorage(cfg Config, name string) (*metricsStorage, error) {
+	if !tenant.Valid(name) {
+		return nil, apperrors.ErrTenantInvalid
+	}
+
+	var filePath string
 	var diskW DiskWriter
-	if flagFileStoragePath != "" {
+	if cfg.FileStoragePath != "" {
+		filePath = tenantPath(cfg.FileStoragePath, name)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return nil, err
+		}
 		var err error
-		diskW, err = NewDiskWriter(flagFileStoragePath)
+		diskW, err = NewDiskWriter(filePath, cfg.SnapshotKeep)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	memoryStorage := &metricsStorage{sync.RWMutex{}, sync.RWMutex{}, make(map[string]float64), make(map[string]int64), diskW}
+	memoryStorage := newMetricsStorage(diskW, time.Duration(cfg.HistoryRetention)*time.Second)
+	memoryStorage.keys = newIdempotencyKeys(cfg.idempotencyTTL())
 
 	// Загружаем storage из файла, если необходимо
-	if flagRestore && flagFileStoragePath != "" {
-		reader, err := NewDiskReader(flagFileStoragePath)
+	var walSeq uint64
+	if cfg.Restore && filePath != "" {
+		reader, err := NewDiskReader(filePath, cfg.SnapshotKeep)
 		if err != nil {
-			log.Fatalf("Failed to restore metrics from %v: %v", flagFileStoragePath, err)
+			return nil, err
 		}
-		err = reader.Load(memoryStorage)
+		walSeq, err = reader.Load(memoryStorage)
 		if err != nil {
-			log.Fatalf("Failed to restore metrics from %v: %v", flagFileStoragePath, err)
+			return nil, fmt.Errorf("failed to restore metrics from %v: %w", filePath, err)
 		}
-		err = reader.Close()
+		log.Printf("Read metrics from file: %v\n", filePath)
+	}
+
+	// Лимит учитывает серии снапшота, а обновления из журнала проверяет так же, как при исходной записи
+	memoryStorage.limit = newSeriesLimit(cfg.seriesLimits().of(name), memoryStorage.seriesCount())
+
+	if filePath == "" || cfg.WALSync == "" || cfg.WALSync == WALSyncOff {
+		return memoryStorage, nil
+	}
+
+	// Обновления, принятые после последнего снапшота, восстанавливаем из журнала
+	walPath := filePath + ".wal"
+	if cfg.Restore {
+		var err error
+		walSeq, err = ReplayWAL(walPath, walSeq, memoryStorage.replay)
 		if err != nil {
-			log.Fatalf("Failed to close diskReader: %v", err)
+			return nil, fmt.Errorf("failed to replay WAL %v: %w", walPath, err)
 		}
-		log.Printf("Read metrics from file: %v\n", flagFileStoragePath)
+		log.Printf("Replayed WAL: %v\n", walPath)
+	} else if err := ResetWAL(walPath); err != nil {
+		return nil, fmt.Errorf("failed to reset WAL %v: %w", walPath, err)
 	}
 
+	wal, err := NewWAL(walPath, cfg.WALSync, walSeq)
+	if err != nil {
+		return nil, err
+	}
+	memoryStorage.wal = wal
+
 	return memoryStorage, nil
 }
+
+// idempotencyTTL возвращает время хранения ключей идемпотентности.
+func (c Config) idempotencyTTL() time.Duration {
+	if c.IdempotencyTTL <= 0 {
+		return defaultIdempotencyTTL
+	}
+	return time.Duration(c.IdempotencyTTL) * time.Second
+}
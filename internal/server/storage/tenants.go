@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	apperrors "metrics-service/internal/server/errors"
+	"metrics-service/internal/server/models"
+	"metrics-service/internal/tenant"
+)
+
+// tenantsDirSuffix - суффикс каталога со снапшотами арендаторов рядом с файлом снапшота FileStoragePath.
+const tenantsDirSuffix = ".tenants"
+
+// tenantStorage реализует Storage в виде набора in-memory хранилищ арендаторов.
+//
+// Хранилище арендатора создается при первой записи и имеет свои снапшоты, журнал и лимит серий.
+// Чтение метрик арендатора без хранилища возвращает пустой результат.
+type tenantStorage struct {
+	cfg Config
+
+	mu      sync.RWMutex
+	tenants map[string]*metricsStorage
+
+	// empty - пустое хранилище для чтения метрик арендаторов, которые еще ничего не записали.
+	empty *metricsStorage
+}
+
+// newTenantStorage создает хранилище арендаторов. Хранилища арендатора по умолчанию и арендаторов,
+// чьи снапшоты найдены на диске при восстановлении, открываются сразу.
+func newTenantStorage(cfg Config) (*tenantStorage, error) {
+	t := &tenantStorage{
+		cfg:     cfg,
+		tenants: make(map[string]*metricsStorage),
+		empty:   newMetricsStorage(nil, 0),
+	}
+
+	names := []string{tenant.Default}
+	if cfg.Restore && cfg.FileStoragePath != "" {
+		found, err := tenantNames(cfg.FileStoragePath)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, found...)
+	}
+
+	for _, name := range names {
+		m, err := openMemoryStorage(cfg, name)
+		if err != nil {
+			_ = t.Close()
+			return nil, fmt.Errorf("tenant %q: %w", name, err)
+		}
+		t.tenants[name] = m
+	}
+	return t, nil
+}
+
+func (t *tenantStorage) Update(ctx context.Context, metricType, metricName, metricValStr string) error {
+	m, err := t.forWrite(ctx)
+	if err != nil {
+		return err
+	}
+	return m.Update(ctx, metricType, metricName, metricValStr)
+}
+
+func (t *tenantStorage) UpdateJSON(ctx context.Context, metric *models.Metrics) error {
+	m, err := t.forWrite(ctx)
+	if err != nil {
+		return err
+	}
+	return m.UpdateJSON(ctx, metric)
+}
+
+func (t *tenantStorage) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	m, err := t.forWrite(ctx)
+	if err != nil {
+		return err
+	}
+	return m.UpdateBatch(ctx, metrics)
+}
+
+func (t *tenantStorage) UpdateBatchOnce(ctx context.Context, key string, metrics []models.Metrics) error {
+	m, err := t.forWrite(ctx)
+	if err != nil {
+		return err
+	}
+	return m.UpdateBatchOnce(ctx, key, metrics)
+}
+
+func (t *tenantStorage) Get(ctx context.Context, metricType, metricName string) (string, error) {
+	return t.forRead(ctx).Get(ctx, metricType, metricName)
+}
+
+func (t *tenantStorage) GetJSON(ctx context.Context, metric *models.Metrics) error {
+	return t.forRead(ctx).GetJSON(ctx, metric)
+}
+
+func (t *tenantStorage) GetByLabels(ctx context.Context, metricType, metricName string, labels map[string]string) ([]models.Metrics, error) {
+	return t.forRead(ctx).GetByLabels(ctx, metricType, metricName, labels)
+}
+
+func (t *tenantStorage) GetMetrics(ctx context.Context) ([][]string, error) {
+	return t.forRead(ctx).GetMetrics(ctx)
+}
+
+func (t *tenantStorage) GetMetricsJSON(ctx context.Context) ([]models.Metrics, error) {
+	return t.forRead(ctx).GetMetricsJSON(ctx)
+}
+
+func (t *tenantStorage) GetHistory(ctx context.Context, metricType, metricName string, labels map[string]string, from, to time.Time) ([]models.Sample, error) {
+	return t.forRead(ctx).GetHistory(ctx, metricType, metricName, labels, from, to)
+}
+
+func (t *tenantStorage) Ping(ctx context.Context) error {
+	return apperrors.ErrPingMemory
+}
+
+func (t *tenantStorage) Bootstrap(ctx context.Context) error {
+	return nil
+}
+
+// PruneHistory удаляет устаревшую историю всех арендаторов.
+func (t *tenantStorage) PruneHistory(ctx context.Context) error {
+	for _, m := range t.list() {
+		_ = m.PruneHistory(ctx)
+	}
+	return nil
+}
+
+// Save сохраняет снапшоты всех арендаторов. Ошибка одного арендатора не мешает сохранить остальных.
+func (t *tenantStorage) Save() error {
+	var firstErr error
+	for _, m := range t.list() {
+		if err := m.Save(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// SetSeriesLimits меняет лимиты количества серий и арендаторов. Лимиты открытых хранилищ арендаторов меняются сразу,
+// новый MaxTenants проверяется при создании следующих арендаторов, уже созданные сохраняются.
+func (t *tenantStorage) SetSeriesLimits(maxSeries int, tenantMaxSeries map[string]int, maxTenants int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cfg.MaxSeries, t.cfg.TenantMaxSeries, t.cfg.MaxTenants = maxSeries, tenantMaxSeries, maxTenants
+
+	limits := t.cfg.seriesLimits()
+	for name, m := range t.tenants {
+		m.limit.set(limits.of(name))
+	}
+}
+
+// Close закрывает журналы всех арендаторов.
+func (t *tenantStorage) Close() error {
+	var errs []error
+	for _, m := range t.list() {
+		errs = append(errs, m.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// internal
+
+// forRead возвращает хранилище арендатора из ctx или пустое хранилище, если арендатор еще ничего не записал.
+func (t *tenantStorage) forRead(ctx context.Context) *metricsStorage {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if m, ok := t.tenants[tenant.FromContext(ctx)]; ok {
+		return m
+	}
+	return t.empty
+}
+
+// forWrite возвращает хранилище арендатора из ctx и создает его при первой записи.
+//
+// У каждого арендатора свои файлы снапшотов и журнала, поэтому количество арендаторов ограничено cfg.MaxTenants:
+// сверх него создаются только арендаторы с собственным лимитом серий, остальные получают apperrors.ErrTenantLimit.
+func (t *tenantStorage) forWrite(ctx context.Context) (*metricsStorage, error) {
+	name := tenant.FromContext(ctx)
+
+	t.mu.RLock()
+	m, ok := t.tenants[name]
+	t.mu.RUnlock()
+	if ok {
+		return m, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if m, ok = t.tenants[name]; ok {
+		return m, nil
+	}
+	if _, configured := t.cfg.TenantMaxSeries[name]; !configured && t.cfg.MaxTenants > 0 && len(t.tenants) >= t.cfg.MaxTenants {
+		return nil, apperrors.ErrTenantLimit
+	}
+	m, err := openMemoryStorage(t.cfg, name)
+	if errors.Is(err, apperrors.ErrTenantInvalid) {
+		return nil, err
+	}
+	if err != nil {
+		log.Printf("Failed to open storage of tenant %q: %v", name, err)
+		return nil, apperrors.ErrServer
+	}
+	t.tenants[name] = m
+	log.Printf("Created storage of tenant %q", name)
+	return m, nil
+}
+
+// list возвращает хранилища всех арендаторов.
+func (t *tenantStorage) list() []*metricsStorage {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	list := make([]*metricsStorage, 0, len(t.tenants))
+	for _, m := range t.tenants {
+		list = append(list, m)
+	}
+	return list
+}
+
+// tenantPath возвращает путь к файлу снапшота арендатора name. Снапшот арендатора по умолчанию
+// хранится по пути filePath, как и до разделения на арендаторов, остальные - в каталоге filePath+tenantsDirSuffix.
+func tenantPath(filePath, name string) string {
+	if name == tenant.Default {
+		return filePath
+	}
+	return filepath.Join(filePath+tenantsDirSuffix, name, filepath.Base(filePath))
+}
+
+// tenantNames возвращает имена арендаторов, каталоги которых есть рядом с файлом снапшота filePath.
+func tenantNames(filePath string) ([]string, error) {
+	entries, err := os.ReadDir(filePath + tenantsDirSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() && tenant.Valid(entry.Name()) && entry.Name() != tenant.Default {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apperrors "metrics-service/internal/server/errors"
+	"metrics-service/internal/server/models"
+	"metrics-service/internal/tenant"
+)
+
+func TestTenantStorage(t *testing.T) {
+	fName := filepath.Join(t.TempDir(), "metrics.json")
+	cfg := Config{FileStoragePath: fName, Restore: true, WALSync: WALSyncAlways}
+	ctxA := tenant.WithContext(context.Background(), "team-a")
+	ctxB := tenant.WithContext(context.Background(), "team-b")
+	ctxDefault := context.Background()
+
+	st, err := NewStorage(cfg)
+	require.NoError(t, err)
+	require.NoError(t, st.Update(ctxA, "gauge", "Alloc", "1"))
+	require.NoError(t, st.Update(ctxB, "gauge", "Alloc", "2"))
+	require.NoError(t, st.Update(ctxDefault, "counter", "PollCount", "3"))
+
+	// Одинаковые имена метрик разных арендаторов не пересекаются
+	value, err := st.Get(ctxA, "gauge", "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, "1", value)
+	value, err = st.Get(ctxB, "gauge", "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, "2", value)
+	_, err = st.Get(ctxDefault, "gauge", "Alloc")
+	assert.ErrorIs(t, err, apperrors.ErrMetricNotExist)
+
+	metrics, err := st.GetMetricsJSON(ctxA)
+	require.NoError(t, err)
+	assert.Len(t, metrics, 1)
+
+	// Арендатор без метрик видит пустое хранилище
+	ctxEmpty := tenant.WithContext(context.Background(), "team-c")
+	metrics, err = st.GetMetricsJSON(ctxEmpty)
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+	_, err = st.Get(ctxEmpty, "counter", "PollCount")
+	assert.ErrorIs(t, err, apperrors.ErrMetricNotExist)
+
+	// Снапшот арендатора по умолчанию остается на прежнем месте, остальные - в своих каталогах
+	require.NoError(t, st.Save())
+	assert.FileExists(t, fName)
+	assert.FileExists(t, filepath.Join(fName+tenantsDirSuffix, "team-a", "metrics.json"))
+
+	// Обновление после снапшота восстанавливается из журнала арендатора
+	require.NoError(t, st.Update(ctxB, "gauge", "Alloc", "5"))
+	require.NoError(t, st.Close())
+
+	st, err = NewStorage(cfg)
+	require.NoError(t, err)
+	defer st.Close()
+	value, err = st.Get(ctxA, "gauge", "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, "1", value)
+	value, err = st.Get(ctxB, "gauge", "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, "5", value)
+	value, err = st.Get(ctxDefault, "counter", "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, "3", value)
+
+	// Имя арендатора используется в пути, поэтому недопустимые имена отклоняются
+	err = st.Update(tenant.WithContext(context.Background(), "../team"), "gauge", "Alloc", "1")
+	assert.ErrorIs(t, err, apperrors.ErrTenantInvalid)
+}
+
+func TestTenantStorageSeriesLimit(t *testing.T) {
+	fName := filepath.Join(t.TempDir(), "metrics.json")
+	cfg := Config{FileStoragePath: fName, Restore: true, MaxSeries: 2, TenantMaxSeries: map[string]int{"big": 0}}
+	ctx := tenant.WithContext(context.Background(), "team-a")
+
+	st, err := NewStorage(cfg)
+	require.NoError(t, err)
+	require.NoError(t, st.Update(ctx, "gauge", "g1", "1"))
+	require.NoError(t, st.Update(ctx, "counter", "c1", "1"))
+	assert.ErrorIs(t, st.Update(ctx, "gauge", "g2", "1"), apperrors.ErrSeriesLimit)
+	// Существующие серии обновляются и после достижения лимита
+	require.NoError(t, st.Update(ctx, "gauge", "g1", "2"))
+	require.NoError(t, st.Update(ctx, "counter", "c1", "1"))
+
+	// Пакет с новой серией сверх лимита не применяется целиком
+	delta := int64(1)
+	err = st.UpdateBatch(ctx, []models.Metrics{
+		{ID: "c1", MType: "counter", Delta: &delta},
+		{ID: "c2", MType: "counter", Delta: &delta},
+		{ID: "h1", MType: "histogram", Observations: []float64{1}, Histogram: &models.Histogram{Bounds: []float64{1}}},
+	})
+	assert.ErrorIs(t, err, apperrors.ErrSeriesLimit)
+	value, err := st.Get(ctx, "counter", "c1")
+	require.NoError(t, err)
+	assert.Equal(t, "2", value)
+
+	// Лимит считается для каждого арендатора отдельно, арендатор "big" не ограничен
+	ctxBig := tenant.WithContext(context.Background(), "big")
+	for i := 0; i < 5; i++ {
+		require.NoError(t, st.Update(ctxBig, "gauge", "g"+strconv.Itoa(i), "1"))
+	}
+
+	// После восстановления серии снапшота учитываются в лимите
+	require.NoError(t, st.Save())
+	require.NoError(t, st.Close())
+	st, err = NewStorage(cfg)
+	require.NoError(t, err)
+	defer st.Close()
+	assert.ErrorIs(t, st.Update(ctx, "gauge", "g2", "1"), apperrors.ErrSeriesLimit)
+	require.NoError(t, st.Update(ctx, "gauge", "g1", "3"))
+}
+
+func TestTenantStorageMaxTenants(t *testing.T) {
+	fName := filepath.Join(t.TempDir(), "metrics.json")
+	cfg := Config{FileStoragePath: fName, Restore: true, MaxTenants: 2, TenantMaxSeries: map[string]int{"big": 0}}
+
+	st, err := NewStorage(cfg)
+	require.NoError(t, err)
+	defer st.Close()
+
+	// Арендатор по умолчанию открыт при создании и занимает место в лимите
+	require.NoError(t, st.Update(tenant.WithContext(context.Background(), "team-a"), "gauge", "g1", "1"))
+	err = st.Update(tenant.WithContext(context.Background(), "team-b"), "gauge", "g1", "1")
+	assert.ErrorIs(t, err, apperrors.ErrTenantLimit)
+	_, err = os.Stat(filepath.Dir(tenantPath(fName, "team-b")))
+	assert.True(t, os.IsNotExist(err))
+
+	// Существующие и настроенные арендаторы записывают и сверх лимита
+	require.NoError(t, st.Update(tenant.WithContext(context.Background(), "team-a"), "gauge", "g2", "1"))
+	require.NoError(t, st.Update(tenant.WithContext(context.Background(), "big"), "gauge", "g1", "1"))
+}
+
+func TestTenantStorageSetSeriesLimits(t *testing.T) {
+	st, err := NewStorage(Config{MaxSeries: 1, MaxTenants: 2})
+	require.NoError(t, err)
+	defer st.Close()
+	ctx := tenant.WithContext(context.Background(), "team-a")
+
+	require.NoError(t, st.Update(ctx, "gauge", "g1", "1"))
+	assert.ErrorIs(t, st.Update(ctx, "gauge", "g2", "1"), apperrors.ErrSeriesLimit)
+
+	// Новый лимит действует для открытого хранилища арендатора без перезапуска
+	st.SetSeriesLimits(1, map[string]int{"team-a": 3}, 0)
+	require.NoError(t, st.Update(ctx, "gauge", "g2", "1"))
+	require.NoError(t, st.Update(ctx, "gauge", "g3", "1"))
+	assert.ErrorIs(t, st.Update(ctx, "gauge", "g4", "1"), apperrors.ErrSeriesLimit)
+	require.NoError(t, st.Update(tenant.WithContext(context.Background(), "team-b"), "gauge", "g1", "1"))
+
+	// Серии сверх уменьшенного лимита сохраняются и обновляются, новые не создаются
+	st.SetSeriesLimits(0, map[string]int{"team-a": 1}, 3)
+	require.NoError(t, st.Update(ctx, "gauge", "g3", "2"))
+	assert.ErrorIs(t, st.Update(ctx, "gauge", "g4", "1"), apperrors.ErrSeriesLimit)
+	assert.ErrorIs(t, st.Update(tenant.WithContext(context.Background(), "team-c"), "gauge", "g1", "1"), apperrors.ErrTenantLimit)
+}
@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"metrics-service/internal/server/models"
+)
+
+// Режимы синхронизации WAL с диском.
+const (
+	WALSyncOff      = "off"      // WAL отключен, метрики сохраняются только снапшотами
+	WALSyncNone     = "none"     // запись без fsync: переживает падение процесса, но не ОС
+	WALSyncInterval = "interval" // fsync раз в walSyncInterval
+	WALSyncAlways   = "always"   // fsync после каждой записи
+)
+
+// walSyncInterval - период fsync в режиме WALSyncInterval.
+const walSyncInterval = time.Second
+
+// WAL определяет интерфейс журнала упреждающей записи обновлений in-memory хранилища.
+//
+// Каждое обновление сначала дописывается в журнал, затем применяется к хранилищу.
+// При снапшоте журнал ротируется: текущий сегмент откладывается до успешной записи снапшота,
+// новые обновления пишутся в новый сегмент.
+type WAL interface {
+	// Append дописывает пакет обновлений с ключом идемпотентности key (может быть пустым) под следующим порядковым номером.
+	Append(key string, metrics []models.Metrics) error
+	// LastSeq возвращает номер последней записи журнала.
+	LastSeq() uint64
+	// Rotate откладывает текущий сегмент журнала и начинает новый.
+	Rotate() error
+	// RemoveRotated удаляет отложенный сегмент после успешной записи снапшота.
+	RemoveRotated() error
+	// Close синхронизирует и закрывает журнал.
+	Close() error
+}
+
+// walRecord - запись журнала, одна строка JSON.
+//
+// Номера записей возрастают и не сбрасываются при ротации. Снапшот хранит номер последней вошедшей в него записи,
+// поэтому записи отложенного сегмента, уже вошедшие в снапшот, не применяются повторно.
+type walRecord struct {
+	Seq     uint64           `json:"seq"`
+	Key     string           `json:"key,omitempty"` // ключ идемпотентности пакета
+	Metrics []models.Metrics `json:"metrics"`
+}
+
+// wal реализует интерфейс WAL поверх append-only файла.
+type wal struct {
+	mu       sync.Mutex
+	filePath string
+	file     *os.File
+	syncMode string
+	seq      uint64 // номер последней записи
+	dirty    bool   // есть записи, не синхронизированные с диском
+
+	doneCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewWAL открывает журнал filePath на дозапись, нумерация новых записей продолжается после lastSeq.
+//
+// Перед открытием журнал нужно воспроизвести через ReplayWAL: она обрезает недописанную
+// при падении последнюю запись, иначе новые записи окажутся после поврежденной строки.
+func NewWAL(filePath string, syncMode string, lastSeq uint64) (WAL, error) {
+	switch syncMode {
+	case WALSyncNone, WALSyncInterval, WALSyncAlways:
+	default:
+		return nil, fmt.Errorf("unknown WAL sync mode: %q", syncMode)
+	}
+
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &wal{filePath: filePath, file: file, syncMode: syncMode, seq: lastSeq, doneCh: make(chan struct{})}
+
+	if syncMode == WALSyncInterval {
+		w.wg.Add(1)
+		go w.syncLoop()
+	}
+	return w, nil
+}
+
+// Append дописывает пакет обновлений в журнал под следующим порядковым номером.
+func (w *wal) Append(key string, metrics []models.Metrics) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	data, err := json.Marshal(walRecord{Seq: w.seq + 1, Key: key, Metrics: metrics})
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if _, err = w.file.Write(data); err != nil {
+		return err
+	}
+	w.seq++
+	if w.syncMode == WALSyncAlways {
+		return w.file.Sync()
+	}
+	w.dirty = true
+	return nil
+}
+
+// LastSeq возвращает номер последней записи журнала.
+func (w *wal) LastSeq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.seq
+}
+
+// Rotate откладывает текущий сегмент в filePath.1 и начинает новый.
+//
+// Если отложенный сегмент остался от неудачного снапшота, текущий сегмент дописывается в его конец,
+// чтобы не потерять обновления и сохранить их порядок. Текущий сегмент открывается заново и после ошибки,
+// иначе журнал не принимал бы записи до перезапуска.
+func (w *wal) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	err := w.file.Close()
+	if err == nil {
+		err = w.rotateSegment()
+	}
+
+	file, openErr := os.OpenFile(w.filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	w.file = file
+	if err != nil {
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+// rotateSegment переносит закрытый текущий сегмент в filePath.1.
+//
+// При падении после дописывания в отложенный сегмент, но до удаления текущего, записи окажутся в обоих
+// сегментах. ReplayWAL применяет каждый номер записи один раз, поэтому они не применятся повторно.
+func (w *wal) rotateSegment() error {
+	rotatedPath := w.filePath + ".1"
+	if _, err := os.Stat(rotatedPath); err != nil {
+		return os.Rename(w.filePath, rotatedPath)
+	}
+	if err := appendFile(rotatedPath, w.filePath); err != nil {
+		return err
+	}
+	return os.Remove(w.filePath)
+}
+
+// RemoveRotated удаляет отложенный сегмент журнала.
+func (w *wal) RemoveRotated() error {
+	err := os.Remove(w.filePath + ".1")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Close синхронизирует и закрывает журнал.
+func (w *wal) Close() error {
+	close(w.doneCh)
+	w.wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// syncLoop периодически синхронизирует журнал с диском в режиме WALSyncInterval.
+func (w *wal) syncLoop() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(walSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.dirty {
+				if err := w.file.Sync(); err != nil {
+					log.Printf("Failed to sync WAL %v: %v", w.filePath, err)
+				} else {
+					w.dirty = false
+				}
+			}
+			w.mu.Unlock()
+		case <-w.doneCh:
+			return
+		}
+	}
+}
+
+// ReplayWAL воспроизводит сегменты журнала filePath (сначала отложенный filePath.1, затем текущий),
+// передавая в apply ключ идемпотентности и пакет обновлений каждой записи с номером больше fromSeq.
+// Запись, номер которой уже встречался, не применяется повторно. Возвращает номер последней записи журнала.
+//
+// Воспроизведение сегмента останавливается на первой поврежденной или недописанной записи,
+// сегмент обрезается до последней целой записи.
+func ReplayWAL(filePath string, fromSeq uint64, apply func(key string, metrics []models.Metrics)) (uint64, error) {
+	lastSeq := fromSeq
+	for _, path := range []string{filePath + ".1", filePath} {
+		if err := replayWALSegment(path, &lastSeq, apply); err != nil {
+			return 0, err
+		}
+	}
+	return lastSeq, nil
+}
+
+// ResetWAL удаляет все сегменты журнала filePath.
+func ResetWAL(filePath string) error {
+	for _, path := range []string{filePath + ".1", filePath} {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func replayWALSegment(path string, lastSeq *uint64, apply func(key string, metrics []models.Metrics)) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Printf("WAL %v: truncating incomplete record at offset %d", path, offset)
+				return file.Truncate(offset)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var record walRecord
+		if err = json.Unmarshal(line, &record); err != nil {
+			log.Printf("WAL %v: truncating corrupted record at offset %d: %v", path, offset, err)
+			return file.Truncate(offset)
+		}
+		// Номера записей возрастают, поэтому запись с номером не больше последнего примененного
+		// уже вошла в снапшот или повторяет запись отложенного сегмента
+		if record.Seq > *lastSeq {
+			apply(record.Key, record.Metrics)
+			*lastSeq = record.Seq
+		}
+		offset += int64(len(line))
+	}
+}
+
+// appendFile дописывает содержимое файла src в конец файла dst.
+func appendFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
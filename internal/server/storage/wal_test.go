@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apperrors "metrics-service/internal/server/errors"
+	"metrics-service/internal/server/models"
+)
+
+func TestWALReplay(t *testing.T) {
+	fName := filepath.Join(t.TempDir(), "metrics.json")
+	cfg := Config{FileStoragePath: fName, Restore: true, StoreInterval: 300, WALSync: WALSyncAlways}
+	ctx := context.Background()
+
+	st, err := NewStorage(cfg)
+	require.NoError(t, err)
+	require.NoError(t, st.Update(ctx, "counter", "nameC", "2"))
+	require.NoError(t, st.Update(ctx, "gauge", "nameG", "1.5"))
+	require.NoError(t, st.Save())
+
+	// Обновления после снапшота есть только в журнале
+	delta := int64(3)
+	require.NoError(t, st.UpdateBatch(ctx, []models.Metrics{{ID: "nameC", MType: "counter", Delta: &delta}}))
+	require.NoError(t, st.Close())
+
+	// Недописанная при падении запись в конце журнала
+	walFile, err := os.OpenFile(fName+".wal", os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	_, err = walFile.WriteString(`{"metrics":[{"id":"nameC","type":"counter","delta":10`)
+	require.NoError(t, err)
+	require.NoError(t, walFile.Close())
+
+	st, err = NewStorage(cfg)
+	require.NoError(t, err)
+
+	value, err := st.Get(ctx, "counter", "nameC")
+	require.NoError(t, err)
+	assert.Equal(t, "5", value)
+	value, err = st.Get(ctx, "gauge", "nameG")
+	require.NoError(t, err)
+	assert.Equal(t, "1.5", value)
+
+	// Поврежденная запись обрезана, новые записи журнала читаются
+	require.NoError(t, st.Update(ctx, "counter", "nameC", "1"))
+	require.NoError(t, st.Close())
+	st, err = NewStorage(cfg)
+	require.NoError(t, err)
+	defer st.Close()
+	value, err = st.Get(ctx, "counter", "nameC")
+	require.NoError(t, err)
+	assert.Equal(t, "6", value)
+}
+
+func TestWALCheckpoint(t *testing.T) {
+	fName := filepath.Join(t.TempDir(), "metrics.json")
+	cfg := Config{FileStoragePath: fName, Restore: true, StoreInterval: 300, WALSync: WALSyncNone}
+	ctx := context.Background()
+
+	st, err := NewStorage(cfg)
+	require.NoError(t, err)
+	require.NoError(t, st.Update(ctx, "counter", "nameC", "2"))
+	require.NoError(t, st.Save())
+	require.NoError(t, st.Close())
+
+	// После снапшота журнал пуст, отложенный сегмент удален
+	info, err := os.Stat(fName + ".wal")
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+	_, err = os.Stat(fName + ".wal.1")
+	assert.True(t, os.IsNotExist(err))
+
+	// Снапшот не применяется повторно поверх журнала
+	st, err = NewStorage(cfg)
+	require.NoError(t, err)
+	value, err := st.Get(ctx, "counter", "nameC")
+	require.NoError(t, err)
+	assert.Equal(t, "2", value)
+	require.NoError(t, st.Close())
+
+	// Без восстановления журнал сбрасывается
+	cfg.Restore = false
+	st, err = NewStorage(cfg)
+	require.NoError(t, err)
+	defer st.Close()
+	_, err = st.Get(ctx, "counter", "nameC")
+	assert.Error(t, err)
+}
+
+func TestWALRotatedAfterSnapshot(t *testing.T) {
+	fName := filepath.Join(t.TempDir(), "metrics.json")
+	cfg := Config{FileStoragePath: fName, Restore: true, StoreInterval: 300, WALSync: WALSyncAlways}
+	ctx := context.Background()
+
+	st, err := NewStorage(cfg)
+	require.NoError(t, err)
+	require.NoError(t, st.Update(ctx, "counter", "nameC", "2"))
+	require.NoError(t, st.Save())
+	require.NoError(t, st.Update(ctx, "counter", "nameC", "3"))
+	require.NoError(t, st.Close())
+
+	// Падение после записи снапшота, но до удаления отложенного сегмента
+	record := `{"seq":1,"metrics":[{"id":"nameC","type":"counter","delta":2}]}` + "\n"
+	require.NoError(t, os.WriteFile(fName+".wal.1", []byte(record), 0666))
+
+	st, err = NewStorage(cfg)
+	require.NoError(t, err)
+	defer st.Close()
+	value, err := st.Get(ctx, "counter", "nameC")
+	require.NoError(t, err)
+	assert.Equal(t, "5", value)
+
+	// Нумерация записей продолжается после восстановления
+	require.NoError(t, st.Update(ctx, "counter", "nameC", "1"))
+	data, err := os.ReadFile(fName + ".wal")
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"seq":3`)
+}
+
+func TestWALSyncMode(t *testing.T) {
+	_, err := NewWAL(filepath.Join(t.TempDir(), "metrics.json.wal"), "sometimes", 0)
+	assert.Error(t, err)
+}
+
+func TestWALIdempotencyKeys(t *testing.T) {
+	fName := filepath.Join(t.TempDir(), "metrics.json")
+	cfg := Config{FileStoragePath: fName, Restore: true, StoreInterval: 300, WALSync: WALSyncAlways}
+	ctx := context.Background()
+	delta := int64(2)
+	batch := []models.Metrics{{ID: "nameC", MType: "counter", Delta: &delta}}
+
+	st, err := NewStorage(cfg)
+	require.NoError(t, err)
+	require.NoError(t, st.UpdateBatchOnce(ctx, "agent-1", batch))
+	assert.ErrorIs(t, st.UpdateBatchOnce(ctx, "agent-1", batch), apperrors.ErrDuplicateBatch)
+	require.NoError(t, st.Close())
+
+	// Ключ восстанавливается из журнала вместе с пакетом
+	st, err = NewStorage(cfg)
+	require.NoError(t, err)
+	defer st.Close()
+	assert.ErrorIs(t, st.UpdateBatchOnce(ctx, "agent-1", batch), apperrors.ErrDuplicateBatch)
+	require.NoError(t, st.UpdateBatchOnce(ctx, "agent-2", batch))
+
+	value, err := st.Get(ctx, "counter", "nameC")
+	require.NoError(t, err)
+	assert.Equal(t, "4", value)
+}
+
+func TestWALReplayFailedBatchKey(t *testing.T) {
+	fName := filepath.Join(t.TempDir(), "metrics.json")
+	cfg := Config{FileStoragePath: fName, Restore: true, StoreInterval: 300, WALSync: WALSyncAlways}
+	ctx := context.Background()
+	delta := int64(2)
+	// Observations без объявленных бакетов - ошибка, пакет не применяется
+	batch := []models.Metrics{
+		{ID: "nameC", MType: "counter", Delta: &delta},
+		{ID: "nameH", MType: "histogram", Observations: []float64{1}},
+	}
+
+	st, err := NewStorage(cfg)
+	require.NoError(t, err)
+	assert.ErrorIs(t, st.UpdateBatchOnce(ctx, "agent-1", batch), apperrors.ErrInvalidHistogram)
+	require.NoError(t, st.Close())
+
+	// После перезапуска ключ пакета с ошибкой свободен, исправленный повтор применяется
+	st, err = NewStorage(cfg)
+	require.NoError(t, err)
+	defer st.Close()
+	batch[1].Histogram = &models.Histogram{Bounds: []float64{1}}
+	require.NoError(t, st.UpdateBatchOnce(ctx, "agent-1", batch))
+
+	value, err := st.Get(ctx, "counter", "nameC")
+	require.NoError(t, err)
+	assert.Equal(t, "2", value)
+}
+
+func TestWALRotateInterrupted(t *testing.T) {
+	fName := filepath.Join(t.TempDir(), "metrics.json")
+	cfg := Config{FileStoragePath: fName, Restore: true, StoreInterval: 300, WALSync: WALSyncAlways}
+	ctx := context.Background()
+
+	// Падение при ротации после дописывания текущего сегмента в отложенный, но до удаления текущего
+	records := `{"seq":1,"metrics":[{"id":"nameC","type":"counter","delta":2}]}` + "\n" +
+		`{"seq":2,"metrics":[{"id":"nameC","type":"counter","delta":3}]}` + "\n"
+	require.NoError(t, os.WriteFile(fName+".wal.1", []byte(records), 0666))
+	require.NoError(t, os.WriteFile(fName+".wal", []byte(records[strings.Index(records, "\n")+1:]), 0666))
+
+	st, err := NewStorage(cfg)
+	require.NoError(t, err)
+	defer st.Close()
+	value, err := st.Get(ctx, "counter", "nameC")
+	require.NoError(t, err)
+	assert.Equal(t, "5", value)
+}
+
+func TestWALRotateReopensOnError(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "metrics.json.wal")
+	w, err := NewWAL(walPath, WALSyncNone, 0)
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Отложенный сегмент - каталог, дописать в него текущий сегмент нельзя
+	require.NoError(t, os.Mkdir(walPath+".1", 0755))
+	assert.Error(t, w.Rotate())
+
+	// Журнал продолжает принимать записи
+	delta := int64(1)
+	require.NoError(t, w.Append("", []models.Metrics{{ID: "nameC", MType: "counter", Delta: &delta}}))
+}
@@ -0,0 +1,108 @@
+// Package signature подписывает запросы агента HMAC-SHA256 и проверяет подписи.
+//
+// Подпись покрывает метод и URI запроса, время создания запроса, одноразовое значение (nonce) и тело:
+//
+//	HMAC-SHA256(key, method + "\n" + requestURI + "\n" + timestamp + "\n" + nonce + "\n" + body)
+//
+// Метод и URI не позволяют перенести подпись на другой маршрут: у /update/:metricType/:metricName/:metricVal
+// тело пустое, и метрика со значением передаются только в пути. Время и nonce позволяют серверу отклонять
+// повторно отправленные перехваченные запросы.
+// Идентификатор ключа выбирает один из действующих ключей сервера, что позволяет менять ключи без простоя.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Заголовки подписанного запроса.
+const (
+	// HashHeader - подпись запроса или ответа в hex.
+	HashHeader = "HashSHA256"
+	// KeyIDHeader - идентификатор ключа подписи. Без заголовка используется ключ по умолчанию.
+	KeyIDHeader = "HashKeyID"
+	// TimestampHeader - время подписи в секундах Unix.
+	TimestampHeader = "HashTimestamp"
+	// NonceHeader - одноразовое значение запроса.
+	NonceHeader = "HashNonce"
+)
+
+// MaxNonceLen - максимальная длина nonce.
+const MaxNonceLen = 64
+
+// Sign возвращает подпись запроса method requestURI с телом body, временем timestamp и nonce ключом key.
+// requestURI - путь с параметрами запроса в том виде, в котором он передается в строке запроса HTTP.
+func Sign(key []byte, method, requestURI, timestamp, nonce string, body []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(method))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(requestURI))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(timestamp))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(nonce))
+	h.Write([]byte{'\n'})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify сравнивает подпись hash с вычисленной за постоянное время.
+func Verify(key []byte, hash, method, requestURI, timestamp, nonce string, body []byte) bool {
+	return hmac.Equal([]byte(hash), []byte(Sign(key, method, requestURI, timestamp, nonce, body)))
+}
+
+// SignBody возвращает подпись тела ответа ключом key.
+func SignBody(key, body []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// NewNonce возвращает случайное одноразовое значение.
+func NewNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// Timestamp форматирует время t для заголовка TimestampHeader.
+func Timestamp(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// ParseTimestamp разбирает значение заголовка TimestampHeader.
+func ParseTimestamp(value string) (time.Time, error) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid signature timestamp %q", value)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// ParseKeys разбирает список ключей вида "id1:key1,id2:key2". Пустая строка - пустой список.
+func ParseKeys(value string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	if value == "" {
+		return keys, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		id, key, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || id == "" || key == "" {
+			return nil, errors.New("signing keys must be listed as id:key separated by commas")
+		}
+		if _, ok = keys[id]; ok {
+			return nil, fmt.Errorf("duplicate signing key id %q", id)
+		}
+		keys[id] = []byte(key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,48 @@
+package signature
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignVerify(t *testing.T) {
+	key := []byte("secret-key")
+	body := []byte("test data")
+	timestamp := Timestamp(time.Unix(1700000000, 0))
+	hash := Sign(key, "POST", "/updates/", timestamp, "nonce", body)
+
+	assert.True(t, Verify(key, hash, "POST", "/updates/", timestamp, "nonce", body))
+	assert.False(t, Verify([]byte("other-key"), hash, "POST", "/updates/", timestamp, "nonce", body))
+	assert.False(t, Verify(key, hash, "POST", "/updates/", Timestamp(time.Unix(1700000001, 0)), "nonce", body))
+	assert.False(t, Verify(key, hash, "POST", "/updates/", timestamp, "other-nonce", body))
+	assert.False(t, Verify(key, hash, "POST", "/updates/", timestamp, "nonce", []byte("other data")))
+	// Подпись не переносится на другой метод или маршрут
+	assert.False(t, Verify(key, hash, "PUT", "/updates/", timestamp, "nonce", body))
+	assert.False(t, Verify(key, hash, "POST", "/update/", timestamp, "nonce", body))
+	// Разделитель не позволяет перенести часть nonce в тело
+	assert.False(t, Verify(key, hash, "POST", "/updates/", timestamp, "nonc", []byte("e\ntest data")))
+
+	parsed, err := ParseTimestamp(timestamp)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1700000000), parsed.Unix())
+	_, err = ParseTimestamp("yesterday")
+	assert.Error(t, err)
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys("k1:secret1, k2:secret:2")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"k1": []byte("secret1"), "k2": []byte("secret:2")}, keys)
+
+	keys, err = ParseKeys("")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	for _, value := range []string{"secret", ":secret", "k1:", "k1:a,k1:b", "k1:a,"} {
+		_, err = ParseKeys(value)
+		assert.Error(t, err, value)
+	}
+}
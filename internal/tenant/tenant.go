@@ -0,0 +1,46 @@
+// Package tenant определяет арендаторов сервера - независимые пространства имен метрик.
+//
+// Арендатор запроса определяется middleware сервера по API-ключу или заголовку Header и передается
+// хранилищу через контекст запроса. Запросы без арендатора относятся к арендатору Default.
+package tenant
+
+import "context"
+
+// Default - арендатор запросов, для которых арендатор не задан.
+const Default = "default"
+
+// Header - заголовок запроса с именем арендатора.
+const Header = "X-Tenant"
+
+// MaxLen - максимальная длина имени арендатора.
+const MaxLen = 64
+
+type contextKey struct{}
+
+// WithContext возвращает копию ctx с арендатором name.
+func WithContext(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, contextKey{}, name)
+}
+
+// FromContext возвращает арендатора из ctx или Default, если арендатор не задан.
+func FromContext(ctx context.Context) string {
+	if name, ok := ctx.Value(contextKey{}).(string); ok && name != "" {
+		return name
+	}
+	return Default
+}
+
+// Valid проверяет имя арендатора: от 1 до MaxLen латинских букв, цифр, '-' и '_'.
+// Имя используется в путях файлов снапшотов, поэтому другие символы не допускаются.
+func Valid(name string) bool {
+	if name == "" || len(name) > MaxLen {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
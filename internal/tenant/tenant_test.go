@@ -0,0 +1,37 @@
+package tenant
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, Default, FromContext(ctx))
+	assert.Equal(t, "team-a", FromContext(WithContext(ctx, "team-a")))
+	assert.Equal(t, Default, FromContext(WithContext(ctx, "")))
+}
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"default", true},
+		{"Team_A-1", true},
+		{strings.Repeat("a", MaxLen), true},
+		{"", false},
+		{strings.Repeat("a", MaxLen+1), false},
+		{"..", false},
+		{"team/a", false},
+		{"team a", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Valid(tt.name))
+		})
+	}
+}
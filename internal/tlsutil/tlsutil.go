@@ -0,0 +1,148 @@
+// Package tlsutil собирает TLS-конфигурации сервера и агента.
+//
+// Сервер загружает сертификат и ключ из файлов и перечитывает их при изменении, поэтому
+// обновление сертификата не требует перезапуска. При заданном CA клиентов сервер требует
+// клиентский сертификат (mTLS). Агент доверяет только заданному CA.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// reloadCheckInterval - как часто при рукопожатиях проверяется изменение файлов сертификата.
+const reloadCheckInterval = time.Second
+
+// ServerConfig возвращает TLS-конфигурацию сервера с сертификатом certPath и ключом keyPath.
+// Непустой clientCAPath включает mTLS: клиент должен предъявить сертификат, подписанный этим CA.
+func ServerConfig(certPath, keyPath, clientCAPath string) (*tls.Config, error) {
+	reloader, err := NewCertReloader(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if clientCAPath != "" {
+		pool, err := loadCertPool(clientCAPath)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// ClientConfig возвращает TLS-конфигурацию агента, доверяющую только CA из caPath.
+// Непустые certPath и keyPath задают клиентский сертификат для mTLS.
+func ClientConfig(caPath, certPath, keyPath string) (*tls.Config, error) {
+	pool, err := loadCertPool(caPath)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    pool,
+	}
+
+	if certPath != "" || keyPath != "" {
+		if certPath == "" || keyPath == "" {
+			return nil, errors.New("client certificate and key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// CertReloader отдает сертификат сервера и перечитывает его, когда файлы сертификата или ключа изменились.
+type CertReloader struct {
+	certPath string
+	keyPath  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time // время изменения загруженных файлов
+	checkedAt time.Time
+}
+
+// NewCertReloader загружает сертификат certPath с ключом keyPath.
+func NewCertReloader(certPath, keyPath string) (*CertReloader, error) {
+	r := &CertReloader{certPath: certPath, keyPath: keyPath}
+	if err := r.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	r.checkedAt = time.Now()
+	return r, nil
+}
+
+// GetCertificate реализует tls.Config.GetCertificate. Файлы проверяются не чаще reloadCheckInterval.
+// Если новый сертификат не загружается (например, ключ еще не дописан), используется прежний.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checkedAt) >= reloadCheckInterval {
+		r.checkedAt = time.Now()
+		if err := r.reloadIfChanged(); err != nil {
+			log.Printf("Failed to reload TLS certificate, keeping previous: %v", err)
+		}
+	}
+	return r.cert, nil
+}
+
+func (r *CertReloader) reloadIfChanged() error {
+	modTime, err := latestModTime(r.certPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && modTime.Equal(r.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in CA file %v", path)
+	}
+	return pool, nil
+}
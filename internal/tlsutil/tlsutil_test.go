@@ -0,0 +1,186 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA - тестовый CA, выпускающий сертификаты в каталог dir.
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	path string
+}
+
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, name+".pem")
+	writePEM(t, path, "CERTIFICATE", der)
+	return &testCA{t: t, dir: dir, cert: cert, key: key, path: path}
+}
+
+// issue выпускает сертификат с CommonName cn и возвращает пути к сертификату и ключу.
+func (ca *testCA) issue(name, cn string, serial int64) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(ca.t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(ca.t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(ca.t, err)
+
+	certPath = filepath.Join(ca.dir, name+".crt")
+	keyPath = filepath.Join(ca.dir, name+".key")
+	writePEM(ca.t, certPath, "CERTIFICATE", der)
+	writePEM(ca.t, keyPath, "EC PRIVATE KEY", keyDER)
+	return certPath, keyPath
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+}
+
+// startServer запускает HTTPS-сервер, отвечающий CommonName клиентского сертификата, и возвращает его URL.
+// httptest.Server подставляет свой сертификат, поэтому сервер запускается на обычном listener.
+func startServer(t *testing.T, cfg *tls.Config) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(r.TLS.VerifiedChains) > 0 {
+				io.WriteString(w, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+			}
+		}),
+		TLSConfig: cfg,
+		ErrorLog:  log.New(io.Discard, "", 0),
+	}
+	go server.ServeTLS(listener, "", "")
+	t.Cleanup(func() { server.Close() })
+	return "https://" + listener.Addr().String()
+}
+
+func get(t *testing.T, url string, cfg *tls.Config) (string, error) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body), nil
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	otherCA := newTestCA(t, dir, "other-ca")
+	serverCert, serverKey := ca.issue("server", "server", 2)
+	agentCert, agentKey := ca.issue("agent", "agent-1", 3)
+	foreignCert, foreignKey := otherCA.issue("foreign", "agent-2", 4)
+
+	serverCfg, err := ServerConfig(serverCert, serverKey, ca.path)
+	require.NoError(t, err)
+	url := startServer(t, serverCfg)
+
+	// Клиентский сертификат сопоставляется идентификатору агента
+	clientCfg, err := ClientConfig(ca.path, agentCert, agentKey)
+	require.NoError(t, err)
+	body, err := get(t, url, clientCfg)
+	require.NoError(t, err)
+	assert.Equal(t, "agent-1", body)
+
+	// Без клиентского сертификата и с сертификатом чужого CA соединение отклоняется
+	clientCfg, err = ClientConfig(ca.path, "", "")
+	require.NoError(t, err)
+	_, err = get(t, url, clientCfg)
+	assert.Error(t, err)
+
+	clientCfg, err = ClientConfig(ca.path, foreignCert, foreignKey)
+	require.NoError(t, err)
+	_, err = get(t, url, clientCfg)
+	assert.Error(t, err)
+
+	// Агент доверяет только закрепленному CA
+	clientCfg, err = ClientConfig(otherCA.path, agentCert, agentKey)
+	require.NoError(t, err)
+	_, err = get(t, url, clientCfg)
+	assert.Error(t, err)
+
+	_, err = ClientConfig(ca.path, agentCert, "")
+	assert.Error(t, err)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	certPath, keyPath := ca.issue("server", "server", 2)
+
+	reloader, err := NewCertReloader(certPath, keyPath)
+	require.NoError(t, err)
+	first, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+
+	// Новый сертификат в тех же файлах подхватывается после проверки
+	ca.issue("server", "server", 3)
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certPath, future, future))
+	require.NoError(t, os.Chtimes(keyPath, future, future))
+	reloader.checkedAt = time.Time{}
+
+	second, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.Certificate[0], second.Certificate[0])
+
+	// Поврежденный ключ не заменяет рабочий сертификат
+	require.NoError(t, os.WriteFile(keyPath, []byte("broken"), 0600))
+	later := future.Add(time.Minute)
+	require.NoError(t, os.Chtimes(keyPath, later, later))
+	reloader.checkedAt = time.Time{}
+
+	third, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, second, third)
+}